@@ -0,0 +1,266 @@
+package awsutil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/devicefarm"
+	"github.com/ride/devicefarm/results"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ArtifactManifestFile is the name of the JSON file written by DownloadArtifacts(),
+// which lists every downloaded artifact.
+const ArtifactManifestFile = "manifest.json"
+
+// artifactCategories are all the categories that ListArtifacts accepts.
+var artifactCategories = []string{
+	devicefarm.ArtifactCategoryFile,
+	devicefarm.ArtifactCategoryScreenshot,
+	devicefarm.ArtifactCategoryLog,
+}
+
+// artifactTypes are all the artifact types Device Farm knows of.
+var artifactTypes = []string{
+	devicefarm.ArtifactTypeUnknown,
+	devicefarm.ArtifactTypeScreenshot,
+	devicefarm.ArtifactTypeDeviceLog,
+	devicefarm.ArtifactTypeMessageLog,
+	devicefarm.ArtifactTypeResultLog,
+	devicefarm.ArtifactTypeServiceLog,
+	devicefarm.ArtifactTypeWebkitLog,
+	devicefarm.ArtifactTypeInstrumentationOutput,
+	devicefarm.ArtifactTypeExerciserMonkeyOutput,
+	devicefarm.ArtifactTypeCalabashJsonOutput,
+	devicefarm.ArtifactTypeCalabashPrettyOutput,
+	devicefarm.ArtifactTypeCalabashStandardOutput,
+	devicefarm.ArtifactTypeCalabashJavaXmlOutput,
+	devicefarm.ArtifactTypeAutomationOutput,
+	devicefarm.ArtifactTypeAppiumServerOutput,
+	devicefarm.ArtifactTypeAppiumJavaOutput,
+	devicefarm.ArtifactTypeAppiumJavaXmlOutput,
+	devicefarm.ArtifactTypeAppiumPythonOutput,
+	devicefarm.ArtifactTypeAppiumPythonXmlOutput,
+	devicefarm.ArtifactTypeExplorerEventLog,
+	devicefarm.ArtifactTypeExplorerSummaryLog,
+	devicefarm.ArtifactTypeApplicationCrashReport,
+	devicefarm.ArtifactTypeXctestLog,
+	devicefarm.ArtifactTypeVideo,
+}
+
+// CheckArtifactTypes returns the given artifact types in upper case, e.g.
+// "video" as devicefarm.ArtifactTypeVideo, or an error listing the valid
+// types if any is unknown.
+func CheckArtifactTypes(types []string) ([]string, error) {
+	known := map[string]bool{}
+	for _, t := range artifactTypes {
+		known[t] = true
+	}
+	checked := []string{}
+	for _, t := range types {
+		t = strings.ToUpper(strings.TrimSpace(t))
+		if !known[t] {
+			return nil, fmt.Errorf("Unknown artifact type: %s (valid types: %s)", t, strings.Join(artifactTypes, ", "))
+		}
+		checked = append(checked, t)
+	}
+	return checked, nil
+}
+
+// ListRunArtifacts walks the jobs, suites and tests of a run and returns the
+// artifacts of every test. If types are given, only artifacts of those types
+// are returned. They are checked with CheckArtifactTypes, so that a typo is an
+// error rather than silently matching nothing.
+func (df *DeviceFarm) ListRunArtifacts(ctx context.Context, runArn string, types ...string) ([]*results.Artifact, error) {
+	types, err := CheckArtifactTypes(types)
+	if err != nil {
+		return nil, err
+	}
+	wanted := map[string]bool{}
+	for _, t := range types {
+		wanted[t] = true
+	}
+	artifacts := []*results.Artifact{}
+	jobs, err := df.ListJobs(ctx, runArn)
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range jobs {
+		device := aws.StringValue(job.Name)
+		if job.Device != nil {
+			device = aws.StringValue(job.Device.Name)
+		}
+		suites, err := df.ListSuites(ctx, *job.Arn)
+		if err != nil {
+			return nil, err
+		}
+		for _, suite := range suites {
+			tests, err := df.ListTests(ctx, *suite.Arn)
+			if err != nil {
+				return nil, err
+			}
+			for _, test := range tests {
+				for _, category := range artifactCategories {
+					list, err := df.ListArtifacts(ctx, *test.Arn, category)
+					if err != nil {
+						return nil, err
+					}
+					for _, artifact := range list {
+						if len(wanted) > 0 && !wanted[aws.StringValue(artifact.Type)] {
+							continue
+						}
+						artifacts = append(artifacts, &results.Artifact{
+							Device:    device,
+							Suite:     aws.StringValue(suite.Name),
+							Test:      aws.StringValue(test.Name),
+							Name:      aws.StringValue(artifact.Name),
+							Type:      aws.StringValue(artifact.Type),
+							Extension: aws.StringValue(artifact.Extension),
+							Arn:       aws.StringValue(artifact.Arn),
+							Url:       aws.StringValue(artifact.Url),
+						})
+					}
+				}
+			}
+		}
+	}
+	return artifacts, nil
+}
+
+// DownloadArtifacts downloads artifacts into a device/suite/test/ tree under
+// dir, running at most concurrency downloads in parallel. It then writes an
+// ArtifactManifestFile to dir describing every artifact. If any download fails,
+// the first error is returned and no manifest is written. Cancelling ctx
+// aborts downloads in progress and skips the rest.
+func (df *DeviceFarm) DownloadArtifacts(ctx context.Context, dir string, artifacts []*results.Artifact, concurrency int) error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	assignArtifactFiles(artifacts)
+
+	type result struct {
+		artifact *results.Artifact
+		err      error
+	}
+	// a fixed pool of workers takes artifacts from the queue, which is
+	// filled up front, and once ctx is cancelled skips the rest
+	queue := make(chan *results.Artifact, len(artifacts))
+	for _, artifact := range artifacts {
+		queue <- artifact
+	}
+	close(queue)
+	done := make(chan result, len(artifacts))
+	for i := 0; i < concurrency && i < len(artifacts); i++ {
+		go func() {
+			for artifact := range queue {
+				err := ctx.Err()
+				if err == nil {
+					err = downloadFile(ctx, artifact.Url, filepath.Join(dir, artifact.File))
+				}
+				done <- result{artifact, err}
+			}
+		}()
+	}
+	var firstErr error
+	for range artifacts {
+		r := <-done
+		if r.err != nil {
+			// there's no need to log every download aborted by ctx
+			if ctx.Err() == nil {
+				df.Log.Errorln(r.err)
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+		df.Log.Println(r.artifact.File)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+
+	// there will never be an error marshalling a slice of simple structs
+	manifest, _ := json.MarshalIndent(artifacts, "", "  ")
+	return ioutil.WriteFile(filepath.Join(dir, ArtifactManifestFile), manifest, 0644)
+}
+
+// unsafePathChars matches characters which should not be used in file names.
+var unsafePathChars = regexp.MustCompile("[^A-Za-z0-9 ._()-]+")
+
+// safePathPart returns a version of the given string which can be safely
+// used as a single file or directory name.
+func safePathPart(s string) string {
+	s = unsafePathChars.ReplaceAllString(strings.TrimSpace(s), "_")
+	if len(strings.Trim(s, ".")) == 0 {
+		return "_" + s
+	}
+	return s
+}
+
+// assignArtifactFiles sets the File of each artifact to a unique path of the
+// form device/suite/test/name.extension.
+func assignArtifactFiles(artifacts []*results.Artifact) {
+	used := map[string]bool{}
+	for _, artifact := range artifacts {
+		base := filepath.Join(
+			safePathPart(artifact.Device),
+			safePathPart(artifact.Suite),
+			safePathPart(artifact.Test),
+			safePathPart(artifact.Name))
+		ext := ""
+		if len(artifact.Extension) > 0 {
+			ext = "." + safePathPart(artifact.Extension)
+		}
+		file := base + ext
+		for i := 2; used[file]; i++ {
+			file = base + "-" + strconv.Itoa(i) + ext
+		}
+		used[file] = true
+		artifact.File = file
+	}
+}
+
+// downloadFile downloads the given URL to a file, creating parent
+// directories as needed.
+func downloadFile(ctx context.Context, url, filename string) (err error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return
+	}
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("Download of %s failed: %s", filename, res.Status)
+	}
+	err = os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return
+	}
+	defer func() {
+		closeError := file.Close()
+		if err == nil {
+			err = closeError
+		}
+	}()
+	_, err = io.Copy(file, res.Body)
+	return
+}
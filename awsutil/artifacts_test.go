@@ -0,0 +1,184 @@
+package awsutil
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/devicefarm"
+	"github.com/ride/devicefarm/results"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestListRunArtifacts(t *testing.T) {
+	assert := assert.New(t)
+	client, mock := mockClient()
+
+	enqueueRun := func() {
+		mock.enqueue(&devicefarm.ListJobsOutput{
+			Jobs: []*devicefarm.Job{
+				{Arn: aws.String("jobArn"), Name: aws.String("job"), Device: androidDevice},
+			},
+		}, nil)
+		mock.enqueue(&devicefarm.ListSuitesOutput{
+			Suites: []*devicefarm.Suite{{Arn: aws.String("suiteArn"), Name: aws.String("suite")}},
+		}, nil)
+		mock.enqueue(&devicefarm.ListTestsOutput{
+			Tests: []*devicefarm.Test{{Arn: aws.String("testArn"), Name: aws.String("test")}},
+		}, nil)
+		// one artifact per category
+		mock.enqueue(&devicefarm.ListArtifactsOutput{
+			Artifacts: []*devicefarm.Artifact{
+				{Name: aws.String("Logcat"), Type: aws.String(devicefarm.ArtifactTypeDeviceLog), Extension: aws.String("txt")},
+			},
+		}, nil)
+		mock.enqueue(&devicefarm.ListArtifactsOutput{
+			Artifacts: []*devicefarm.Artifact{
+				{Name: aws.String("Screen"), Type: aws.String(devicefarm.ArtifactTypeScreenshot), Extension: aws.String("png")},
+			},
+		}, nil)
+		mock.enqueue(&devicefarm.ListArtifactsOutput{
+			Artifacts: []*devicefarm.Artifact{
+				{Name: aws.String("Video"), Type: aws.String(devicefarm.ArtifactTypeVideo), Extension: aws.String("mp4")},
+			},
+		}, nil)
+	}
+
+	// should list all artifacts
+	enqueueRun()
+	artifacts, err := client.ListRunArtifacts(ctx, "runArn")
+	assert.Nil(err)
+	assert.Equal(3, len(artifacts))
+	assert.Equal(results.Artifact{
+		Device:    "Samsung Galaxy S3",
+		Suite:     "suite",
+		Test:      "test",
+		Name:      "Logcat",
+		Type:      devicefarm.ArtifactTypeDeviceLog,
+		Extension: "txt",
+	}, *artifacts[0])
+
+	// check the categories given to mock.ListArtifacts()
+	inputs := mock.Inputs()
+	assert.Equal(devicefarm.ArtifactCategoryFile, *inputs[3][0].(*devicefarm.ListArtifactsInput).Type)
+	assert.Equal(devicefarm.ArtifactCategoryScreenshot, *inputs[4][0].(*devicefarm.ListArtifactsInput).Type)
+	assert.Equal(devicefarm.ArtifactCategoryLog, *inputs[5][0].(*devicefarm.ListArtifactsInput).Type)
+
+	// should filter by type
+	enqueueRun()
+	artifacts, err = client.ListRunArtifacts(ctx, "runArn", "video", devicefarm.ArtifactTypeDeviceLog)
+	assert.Nil(err)
+	assert.Equal(2, len(artifacts))
+	assert.Equal("Logcat", artifacts[0].Name)
+	assert.Equal("Video", artifacts[1].Name)
+
+	// should fail on an unknown type, without calling the API
+	calls := len(mock.Inputs())
+	artifacts, err = client.ListRunArtifacts(ctx, "runArn", "DEVICELOG")
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "Unknown artifact type: DEVICELOG")
+	assert.Contains(err.Error(), devicefarm.ArtifactTypeDeviceLog)
+	assert.Nil(artifacts)
+	assert.Equal(calls, len(mock.Inputs()))
+
+	// should fail due to error
+	mock.enqueue(nil, errors.New("fake error"))
+	artifacts, err = client.ListRunArtifacts(ctx, "runArn")
+	assert.NotNil(err)
+	assert.Nil(artifacts)
+}
+
+func TestDownloadArtifacts(t *testing.T) {
+	assert := assert.New(t)
+	client, _ := mockClient()
+
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/missing" {
+			res.WriteHeader(http.StatusForbidden)
+			return
+		}
+		res.Write([]byte(req.URL.Path))
+	}))
+	defer server.Close()
+
+	tmpDir, err := ioutil.TempDir("", "devicefarm")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	artifacts := []*results.Artifact{
+		{Device: "Phone (AT&T)", Suite: "suite", Test: "test", Name: "log", Extension: "txt", Url: server.URL + "/a"},
+		{Device: "Phone (AT&T)", Suite: "suite", Test: "test", Name: "log", Extension: "txt", Url: server.URL + "/b"},
+		{Device: "Phone (AT&T)", Suite: "../..", Test: "a/b", Name: "video", Url: server.URL + "/c"},
+	}
+
+	// should succeed, giving each artifact a unique, safe path
+	err = client.DownloadArtifacts(ctx, tmpDir, artifacts, 2)
+	assert.Nil(err)
+	assert.Equal(filepath.Join("Phone (AT_T)", "suite", "test", "log.txt"), artifacts[0].File)
+	assert.Equal(filepath.Join("Phone (AT_T)", "suite", "test", "log-2.txt"), artifacts[1].File)
+	assert.Equal(filepath.Join("Phone (AT_T)", ".._..", "a_b", "video"), artifacts[2].File)
+	for i, path := range []string{"/a", "/b", "/c"} {
+		bytes, err := ioutil.ReadFile(filepath.Join(tmpDir, artifacts[i].File))
+		assert.Nil(err)
+		assert.Equal(path, string(bytes))
+	}
+
+	// manifest should list every artifact
+	bytes, err := ioutil.ReadFile(filepath.Join(tmpDir, ArtifactManifestFile))
+	assert.Nil(err)
+	manifest := []*results.Artifact{}
+	assert.Nil(json.Unmarshal(bytes, &manifest))
+	assert.Equal(3, len(manifest))
+	assert.Equal(artifacts[1].File, manifest[1].File)
+
+	// should fail because of a non-2xx response
+	artifacts = []*results.Artifact{{Name: "missing", Url: server.URL + "/missing"}}
+	err = client.DownloadArtifacts(ctx, tmpDir, artifacts, 0)
+	assert.NotNil(err)
+}
+
+func TestDownloadArtifactsCancellation(t *testing.T) {
+	assert := assert.New(t)
+	client, _ := mockClient()
+
+	// the server never responds, until the request is cancelled
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-req.Context().Done()
+	}))
+
+	tmpDir, err := ioutil.TempDir("", "devicefarm")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	artifacts := []*results.Artifact{}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		artifacts = append(artifacts, &results.Artifact{Name: name, Url: server.URL + "/" + name})
+	}
+
+	// should only start as many downloads as there are workers, then abort
+	// them and skip the rest, without a manifest
+	assertNoLeaks(t, func() {
+		cancelCtx, cancel := context.WithCancel(ctx)
+		time.AfterFunc(20*time.Millisecond, cancel)
+		err = client.DownloadArtifacts(cancelCtx, tmpDir, artifacts, 2)
+		assert.Equal(context.Canceled, err)
+		server.Close()
+	})
+	assert.Equal(int32(2), atomic.LoadInt32(&requests))
+	_, err = os.Stat(filepath.Join(tmpDir, ArtifactManifestFile))
+	assert.True(os.IsNotExist(err))
+}
@@ -2,13 +2,49 @@ package awsutil
 
 import (
 	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"time"
 )
 
 const ENV_ACCESS_KEY = "AWS_ACCESS_KEY_ID"
 const ENV_SECRET = "AWS_SECRET_ACCESS_KEY"
+const ENV_SESSION_TOKEN = "AWS_SESSION_TOKEN"
+const ENV_CONTAINER_CREDS_URI = "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"
+
+// A CredsProvider looks for credentials in one place, such as the environment
+// or a file. ok is false if none were found there.
+type CredsProvider func() (ok bool, creds *credentials.Credentials)
+
+// CredsChain returns the credentials from the first provider which finds any.
+func CredsChain(providers ...CredsProvider) (ok bool, creds *credentials.Credentials) {
+	for _, provider := range providers {
+		if ok, creds = provider(); ok {
+			return
+		}
+	}
+	return false, nil
+}
+
+// DefaultCredsProviders returns the providers to check for credentials when
+// no profile is given, in order: the environment, the given JSON file, the
+// shared credentials file (~/.aws/credentials, using AWS_PROFILE if set), the
+// ECS container role, and finally the EC2 instance role.
+func DefaultCredsProviders(filename string) []CredsProvider {
+	return []CredsProvider{
+		CredsFromEnv,
+		func() (bool, *credentials.Credentials) { return CredsFromFile(filename) },
+		func() (bool, *credentials.Credentials) { return CredsFromProfile("", "") },
+		CredsFromContainer,
+		CredsFromEC2Role,
+	}
+}
 
 func CredsFromEnv() (ok bool, creds *credentials.Credentials) {
 	ok = false
@@ -16,7 +52,7 @@ func CredsFromEnv() (ok bool, creds *credentials.Credentials) {
 	secret := os.Getenv(ENV_SECRET)
 	if len(key) > 0 && len(secret) > 0 {
 		ok = true
-		creds = credentials.NewStaticCredentials(key, secret, "")
+		creds = credentials.NewStaticCredentials(key, secret, os.Getenv(ENV_SESSION_TOKEN))
 	}
 	return
 }
@@ -24,6 +60,7 @@ func CredsFromEnv() (ok bool, creds *credentials.Credentials) {
 type credsJson struct {
 	AccessKey string `json:"AWS_ACCESS_KEY_ID"`
 	Secret    string `json:"AWS_SECRET_ACCESS_KEY"`
+	Token     string `json:"AWS_SESSION_TOKEN"`
 }
 
 func CredsFromFile(filename string) (ok bool, creds *credentials.Credentials) {
@@ -39,7 +76,83 @@ func CredsFromFile(filename string) (ok bool, creds *credentials.Credentials) {
 	}
 	if len(credsJson.AccessKey) > 0 && len(credsJson.Secret) > 0 {
 		ok = true
-		creds = credentials.NewStaticCredentials(credsJson.AccessKey, credsJson.Secret, "")
+		creds = credentials.NewStaticCredentials(credsJson.AccessKey, credsJson.Secret, credsJson.Token)
 	}
 	return
 }
+
+// CredsFromProfile reads a profile from a shared credentials file in the
+// format of ~/.aws/credentials. A blank filename means the default file, and
+// a blank profile means AWS_PROFILE, or "default" if that is unset.
+func CredsFromProfile(filename string, profile string) (ok bool, creds *credentials.Credentials) {
+	return credsIfValid(credentials.NewSharedCredentials(filename, profile))
+}
+
+// CredsFromContainer gets the credentials of the task role when running in
+// an ECS container.
+func CredsFromContainer() (ok bool, creds *credentials.Credentials) {
+	uri := os.Getenv(ENV_CONTAINER_CREDS_URI)
+	if len(uri) == 0 {
+		return false, nil
+	}
+	return credsIfValid(credentials.NewCredentials(&containerCredsProvider{
+		Url: containerCredsHost + uri,
+	}))
+}
+
+// CredsFromEC2Role gets the credentials of the instance role when running on
+// an EC2 instance.
+func CredsFromEC2Role() (ok bool, creds *credentials.Credentials) {
+	sess := session.New(&aws.Config{MaxRetries: aws.Int(0)})
+	return credsIfValid(ec2rolecreds.NewCredentials(sess))
+}
+
+// credsIfValid returns true and the credentials if they can be retrieved,
+// and false otherwise.
+func credsIfValid(creds *credentials.Credentials) (bool, *credentials.Credentials) {
+	if _, err := creds.Get(); err != nil {
+		return false, nil
+	}
+	return true, creds
+}
+
+// containerCredsHost serves credentials to ECS containers, at the path given
+// in ENV_CONTAINER_CREDS_URI.
+const containerCredsHost = "http://169.254.170.2"
+
+// A containerCredsProvider retrieves temporary credentials from Url in the
+// format served to ECS containers, and refreshes them before they expire.
+type containerCredsProvider struct {
+	credentials.Expiry
+	Url string
+}
+
+type containerCredsJson struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+func (provider *containerCredsProvider) Retrieve() (credentials.Value, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	res, err := client.Get(provider.Url)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return credentials.Value{}, fmt.Errorf("Could not get container credentials: %s", res.Status)
+	}
+	credsJson := &containerCredsJson{}
+	err = json.NewDecoder(res.Body).Decode(credsJson)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	provider.SetExpiration(credsJson.Expiration, time.Minute)
+	return credentials.Value{
+		AccessKeyID:     credsJson.AccessKeyId,
+		SecretAccessKey: credsJson.SecretAccessKey,
+		SessionToken:    credsJson.Token,
+	}, nil
+}
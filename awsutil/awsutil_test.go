@@ -3,8 +3,11 @@ package awsutil
 import (
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestCredsFromEnv(t *testing.T) {
@@ -12,14 +15,17 @@ func TestCredsFromEnv(t *testing.T) {
 
 	previousKey := os.Getenv(ENV_ACCESS_KEY)
 	previousSecret := os.Getenv(ENV_SECRET)
+	previousToken := os.Getenv(ENV_SESSION_TOKEN)
 	defer func() {
 		os.Setenv(ENV_ACCESS_KEY, previousKey)
 		os.Setenv(ENV_SECRET, previousSecret)
+		os.Setenv(ENV_SESSION_TOKEN, previousToken)
 	}()
 
 	// should fail when env vars are unset
 	os.Setenv(ENV_ACCESS_KEY, "")
 	os.Setenv(ENV_SECRET, "")
+	os.Setenv(ENV_SESSION_TOKEN, "")
 	ok, _ := CredsFromEnv()
 	assert.False(ok)
 
@@ -29,6 +35,19 @@ func TestCredsFromEnv(t *testing.T) {
 	ok, creds := CredsFromEnv()
 	assert.True(ok)
 	assert.Equal(*credentials.NewStaticCredentials("access-key", "secret", ""), *creds)
+
+	// should include the session token
+	os.Setenv(ENV_SESSION_TOKEN, "token")
+	ok, creds = CredsFromEnv()
+	assert.True(ok)
+	value, err := creds.Get()
+	assert.Nil(err)
+	assert.Equal(credentials.Value{
+		AccessKeyID:     "access-key",
+		SecretAccessKey: "secret",
+		SessionToken:    "token",
+		ProviderName:    credentials.StaticProviderName,
+	}, value)
 }
 
 func TestCredsFromFile(t *testing.T) {
@@ -46,4 +65,116 @@ func TestCredsFromFile(t *testing.T) {
 	ok, creds := CredsFromFile("./testdata/creds.json")
 	assert.True(ok)
 	assert.Equal(*credentials.NewStaticCredentials("access-key", "secret", ""), *creds)
+
+	// should include the session token
+	ok, creds = CredsFromFile("./testdata/creds-token.json")
+	assert.True(ok)
+	value, err := creds.Get()
+	assert.Nil(err)
+	assert.Equal(credentials.Value{
+		AccessKeyID:     "access-key",
+		SecretAccessKey: "secret",
+		SessionToken:    "token",
+		ProviderName:    credentials.StaticProviderName,
+	}, value)
+}
+
+func TestCredsFromProfile(t *testing.T) {
+	assert := assert.New(t)
+
+	previousProfile := os.Getenv("AWS_PROFILE")
+	defer os.Setenv("AWS_PROFILE", previousProfile)
+	os.Setenv("AWS_PROFILE", "")
+
+	// should fail because file doesn't exist
+	ok, _ := CredsFromProfile("./testdata/does-not-exist", "")
+	assert.False(ok)
+
+	// should fail because the profile doesn't exist
+	ok, _ = CredsFromProfile("./testdata/credentials", "missing")
+	assert.False(ok)
+
+	// should use the default profile
+	ok, creds := CredsFromProfile("./testdata/credentials", "")
+	assert.True(ok)
+	value, err := creds.Get()
+	assert.Nil(err)
+	assert.Equal("default-key", value.AccessKeyID)
+
+	// should use AWS_PROFILE
+	os.Setenv("AWS_PROFILE", "testing")
+	ok, creds = CredsFromProfile("./testdata/credentials", "")
+	assert.True(ok)
+	value, err = creds.Get()
+	assert.Nil(err)
+	assert.Equal("testing-key", value.AccessKeyID)
+	assert.Equal("testing-token", value.SessionToken)
+
+	// should prefer the given profile
+	ok, creds = CredsFromProfile("./testdata/credentials", "default")
+	assert.True(ok)
+	value, err = creds.Get()
+	assert.Nil(err)
+	assert.Equal("default-key", value.AccessKeyID)
+}
+
+func TestCredsFromContainer(t *testing.T) {
+	assert := assert.New(t)
+
+	previousUri := os.Getenv(ENV_CONTAINER_CREDS_URI)
+	defer os.Setenv(ENV_CONTAINER_CREDS_URI, previousUri)
+
+	// should fail when not in a container
+	os.Setenv(ENV_CONTAINER_CREDS_URI, "")
+	ok, _ := CredsFromContainer()
+	assert.False(ok)
+
+	expiration := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v2/credentials/foo" {
+			res.WriteHeader(http.StatusNotFound)
+			return
+		}
+		res.Write([]byte(`{
+			"AccessKeyId": "access-key",
+			"SecretAccessKey": "secret",
+			"Token": "token",
+			"Expiration": "` + expiration + `"
+		}`))
+	}))
+	defer server.Close()
+
+	// should retrieve and expire credentials
+	provider := &containerCredsProvider{Url: server.URL + "/v2/credentials/foo"}
+	value, err := provider.Retrieve()
+	assert.Nil(err)
+	assert.Equal(credentials.Value{AccessKeyID: "access-key", SecretAccessKey: "secret", SessionToken: "token"}, value)
+	assert.False(provider.IsExpired())
+
+	// should fail because of a non-2xx response
+	provider = &containerCredsProvider{Url: server.URL + "/missing"}
+	_, err = provider.Retrieve()
+	assert.NotNil(err)
+}
+
+func TestCredsChain(t *testing.T) {
+	assert := assert.New(t)
+
+	none := func() (bool, *credentials.Credentials) { return false, nil }
+	first := credentials.NewStaticCredentials("first", "secret", "")
+	second := credentials.NewStaticCredentials("second", "secret", "")
+
+	// should return the first credentials found
+	ok, creds := CredsChain(
+		none,
+		func() (bool, *credentials.Credentials) { return true, first },
+		func() (bool, *credentials.Credentials) { return true, second },
+	)
+	assert.True(ok)
+	assert.Equal(first, creds)
+
+	// should fail when no credentials are found
+	ok, creds = CredsChain(none, none)
+	assert.False(ok)
+	assert.Nil(creds)
 }
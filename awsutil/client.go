@@ -1,9 +1,9 @@
 package awsutil
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -11,35 +11,83 @@ import (
 	"github.com/aws/aws-sdk-go/service/devicefarm/devicefarmiface"
 	"github.com/ride/devicefarm/util"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 )
 
+// DeviceFarm wraps the Device Farm API. CreateUpload reuses earlier uploads
+// of the same file, found in Uploads (if set) or by listing the project's
+// uploads, unless NoCache is true.
 type DeviceFarm struct {
 	Client          devicefarmiface.DeviceFarmAPI
 	Log             util.Logger
+	Uploads         *UploadCache
+	NoCache         bool
 	allDevicesCache DeviceList
 	initialized     bool
 }
 
-func NewClient(creds *credentials.Credentials, log util.Logger) *DeviceFarm {
+func NewClient(creds *credentials.Credentials, region string, log util.Logger) *DeviceFarm {
 	sess := session.New(&aws.Config{
-		Region:      aws.String("us-west-2"),
+		Region:      aws.String(region),
 		Credentials: creds,
 	})
 	client := devicefarm.New(sess)
-	return &DeviceFarm{client, log, nil, false}
+	return &DeviceFarm{Client: client, Log: log}
 }
 
-func (df *DeviceFarm) SearchDevices(search string, androidOnly bool, iosOnly bool) (devices DeviceList, err error) {
-	params := &devicefarm.ListDevicesInput{}
-	r, err := df.Client.ListDevices(params)
+// pages calls list unless ctx is cancelled. list should go through every
+// page of one of the SDK's List*Pages methods, with a callback which returns
+// ctx.Err() == nil, so that it stops early and returns ctx's error if ctx is
+// cancelled between pages.
+func pages(ctx context.Context, list func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := list(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// EachDevice calls fn with every device available in Device Farm, fetching
+// further pages as needed, until fn returns false.
+func (df *DeviceFarm) EachDevice(ctx context.Context, fn func(*devicefarm.Device) bool) error {
+	return pages(ctx, func() error {
+		input := &devicefarm.ListDevicesInput{}
+		return df.Client.ListDevicesPages(input, func(page *devicefarm.ListDevicesOutput, last bool) bool {
+			for _, device := range page.Devices {
+				if !fn(device) {
+					return false
+				}
+			}
+			return ctx.Err() == nil
+		})
+	})
+}
+
+// ListDevices returns every device available in Device Farm.
+func (df *DeviceFarm) ListDevices(ctx context.Context) (DeviceList, error) {
+	devices := DeviceList{}
+	err := df.EachDevice(ctx, func(device *devicefarm.Device) bool {
+		devices = append(devices, device)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+func (df *DeviceFarm) SearchDevices(ctx context.Context, search string, androidOnly bool, iosOnly bool) (devices DeviceList, err error) {
+	allDevices, err := df.ListDevices(ctx)
 	if err != nil {
 		return
 	}
-	allDevices := DeviceList(r.Devices)
 	allDevices.Sort()
 	search = strings.ToLower(search)
 	doSearch := len(search) > 0
@@ -59,28 +107,321 @@ func (df *DeviceFarm) SearchDevices(search string, androidOnly bool, iosOnly boo
 	return
 }
 
-func (df *DeviceFarm) ListDevicePools(projectArn string) ([]*devicefarm.DevicePool, error) {
-	params := &devicefarm.ListDevicePoolsInput{Arn: aws.String(projectArn)}
-	r, err := df.Client.ListDevicePools(params)
+// DevicesNotOnPlatform returns the devices from the given list of device ARNs
+// which do not belong to the given platform (e.g. devicefarm.DevicePlatformIos).
+func (df *DeviceFarm) DevicesNotOnPlatform(ctx context.Context, deviceArns []string, platform string) (devices DeviceList, err error) {
+	allDevices, err := df.ListDevices(ctx)
+	if err != nil {
+		return
+	}
+	wanted := map[string]bool{}
+	for _, arn := range deviceArns {
+		wanted[arn] = true
+	}
+	for _, device := range allDevices {
+		if wanted[*device.Arn] && *device.Platform != platform {
+			devices = append(devices, device)
+		}
+	}
+	devices.Sort()
+	return
+}
+
+// EachDevicePool calls fn with every device pool in the project, fetching
+// further pages as needed, until fn returns false.
+func (df *DeviceFarm) EachDevicePool(ctx context.Context, projectArn string, fn func(*devicefarm.DevicePool) bool) error {
+	return pages(ctx, func() error {
+		input := &devicefarm.ListDevicePoolsInput{Arn: aws.String(projectArn)}
+		return df.Client.ListDevicePoolsPages(input, func(page *devicefarm.ListDevicePoolsOutput, last bool) bool {
+			for _, pool := range page.DevicePools {
+				if !fn(pool) {
+					return false
+				}
+			}
+			return ctx.Err() == nil
+		})
+	})
+}
+
+func (df *DeviceFarm) ListDevicePools(ctx context.Context, projectArn string) ([]*devicefarm.DevicePool, error) {
+	pools := []*devicefarm.DevicePool{}
+	err := df.EachDevicePool(ctx, projectArn, func(pool *devicefarm.DevicePool) bool {
+		pools = append(pools, pool)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pools, nil
+}
+
+// EachRun calls fn with every run in the project, fetching further pages as
+// needed, until fn returns false.
+func (df *DeviceFarm) EachRun(ctx context.Context, projectArn string, fn func(*devicefarm.Run) bool) error {
+	return pages(ctx, func() error {
+		input := &devicefarm.ListRunsInput{Arn: aws.String(projectArn)}
+		return df.Client.ListRunsPages(input, func(page *devicefarm.ListRunsOutput, last bool) bool {
+			for _, run := range page.Runs {
+				if !fn(run) {
+					return false
+				}
+			}
+			return ctx.Err() == nil
+		})
+	})
+}
+
+func (df *DeviceFarm) ListRuns(ctx context.Context, projectArn string) ([]*devicefarm.Run, error) {
+	runs := []*devicefarm.Run{}
+	err := df.EachRun(ctx, projectArn, func(run *devicefarm.Run) bool {
+		runs = append(runs, run)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+// FindRun returns the run in the given project whose ID (see
+// util.Arn.ResourceId) starts with the given prefix, like a short git commit
+// hash. It returns an error if no run, or more than one run, matches.
+func (df *DeviceFarm) FindRun(ctx context.Context, projectArn, id string) (*devicefarm.Run, error) {
+	id = strings.ToLower(id)
+	matches := []*devicefarm.Run{}
+	err := df.EachRun(ctx, projectArn, func(run *devicefarm.Run) bool {
+		arn, err := util.NewArn(aws.StringValue(run.Arn))
+		if err == nil && strings.HasPrefix(strings.ToLower(arn.ResourceId()), id) {
+			matches = append(matches, run)
+		}
+		// a second match is enough to know the ID is ambiguous
+		return len(matches) < 2
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch len(matches) {
+	case 0:
+		return nil, errors.New("No run found with ID: " + id)
+	case 1:
+		return matches[0], nil
+	}
+	return nil, fmt.Errorf("Run ID %s is ambiguous, it matches more than one run", id)
+}
+
+// EachJob calls fn with every job (one per device) in the run, fetching
+// further pages as needed, until fn returns false.
+func (df *DeviceFarm) EachJob(ctx context.Context, runArn string, fn func(*devicefarm.Job) bool) error {
+	return pages(ctx, func() error {
+		input := &devicefarm.ListJobsInput{Arn: aws.String(runArn)}
+		return df.Client.ListJobsPages(input, func(page *devicefarm.ListJobsOutput, last bool) bool {
+			for _, job := range page.Jobs {
+				if !fn(job) {
+					return false
+				}
+			}
+			return ctx.Err() == nil
+		})
+	})
+}
+
+func (df *DeviceFarm) ListJobs(ctx context.Context, runArn string) ([]*devicefarm.Job, error) {
+	jobs := []*devicefarm.Job{}
+	err := df.EachJob(ctx, runArn, func(job *devicefarm.Job) bool {
+		jobs = append(jobs, job)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// EachSuite calls fn with every suite in the job, fetching further pages as
+// needed, until fn returns false.
+func (df *DeviceFarm) EachSuite(ctx context.Context, jobArn string, fn func(*devicefarm.Suite) bool) error {
+	return pages(ctx, func() error {
+		input := &devicefarm.ListSuitesInput{Arn: aws.String(jobArn)}
+		return df.Client.ListSuitesPages(input, func(page *devicefarm.ListSuitesOutput, last bool) bool {
+			for _, suite := range page.Suites {
+				if !fn(suite) {
+					return false
+				}
+			}
+			return ctx.Err() == nil
+		})
+	})
+}
+
+func (df *DeviceFarm) ListSuites(ctx context.Context, jobArn string) ([]*devicefarm.Suite, error) {
+	suites := []*devicefarm.Suite{}
+	err := df.EachSuite(ctx, jobArn, func(suite *devicefarm.Suite) bool {
+		suites = append(suites, suite)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return suites, nil
+}
+
+// EachTest calls fn with every test in the suite, fetching further pages as
+// needed, until fn returns false.
+func (df *DeviceFarm) EachTest(ctx context.Context, suiteArn string, fn func(*devicefarm.Test) bool) error {
+	return pages(ctx, func() error {
+		input := &devicefarm.ListTestsInput{Arn: aws.String(suiteArn)}
+		return df.Client.ListTestsPages(input, func(page *devicefarm.ListTestsOutput, last bool) bool {
+			for _, test := range page.Tests {
+				if !fn(test) {
+					return false
+				}
+			}
+			return ctx.Err() == nil
+		})
+	})
+}
+
+func (df *DeviceFarm) ListTests(ctx context.Context, suiteArn string) ([]*devicefarm.Test, error) {
+	tests := []*devicefarm.Test{}
+	err := df.EachTest(ctx, suiteArn, func(test *devicefarm.Test) bool {
+		tests = append(tests, test)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tests, nil
+}
+
+// EachArtifact calls fn with every artifact of the given category (e.g.
+// devicefarm.ArtifactCategoryScreenshot) for a run, job, suite or test,
+// fetching further pages as needed, until fn returns false.
+func (df *DeviceFarm) EachArtifact(ctx context.Context, arn, category string, fn func(*devicefarm.Artifact) bool) error {
+	return pages(ctx, func() error {
+		input := &devicefarm.ListArtifactsInput{Arn: aws.String(arn), Type: aws.String(category)}
+		return df.Client.ListArtifactsPages(input, func(page *devicefarm.ListArtifactsOutput, last bool) bool {
+			for _, artifact := range page.Artifacts {
+				if !fn(artifact) {
+					return false
+				}
+			}
+			return ctx.Err() == nil
+		})
+	})
+}
+
+// ListArtifacts lists artifacts of the given category (e.g.
+// devicefarm.ArtifactCategoryScreenshot) for a run, job, suite or test.
+func (df *DeviceFarm) ListArtifacts(ctx context.Context, arn, category string) ([]*devicefarm.Artifact, error) {
+	artifacts := []*devicefarm.Artifact{}
+	err := df.EachArtifact(ctx, arn, category, func(artifact *devicefarm.Artifact) bool {
+		artifacts = append(artifacts, artifact)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return artifacts, nil
+}
+
+// EachUpload calls fn with every upload in the project, fetching further
+// pages as needed, until fn returns false.
+func (df *DeviceFarm) EachUpload(ctx context.Context, projectArn string, fn func(*devicefarm.Upload) bool) error {
+	return pages(ctx, func() error {
+		input := &devicefarm.ListUploadsInput{Arn: aws.String(projectArn)}
+		return df.Client.ListUploadsPages(input, func(page *devicefarm.ListUploadsOutput, last bool) bool {
+			for _, upload := range page.Uploads {
+				if !fn(upload) {
+					return false
+				}
+			}
+			return ctx.Err() == nil
+		})
+	})
+}
+
+func (df *DeviceFarm) ListUploads(ctx context.Context, projectArn string) ([]*devicefarm.Upload, error) {
+	uploads := []*devicefarm.Upload{}
+	err := df.EachUpload(ctx, projectArn, func(upload *devicefarm.Upload) bool {
+		uploads = append(uploads, upload)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return uploads, nil
+}
+
+// EachSample calls fn with every performance sample (CPU, memory, etc.) of
+// a job, fetching further pages as needed, until fn returns false.
+func (df *DeviceFarm) EachSample(ctx context.Context, jobArn string, fn func(*devicefarm.Sample) bool) error {
+	return pages(ctx, func() error {
+		input := &devicefarm.ListSamplesInput{Arn: aws.String(jobArn)}
+		return df.Client.ListSamplesPages(input, func(page *devicefarm.ListSamplesOutput, last bool) bool {
+			for _, sample := range page.Samples {
+				if !fn(sample) {
+					return false
+				}
+			}
+			return ctx.Err() == nil
+		})
+	})
+}
+
+func (df *DeviceFarm) ListSamples(ctx context.Context, jobArn string) ([]*devicefarm.Sample, error) {
+	samples := []*devicefarm.Sample{}
+	err := df.EachSample(ctx, jobArn, func(sample *devicefarm.Sample) bool {
+		samples = append(samples, sample)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+// EachUniqueProblem calls fn with every unique problem of a run, job, suite
+// or test, along with its result (e.g. devicefarm.ExecutionResultFailed),
+// fetching further pages as needed, until fn returns false.
+func (df *DeviceFarm) EachUniqueProblem(ctx context.Context, arn string, fn func(string, *devicefarm.UniqueProblem) bool) error {
+	return pages(ctx, func() error {
+		input := &devicefarm.ListUniqueProblemsInput{Arn: aws.String(arn)}
+		return df.Client.ListUniqueProblemsPages(input, func(page *devicefarm.ListUniqueProblemsOutput, last bool) bool {
+			for result, problems := range page.UniqueProblems {
+				for _, problem := range problems {
+					if !fn(result, problem) {
+						return false
+					}
+				}
+			}
+			return ctx.Err() == nil
+		})
+	})
+}
+
+// ListUniqueProblems returns the unique problems of a run, job, suite or
+// test, keyed by result (e.g. devicefarm.ExecutionResultFailed).
+func (df *DeviceFarm) ListUniqueProblems(ctx context.Context, arn string) (map[string][]*devicefarm.UniqueProblem, error) {
+	problems := map[string][]*devicefarm.UniqueProblem{}
+	err := df.EachUniqueProblem(ctx, arn, func(result string, problem *devicefarm.UniqueProblem) bool {
+		problems[result] = append(problems[result], problem)
+		return true
+	})
 	if err != nil {
 		return nil, err
 	}
-	return r.DevicePools, nil
+	return problems, nil
 }
 
-func (df *DeviceFarm) CreateDevicePool(projectArn string, name string, deviceArns []string) (*devicefarm.DevicePool, error) {
-	// there will never be an error marshalling a simple slice of strings
-	val, _ := json.Marshal(deviceArns)
+func (df *DeviceFarm) CreateDevicePool(ctx context.Context, projectArn string, name string, rules []*devicefarm.Rule) (*devicefarm.DevicePool, error) {
 	params := &devicefarm.CreateDevicePoolInput{
-		ProjectArn: aws.String(projectArn),
-		Name:       aws.String(name),
-		Rules: []*devicefarm.Rule{
-			{
-				Attribute: aws.String("ARN"),
-				Operator:  aws.String("IN"),
-				Value:     aws.String(string(val)),
-			},
-		},
+		ProjectArn:  aws.String(projectArn),
+		Name:        aws.String(name),
+		Description: aws.String(poolDescription(time.Now())),
+		Rules:       rules,
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 	r, err := df.Client.CreateDevicePool(params)
 	if err != nil {
@@ -89,19 +430,15 @@ func (df *DeviceFarm) CreateDevicePool(projectArn string, name string, deviceArn
 	return r.DevicePool, nil
 }
 
-func (df *DeviceFarm) UpdateDevicePool(pool *devicefarm.DevicePool, deviceArns []string) (*devicefarm.DevicePool, error) {
-	// there will never be an error marshalling a simple slice of strings
-	val, _ := json.Marshal(deviceArns)
+func (df *DeviceFarm) UpdateDevicePool(ctx context.Context, pool *devicefarm.DevicePool, rules []*devicefarm.Rule) (*devicefarm.DevicePool, error) {
 	params := &devicefarm.UpdateDevicePoolInput{
-		Arn:  pool.Arn,
-		Name: pool.Name,
-		Rules: []*devicefarm.Rule{
-			{
-				Attribute: aws.String("ARN"),
-				Operator:  aws.String("IN"),
-				Value:     aws.String(string(val)),
-			},
-		},
+		Arn:         pool.Arn,
+		Name:        pool.Name,
+		Description: aws.String(poolDescription(time.Now())),
+		Rules:       rules,
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 	r, err := df.Client.UpdateDevicePool(params)
 	if err != nil {
@@ -110,86 +447,155 @@ func (df *DeviceFarm) UpdateDevicePool(pool *devicefarm.DevicePool, deviceArns [
 	return r.DevicePool, nil
 }
 
-func (df *DeviceFarm) DevicePoolMatches(pool *devicefarm.DevicePool, deviceArns []string) bool {
-	// there will never be an error marshalling a simple slice of strings
-	val, _ := json.Marshal(deviceArns)
+// DevicePoolMatches returns true if the pool has exactly the given rules, in
+// any order.
+func (df *DeviceFarm) DevicePoolMatches(pool *devicefarm.DevicePool, rules []*devicefarm.Rule) bool {
+	if len(pool.Rules) != len(rules) {
+		return false
+	}
+	wanted := map[string]int{}
+	for _, rule := range rules {
+		wanted[ruleKey(rule)]++
+	}
 	for _, rule := range pool.Rules {
-		if *rule.Attribute != "ARN" || *rule.Operator != "IN" {
-			return false
-		}
-		if *rule.Value != string(val) {
+		key := ruleKey(rule)
+		if wanted[key] == 0 {
 			return false
 		}
+		wanted[key]--
 	}
 	return true
 }
 
-func (df *DeviceFarm) UploadToS3(s3Url string, bytes io.ReadSeeker) (err error) {
-	req, err := http.NewRequest("PUT", s3Url, bytes)
+// ruleKey returns a string identifying a rule's attribute, operator and value.
+func ruleKey(rule *devicefarm.Rule) string {
+	return aws.StringValue(rule.Attribute) + " " + aws.StringValue(rule.Operator) + " " + aws.StringValue(rule.Value)
+}
+
+// uploadAttempts is how many times UploadToS3 tries an upload before giving
+// up. uploadRetryDelay is the delay before the first retry, and doubles after
+// each failed attempt.
+var uploadAttempts = 4
+var uploadRetryDelay = 2 * time.Second
+
+// UploadToS3 streams a file to a presigned S3 URL, reporting progress to the
+// logger. Network errors and 5xx responses are retried with backoff, while
+// other non-2xx responses fail immediately with the error returned by S3.
+// Cancelling ctx aborts the upload.
+func (df *DeviceFarm) UploadToS3(ctx context.Context, s3Url string, file *os.File) error {
+	info, err := file.Stat()
 	if err != nil {
-		// TODO: Not sure how to add test coverage for this line
-		return
+		return err
+	}
+	body := util.NewProgressReader(file, info.Size(), filepath.Base(file.Name()), df.Log)
+	delay := uploadRetryDelay
+	for attempt := 1; ; attempt++ {
+		retry, err := putToS3(ctx, s3Url, body)
+		if err == nil || !retry || attempt >= uploadAttempts {
+			return err
+		}
+		df.Log.Warnf("%s, retrying in %s", err, delay)
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+		delay *= 2
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		body.Reset()
+	}
+}
+
+// putToS3 makes a single upload attempt, and returns whether a failed
+// attempt is worth retrying.
+func putToS3(ctx context.Context, s3Url string, body *util.ProgressReader) (retry bool, err error) {
+	req, err := http.NewRequest("PUT", s3Url, body)
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	// S3 rejects chunked uploads, so the length must be known up front
+	req.ContentLength = body.Total
+	if body.Total == 0 {
+		req.Body = http.NoBody
 	}
 	req.Header.Set("Content-Type", "application/octet-stream")
-	client := &http.Client{}
-	res, err := client.Do(req)
+	res, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return
+		return ctx.Err() == nil, err
 	}
 	defer res.Body.Close()
-	return
+	if res.StatusCode >= 200 && res.StatusCode <= 299 {
+		return false, nil
+	}
+	message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+	err = fmt.Errorf("Upload to S3 failed: %s: %s", res.Status, strings.TrimSpace(string(message)))
+	return res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests, err
 }
 
-// fileReaderSeeker reads a file into an io.ReadSeeker, see:
-// https://github.com/aws/aws-sdk-go/issues/142
-// https://github.com/aws/aws-sdk-go/issues/337
-// TODO: Get rid of this crap if possible
-func (df *DeviceFarm) fileReaderSeeker(filename string) (r io.ReadSeeker, err error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return
+// sleep waits for the given duration, or until ctx is cancelled.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
 	}
-	defer file.Close()
-	fileInfo, err := file.Stat()
+}
+
+// CreateUpload uploads a file to the project, returning the upload's ARN. If
+// a succeeded upload of an identical file (by SHA-256) and type exists, its
+// ARN is returned instead, unless df.NoCache is true.
+func (df *DeviceFarm) CreateUpload(ctx context.Context, projectArn, filename, uploadType, name string) (uploadArn string, err error) {
+	hash, err := fileHash(filename)
 	if err != nil {
-		// TODO: Not sure how to add test coverage for this line
 		return
 	}
-	fileSize := fileInfo.Size()
-	buffer := make([]byte, fileSize)
-	file.Read(buffer)
-	r = bytes.NewReader(buffer)
-	return
-}
+	if !df.NoCache {
+		if arn, ok := df.findUpload(ctx, projectArn, uploadType, hash); ok {
+			df.Log.Println("Reusing identical upload", arn)
+			return arn, nil
+		}
+	}
 
-func (df *DeviceFarm) CreateUpload(projectArn, filename, uploadType, name string) (uploadArn string, err error) {
 	// create upload object, get signed S3 URL
 	params := &devicefarm.CreateUploadInput{
-		Name:        aws.String(name),
+		Name:        aws.String(uploadName(hash, uploadType, name)),
 		ProjectArn:  aws.String(projectArn),
 		Type:        aws.String(uploadType),
 		ContentType: aws.String("application/octet-stream"),
 	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
 	rApp, err := df.Client.CreateUpload(params)
 	if err != nil {
 		return
 	}
 	signedUrl := *rApp.Upload.Url
 
-	// get io.ReadSeeker from file
-	r, err := df.fileReaderSeeker(filename)
+	file, err := os.Open(filename)
 	if err != nil {
 		return
 	}
+	defer file.Close()
 
-	err = df.UploadToS3(signedUrl, r)
+	err = df.UploadToS3(ctx, signedUrl, file)
+	if err != nil {
+		return
+	}
 	uploadArn = *rApp.Upload.Arn
-
+	df.cacheUpload(uploadCacheKey(projectArn, uploadType, hash), uploadArn)
 	return
 }
 
-func (df *DeviceFarm) UploadSucceeded(arn string) (bool, error) {
+func (df *DeviceFarm) UploadSucceeded(ctx context.Context, arn string) (bool, error) {
 	params := &devicefarm.GetUploadInput{Arn: aws.String(arn)}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
 	r, err := df.Client.GetUpload(params)
 	if err != nil {
 		return false, err
@@ -203,62 +609,87 @@ func (df *DeviceFarm) UploadSucceeded(arn string) (bool, error) {
 	return false, nil
 }
 
-func (df *DeviceFarm) WaitForUploadsToSucceed(timeoutMs, delayMs int, arns ...string) error {
-	errchan := make(chan error)
-	quitchan := make(chan bool)
-	go func() {
-		var err error
-		var succeeded bool
-	mainloop:
-		for len(arns) > 0 {
-			select {
-			case <-quitchan:
-				break mainloop
-			default:
+// WaitForUploadsToSucceed polls the given uploads every delayMs until they
+// have all succeeded. It fails if any upload fails, if they do not succeed
+// within timeoutMs, or if ctx is cancelled.
+func (df *DeviceFarm) WaitForUploadsToSucceed(ctx context.Context, timeoutMs, delayMs int, arns ...string) error {
+	waitCtx, cancel := context.WithTimeout(ctx, time.Duration(timeoutMs)*time.Millisecond)
+	defer cancel()
+	for len(arns) > 0 {
+		nextArns := []string{}
+		for _, arn := range arns {
+			succeeded, err := df.UploadSucceeded(waitCtx, arn)
+			if err != nil {
+				return waitError(ctx, err, "Timed out")
 			}
-			nextArns := []string{}
-			for _, arn := range arns {
-				succeeded, err = df.UploadSucceeded(arn)
-				if err != nil {
-					break mainloop
-				}
-				if succeeded {
-					continue
-				}
+			if !succeeded {
 				nextArns = append(nextArns, arn)
 			}
-			arns = nextArns
-			if len(arns) > 0 && delayMs > 0 {
-				time.Sleep(time.Duration(delayMs) * time.Millisecond)
+		}
+		arns = nextArns
+		if len(arns) > 0 {
+			if err := sleep(waitCtx, time.Duration(delayMs)*time.Millisecond); err != nil {
+				return waitError(ctx, err, "Timed out")
 			}
 		}
-		errchan <- err
-	}()
-	select {
-	case <-time.After(time.Duration(timeoutMs) * time.Millisecond):
-		quitchan <- true
-		return errors.New("Timed out")
-	case err := <-errchan:
-		return err
 	}
+	return nil
+}
+
+// waitError returns the error to report when polling under a context derived
+// from ctx with a timeout fails: the given message if the timeout expired,
+// and otherwise err, e.g. because ctx itself was cancelled.
+func waitError(ctx context.Context, err error, timeoutMessage string) error {
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		return errors.New(timeoutMessage)
+	}
+	return err
+}
+
+// A RunConfig specifies the files to upload and the type of test to schedule
+// when creating a test run. AppType and TestPackageType are Device Farm upload
+// types, and TestType is a Device Farm test type. App may be blank for tests
+// which do not need an app, such as Appium web tests, and TestPackage may be
+// blank for tests which do not need a test package, such as built-in tests.
+// TestParameters are passed to the test as-is. Name is the name of the run,
+// which may be blank.
+type RunConfig struct {
+	Name            string
+	App             string
+	AppType         string
+	TestPackage     string
+	TestPackageType string
+	TestType        string
+	TestParameters  map[string]string
 }
 
-func (df *DeviceFarm) CreateRun(projectArn, poolArn, apk, apkInstrumentation string) (string, error) {
+func (df *DeviceFarm) CreateRun(ctx context.Context, projectArn, poolArn string, runConfig *RunConfig) (string, error) {
 	log := df.Log
 	log.Println(">> Uploading files...")
-	log.Println(apk)
-	appArn, err := df.CreateUpload(projectArn, apk, "ANDROID_APP", "app.apk")
-	if err != nil {
-		return "", err
+	var appArn *string
+	uploadArns := []string{}
+	if len(runConfig.App) > 0 {
+		log.Println(runConfig.App)
+		arn, err := df.CreateUpload(ctx, projectArn, runConfig.App, runConfig.AppType, filepath.Base(runConfig.App))
+		if err != nil {
+			return "", err
+		}
+		appArn = aws.String(arn)
+		uploadArns = append(uploadArns, arn)
 	}
-	log.Println(apkInstrumentation)
-	instArn, err := df.CreateUpload(projectArn, apkInstrumentation, "INSTRUMENTATION_TEST_PACKAGE", "instrumentation.apk")
-	if err != nil {
-		return "", err
+	var testPackageArn *string
+	if len(runConfig.TestPackage) > 0 {
+		log.Println(runConfig.TestPackage)
+		arn, err := df.CreateUpload(ctx, projectArn, runConfig.TestPackage, runConfig.TestPackageType, filepath.Base(runConfig.TestPackage))
+		if err != nil {
+			return "", err
+		}
+		testPackageArn = aws.String(arn)
+		uploadArns = append(uploadArns, arn)
 	}
 
 	log.Println(">> Waiting for files to be processed...")
-	err = df.WaitForUploadsToSucceed(60000, 5000, appArn, instArn)
+	err := df.WaitForUploadsToSucceed(ctx, 60000, 5000, uploadArns...)
 	if err != nil {
 		return "", err
 	}
@@ -268,10 +699,20 @@ func (df *DeviceFarm) CreateRun(projectArn, poolArn, apk, apkInstrumentation str
 		DevicePoolArn: aws.String(poolArn),
 		ProjectArn:    aws.String(projectArn),
 		Test: &devicefarm.ScheduleRunTest{
-			Type:           aws.String("INSTRUMENTATION"),
-			TestPackageArn: aws.String(instArn),
+			Type:           aws.String(runConfig.TestType),
+			TestPackageArn: testPackageArn,
 		},
-		AppArn: aws.String(appArn),
+		AppArn: appArn,
+	}
+	if len(runConfig.Name) > 0 {
+		log.Println(runConfig.Name)
+		params.Name = aws.String(runConfig.Name)
+	}
+	if len(runConfig.TestParameters) > 0 {
+		params.Test.Parameters = aws.StringMap(runConfig.TestParameters)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
 	}
 	r, err := df.Client.ScheduleRun(params)
 	if err != nil {
@@ -279,3 +720,127 @@ func (df *DeviceFarm) CreateRun(projectArn, poolArn, apk, apkInstrumentation str
 	}
 	return *r.Run.Arn, nil
 }
+
+// Exit codes for each final ExecutionResult of a run. See ResultExitCode().
+// Exit code 1 is reserved for general errors, such as timeouts.
+const (
+	ExitPassed  = 0
+	ExitWarned  = 2
+	ExitFailed  = 3
+	ExitErrored = 4
+	ExitStopped = 5
+	ExitUnknown = 6
+)
+
+// ResultExitCode maps the ExecutionResult of a completed run to a process exit code.
+func ResultExitCode(result string) int {
+	switch result {
+	case devicefarm.ExecutionResultPassed:
+		return ExitPassed
+	case devicefarm.ExecutionResultWarned:
+		return ExitWarned
+	case devicefarm.ExecutionResultFailed:
+		return ExitFailed
+	case devicefarm.ExecutionResultErrored:
+		return ExitErrored
+	case devicefarm.ExecutionResultStopped:
+		return ExitStopped
+	}
+	return ExitUnknown
+}
+
+// FormatCounters returns a short human-readable summary of test counters.
+func FormatCounters(counters *devicefarm.Counters) string {
+	if counters == nil {
+		return "(no results yet)"
+	}
+	return formatCounters(ConvertCounters(counters))
+}
+
+func (df *DeviceFarm) GetRun(ctx context.Context, arn string) (*devicefarm.Run, error) {
+	params := &devicefarm.GetRunInput{Arn: aws.String(arn)}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r, err := df.Client.GetRun(params)
+	if err != nil {
+		return nil, err
+	}
+	return r.Run, nil
+}
+
+func (df *DeviceFarm) GetTest(ctx context.Context, arn string) (*devicefarm.Test, error) {
+	params := &devicefarm.GetTestInput{Arn: aws.String(arn)}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r, err := df.Client.GetTest(params)
+	if err != nil {
+		return nil, err
+	}
+	return r.Test, nil
+}
+
+// WaitForRun polls the given run every delayMs until its status is COMPLETED,
+// logging each status transition along with the run's counters. It returns
+// the completed run, or an error if the run will not complete within timeoutMs
+// or ctx is cancelled. See also WatchRun.
+func (df *DeviceFarm) WaitForRun(ctx context.Context, arn string, timeoutMs, delayMs int) (*devicefarm.Run, error) {
+	lastStatus := ""
+	return df.pollRun(ctx, arn, timeoutMs, delayMs, func(run *devicefarm.Run) error {
+		status := aws.StringValue(run.Status)
+		if status != lastStatus {
+			df.Log.Printf("%s %s\n", status, FormatCounters(run.Counters))
+			lastStatus = status
+		}
+		return nil
+	})
+}
+
+// pollRun gets the given run every delayMs, calling fn with it, until its
+// status is COMPLETED. It stops early if fn returns an error, if the run will
+// not complete within timeoutMs, or if ctx is cancelled.
+func (df *DeviceFarm) pollRun(ctx context.Context, arn string, timeoutMs, delayMs int, fn func(*devicefarm.Run) error) (*devicefarm.Run, error) {
+	delay := time.Duration(delayMs) * time.Millisecond
+	deadline := time.Now().Add(time.Duration(timeoutMs) * time.Millisecond)
+	for {
+		run, err := df.GetRun(ctx, arn)
+		if err != nil {
+			return nil, err
+		}
+		if err := fn(run); err != nil {
+			return nil, err
+		}
+		if aws.StringValue(run.Status) == devicefarm.ExecutionStatusCompleted {
+			return run, nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return nil, errors.New("Timed out waiting for run: " + arn)
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// StopRun asks Device Farm to stop a run. Tests which have not started are
+// skipped, and the run completes with the STOPPED result.
+func (df *DeviceFarm) StopRun(ctx context.Context, arn string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	params := &devicefarm.StopRunInput{Arn: aws.String(arn)}
+	_, err := df.Client.StopRun(params)
+	return err
+}
+
+// DeleteRun deletes a run and its results. Device Farm does not delete runs
+// which are still running, so stop them first.
+func (df *DeviceFarm) DeleteRun(ctx context.Context, arn string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	params := &devicefarm.DeleteRunInput{Arn: aws.String(arn)}
+	_, err := df.Client.DeleteRun(params)
+	return err
+}
@@ -9,15 +9,20 @@ any real requests to AWS.
 
 I am only implementing methods as needed by tests, the rest produce a panic. As you can see
 from the enqueue() and dequeue() methods, the idea is for tests to enqueue arbitrary values
-which will then be dequeued and returned in FIFO order by methods.
+which will then be dequeued and returned in FIFO order by methods. List methods can be given
+several pages of results with enqueuePages(), which their Pages methods go through like the
+real client does.
 
 See client_test.go for usage.
 
 */
 
 import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/devicefarm"
+	"reflect"
 )
 
 type MockClient struct {
@@ -29,6 +34,18 @@ func (client *MockClient) enqueue(values ...interface{}) {
 	client.outputs = append(client.outputs, values)
 }
 
+// enqueuePages enqueues the outputs of a list method as consecutive pages of
+// one result, by setting the NextToken of every page except the last.
+func (client *MockClient) enqueuePages(pages ...interface{}) {
+	for i, page := range pages {
+		if i < len(pages)-1 {
+			token := fmt.Sprintf("page-%d", i+2)
+			reflect.ValueOf(page).Elem().FieldByName("NextToken").Set(reflect.ValueOf(&token))
+		}
+		client.enqueue(page, nil)
+	}
+}
+
 func (client *MockClient) dequeue() []interface{} {
 	if len(client.outputs) == 0 {
 		panic("Nothing in MockClient queue")
@@ -94,8 +111,18 @@ func (client *MockClient) DeleteDevicePoolRequest(*devicefarm.DeleteDevicePoolIn
 	panic("Not implemented")
 }
 
-func (client *MockClient) DeleteDevicePool(*devicefarm.DeleteDevicePoolInput) (*devicefarm.DeleteDevicePoolOutput, error) {
-	panic("Not implemented")
+func (client *MockClient) DeleteDevicePool(input *devicefarm.DeleteDevicePoolInput) (*devicefarm.DeleteDevicePoolOutput, error) {
+	client.input(input)
+	response := client.dequeue()
+	var out *devicefarm.DeleteDevicePoolOutput
+	if response[0] != nil {
+		out = response[0].(*devicefarm.DeleteDevicePoolOutput)
+	}
+	var err error
+	if response[1] != nil {
+		err = response[1].(error)
+	}
+	return out, err
 }
 
 func (client *MockClient) DeleteProjectRequest(*devicefarm.DeleteProjectInput) (*request.Request, *devicefarm.DeleteProjectOutput) {
@@ -110,8 +137,18 @@ func (client *MockClient) DeleteRunRequest(*devicefarm.DeleteRunInput) (*request
 	panic("Not implemented")
 }
 
-func (client *MockClient) DeleteRun(*devicefarm.DeleteRunInput) (*devicefarm.DeleteRunOutput, error) {
-	panic("Not implemented")
+func (client *MockClient) DeleteRun(input *devicefarm.DeleteRunInput) (*devicefarm.DeleteRunOutput, error) {
+	client.input(input)
+	response := client.dequeue()
+	var out *devicefarm.DeleteRunOutput
+	if response[0] != nil {
+		out = response[0].(*devicefarm.DeleteRunOutput)
+	}
+	var err error
+	if response[1] != nil {
+		err = response[1].(error)
+	}
+	return out, err
 }
 
 func (client *MockClient) DeleteUploadRequest(*devicefarm.DeleteUploadInput) (*request.Request, *devicefarm.DeleteUploadOutput) {
@@ -186,8 +223,18 @@ func (client *MockClient) GetRunRequest(*devicefarm.GetRunInput) (*request.Reque
 	panic("Not implemented")
 }
 
-func (client *MockClient) GetRun(*devicefarm.GetRunInput) (*devicefarm.GetRunOutput, error) {
-	panic("Not implemented")
+func (client *MockClient) GetRun(input *devicefarm.GetRunInput) (*devicefarm.GetRunOutput, error) {
+	client.input(input)
+	response := client.dequeue()
+	var out *devicefarm.GetRunOutput
+	if response[0] != nil {
+		out = response[0].(*devicefarm.GetRunOutput)
+	}
+	var err error
+	if response[1] != nil {
+		err = response[1].(error)
+	}
+	return out, err
 }
 
 func (client *MockClient) GetSuiteRequest(*devicefarm.GetSuiteInput) (*request.Request, *devicefarm.GetSuiteOutput) {
@@ -202,8 +249,18 @@ func (client *MockClient) GetTestRequest(*devicefarm.GetTestInput) (*request.Req
 	panic("Not implemented")
 }
 
-func (client *MockClient) GetTest(*devicefarm.GetTestInput) (*devicefarm.GetTestOutput, error) {
-	panic("Not implemented")
+func (client *MockClient) GetTest(input *devicefarm.GetTestInput) (*devicefarm.GetTestOutput, error) {
+	client.input(input)
+	response := client.dequeue()
+	var out *devicefarm.GetTestOutput
+	if response[0] != nil {
+		out = response[0].(*devicefarm.GetTestOutput)
+	}
+	var err error
+	if response[1] != nil {
+		err = response[1].(error)
+	}
+	return out, err
 }
 
 func (client *MockClient) GetUploadRequest(*devicefarm.GetUploadInput) (*request.Request, *devicefarm.GetUploadOutput) {
@@ -228,12 +285,34 @@ func (client *MockClient) ListArtifactsRequest(*devicefarm.ListArtifactsInput) (
 	panic("Not implemented")
 }
 
-func (client *MockClient) ListArtifacts(*devicefarm.ListArtifactsInput) (*devicefarm.ListArtifactsOutput, error) {
-	panic("Not implemented")
+func (client *MockClient) ListArtifacts(input *devicefarm.ListArtifactsInput) (*devicefarm.ListArtifactsOutput, error) {
+	client.input(input)
+	response := client.dequeue()
+	var out *devicefarm.ListArtifactsOutput
+	if response[0] != nil {
+		out = response[0].(*devicefarm.ListArtifactsOutput)
+	}
+	var err error
+	if response[1] != nil {
+		err = response[1].(error)
+	}
+	return out, err
 }
 
-func (client *MockClient) ListArtifactsPages(*devicefarm.ListArtifactsInput, func(*devicefarm.ListArtifactsOutput, bool) bool) error {
-	panic("Not implemented")
+func (client *MockClient) ListArtifactsPages(input *devicefarm.ListArtifactsInput, fn func(*devicefarm.ListArtifactsOutput, bool) bool) error {
+	for {
+		out, err := client.ListArtifacts(input)
+		if err != nil {
+			return err
+		}
+		last := len(aws.StringValue(out.NextToken)) == 0
+		if !fn(out, last) || last {
+			return nil
+		}
+		next := *input
+		next.NextToken = out.NextToken
+		input = &next
+	}
 }
 
 func (client *MockClient) ListDevicePoolsRequest(*devicefarm.ListDevicePoolsInput) (*request.Request, *devicefarm.ListDevicePoolsOutput) {
@@ -254,8 +333,20 @@ func (client *MockClient) ListDevicePools(input *devicefarm.ListDevicePoolsInput
 	return out, err
 }
 
-func (client *MockClient) ListDevicePoolsPages(*devicefarm.ListDevicePoolsInput, func(*devicefarm.ListDevicePoolsOutput, bool) bool) error {
-	panic("Not implemented")
+func (client *MockClient) ListDevicePoolsPages(input *devicefarm.ListDevicePoolsInput, fn func(*devicefarm.ListDevicePoolsOutput, bool) bool) error {
+	for {
+		out, err := client.ListDevicePools(input)
+		if err != nil {
+			return err
+		}
+		last := len(aws.StringValue(out.NextToken)) == 0
+		if !fn(out, last) || last {
+			return nil
+		}
+		next := *input
+		next.NextToken = out.NextToken
+		input = &next
+	}
 }
 
 func (client *MockClient) ListDevicesRequest(*devicefarm.ListDevicesInput) (*request.Request, *devicefarm.ListDevicesOutput) {
@@ -276,20 +367,54 @@ func (client *MockClient) ListDevices(input *devicefarm.ListDevicesInput) (*devi
 	return out, err
 }
 
-func (client *MockClient) ListDevicesPages(*devicefarm.ListDevicesInput, func(*devicefarm.ListDevicesOutput, bool) bool) error {
-	panic("Not implemented")
+func (client *MockClient) ListDevicesPages(input *devicefarm.ListDevicesInput, fn func(*devicefarm.ListDevicesOutput, bool) bool) error {
+	for {
+		out, err := client.ListDevices(input)
+		if err != nil {
+			return err
+		}
+		last := len(aws.StringValue(out.NextToken)) == 0
+		if !fn(out, last) || last {
+			return nil
+		}
+		next := *input
+		next.NextToken = out.NextToken
+		input = &next
+	}
 }
 
 func (client *MockClient) ListJobsRequest(*devicefarm.ListJobsInput) (*request.Request, *devicefarm.ListJobsOutput) {
 	panic("Not implemented")
 }
 
-func (client *MockClient) ListJobs(*devicefarm.ListJobsInput) (*devicefarm.ListJobsOutput, error) {
-	panic("Not implemented")
+func (client *MockClient) ListJobs(input *devicefarm.ListJobsInput) (*devicefarm.ListJobsOutput, error) {
+	client.input(input)
+	response := client.dequeue()
+	var out *devicefarm.ListJobsOutput
+	if response[0] != nil {
+		out = response[0].(*devicefarm.ListJobsOutput)
+	}
+	var err error
+	if response[1] != nil {
+		err = response[1].(error)
+	}
+	return out, err
 }
 
-func (client *MockClient) ListJobsPages(*devicefarm.ListJobsInput, func(*devicefarm.ListJobsOutput, bool) bool) error {
-	panic("Not implemented")
+func (client *MockClient) ListJobsPages(input *devicefarm.ListJobsInput, fn func(*devicefarm.ListJobsOutput, bool) bool) error {
+	for {
+		out, err := client.ListJobs(input)
+		if err != nil {
+			return err
+		}
+		last := len(aws.StringValue(out.NextToken)) == 0
+		if !fn(out, last) || last {
+			return nil
+		}
+		next := *input
+		next.NextToken = out.NextToken
+		input = &next
+	}
 }
 
 func (client *MockClient) ListOfferingTransactionsRequest(*devicefarm.ListOfferingTransactionsInput) (*request.Request, *devicefarm.ListOfferingTransactionsOutput) {
@@ -332,72 +457,204 @@ func (client *MockClient) ListRunsRequest(*devicefarm.ListRunsInput) (*request.R
 	panic("Not implemented")
 }
 
-func (client *MockClient) ListRuns(*devicefarm.ListRunsInput) (*devicefarm.ListRunsOutput, error) {
-	panic("Not implemented")
+func (client *MockClient) ListRuns(input *devicefarm.ListRunsInput) (*devicefarm.ListRunsOutput, error) {
+	client.input(input)
+	response := client.dequeue()
+	var out *devicefarm.ListRunsOutput
+	if response[0] != nil {
+		out = response[0].(*devicefarm.ListRunsOutput)
+	}
+	var err error
+	if response[1] != nil {
+		err = response[1].(error)
+	}
+	return out, err
 }
 
-func (client *MockClient) ListRunsPages(*devicefarm.ListRunsInput, func(*devicefarm.ListRunsOutput, bool) bool) error {
-	panic("Not implemented")
+func (client *MockClient) ListRunsPages(input *devicefarm.ListRunsInput, fn func(*devicefarm.ListRunsOutput, bool) bool) error {
+	for {
+		out, err := client.ListRuns(input)
+		if err != nil {
+			return err
+		}
+		last := len(aws.StringValue(out.NextToken)) == 0
+		if !fn(out, last) || last {
+			return nil
+		}
+		next := *input
+		next.NextToken = out.NextToken
+		input = &next
+	}
 }
 
 func (client *MockClient) ListSamplesRequest(*devicefarm.ListSamplesInput) (*request.Request, *devicefarm.ListSamplesOutput) {
 	panic("Not implemented")
 }
 
-func (client *MockClient) ListSamples(*devicefarm.ListSamplesInput) (*devicefarm.ListSamplesOutput, error) {
-	panic("Not implemented")
+func (client *MockClient) ListSamples(input *devicefarm.ListSamplesInput) (*devicefarm.ListSamplesOutput, error) {
+	client.input(input)
+	response := client.dequeue()
+	var out *devicefarm.ListSamplesOutput
+	if response[0] != nil {
+		out = response[0].(*devicefarm.ListSamplesOutput)
+	}
+	var err error
+	if response[1] != nil {
+		err = response[1].(error)
+	}
+	return out, err
 }
 
-func (client *MockClient) ListSamplesPages(*devicefarm.ListSamplesInput, func(*devicefarm.ListSamplesOutput, bool) bool) error {
-	panic("Not implemented")
+func (client *MockClient) ListSamplesPages(input *devicefarm.ListSamplesInput, fn func(*devicefarm.ListSamplesOutput, bool) bool) error {
+	for {
+		out, err := client.ListSamples(input)
+		if err != nil {
+			return err
+		}
+		last := len(aws.StringValue(out.NextToken)) == 0
+		if !fn(out, last) || last {
+			return nil
+		}
+		next := *input
+		next.NextToken = out.NextToken
+		input = &next
+	}
 }
 
 func (client *MockClient) ListSuitesRequest(*devicefarm.ListSuitesInput) (*request.Request, *devicefarm.ListSuitesOutput) {
 	panic("Not implemented")
 }
 
-func (client *MockClient) ListSuites(*devicefarm.ListSuitesInput) (*devicefarm.ListSuitesOutput, error) {
-	panic("Not implemented")
+func (client *MockClient) ListSuites(input *devicefarm.ListSuitesInput) (*devicefarm.ListSuitesOutput, error) {
+	client.input(input)
+	response := client.dequeue()
+	var out *devicefarm.ListSuitesOutput
+	if response[0] != nil {
+		out = response[0].(*devicefarm.ListSuitesOutput)
+	}
+	var err error
+	if response[1] != nil {
+		err = response[1].(error)
+	}
+	return out, err
 }
 
-func (client *MockClient) ListSuitesPages(*devicefarm.ListSuitesInput, func(*devicefarm.ListSuitesOutput, bool) bool) error {
-	panic("Not implemented")
+func (client *MockClient) ListSuitesPages(input *devicefarm.ListSuitesInput, fn func(*devicefarm.ListSuitesOutput, bool) bool) error {
+	for {
+		out, err := client.ListSuites(input)
+		if err != nil {
+			return err
+		}
+		last := len(aws.StringValue(out.NextToken)) == 0
+		if !fn(out, last) || last {
+			return nil
+		}
+		next := *input
+		next.NextToken = out.NextToken
+		input = &next
+	}
 }
 
 func (client *MockClient) ListTestsRequest(*devicefarm.ListTestsInput) (*request.Request, *devicefarm.ListTestsOutput) {
 	panic("Not implemented")
 }
 
-func (client *MockClient) ListTests(*devicefarm.ListTestsInput) (*devicefarm.ListTestsOutput, error) {
-	panic("Not implemented")
+func (client *MockClient) ListTests(input *devicefarm.ListTestsInput) (*devicefarm.ListTestsOutput, error) {
+	client.input(input)
+	response := client.dequeue()
+	var out *devicefarm.ListTestsOutput
+	if response[0] != nil {
+		out = response[0].(*devicefarm.ListTestsOutput)
+	}
+	var err error
+	if response[1] != nil {
+		err = response[1].(error)
+	}
+	return out, err
 }
 
-func (client *MockClient) ListTestsPages(*devicefarm.ListTestsInput, func(*devicefarm.ListTestsOutput, bool) bool) error {
-	panic("Not implemented")
+func (client *MockClient) ListTestsPages(input *devicefarm.ListTestsInput, fn func(*devicefarm.ListTestsOutput, bool) bool) error {
+	for {
+		out, err := client.ListTests(input)
+		if err != nil {
+			return err
+		}
+		last := len(aws.StringValue(out.NextToken)) == 0
+		if !fn(out, last) || last {
+			return nil
+		}
+		next := *input
+		next.NextToken = out.NextToken
+		input = &next
+	}
 }
 
 func (client *MockClient) ListUniqueProblemsRequest(*devicefarm.ListUniqueProblemsInput) (*request.Request, *devicefarm.ListUniqueProblemsOutput) {
 	panic("Not implemented")
 }
 
-func (client *MockClient) ListUniqueProblems(*devicefarm.ListUniqueProblemsInput) (*devicefarm.ListUniqueProblemsOutput, error) {
-	panic("Not implemented")
+func (client *MockClient) ListUniqueProblems(input *devicefarm.ListUniqueProblemsInput) (*devicefarm.ListUniqueProblemsOutput, error) {
+	client.input(input)
+	response := client.dequeue()
+	var out *devicefarm.ListUniqueProblemsOutput
+	if response[0] != nil {
+		out = response[0].(*devicefarm.ListUniqueProblemsOutput)
+	}
+	var err error
+	if response[1] != nil {
+		err = response[1].(error)
+	}
+	return out, err
 }
 
-func (client *MockClient) ListUniqueProblemsPages(*devicefarm.ListUniqueProblemsInput, func(*devicefarm.ListUniqueProblemsOutput, bool) bool) error {
-	panic("Not implemented")
+func (client *MockClient) ListUniqueProblemsPages(input *devicefarm.ListUniqueProblemsInput, fn func(*devicefarm.ListUniqueProblemsOutput, bool) bool) error {
+	for {
+		out, err := client.ListUniqueProblems(input)
+		if err != nil {
+			return err
+		}
+		last := len(aws.StringValue(out.NextToken)) == 0
+		if !fn(out, last) || last {
+			return nil
+		}
+		next := *input
+		next.NextToken = out.NextToken
+		input = &next
+	}
 }
 
 func (client *MockClient) ListUploadsRequest(*devicefarm.ListUploadsInput) (*request.Request, *devicefarm.ListUploadsOutput) {
 	panic("Not implemented")
 }
 
-func (client *MockClient) ListUploads(*devicefarm.ListUploadsInput) (*devicefarm.ListUploadsOutput, error) {
-	panic("Not implemented")
+func (client *MockClient) ListUploads(input *devicefarm.ListUploadsInput) (*devicefarm.ListUploadsOutput, error) {
+	client.input(input)
+	response := client.dequeue()
+	var out *devicefarm.ListUploadsOutput
+	if response[0] != nil {
+		out = response[0].(*devicefarm.ListUploadsOutput)
+	}
+	var err error
+	if response[1] != nil {
+		err = response[1].(error)
+	}
+	return out, err
 }
 
-func (client *MockClient) ListUploadsPages(*devicefarm.ListUploadsInput, func(*devicefarm.ListUploadsOutput, bool) bool) error {
-	panic("Not implemented")
+func (client *MockClient) ListUploadsPages(input *devicefarm.ListUploadsInput, fn func(*devicefarm.ListUploadsOutput, bool) bool) error {
+	for {
+		out, err := client.ListUploads(input)
+		if err != nil {
+			return err
+		}
+		last := len(aws.StringValue(out.NextToken)) == 0
+		if !fn(out, last) || last {
+			return nil
+		}
+		next := *input
+		next.NextToken = out.NextToken
+		input = &next
+	}
 }
 
 func (client *MockClient) PurchaseOfferingRequest(*devicefarm.PurchaseOfferingInput) (*request.Request, *devicefarm.PurchaseOfferingOutput) {
@@ -420,16 +677,36 @@ func (client *MockClient) ScheduleRunRequest(*devicefarm.ScheduleRunInput) (*req
 	panic("Not implemented")
 }
 
-func (client *MockClient) ScheduleRun(*devicefarm.ScheduleRunInput) (*devicefarm.ScheduleRunOutput, error) {
-	panic("Not implemented")
+func (client *MockClient) ScheduleRun(input *devicefarm.ScheduleRunInput) (*devicefarm.ScheduleRunOutput, error) {
+	client.input(input)
+	response := client.dequeue()
+	var out *devicefarm.ScheduleRunOutput
+	if response[0] != nil {
+		out = response[0].(*devicefarm.ScheduleRunOutput)
+	}
+	var err error
+	if response[1] != nil {
+		err = response[1].(error)
+	}
+	return out, err
 }
 
 func (client *MockClient) StopRunRequest(*devicefarm.StopRunInput) (*request.Request, *devicefarm.StopRunOutput) {
 	panic("Not implemented")
 }
 
-func (client *MockClient) StopRun(*devicefarm.StopRunInput) (*devicefarm.StopRunOutput, error) {
-	panic("Not implemented")
+func (client *MockClient) StopRun(input *devicefarm.StopRunInput) (*devicefarm.StopRunOutput, error) {
+	client.input(input)
+	response := client.dequeue()
+	var out *devicefarm.StopRunOutput
+	if response[0] != nil {
+		out = response[0].(*devicefarm.StopRunOutput)
+	}
+	var err error
+	if response[1] != nil {
+		err = response[1].(error)
+	}
+	return out, err
 }
 
 func (client *MockClient) UpdateDevicePoolRequest(*devicefarm.UpdateDevicePoolInput) (*request.Request, *devicefarm.UpdateDevicePoolOutput) {
@@ -1,22 +1,30 @@
 package awsutil
 
 import (
+	"context"
 	"errors"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/service/devicefarm"
 	"github.com/ride/devicefarm/util"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
 	"testing"
 	"time"
 )
 
+// the context given to DeviceFarm methods by tests which don't cancel
+var ctx = context.Background()
+
 // fake devices
 var androidDevice *devicefarm.Device = &devicefarm.Device{
 	Name:     aws.String("Samsung Galaxy S3"),
@@ -32,7 +40,7 @@ var iosDevice *devicefarm.Device = &devicefarm.Device{
 // see client_mock_test.go for MockClient implementation
 func mockClient() (*DeviceFarm, *MockClient) {
 	mock := &MockClient{}
-	client := &DeviceFarm{mock, util.NilLogger, nil, false}
+	client := &DeviceFarm{Client: mock, Log: util.NilLogger}
 	return client, mock
 }
 
@@ -76,8 +84,9 @@ func TestNewClient(t *testing.T) {
 	assert := assert.New(t)
 	creds := credentials.NewStaticCredentials("foo", "bar", "baz")
 	log := util.NilLogger
-	client := NewClient(creds, log)
+	client := NewClient(creds, "eu-west-1", log)
 	assert.NotNil(client)
+	assert.Equal("eu-west-1", *client.Client.(*devicefarm.DeviceFarm).Config.Region)
 }
 
 func TestSearchDevices(t *testing.T) {
@@ -90,31 +99,57 @@ func TestSearchDevices(t *testing.T) {
 	mock.enqueue(output, nil)
 
 	// blank search should return both devices, sorted
-	result, err := client.SearchDevices("", false, false)
+	result, err := client.SearchDevices(ctx, "", false, false)
 	assert.Nil(err)
 	assert.Equal(DeviceList{iosDevice, androidDevice}, result)
 
 	// search should only return the iphone
 	mock.enqueue(output, nil)
-	result, err = client.SearchDevices("iphone", false, false)
+	result, err = client.SearchDevices(ctx, "iphone", false, false)
 	assert.Nil(err)
 	assert.Equal(DeviceList{iosDevice}, result)
 
 	// android filter should only return the android phone
 	mock.enqueue(output, nil)
-	result, err = client.SearchDevices("", true, false)
+	result, err = client.SearchDevices(ctx, "", true, false)
 	assert.Nil(err)
 	assert.Equal(DeviceList{androidDevice}, result)
 
 	// ios filter should only return the iphone
 	mock.enqueue(output, nil)
-	result, err = client.SearchDevices("", false, true)
+	result, err = client.SearchDevices(ctx, "", false, true)
 	assert.Nil(err)
 	assert.Equal(DeviceList{iosDevice}, result)
 
 	// should fail due to error
 	mock.enqueue(nil, errors.New("fake error"))
-	result, err = client.SearchDevices("", false, false)
+	result, err = client.SearchDevices(ctx, "", false, false)
+	assert.NotNil(err)
+	assert.Nil(result)
+}
+
+func TestDevicesNotOnPlatform(t *testing.T) {
+	assert := assert.New(t)
+	client, mock := mockClient()
+
+	output := &devicefarm.ListDevicesOutput{}
+	output.Devices = []*devicefarm.Device{androidDevice, iosDevice}
+
+	// only the android device should be returned
+	mock.enqueue(output, nil)
+	result, err := client.DevicesNotOnPlatform(ctx, []string{"arn123", "arn456"}, devicefarm.DevicePlatformIos)
+	assert.Nil(err)
+	assert.Equal(DeviceList{androidDevice}, result)
+
+	// devices not in the list should be ignored
+	mock.enqueue(output, nil)
+	result, err = client.DevicesNotOnPlatform(ctx, []string{"arn123"}, devicefarm.DevicePlatformAndroid)
+	assert.Nil(err)
+	assert.Equal(0, len(result))
+
+	// should fail due to error
+	mock.enqueue(nil, errors.New("fake error"))
+	result, err = client.DevicesNotOnPlatform(ctx, []string{"arn123"}, devicefarm.DevicePlatformIos)
 	assert.NotNil(err)
 	assert.Nil(result)
 }
@@ -134,17 +169,199 @@ func TestListDevicePools(t *testing.T) {
 		},
 	}
 	mock.enqueue(output, nil)
-	pools, err := client.ListDevicePools("foo")
+	pools, err := client.ListDevicePools(ctx, "foo")
 	assert.Nil(err)
 	assert.Equal(output.DevicePools, pools)
 
 	// should fail due to error
 	mock.enqueue(nil, errors.New("fake error"))
-	pools, err = client.ListDevicePools("foo")
+	pools, err = client.ListDevicePools(ctx, "foo")
 	assert.NotNil(err)
 	assert.Nil(pools)
 }
 
+func TestListPages(t *testing.T) {
+	assert := assert.New(t)
+	client, mock := mockClient()
+
+	// nextToken returns the NextToken given to the nth call of the mock
+	nextToken := func(n int) string {
+		input := reflect.ValueOf(mock.Inputs()[n][0]).Elem()
+		return aws.StringValue(input.FieldByName("NextToken").Interface().(*string))
+	}
+
+	// should combine every page of devices
+	mock.enqueuePages(
+		&devicefarm.ListDevicesOutput{Devices: []*devicefarm.Device{androidDevice}},
+		&devicefarm.ListDevicesOutput{Devices: []*devicefarm.Device{iosDevice}},
+	)
+	devices, err := client.SearchDevices(ctx, "", false, false)
+	assert.Nil(err)
+	assert.Equal(2, len(devices))
+
+	mock.enqueuePages(
+		&devicefarm.ListDevicePoolsOutput{DevicePools: []*devicefarm.DevicePool{{Name: aws.String("a")}}},
+		&devicefarm.ListDevicePoolsOutput{DevicePools: []*devicefarm.DevicePool{{Name: aws.String("b")}}},
+		&devicefarm.ListDevicePoolsOutput{DevicePools: []*devicefarm.DevicePool{{Name: aws.String("c")}}},
+	)
+	pools, err := client.ListDevicePools(ctx, "projectArn")
+	assert.Nil(err)
+	assert.Equal(3, len(pools))
+	assert.Equal("c", *pools[2].Name)
+	assert.Equal("", nextToken(2))
+	assert.Equal("page-2", nextToken(3))
+	assert.Equal("page-3", nextToken(4))
+
+	mock.enqueuePages(
+		&devicefarm.ListUploadsOutput{Uploads: []*devicefarm.Upload{{Name: aws.String("a")}}},
+		&devicefarm.ListUploadsOutput{Uploads: []*devicefarm.Upload{{Name: aws.String("b")}}},
+	)
+	uploads, err := client.ListUploads(ctx, "projectArn")
+	assert.Nil(err)
+	assert.Equal(2, len(uploads))
+
+	mock.enqueuePages(
+		&devicefarm.ListSamplesOutput{Samples: []*devicefarm.Sample{{Arn: aws.String("a")}}},
+		&devicefarm.ListSamplesOutput{Samples: []*devicefarm.Sample{{Arn: aws.String("b")}}},
+	)
+	samples, err := client.ListSamples(ctx, "jobArn")
+	assert.Nil(err)
+	assert.Equal(2, len(samples))
+
+	// should merge unique problems by result
+	failed := devicefarm.ExecutionResultFailed
+	mock.enqueuePages(
+		&devicefarm.ListUniqueProblemsOutput{UniqueProblems: map[string][]*devicefarm.UniqueProblem{
+			failed: {{Message: aws.String("a")}},
+		}},
+		&devicefarm.ListUniqueProblemsOutput{UniqueProblems: map[string][]*devicefarm.UniqueProblem{
+			failed:                            {{Message: aws.String("b")}},
+			devicefarm.ExecutionResultErrored: {{Message: aws.String("c")}},
+		}},
+	)
+	problems, err := client.ListUniqueProblems(ctx, "runArn")
+	assert.Nil(err)
+	assert.Equal(2, len(problems[failed]))
+	assert.Equal(1, len(problems[devicefarm.ExecutionResultErrored]))
+
+	// should fail due to an error on a later page
+	mock.enqueue(&devicefarm.ListRunsOutput{
+		Runs:      []*devicefarm.Run{{Arn: aws.String("a")}},
+		NextToken: aws.String("page-2"),
+	}, nil)
+	mock.enqueue(nil, errors.New("fake error"))
+	runs, err := client.ListRuns(ctx, "projectArn")
+	assert.NotNil(err)
+	assert.Nil(runs)
+}
+
+func TestEachRun(t *testing.T) {
+	assert := assert.New(t)
+	client, mock := mockClient()
+
+	// should stop fetching pages once the callback returns false
+	mock.enqueuePages(
+		&devicefarm.ListRunsOutput{Runs: []*devicefarm.Run{{Arn: aws.String("a")}, {Arn: aws.String("b")}}},
+		&devicefarm.ListRunsOutput{Runs: []*devicefarm.Run{{Arn: aws.String("c")}}},
+	)
+	arns := []string{}
+	err := client.EachRun(ctx, "projectArn", func(run *devicefarm.Run) bool {
+		arns = append(arns, *run.Arn)
+		return len(arns) < 2
+	})
+	assert.Nil(err)
+	assert.Equal([]string{"a", "b"}, arns)
+	assert.Equal(1, len(mock.Inputs()))
+
+	// should stop in the middle of a later page too
+	client, mock = mockClient()
+	mock.enqueuePages(
+		&devicefarm.ListRunsOutput{Runs: []*devicefarm.Run{{Arn: aws.String("a")}}},
+		&devicefarm.ListRunsOutput{Runs: []*devicefarm.Run{{Arn: aws.String("b")}, {Arn: aws.String("c")}}},
+		&devicefarm.ListRunsOutput{Runs: []*devicefarm.Run{{Arn: aws.String("d")}}},
+	)
+	arns = []string{}
+	err = client.EachRun(ctx, "projectArn", func(run *devicefarm.Run) bool {
+		arns = append(arns, *run.Arn)
+		return *run.Arn != "b"
+	})
+	assert.Nil(err)
+	assert.Equal([]string{"a", "b"}, arns)
+	assert.Equal(2, len(mock.Inputs()))
+	assert.Equal("page-2", *mock.Inputs()[1][0].(*devicefarm.ListRunsInput).NextToken)
+}
+
+func TestEachUniqueProblem(t *testing.T) {
+	assert := assert.New(t)
+	client, mock := mockClient()
+
+	// should stop fetching pages once the callback returns false
+	problem := func(message string) *devicefarm.UniqueProblem {
+		return &devicefarm.UniqueProblem{Message: aws.String(message)}
+	}
+	mock.enqueuePages(
+		&devicefarm.ListUniqueProblemsOutput{UniqueProblems: map[string][]*devicefarm.UniqueProblem{
+			devicefarm.ExecutionResultFailed: {problem("a"), problem("b")},
+		}},
+		&devicefarm.ListUniqueProblemsOutput{UniqueProblems: map[string][]*devicefarm.UniqueProblem{
+			devicefarm.ExecutionResultFailed: {problem("c")},
+		}},
+	)
+	messages := []string{}
+	err := client.EachUniqueProblem(ctx, "runArn", func(result string, problem *devicefarm.UniqueProblem) bool {
+		messages = append(messages, *problem.Message)
+		return false
+	})
+	assert.Nil(err)
+	assert.Equal([]string{"a"}, messages)
+	assert.Equal(1, len(mock.Inputs()))
+}
+
+func TestListRunsPages(t *testing.T) {
+	assert := assert.New(t)
+	client, mock := mockClient()
+
+	// should fetch every page, passing on the token of the next page
+	mock.enqueuePages(
+		&devicefarm.ListRunsOutput{Runs: []*devicefarm.Run{{Arn: aws.String("a")}, {Arn: aws.String("b")}}},
+		&devicefarm.ListRunsOutput{Runs: []*devicefarm.Run{{Arn: aws.String("c")}}},
+	)
+	runs, err := client.ListRuns(ctx, "projectArn")
+	assert.Nil(err)
+	assert.Equal(3, len(runs))
+	assert.Equal("c", *runs[2].Arn)
+	assert.Equal(2, len(mock.Inputs()))
+	assert.Nil(mock.Inputs()[0][0].(*devicefarm.ListRunsInput).NextToken)
+	assert.Equal("page-2", *mock.Inputs()[1][0].(*devicefarm.ListRunsInput).NextToken)
+	assert.Equal("projectArn", *mock.Inputs()[1][0].(*devicefarm.ListRunsInput).Arn)
+
+	// should stop fetching pages once cancelled
+	cancelCtx, cancel := context.WithCancel(ctx)
+	client, mock = mockClient()
+	mock.enqueuePages(
+		&devicefarm.ListRunsOutput{Runs: []*devicefarm.Run{{Arn: aws.String("a")}}},
+		&devicefarm.ListRunsOutput{Runs: []*devicefarm.Run{{Arn: aws.String("b")}}},
+	)
+	client.Client = &cancellingClient{MockClient: mock, cancel: cancel}
+	runs, err = client.ListRuns(cancelCtx, "projectArn")
+	assert.Equal(context.Canceled, err)
+	assert.Nil(runs)
+	assert.Equal(1, len(mock.Inputs()))
+}
+
+// cancellingClient cancels a context once a page of runs has been listed.
+type cancellingClient struct {
+	*MockClient
+	cancel func()
+}
+
+func (client *cancellingClient) ListRunsPages(input *devicefarm.ListRunsInput, fn func(*devicefarm.ListRunsOutput, bool) bool) error {
+	return client.MockClient.ListRunsPages(input, func(page *devicefarm.ListRunsOutput, last bool) bool {
+		client.cancel()
+		return fn(page, last)
+	})
+}
+
 func TestCreateDevicePool(t *testing.T) {
 	assert := assert.New(t)
 	client, mock := mockClient()
@@ -158,14 +375,16 @@ func TestCreateDevicePool(t *testing.T) {
 	mock.enqueue(output, nil)
 
 	// should succeed and return device pool
-	pool, err := client.CreateDevicePool("arn", "name", []string{"foo"})
+	pool, err := client.CreateDevicePool(ctx, "arn", "name", arnRules("[\"foo\"]"))
 	assert.Nil(err)
 	assert.Equal(*output.DevicePool, *pool)
 
 	// check input given to mock.CreateDevicePool()
+	actualInput := (mock.Inputs()[0][0]).(*devicefarm.CreateDevicePoolInput)
 	expectedInput := devicefarm.CreateDevicePoolInput{
-		ProjectArn: aws.String("arn"),
-		Name:       aws.String("name"),
+		ProjectArn:  aws.String("arn"),
+		Name:        aws.String("name"),
+		Description: actualInput.Description,
 		Rules: []*devicefarm.Rule{
 			{
 				Attribute: aws.String("ARN"),
@@ -174,12 +393,16 @@ func TestCreateDevicePool(t *testing.T) {
 			},
 		},
 	}
-	actualInput := (mock.Inputs()[0][0]).(*devicefarm.CreateDevicePoolInput)
 	assert.Equal(expectedInput, *actualInput)
 
+	// the description should record when the pool was created
+	updated, ok := PoolUpdated(&devicefarm.DevicePool{Description: actualInput.Description})
+	assert.True(ok)
+	assert.WithinDuration(time.Now(), updated, time.Minute)
+
 	// should fail due to error
 	mock.enqueue(nil, errors.New("fake error"))
-	pool, err = client.CreateDevicePool("arn", "name", []string{"foo"})
+	pool, err = client.CreateDevicePool(ctx, "arn", "name", arnRules("[\"foo\"]"))
 	assert.NotNil(err)
 	assert.Nil(pool)
 }
@@ -199,14 +422,16 @@ func TestUpdateDevicePool(t *testing.T) {
 	mock.enqueue(output, nil)
 
 	// should succeed and return device pool
-	updatedPool, err := client.UpdateDevicePool(pool, []string{"foo"})
+	updatedPool, err := client.UpdateDevicePool(ctx, pool, arnRules("[\"foo\"]"))
 	assert.Nil(err)
 	assert.Equal(*pool, *updatedPool)
 
 	// check input given to mock.UpdateDevicePool()
+	actualInput := (mock.Inputs()[0][0]).(*devicefarm.UpdateDevicePoolInput)
 	expectedInput := devicefarm.UpdateDevicePoolInput{
-		Arn:  aws.String("poolarn"),
-		Name: aws.String("poolname"),
+		Arn:         aws.String("poolarn"),
+		Name:        aws.String("poolname"),
+		Description: actualInput.Description,
 		Rules: []*devicefarm.Rule{
 			{
 				Attribute: aws.String("ARN"),
@@ -215,12 +440,16 @@ func TestUpdateDevicePool(t *testing.T) {
 			},
 		},
 	}
-	actualInput := (mock.Inputs()[0][0]).(*devicefarm.UpdateDevicePoolInput)
 	assert.Equal(expectedInput, *actualInput)
 
+	// the description should record when the pool was updated
+	updated, ok := PoolUpdated(&devicefarm.DevicePool{Description: actualInput.Description})
+	assert.True(ok)
+	assert.WithinDuration(time.Now(), updated, time.Minute)
+
 	// should fail due to error
 	mock.enqueue(nil, errors.New("fake error"))
-	pool, err = client.UpdateDevicePool(pool, []string{"foo"})
+	pool, err = client.UpdateDevicePool(ctx, pool, arnRules("[\"foo\"]"))
 	assert.NotNil(err)
 	assert.Nil(pool)
 }
@@ -240,13 +469,27 @@ func TestDevicePoolMatches(t *testing.T) {
 	}
 
 	// should match
-	result := client.DevicePoolMatches(pool, []string{"foo"})
+	result := client.DevicePoolMatches(pool, arnRules("[\"foo\"]"))
 	assert.True(result)
 
 	// should not match
-	result = client.DevicePoolMatches(pool, []string{"foo", "bar"})
+	result = client.DevicePoolMatches(pool, arnRules("[\"foo\",\"bar\"]"))
 	assert.False(result)
 
+	// should not match, because there are extra rules
+	platformRule := &devicefarm.Rule{
+		Attribute: aws.String("PLATFORM"),
+		Operator:  aws.String("EQUALS"),
+		Value:     aws.String("\"ANDROID\""),
+	}
+	result = client.DevicePoolMatches(pool, append(arnRules("[\"foo\"]"), platformRule))
+	assert.False(result)
+
+	// should match regardless of rule order
+	pool.Rules = append(pool.Rules, platformRule)
+	result = client.DevicePoolMatches(pool, []*devicefarm.Rule{platformRule, arnRules("[\"foo\"]")[0]})
+	assert.True(result)
+
 	pool = &devicefarm.DevicePool{
 		Rules: []*devicefarm.Rule{
 			{
@@ -258,26 +501,124 @@ func TestDevicePoolMatches(t *testing.T) {
 	}
 
 	// should not match
-	result = client.DevicePoolMatches(pool, []string{"foo"})
+	result = client.DevicePoolMatches(pool, arnRules("[\"foo\"]"))
 	assert.False(result)
+
+	// an empty pool should only match no rules
+	pool = &devicefarm.DevicePool{}
+	assert.False(client.DevicePoolMatches(pool, arnRules("[\"foo\"]")))
+	assert.True(client.DevicePoolMatches(pool, []*devicefarm.Rule{}))
+}
+
+// arnRules returns a single ARN IN rule with the given JSON value.
+func arnRules(value string) []*devicefarm.Rule {
+	return []*devicefarm.Rule{
+		{
+			Attribute: aws.String("ARN"),
+			Operator:  aws.String("IN"),
+			Value:     aws.String(value),
+		},
+	}
 }
 
 func TestUploadToS3(t *testing.T) {
 	assert := assert.New(t)
 	client, _ := mockClient()
 
-	url, ln, err := mockS3(t, "foo")
-	defer ln.Close()
+	defer func(delay time.Duration) { uploadRetryDelay = delay }(uploadRetryDelay)
+	uploadRetryDelay = time.Millisecond
+
+	// the server responds with each status in turn, then 201
+	statuses := []int{}
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		requests++
+		body, err := ioutil.ReadAll(req.Body)
+		assert.Nil(err)
+		assert.Equal("Foo\n", string(body))
+		assert.Equal(int64(4), req.ContentLength)
+		assert.Empty(req.TransferEncoding)
+		if len(statuses) > 0 {
+			res.WriteHeader(statuses[0])
+			res.Write([]byte("<Error><Code>Status</Code></Error>"))
+			statuses = statuses[1:]
+			return
+		}
+		res.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	file, err := os.Open("testdata/foo.txt")
+	assert.Nil(err)
+	defer file.Close()
+	rewind := func() {
+		file.Seek(0, io.SeekStart)
+		requests = 0
+	}
 
 	// should succeed
-	err = client.UploadToS3(url, strings.NewReader("foo"))
+	err = client.UploadToS3(ctx, server.URL, file)
+	assert.Nil(err)
+	assert.Equal(1, requests)
+
+	// should retry 5xx responses
+	rewind()
+	statuses = []int{http.StatusServiceUnavailable, http.StatusInternalServerError}
+	err = client.UploadToS3(ctx, server.URL, file)
 	assert.Nil(err)
+	assert.Equal(3, requests)
+
+	// should give up after uploadAttempts
+	rewind()
+	statuses = []int{500, 500, 500, 500, 500}
+	err = client.UploadToS3(ctx, server.URL, file)
+	assert.NotNil(err)
+	assert.Equal(uploadAttempts, requests)
+
+	// should fail immediately with the S3 error on other responses
+	rewind()
+	statuses = []int{http.StatusForbidden}
+	err = client.UploadToS3(ctx, server.URL, file)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "403 Forbidden")
+	assert.Contains(err.Error(), "<Code>Status</Code>")
+	assert.Equal(1, requests)
 
 	// should fail because 'fakeurl' does not exist
-	err = client.UploadToS3("fakeurl", nil)
+	rewind()
+	err = client.UploadToS3(ctx, "fakeurl", file)
 	assert.NotNil(err)
 }
 
+func TestUploadToS3Cancellation(t *testing.T) {
+	assert := assert.New(t)
+	client, _ := mockClient()
+
+	// the server never responds, until the request is cancelled
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		requests++
+		// the request is only cancelled once its body has been read
+		ioutil.ReadAll(req.Body)
+		<-req.Context().Done()
+	}))
+
+	file, err := os.Open("testdata/foo.txt")
+	assert.Nil(err)
+	defer file.Close()
+
+	// should abort the upload without retrying
+	assertNoLeaks(t, func() {
+		cancelCtx, cancel := context.WithCancel(ctx)
+		time.AfterFunc(20*time.Millisecond, cancel)
+		err = client.UploadToS3(cancelCtx, server.URL, file)
+		assert.NotNil(err)
+		assert.Equal(context.Canceled, cancelCtx.Err())
+		server.Close()
+	})
+	assert.Equal(1, requests)
+}
+
 func TestCreateUpload(t *testing.T) {
 	assert := assert.New(t)
 	client, mock := mockClient()
@@ -304,20 +645,23 @@ func TestCreateUpload(t *testing.T) {
 	}
 
 	// should fail because foo.txt does not exist
-	mock.enqueue(output, nil)
-	_, err = client.CreateUpload("projectArn", filename, "uploadType", "name")
+	_, err = client.CreateUpload(ctx, "projectArn", filename, "uploadType", "name")
 	assert.NotNil(err)
 
-	// should succeed
+	// should succeed, naming the upload after the file's hash
 	util.CopyFile("testdata/foo.txt", filename)
+	mock.enqueue(&devicefarm.ListUploadsOutput{}, nil)
 	mock.enqueue(output, nil)
-	uploadArn, err := client.CreateUpload("projectArn", filename, "uploadType", "name")
+	uploadArn, err := client.CreateUpload(ctx, "projectArn", filename, "uploadType", "name")
 	assert.Nil(err)
 	assert.Equal("uploadArn", uploadArn)
+	hash, _ := fileHash(filename)
+	assert.Equal(hash+"-uploadType-name", *mock.Inputs()[1][0].(*devicefarm.CreateUploadInput).Name)
 
 	// should fail due to error
+	mock.enqueue(&devicefarm.ListUploadsOutput{}, nil)
 	mock.enqueue(nil, errors.New("fake error"))
-	_, err = client.CreateUpload("projectArn", filename, "uploadType", "name")
+	_, err = client.CreateUpload(ctx, "projectArn", filename, "uploadType", "name")
 	assert.NotNil(err)
 }
 
@@ -333,7 +677,7 @@ func TestWaitForUploadsToSucceed(t *testing.T) {
 		},
 	}
 	mock.enqueue(output, nil)
-	err := client.WaitForUploadsToSucceed(1000, 0, "arn123")
+	err := client.WaitForUploadsToSucceed(ctx, 1000, 0, "arn123")
 	assert.Nil(err)
 
 	// should succeed on the third iteration
@@ -352,7 +696,7 @@ func TestWaitForUploadsToSucceed(t *testing.T) {
 		},
 	}
 	mock.enqueue(output, nil)
-	err = client.WaitForUploadsToSucceed(1000, 0, "arn123")
+	err = client.WaitForUploadsToSucceed(ctx, 1000, 0, "arn123")
 	assert.Nil(err)
 
 	// should fail because upload failed
@@ -363,12 +707,12 @@ func TestWaitForUploadsToSucceed(t *testing.T) {
 		},
 	}
 	mock.enqueue(output, nil)
-	err = client.WaitForUploadsToSucceed(1000, 0, "arn123")
+	err = client.WaitForUploadsToSucceed(ctx, 1000, 0, "arn123")
 	assert.NotNil(err)
 
 	// should fail due to error
 	mock.enqueue(nil, errors.New("Fake error"))
-	err = client.WaitForUploadsToSucceed(1000, 0, "arn123")
+	err = client.WaitForUploadsToSucceed(ctx, 1000, 0, "arn123")
 	assert.NotNil(err)
 
 	// should fail because of timeout
@@ -379,6 +723,302 @@ func TestWaitForUploadsToSucceed(t *testing.T) {
 		},
 	}
 	mock.enqueue(output, nil)
-	err = client.WaitForUploadsToSucceed(1, 2, "arn123")
+	err = client.WaitForUploadsToSucceed(ctx, 1, 50, "arn123")
+	assert.NotNil(err)
+}
+
+func TestWaitForRun(t *testing.T) {
+	assert := assert.New(t)
+	client, mock := mockClient()
+
+	runOutput := func(status, result string, passed int64) *devicefarm.GetRunOutput {
+		return &devicefarm.GetRunOutput{
+			Run: &devicefarm.Run{
+				Arn:      aws.String("arn123"),
+				Status:   aws.String(status),
+				Result:   aws.String(result),
+				Counters: &devicefarm.Counters{Passed: aws.Int64(passed)},
+			},
+		}
+	}
+
+	// should succeed on the fourth iteration, logging only status transitions
+	out, log := util.NewCaptureLogger()
+	client.Log = log
+	mock.enqueue(runOutput(devicefarm.ExecutionStatusScheduling, devicefarm.ExecutionResultPending, 0), nil)
+	mock.enqueue(runOutput(devicefarm.ExecutionStatusRunning, devicefarm.ExecutionResultPending, 0), nil)
+	mock.enqueue(runOutput(devicefarm.ExecutionStatusRunning, devicefarm.ExecutionResultPending, 1), nil)
+	mock.enqueue(runOutput(devicefarm.ExecutionStatusCompleted, devicefarm.ExecutionResultPassed, 2), nil)
+	run, err := client.WaitForRun(ctx, "arn123", 1000, 0)
+	assert.Nil(err)
+	assert.Equal(devicefarm.ExecutionResultPassed, *run.Result)
+	assert.Equal(3, len(out.Out()))
+	assert.True(strings.HasPrefix(out.Out()[2], "COMPLETED (total: 0, passed: 2,"))
+
+	// check input given to mock.GetRun()
+	actualInput := (mock.Inputs()[0][0]).(*devicefarm.GetRunInput)
+	assert.Equal("arn123", *actualInput.Arn)
+
+	// should fail due to error
+	mock.enqueue(nil, errors.New("fake error"))
+	run, err = client.WaitForRun(ctx, "arn123", 1000, 0)
+	assert.NotNil(err)
+	assert.Nil(run)
+
+	// should fail because of timeout
+	mock.enqueue(runOutput(devicefarm.ExecutionStatusRunning, devicefarm.ExecutionResultPending, 0), nil)
+	run, err = client.WaitForRun(ctx, "arn123", 1, 2)
+	assert.NotNil(err)
+	assert.Nil(run)
+}
+
+// assertNoLeaks runs f, then checks that every goroutine it started has
+// exited, allowing a moment for goroutines which are just finishing.
+func assertNoLeaks(t *testing.T, f func()) {
+	before := runtime.NumGoroutine()
+	f()
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, runtime.NumGoroutine() <= before, "goroutines leaked: %d before, %d after", before, runtime.NumGoroutine())
+}
+
+func TestWaitCancellation(t *testing.T) {
+	assert := assert.New(t)
+	client, mock := mockClient()
+
+	processing := &devicefarm.GetUploadOutput{
+		Upload: &devicefarm.Upload{Status: aws.String(devicefarm.UploadStatusProcessing)},
+	}
+	running := &devicefarm.GetRunOutput{
+		Run: &devicefarm.Run{Status: aws.String(devicefarm.ExecutionStatusRunning)},
+	}
+
+	assertNoLeaks(t, func() {
+		// should stop waiting for uploads when cancelled
+		cancelCtx, cancel := context.WithCancel(ctx)
+		time.AfterFunc(20*time.Millisecond, cancel)
+		mock.enqueue(processing, nil)
+		start := time.Now()
+		err := client.WaitForUploadsToSucceed(cancelCtx, 60000, 60000, "arn123")
+		assert.Equal(context.Canceled, err)
+		assert.True(time.Since(start) < time.Second)
+
+		// should report a timeout, rather than a context error
+		mock.enqueue(processing, nil)
+		err = client.WaitForUploadsToSucceed(ctx, 20, 60000, "arn123")
+		assert.NotNil(err)
+		assert.Equal("Timed out", err.Error())
+
+		// should stop waiting for a run when cancelled
+		cancelCtx, cancel = context.WithCancel(ctx)
+		time.AfterFunc(20*time.Millisecond, cancel)
+		mock.enqueue(running, nil)
+		start = time.Now()
+		run, err := client.WaitForRun(cancelCtx, "arn123", 120000, 60000)
+		assert.Equal(context.Canceled, err)
+		assert.Nil(run)
+		assert.True(time.Since(start) < time.Second)
+	})
+
+	// should not call the API once cancelled
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	client, mock = mockClient()
+	runs, err := client.ListRuns(cancelCtx, "projectArn")
+	assert.Equal(context.Canceled, err)
+	assert.Nil(runs)
+	_, err = client.CreateRun(cancelCtx, "projectArn", "poolArn", &RunConfig{App: "testdata/foo.txt"})
+	assert.Equal(context.Canceled, err)
+	assert.Equal(0, len(mock.Inputs()))
+}
+
+func TestStopRun(t *testing.T) {
+	assert := assert.New(t)
+	client, mock := mockClient()
+
+	// should succeed
+	mock.enqueue(&devicefarm.StopRunOutput{}, nil)
+	err := client.StopRun(ctx, "runArn")
+	assert.Nil(err)
+	assert.Equal("runArn", *mock.Inputs()[0][0].(*devicefarm.StopRunInput).Arn)
+
+	// should fail due to error
+	mock.enqueue(nil, errors.New("fake error"))
+	err = client.StopRun(ctx, "runArn")
 	assert.NotNil(err)
 }
+
+func TestDeleteRun(t *testing.T) {
+	assert := assert.New(t)
+	client, mock := mockClient()
+
+	// should succeed
+	mock.enqueue(&devicefarm.DeleteRunOutput{}, nil)
+	err := client.DeleteRun(ctx, "runArn")
+	assert.Nil(err)
+	assert.Equal("runArn", *mock.Inputs()[0][0].(*devicefarm.DeleteRunInput).Arn)
+
+	// should fail due to error
+	mock.enqueue(nil, errors.New("fake error"))
+	err = client.DeleteRun(ctx, "runArn")
+	assert.NotNil(err)
+}
+
+func TestFindRun(t *testing.T) {
+	assert := assert.New(t)
+	client, mock := mockClient()
+	prefix := "arn:aws:devicefarm:us-west-2:026109802893:run:1124416c-bfb2-4334-817c-e211ecef7dc0/"
+	runs := &devicefarm.ListRunsOutput{Runs: []*devicefarm.Run{
+		{Arn: aws.String(prefix + "0fcac17b-6122-44d7-ae5a-12345678abcd")},
+		{Arn: aws.String(prefix + "0fcad000-6122-44d7-ae5a-12345678abcd")},
+		{Arn: aws.String(prefix + "9b1e0000-6122-44d7-ae5a-12345678abcd")},
+	}}
+
+	// should find a run by a unique prefix of its ID
+	mock.enqueue(runs, nil)
+	run, err := client.FindRun(ctx, "projectArn", "0FCAC")
+	assert.Nil(err)
+	assert.Equal(prefix+"0fcac17b-6122-44d7-ae5a-12345678abcd", *run.Arn)
+
+	// should fail when the prefix is ambiguous
+	mock.enqueue(runs, nil)
+	_, err = client.FindRun(ctx, "projectArn", "0fca")
+	assert.Equal("Run ID 0fca is ambiguous, it matches more than one run", err.Error())
+
+	// should fail when no run matches
+	mock.enqueue(runs, nil)
+	_, err = client.FindRun(ctx, "projectArn", "ffff")
+	assert.Equal("No run found with ID: ffff", err.Error())
+
+	// should fail due to error
+	mock.enqueue(nil, errors.New("fake error"))
+	_, err = client.FindRun(ctx, "projectArn", "0fcac")
+	assert.NotNil(err)
+	// should stop fetching pages once the ID is known to be ambiguous
+	client, mock = mockClient()
+	mock.enqueuePages(
+		&devicefarm.ListRunsOutput{Runs: runs.Runs[:2]},
+		&devicefarm.ListRunsOutput{Runs: runs.Runs[2:]},
+	)
+	_, err = client.FindRun(ctx, "projectArn", "0fca")
+	assert.NotNil(err)
+	assert.Equal(1, len(mock.Inputs()))
+}
+
+func TestResultExitCode(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(0, ResultExitCode(devicefarm.ExecutionResultPassed))
+	codes := map[int]bool{}
+	for _, result := range []string{
+		devicefarm.ExecutionResultPassed,
+		devicefarm.ExecutionResultWarned,
+		devicefarm.ExecutionResultFailed,
+		devicefarm.ExecutionResultErrored,
+		devicefarm.ExecutionResultStopped,
+		devicefarm.ExecutionResultPending,
+	} {
+		codes[ResultExitCode(result)] = true
+	}
+	// every result should have a distinct exit code
+	assert.Equal(6, len(codes))
+	assert.False(codes[1])
+}
+
+func TestCreateRun(t *testing.T) {
+	assert := assert.New(t)
+	client, mock := mockClient()
+	client.NoCache = true
+
+	// create mock S3 server
+	url, ln, err := mockS3(t, "Foo\n")
+	defer ln.Close()
+
+	uploadOutput := func(arn string) *devicefarm.CreateUploadOutput {
+		return &devicefarm.CreateUploadOutput{
+			Upload: &devicefarm.Upload{Arn: aws.String(arn), Url: aws.String(url)},
+		}
+	}
+	succeededOutput := &devicefarm.GetUploadOutput{
+		Upload: &devicefarm.Upload{Status: aws.String(devicefarm.UploadStatusSucceeded)},
+	}
+	runOutput := &devicefarm.ScheduleRunOutput{
+		Run: &devicefarm.Run{Arn: aws.String("runArn")},
+	}
+
+	// should upload the app and test package, then schedule the run
+	mock.enqueue(uploadOutput("appArn"), nil)
+	mock.enqueue(uploadOutput("testArn"), nil)
+	mock.enqueue(succeededOutput, nil)
+	mock.enqueue(succeededOutput, nil)
+	mock.enqueue(runOutput, nil)
+	runArn, err := client.CreateRun(ctx, "projectArn", "poolArn", &RunConfig{
+		Name:            "master@1a2b3c4",
+		App:             "testdata/foo.txt",
+		AppType:         devicefarm.UploadTypeAndroidApp,
+		TestPackage:     "testdata/foo.txt",
+		TestPackageType: devicefarm.UploadTypeInstrumentationTestPackage,
+		TestType:        devicefarm.TestTypeInstrumentation,
+	})
+	assert.Nil(err)
+	assert.Equal("runArn", runArn)
+	inputs := mock.Inputs()
+	assert.Equal(5, len(inputs))
+	appUpload := inputs[0][0].(*devicefarm.CreateUploadInput)
+	assert.Equal(devicefarm.UploadTypeAndroidApp, *appUpload.Type)
+	assert.True(strings.HasSuffix(*appUpload.Name, "-ANDROID_APP-foo.txt"))
+	scheduleInput := inputs[4][0].(*devicefarm.ScheduleRunInput)
+	assert.Equal("appArn", *scheduleInput.AppArn)
+	assert.Equal("testArn", *scheduleInput.Test.TestPackageArn)
+	assert.Equal(devicefarm.TestTypeInstrumentation, *scheduleInput.Test.Type)
+	assert.Equal("master@1a2b3c4", *scheduleInput.Name)
+
+	// should not upload an app when none is given
+	client, mock = mockClient()
+	client.NoCache = true
+	mock.enqueue(uploadOutput("testArn"), nil)
+	mock.enqueue(succeededOutput, nil)
+	mock.enqueue(runOutput, nil)
+	runArn, err = client.CreateRun(ctx, "projectArn", "poolArn", &RunConfig{
+		TestPackage:     "testdata/foo.txt",
+		TestPackageType: devicefarm.UploadTypeAppiumWebPythonTestPackage,
+		TestType:        devicefarm.TestTypeAppiumWebPython,
+	})
+	assert.Nil(err)
+	assert.Equal("runArn", runArn)
+	inputs = mock.Inputs()
+	assert.Equal(3, len(inputs))
+	scheduleInput = inputs[2][0].(*devicefarm.ScheduleRunInput)
+	assert.Nil(scheduleInput.AppArn)
+	assert.Nil(scheduleInput.Name)
+	assert.Equal(devicefarm.TestTypeAppiumWebPython, *scheduleInput.Test.Type)
+
+	// should not upload a test package when none is given, and pass parameters
+	client, mock = mockClient()
+	client.NoCache = true
+	mock.enqueue(uploadOutput("appArn"), nil)
+	mock.enqueue(succeededOutput, nil)
+	mock.enqueue(runOutput, nil)
+	runArn, err = client.CreateRun(ctx, "projectArn", "poolArn", &RunConfig{
+		App:            "testdata/foo.txt",
+		AppType:        devicefarm.UploadTypeAndroidApp,
+		TestType:       devicefarm.TestTypeBuiltinFuzz,
+		TestParameters: map[string]string{"event_count": "100"},
+	})
+	assert.Nil(err)
+	assert.Equal("runArn", runArn)
+	inputs = mock.Inputs()
+	assert.Equal(3, len(inputs))
+	scheduleInput = inputs[2][0].(*devicefarm.ScheduleRunInput)
+	assert.Equal("appArn", *scheduleInput.AppArn)
+	assert.Nil(scheduleInput.Test.TestPackageArn)
+	assert.Equal("100", *scheduleInput.Test.Parameters["event_count"])
+
+	// should fail due to error
+	mock.enqueue(nil, errors.New("fake error"))
+	_, err = client.CreateRun(ctx, "projectArn", "poolArn", &RunConfig{App: "testdata/foo.txt"})
+	assert.NotNil(err)
+}
+
@@ -0,0 +1,198 @@
+package awsutil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/devicefarm"
+	"github.com/ride/devicefarm/results"
+	"github.com/ride/devicefarm/util"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// A JobProgress is the state of one job (i.e. one device) of a run which is
+// in progress. Suite is the name of the suite the job is running, if any.
+type JobProgress struct {
+	Job   *results.Job
+	Suite string
+}
+
+// A RunRenderer shows the progress of a run each time WatchRun polls it.
+type RunRenderer interface {
+	Render(run *results.Run, jobs []*JobProgress)
+}
+
+// NewRunRenderer returns a TableRenderer if the logger writes to a terminal,
+// and otherwise a LineRenderer, e.g. for CI logs.
+func NewRunRenderer(log util.Logger) RunRenderer {
+	if util.IsTerminal(log) {
+		return &TableRenderer{Log: log}
+	}
+	return &LineRenderer{Log: log}
+}
+
+// WatchRun is like WaitForRun, but on each poll it also lists the run's jobs
+// and the suite each running job is on, and passes them to the renderer. The
+// progress of the jobs is only for show, so if it cannot be listed this is a
+// warning, and only the run is rendered.
+func (df *DeviceFarm) WatchRun(ctx context.Context, arn string, timeoutMs, delayMs int, renderer RunRenderer) (*devicefarm.Run, error) {
+	return df.pollRun(ctx, arn, timeoutMs, delayMs, func(run *devicefarm.Run) error {
+		jobs, err := df.JobProgress(ctx, arn)
+		if err != nil {
+			df.Log.Warnln("Could not list the progress of each device:", err)
+		}
+		renderer.Render(ConvertRun(run), jobs)
+		return nil
+	})
+}
+
+// JobProgress returns the progress of each job of a run, sorted by device.
+// The current suite is only looked up for jobs which are running.
+func (df *DeviceFarm) JobProgress(ctx context.Context, runArn string) ([]*JobProgress, error) {
+	jobs, err := df.ListJobs(ctx, runArn)
+	if err != nil {
+		return nil, err
+	}
+	progress := []*JobProgress{}
+	for _, job := range jobs {
+		p := &JobProgress{Job: ConvertJob(job)}
+		if aws.StringValue(job.Status) == devicefarm.ExecutionStatusRunning {
+			suites, err := df.ListSuites(ctx, aws.StringValue(job.Arn))
+			if err != nil {
+				return nil, err
+			}
+			for _, suite := range suites {
+				if aws.StringValue(suite.Status) == devicefarm.ExecutionStatusRunning {
+					p.Suite = aws.StringValue(suite.Name)
+					break
+				}
+			}
+		}
+		progress = append(progress, p)
+	}
+	sort.SliceStable(progress, func(i, j int) bool {
+		return progress[i].device() < progress[j].device()
+	})
+	return progress, nil
+}
+
+// device returns the job's device and OS, e.g. "Google Pixel (7.1.2)".
+func (p *JobProgress) device() string {
+	if len(p.Job.Os) == 0 {
+		return p.Job.Device
+	}
+	return p.Job.Device + " (" + p.Job.Os + ")"
+}
+
+// elapsed returns how long the job has been running, or how long it ran if it
+// has stopped.
+func (p *JobProgress) elapsed(now time.Time) time.Duration {
+	timing := p.Job.Timing
+	switch {
+	case timing.Started.IsZero():
+		return 0
+	case timing.Stopped.IsZero():
+		return now.Sub(timing.Started).Round(time.Second)
+	}
+	return timing.Duration().Round(time.Second)
+}
+
+// status returns the job's result once it has completed, and otherwise its
+// status.
+func (p *JobProgress) status() string {
+	if p.Job.Status == devicefarm.ExecutionStatusCompleted && len(p.Job.Result) > 0 {
+		return p.Job.Result
+	}
+	return p.Job.Status
+}
+
+func formatElapsed(d time.Duration) string {
+	if d <= 0 {
+		return "-"
+	}
+	return d.String()
+}
+
+// A TableRenderer redraws a table of every job in place each time it renders,
+// using ANSI escape codes. It should only be used on a terminal.
+type TableRenderer struct {
+	Log   util.Logger
+	Now   func() time.Time
+	lines int
+}
+
+func (r *TableRenderer) Render(run *results.Run, jobs []*JobProgress) {
+	now := time.Now()
+	if r.Now != nil {
+		now = r.Now()
+	}
+	out := &bytes.Buffer{}
+	fmt.Fprintf(out, "Run: %s %s\n", run.Status, formatCounters(run.Counters))
+	table := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "DEVICE\tSTATUS\tSUITE\tPASSED\tFAILED\tERRORED\tELAPSED")
+	for _, job := range jobs {
+		suite := job.Suite
+		if len(suite) == 0 {
+			suite = "-"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%d\t%d\t%d\t%s\n",
+			job.device(),
+			job.status(),
+			suite,
+			job.Job.Counters.Passed,
+			job.Job.Counters.Failed,
+			job.Job.Counters.Errored,
+			formatElapsed(job.elapsed(now)))
+	}
+	table.Flush()
+	if r.lines > 0 {
+		// move up to the first line of the last table and clear to the end
+		r.Log.Printf("\033[%dA\033[J", r.lines)
+	}
+	r.Log.Print(out.String())
+	r.lines = strings.Count(out.String(), "\n")
+}
+
+// A LineRenderer prints append-only status lines: one when the run's status
+// changes, and one for each job whose status, suite or counters change.
+type LineRenderer struct {
+	Log  util.Logger
+	Now  func() time.Time
+	last map[string]string
+}
+
+func (r *LineRenderer) Render(run *results.Run, jobs []*JobProgress) {
+	now := time.Now()
+	if r.Now != nil {
+		now = r.Now()
+	}
+	if r.last == nil {
+		r.last = map[string]string{}
+	}
+	if line := run.Status + " " + formatCounters(run.Counters); line != r.last[run.Arn] {
+		r.Log.Println(line)
+		r.last[run.Arn] = line
+	}
+	for _, job := range jobs {
+		line := job.status()
+		if len(job.Suite) > 0 {
+			line += " " + job.Suite
+		}
+		line += " " + formatCounters(job.Job.Counters)
+		if line == r.last[job.Job.Arn] {
+			continue
+		}
+		r.last[job.Job.Arn] = line
+		r.Log.Printf("  %s: %s [%s]\n", job.device(), line, formatElapsed(job.elapsed(now)))
+	}
+}
+
+// formatCounters is FormatCounters for results.Counters.
+func formatCounters(c results.Counters) string {
+	return fmt.Sprintf("(total: %d, passed: %d, failed: %d, errored: %d, warned: %d, skipped: %d, stopped: %d)",
+		c.Total, c.Passed, c.Failed, c.Errored, c.Warned, c.Skipped, c.Stopped)
+}
@@ -0,0 +1,193 @@
+package awsutil
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/devicefarm"
+	"github.com/ride/devicefarm/results"
+	"github.com/ride/devicefarm/util"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+var dashboardStart = time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+
+func dashboardNow() time.Time {
+	return dashboardStart.Add(90 * time.Second)
+}
+
+func progressJob(arn, device, status string, passed int64, suite string) *JobProgress {
+	return &JobProgress{
+		Job: &results.Job{
+			Arn:      arn,
+			Device:   device,
+			Os:       "9",
+			Status:   status,
+			Counters: results.Counters{Passed: passed},
+			Timing:   results.Timing{Started: dashboardStart},
+		},
+		Suite: suite,
+	}
+}
+
+// recordingRenderer keeps every job list it is asked to render.
+type recordingRenderer struct {
+	runs []*results.Run
+	jobs [][]*JobProgress
+}
+
+func (r *recordingRenderer) Render(run *results.Run, jobs []*JobProgress) {
+	r.runs = append(r.runs, run)
+	r.jobs = append(r.jobs, jobs)
+}
+
+func TestWatchRun(t *testing.T) {
+	assert := assert.New(t)
+	client, mock := mockClient()
+
+	runOutput := func(status string) *devicefarm.GetRunOutput {
+		return &devicefarm.GetRunOutput{
+			Run: &devicefarm.Run{
+				Arn:    aws.String("run123"),
+				Status: aws.String(status),
+				Result: aws.String(devicefarm.ExecutionResultPending),
+			},
+		}
+	}
+	job := func(arn, device, status string) *devicefarm.Job {
+		return &devicefarm.Job{
+			Arn:    aws.String(arn),
+			Status: aws.String(status),
+			Device: &devicefarm.Device{Name: aws.String(device), Os: aws.String("9")},
+		}
+	}
+
+	mock.enqueue(runOutput(devicefarm.ExecutionStatusRunning), nil)
+	mock.enqueue(&devicefarm.ListJobsOutput{Jobs: []*devicefarm.Job{
+		job("job2", "Pixel", devicefarm.ExecutionStatusRunning),
+		job("job1", "Galaxy", devicefarm.ExecutionStatusPending),
+	}}, nil)
+	mock.enqueue(&devicefarm.ListSuitesOutput{Suites: []*devicefarm.Suite{
+		{Name: aws.String("Setup Suite"), Status: aws.String(devicefarm.ExecutionStatusCompleted)},
+		{Name: aws.String("Tests Suite"), Status: aws.String(devicefarm.ExecutionStatusRunning)},
+	}}, nil)
+	mock.enqueue(runOutput(devicefarm.ExecutionStatusCompleted), nil)
+	mock.enqueue(&devicefarm.ListJobsOutput{Jobs: []*devicefarm.Job{
+		job("job2", "Pixel", devicefarm.ExecutionStatusCompleted),
+		job("job1", "Galaxy", devicefarm.ExecutionStatusCompleted),
+	}}, nil)
+
+	renderer := &recordingRenderer{}
+	run, err := client.WatchRun(ctx, "run123", 1000, 0, renderer)
+	assert.Nil(err)
+	assert.Equal(devicefarm.ExecutionStatusCompleted, *run.Status)
+	assert.Equal(2, len(renderer.jobs))
+	assert.Equal(devicefarm.ExecutionStatusRunning, renderer.runs[0].Status)
+
+	// jobs should be sorted by device, with the running suite
+	first := renderer.jobs[0]
+	assert.Equal("Galaxy (9)", first[0].device())
+	assert.Equal("", first[0].Suite)
+	assert.Equal("Pixel (9)", first[1].device())
+	assert.Equal("Tests Suite", first[1].Suite)
+
+	// suites should only be listed for running jobs
+	listSuites := mock.Inputs()[2][0].(*devicefarm.ListSuitesInput)
+	assert.Equal("job2", *listSuites.Arn)
+	assert.Equal(5, len(mock.Inputs()))
+
+	// should warn and keep polling if jobs cannot be listed, rendering only
+	// the run
+	warnings := &util.CaptureWriter{}
+	client.Log = util.NewStandardLogger(ioutil.Discard, warnings)
+	renderer = &recordingRenderer{}
+	mock.enqueue(runOutput(devicefarm.ExecutionStatusRunning), nil)
+	mock.enqueue(nil, errors.New("fake error"))
+	mock.enqueue(runOutput(devicefarm.ExecutionStatusCompleted), nil)
+	mock.enqueue(&devicefarm.ListJobsOutput{Jobs: []*devicefarm.Job{}}, nil)
+	run, err = client.WatchRun(ctx, "run123", 1000, 0, renderer)
+	assert.Nil(err)
+	assert.Equal(devicefarm.ExecutionStatusCompleted, *run.Status)
+	assert.Equal(2, len(renderer.runs))
+	assert.Equal(0, len(renderer.jobs[0]))
+	assert.Equal(1, len(warnings.Out()))
+	assert.Contains(warnings.Out()[0], "fake error")
+}
+
+func TestJobProgressElapsed(t *testing.T) {
+	assert := assert.New(t)
+	job := progressJob("job1", "Pixel", devicefarm.ExecutionStatusRunning, 0, "")
+	assert.Equal(90*time.Second, job.elapsed(dashboardNow()))
+	job.Job.Timing.Stopped = dashboardStart.Add(time.Minute)
+	assert.Equal(time.Minute, job.elapsed(dashboardNow()))
+	job.Job.Timing = results.Timing{}
+	assert.Equal(time.Duration(0), job.elapsed(dashboardNow()))
+	assert.Equal("-", formatElapsed(job.elapsed(dashboardNow())))
+}
+
+func TestLineRenderer(t *testing.T) {
+	assert := assert.New(t)
+	out, log := util.NewCaptureLogger()
+	renderer := &LineRenderer{Log: log, Now: dashboardNow}
+	run := &results.Run{Arn: "run123", Status: devicefarm.ExecutionStatusRunning}
+
+	renderer.Render(run, []*JobProgress{
+		progressJob("job1", "Galaxy", devicefarm.ExecutionStatusPending, 0, ""),
+		progressJob("job2", "Pixel", devicefarm.ExecutionStatusRunning, 1, "Tests Suite"),
+	})
+	assert.Equal(3, len(out.Out()))
+	assert.True(strings.HasPrefix(out.Out()[0], "RUNNING (total: 0, passed: 0,"))
+	assert.True(strings.HasPrefix(out.Out()[2], "  Pixel (9): RUNNING Tests Suite (total: 0, passed: 1,"))
+	assert.True(strings.HasSuffix(out.Out()[2], "[1m30s]\n"))
+
+	// only changes should be printed
+	renderer.Render(run, []*JobProgress{
+		progressJob("job1", "Galaxy", devicefarm.ExecutionStatusPending, 0, ""),
+		progressJob("job2", "Pixel", devicefarm.ExecutionStatusRunning, 2, "Tests Suite"),
+	})
+	assert.Equal(4, len(out.Out()))
+	assert.True(strings.HasPrefix(out.Out()[3], "  Pixel (9): RUNNING Tests Suite (total: 0, passed: 2,"))
+
+	// completed jobs should show their result
+	done := progressJob("job1", "Galaxy", devicefarm.ExecutionStatusCompleted, 3, "")
+	done.Job.Result = devicefarm.ExecutionResultPassed
+	renderer.Render(run, []*JobProgress{done})
+	assert.Equal(5, len(out.Out()))
+	assert.True(strings.HasPrefix(out.Out()[4], "  Galaxy (9): PASSED (total: 0, passed: 3,"))
+}
+
+func TestTableRenderer(t *testing.T) {
+	assert := assert.New(t)
+	out, log := util.NewCaptureLogger()
+	renderer := &TableRenderer{Log: log, Now: dashboardNow}
+	run := &results.Run{Arn: "run123", Status: devicefarm.ExecutionStatusRunning}
+	jobs := []*JobProgress{
+		progressJob("job1", "Galaxy", devicefarm.ExecutionStatusPending, 0, ""),
+		progressJob("job2", "Pixel", devicefarm.ExecutionStatusRunning, 1, "Tests Suite"),
+	}
+
+	renderer.Render(run, jobs)
+	assert.Equal(1, len(out.Out()))
+	lines := strings.Split(strings.TrimSuffix(out.Out()[0], "\n"), "\n")
+	assert.Equal(4, len(lines))
+	assert.True(strings.HasPrefix(lines[0], "Run: RUNNING (total: 0,"))
+	assert.Equal("DEVICE      STATUS   SUITE        PASSED  FAILED  ERRORED  ELAPSED", lines[1])
+	assert.Equal("Galaxy (9)  PENDING  -            0       0       0        1m30s", lines[2])
+	assert.Equal("Pixel (9)   RUNNING  Tests Suite  1       0       0        1m30s", lines[3])
+
+	// the table should be redrawn over the last one
+	renderer.Render(run, jobs)
+	assert.Equal(3, len(out.Out()))
+	assert.Equal("\033[4A\033[J", out.Out()[1])
+	assert.Equal(out.Out()[0], out.Out()[2])
+}
+
+func TestNewRunRenderer(t *testing.T) {
+	assert := assert.New(t)
+	_, log := util.NewCaptureLogger()
+	_, ok := NewRunRenderer(log).(*LineRenderer)
+	assert.True(ok)
+}
@@ -0,0 +1,121 @@
+package awsutil
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/devicefarm"
+	"path"
+	"strings"
+	"time"
+)
+
+// branchPoolPrefix starts the name of every device pool created for a branch.
+const branchPoolPrefix = "df:"
+
+// poolDescriptionPrefix starts the description of every device pool created
+// or updated by this package, and is followed by the time of the change.
+const poolDescriptionPrefix = "Managed by devicefarm, updated "
+
+// BranchPoolName returns the name of the remote device pool used to run the
+// given pool from devicefarm.yml on the given branch.
+func BranchPoolName(branch, pool string) string {
+	return branchPoolPrefix + branch + ":" + pool
+}
+
+// ParseBranchPoolName returns the branch and pool of a name created by
+// BranchPoolName, or false if the name does not follow that scheme. Git does
+// not allow ":" in branch names, so the branch ends at the first ":".
+func ParseBranchPoolName(name string) (branch, pool string, ok bool) {
+	if !strings.HasPrefix(name, branchPoolPrefix) {
+		return "", "", false
+	}
+	parts := strings.SplitN(name[len(branchPoolPrefix):], ":", 2)
+	if len(parts) < 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// poolDescription returns the description given to a device pool which is
+// created or updated at the given time.
+func poolDescription(t time.Time) string {
+	return poolDescriptionPrefix + t.UTC().Format(time.RFC3339)
+}
+
+// PoolUpdated returns the time that a device pool was last created or updated
+// by this package. It returns false if the pool's description has no such
+// time, e.g. because an older version created it.
+func PoolUpdated(pool *devicefarm.DevicePool) (time.Time, bool) {
+	description := aws.StringValue(pool.Description)
+	if !strings.HasPrefix(description, poolDescriptionPrefix) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, description[len(poolDescriptionPrefix):])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+func (df *DeviceFarm) DeleteDevicePool(ctx context.Context, poolArn string) error {
+	params := &devicefarm.DeleteDevicePoolInput{Arn: aws.String(poolArn)}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := df.Client.DeleteDevicePool(params)
+	return err
+}
+
+// StalePoolOptions configure which device pools StaleDevicePools returns.
+// Branches are the branches which still exist. Keep lists branch names or
+// patterns (see path.Match) whose pools are never stale. If OlderThan is
+// non-zero, only pools last updated at least that long ago are stale, and
+// pools with no known update time are assumed to be old enough.
+type StalePoolOptions struct {
+	Branches  []string
+	Keep      []string
+	OlderThan time.Duration
+}
+
+// StaleDevicePools returns the device pools in the project which were created
+// for branches that no longer exist. Pools whose names do not follow the
+// BranchPoolName scheme are never returned.
+func (df *DeviceFarm) StaleDevicePools(ctx context.Context, projectArn string, options *StalePoolOptions) ([]*devicefarm.DevicePool, error) {
+	pools, err := df.ListDevicePools(ctx, projectArn)
+	if err != nil {
+		return nil, err
+	}
+	branches := map[string]bool{}
+	for _, branch := range options.Branches {
+		branches[branch] = true
+	}
+	stale := []*devicefarm.DevicePool{}
+	for _, pool := range pools {
+		branch, _, ok := ParseBranchPoolName(aws.StringValue(pool.Name))
+		if !ok || branches[branch] || keepBranch(branch, options.Keep) {
+			continue
+		}
+		if options.OlderThan > 0 {
+			updated, ok := PoolUpdated(pool)
+			if ok && time.Since(updated) < options.OlderThan {
+				continue
+			}
+		}
+		stale = append(stale, pool)
+	}
+	return stale, nil
+}
+
+// keepBranch returns true if the branch is equal to, or matches, any of the
+// given names or patterns.
+func keepBranch(branch string, keep []string) bool {
+	for _, pattern := range keep {
+		if pattern == branch {
+			return true
+		}
+		if matched, err := path.Match(pattern, branch); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
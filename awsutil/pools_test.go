@@ -0,0 +1,118 @@
+package awsutil
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/devicefarm"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestBranchPoolName(t *testing.T) {
+	assert := assert.New(t)
+
+	name := BranchPoolName("feature/foo", "samsung_s5")
+	assert.Equal("df:feature/foo:samsung_s5", name)
+
+	// should parse names from BranchPoolName
+	branch, pool, ok := ParseBranchPoolName(name)
+	assert.True(ok)
+	assert.Equal("feature/foo", branch)
+	assert.Equal("samsung_s5", pool)
+
+	// the pool may contain ":"
+	branch, pool, ok = ParseBranchPoolName("df:master:foo:bar")
+	assert.True(ok)
+	assert.Equal("master", branch)
+	assert.Equal("foo:bar", pool)
+
+	// should not parse other names
+	for _, name := range []string{"Top Devices", "df:", "df:master", "df::foo", "df:master:"} {
+		_, _, ok = ParseBranchPoolName(name)
+		assert.False(ok, name)
+	}
+}
+
+func TestPoolUpdated(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	pool := &devicefarm.DevicePool{Description: aws.String(poolDescription(now))}
+	updated, ok := PoolUpdated(pool)
+	assert.True(ok)
+	assert.Equal(now, updated)
+
+	// should fail without a description
+	_, ok = PoolUpdated(&devicefarm.DevicePool{})
+	assert.False(ok)
+
+	// should fail with an invalid time
+	_, ok = PoolUpdated(&devicefarm.DevicePool{Description: aws.String(poolDescriptionPrefix + "yesterday")})
+	assert.False(ok)
+}
+
+func TestDeleteDevicePool(t *testing.T) {
+	assert := assert.New(t)
+	client, mock := mockClient()
+
+	// should succeed
+	mock.enqueue(&devicefarm.DeleteDevicePoolOutput{}, nil)
+	err := client.DeleteDevicePool(ctx, "poolArn")
+	assert.Nil(err)
+	assert.Equal("poolArn", *mock.Inputs()[0][0].(*devicefarm.DeleteDevicePoolInput).Arn)
+
+	// should fail due to error
+	mock.enqueue(nil, errors.New("fake error"))
+	err = client.DeleteDevicePool(ctx, "poolArn")
+	assert.NotNil(err)
+}
+
+func TestStaleDevicePools(t *testing.T) {
+	assert := assert.New(t)
+	client, mock := mockClient()
+
+	recent := aws.String(poolDescription(time.Now().Add(-time.Hour)))
+	old := aws.String(poolDescription(time.Now().Add(-48 * time.Hour)))
+	output := &devicefarm.ListDevicePoolsOutput{
+		DevicePools: []*devicefarm.DevicePool{
+			{Name: aws.String("Top Devices")},
+			{Name: aws.String("df:master:foo"), Description: old},
+			{Name: aws.String("df:deleted:foo"), Description: old},
+			{Name: aws.String("df:deleted:bar"), Description: recent},
+			{Name: aws.String("df:release/1.0:foo"), Description: old},
+			{Name: aws.String("df:unknown:foo")},
+		},
+	}
+	names := func(pools []*devicefarm.DevicePool) []string {
+		list := []string{}
+		for _, pool := range pools {
+			list = append(list, *pool.Name)
+		}
+		return list
+	}
+
+	// should return every pool for a missing branch
+	mock.enqueue(output, nil)
+	stale, err := client.StaleDevicePools(ctx, "projectArn", &StalePoolOptions{
+		Branches: []string{"master"},
+	})
+	assert.Nil(err)
+	assert.Equal([]string{"df:deleted:foo", "df:deleted:bar", "df:release/1.0:foo", "df:unknown:foo"}, names(stale))
+
+	// should skip kept branches, and pools updated recently
+	mock.enqueue(output, nil)
+	stale, err = client.StaleDevicePools(ctx, "projectArn", &StalePoolOptions{
+		Branches:  []string{"master"},
+		Keep:      []string{"release/*"},
+		OlderThan: 24 * time.Hour,
+	})
+	assert.Nil(err)
+	assert.Equal([]string{"df:deleted:foo", "df:unknown:foo"}, names(stale))
+
+	// should fail due to error
+	mock.enqueue(nil, errors.New("fake error"))
+	stale, err = client.StaleDevicePools(ctx, "projectArn", &StalePoolOptions{})
+	assert.NotNil(err)
+	assert.Nil(stale)
+}
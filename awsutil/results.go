@@ -0,0 +1,187 @@
+package awsutil
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/devicefarm"
+	"github.com/ride/devicefarm/results"
+	"time"
+)
+
+// RunResults walks the jobs, suites and tests of a run and returns the whole
+// hierarchy as a results.Run. If a test did not pass and has no message, the
+// message is fetched with GetTest.
+func (df *DeviceFarm) RunResults(ctx context.Context, runArn string) (*results.Run, error) {
+	run, err := df.GetRun(ctx, runArn)
+	if err != nil {
+		return nil, err
+	}
+	result := ConvertRun(run)
+	jobs, err := df.ListJobs(ctx, runArn)
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range jobs {
+		resultJob := ConvertJob(job)
+		result.Jobs = append(result.Jobs, resultJob)
+		suites, err := df.ListSuites(ctx, *job.Arn)
+		if err != nil {
+			return nil, err
+		}
+		for _, suite := range suites {
+			resultSuite := ConvertSuite(suite)
+			resultJob.Suites = append(resultJob.Suites, resultSuite)
+			tests, err := df.ListTests(ctx, *suite.Arn)
+			if err != nil {
+				return nil, err
+			}
+			for _, test := range tests {
+				passed := aws.StringValue(test.Result) == devicefarm.ExecutionResultPassed
+				if !passed && len(aws.StringValue(test.Message)) == 0 {
+					test, err = df.GetTest(ctx, *test.Arn)
+					if err != nil {
+						return nil, err
+					}
+				}
+				resultSuite.Tests = append(resultSuite.Tests, ConvertTest(test))
+			}
+		}
+	}
+	return result, nil
+}
+
+// ConvertCounters converts Device Farm counters into results.Counters.
+func ConvertCounters(counters *devicefarm.Counters) results.Counters {
+	if counters == nil {
+		return results.Counters{}
+	}
+	return results.Counters{
+		Total:   aws.Int64Value(counters.Total),
+		Passed:  aws.Int64Value(counters.Passed),
+		Failed:  aws.Int64Value(counters.Failed),
+		Errored: aws.Int64Value(counters.Errored),
+		Warned:  aws.Int64Value(counters.Warned),
+		Skipped: aws.Int64Value(counters.Skipped),
+		Stopped: aws.Int64Value(counters.Stopped),
+	}
+}
+
+func convertTiming(started, stopped *time.Time, minutes *devicefarm.DeviceMinutes) results.Timing {
+	timing := results.Timing{
+		Started: aws.TimeValue(started),
+		Stopped: aws.TimeValue(stopped),
+	}
+	if minutes != nil {
+		timing.DeviceMinutes = aws.Float64Value(minutes.Total)
+	}
+	return timing
+}
+
+// ConvertRun converts a Device Farm run into a results.Run with no jobs.
+func ConvertRun(run *devicefarm.Run) *results.Run {
+	return &results.Run{
+		Arn:      aws.StringValue(run.Arn),
+		Name:     aws.StringValue(run.Name),
+		Status:   aws.StringValue(run.Status),
+		Result:   aws.StringValue(run.Result),
+		Message:  aws.StringValue(run.Message),
+		Created:  aws.TimeValue(run.Created),
+		Counters: ConvertCounters(run.Counters),
+		Timing:   convertTiming(run.Started, run.Stopped, run.DeviceMinutes),
+		Jobs:     []*results.Job{},
+	}
+}
+
+// ConvertJob converts a Device Farm job into a results.Job with no suites.
+func ConvertJob(job *devicefarm.Job) *results.Job {
+	result := &results.Job{
+		Arn:      aws.StringValue(job.Arn),
+		Device:   aws.StringValue(job.Name),
+		Status:   aws.StringValue(job.Status),
+		Result:   aws.StringValue(job.Result),
+		Message:  aws.StringValue(job.Message),
+		Counters: ConvertCounters(job.Counters),
+		Timing:   convertTiming(job.Started, job.Stopped, job.DeviceMinutes),
+		Suites:   []*results.Suite{},
+	}
+	if job.Device != nil {
+		result.Device = aws.StringValue(job.Device.Name)
+		result.Platform = aws.StringValue(job.Device.Platform)
+		result.Os = aws.StringValue(job.Device.Os)
+	}
+	return result
+}
+
+// ConvertSuite converts a Device Farm suite into a results.Suite with no
+// tests.
+func ConvertSuite(suite *devicefarm.Suite) *results.Suite {
+	return &results.Suite{
+		Arn:      aws.StringValue(suite.Arn),
+		Name:     aws.StringValue(suite.Name),
+		Status:   aws.StringValue(suite.Status),
+		Result:   aws.StringValue(suite.Result),
+		Message:  aws.StringValue(suite.Message),
+		Counters: ConvertCounters(suite.Counters),
+		Timing:   convertTiming(suite.Started, suite.Stopped, suite.DeviceMinutes),
+		Tests:    []*results.Test{},
+	}
+}
+
+// ConvertTest converts a Device Farm test into a results.Test.
+func ConvertTest(test *devicefarm.Test) *results.Test {
+	return &results.Test{
+		Arn:     aws.StringValue(test.Arn),
+		Name:    aws.StringValue(test.Name),
+		Status:  aws.StringValue(test.Status),
+		Result:  aws.StringValue(test.Result),
+		Message: aws.StringValue(test.Message),
+		Timing:  convertTiming(test.Started, test.Stopped, test.DeviceMinutes),
+	}
+}
+
+// ConvertProblems converts Device Farm's unique problems, keyed by result,
+// into results.Problems sorted by results.SortProblems. Problems of tests
+// which passed are left out.
+func ConvertProblems(unique map[string][]*devicefarm.UniqueProblem) []*results.Problem {
+	problems := []*results.Problem{}
+	for result, list := range unique {
+		if result == results.ResultPassed {
+			continue
+		}
+		for _, u := range list {
+			problem := &results.Problem{
+				Result:      result,
+				Message:     aws.StringValue(u.Message),
+				Occurrences: []*results.ProblemOccurrence{},
+			}
+			for _, p := range u.Problems {
+				problem.Occurrences = append(problem.Occurrences, convertProblemOccurrence(p))
+			}
+			problems = append(problems, problem)
+		}
+	}
+	results.SortProblems(problems)
+	return problems
+}
+
+func convertProblemOccurrence(p *devicefarm.Problem) *results.ProblemOccurrence {
+	o := &results.ProblemOccurrence{}
+	if p.Device != nil {
+		o.Device = aws.StringValue(p.Device.Name)
+		o.Os = aws.StringValue(p.Device.Os)
+	} else if p.Job != nil {
+		o.Device = aws.StringValue(p.Job.Name)
+	}
+	for _, detail := range []*devicefarm.ProblemDetail{p.Job, p.Suite, p.Test} {
+		if detail != nil && len(aws.StringValue(detail.Arn)) > 0 {
+			o.Arn = aws.StringValue(detail.Arn)
+		}
+	}
+	if p.Suite != nil {
+		o.Suite = aws.StringValue(p.Suite.Name)
+	}
+	if p.Test != nil {
+		o.Test = aws.StringValue(p.Test.Name)
+	}
+	return o
+}
@@ -0,0 +1,126 @@
+package awsutil
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/devicefarm"
+	"github.com/ride/devicefarm/results"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRunResults(t *testing.T) {
+	assert := assert.New(t)
+	client, mock := mockClient()
+
+	// should build the whole hierarchy, fetching the failed test's message
+	mock.enqueue(&devicefarm.GetRunOutput{
+		Run: &devicefarm.Run{
+			Arn:      aws.String("runArn"),
+			Result:   aws.String(devicefarm.ExecutionResultFailed),
+			Counters: &devicefarm.Counters{Total: aws.Int64(2), Failed: aws.Int64(1)},
+		},
+	}, nil)
+	mock.enqueue(&devicefarm.ListJobsOutput{
+		Jobs: []*devicefarm.Job{{Arn: aws.String("jobArn"), Device: androidDevice}},
+	}, nil)
+	mock.enqueue(&devicefarm.ListSuitesOutput{
+		Suites: []*devicefarm.Suite{{Arn: aws.String("suiteArn"), Name: aws.String("suite")}},
+	}, nil)
+	mock.enqueue(&devicefarm.ListTestsOutput{
+		Tests: []*devicefarm.Test{
+			{Arn: aws.String("passedArn"), Name: aws.String("passed"), Result: aws.String(devicefarm.ExecutionResultPassed)},
+			{Arn: aws.String("failedArn"), Name: aws.String("failed"), Result: aws.String(devicefarm.ExecutionResultFailed)},
+		},
+	}, nil)
+	mock.enqueue(&devicefarm.GetTestOutput{
+		Test: &devicefarm.Test{
+			Arn:     aws.String("failedArn"),
+			Name:    aws.String("failed"),
+			Result:  aws.String(devicefarm.ExecutionResultFailed),
+			Message: aws.String("assertion failed"),
+		},
+	}, nil)
+	run, err := client.RunResults(ctx, "runArn")
+	assert.Nil(err)
+	assert.Equal("runArn", run.Arn)
+	assert.Equal(int64(1), run.Counters.Failed)
+	assert.Equal(1, len(run.Jobs))
+	assert.Equal("Samsung Galaxy S3", run.Jobs[0].Device)
+	assert.Equal(devicefarm.DevicePlatformAndroid, run.Jobs[0].Platform)
+	assert.Equal("suite", run.Jobs[0].Suites[0].Name)
+	tests := run.Jobs[0].Suites[0].Tests
+	assert.Equal(2, len(tests))
+	assert.Equal("", tests[0].Message)
+	assert.Equal("assertion failed", tests[1].Message)
+	getTestInput := mock.Inputs()[4][0].(*devicefarm.GetTestInput)
+	assert.Equal("failedArn", *getTestInput.Arn)
+
+	// should fail due to error
+	mock.enqueue(nil, errors.New("fake error"))
+	run, err = client.RunResults(ctx, "runArn")
+	assert.NotNil(err)
+	assert.Nil(run)
+}
+
+func TestConvertProblems(t *testing.T) {
+	assert := assert.New(t)
+	problems := ConvertProblems(map[string][]*devicefarm.UniqueProblem{
+		devicefarm.ExecutionResultFailed: {
+			{
+				Message: aws.String("junit.framework.AssertionFailedError: expected <true>\n\tat com.example.LoginTest.testLogout(LoginTest.java:42)"),
+				Problems: []*devicefarm.Problem{
+					{
+						Device: &devicefarm.Device{Name: aws.String("Google Pixel"), Os: aws.String("9")},
+						Suite:  &devicefarm.ProblemDetail{Name: aws.String("com.example.LoginTest")},
+						Test:   &devicefarm.ProblemDetail{Arn: aws.String("arn:test1"), Name: aws.String("testLogout")},
+					},
+				},
+			},
+			{
+				Message: aws.String("Timed out | waiting for `login`"),
+				Problems: []*devicefarm.Problem{
+					{
+						Device: &devicefarm.Device{Name: aws.String("Google Pixel"), Os: aws.String("9")},
+						Suite:  &devicefarm.ProblemDetail{Name: aws.String("com.example.LoginTest")},
+						Test:   &devicefarm.ProblemDetail{Name: aws.String("testLogin")},
+					},
+					{
+						Device: &devicefarm.Device{Name: aws.String("Galaxy S9"), Os: aws.String("8.0.0")},
+						Suite:  &devicefarm.ProblemDetail{Name: aws.String("com.example.LoginTest")},
+						Test:   &devicefarm.ProblemDetail{Name: aws.String("testLogin")},
+					},
+				},
+			},
+		},
+		devicefarm.ExecutionResultErrored: {
+			{
+				Message: aws.String("Device failed to set up"),
+				Problems: []*devicefarm.Problem{
+					{Job: &devicefarm.ProblemDetail{Arn: aws.String("arn:job1"), Name: aws.String("Galaxy S4")}},
+				},
+			},
+		},
+		devicefarm.ExecutionResultPassed: {
+			{Message: aws.String("Passed")},
+		},
+	})
+
+	// should leave out passed problems, and sort by result then test count
+	assert.Equal(3, len(problems))
+	assert.Equal(results.ResultErrored, problems[0].Result)
+	assert.Equal("Timed out | waiting for `login`", problems[1].Message)
+	assert.Equal(results.ResultFailed, problems[2].Result)
+
+	// occurrences should have their device and test
+	assert.Equal(&results.ProblemOccurrence{
+		Device: "Google Pixel",
+		Os:     "9",
+		Suite:  "com.example.LoginTest",
+		Test:   "testLogout",
+		Arn:    "arn:test1",
+	}, problems[2].Occurrences[0])
+
+	// without a device, the job name should be used
+	assert.Equal(&results.ProblemOccurrence{Device: "Galaxy S4", Arn: "arn:job1"}, problems[0].Occurrences[0])
+}
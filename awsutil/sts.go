@@ -0,0 +1,137 @@
+package awsutil
+
+import (
+	"encoding/xml"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/private/signer/v4"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// The vendored SDK has no STS package, so this file implements the one STS
+// call we need, AssumeRole, on top of the SDK's request handling and request
+// signing. See:
+// http://docs.aws.amazon.com/STS/latest/APIReference/API_AssumeRole.html
+
+// An AssumeRoleProvider retrieves temporary credentials by assuming an IAM
+// role with STS, and refreshes them shortly before they expire. Client must
+// be created by newSTSClient.
+type AssumeRoleProvider struct {
+	credentials.Expiry
+	Client          *client.Client
+	RoleArn         string
+	RoleSessionName string
+	Duration        time.Duration
+}
+
+// AssumeRoleCreds returns credentials for the given role, which are obtained
+// from STS in the given region using the given credentials.
+func AssumeRoleCreds(creds *credentials.Credentials, region string, roleArn string) *credentials.Credentials {
+	return credentials.NewCredentials(&AssumeRoleProvider{
+		Client:          newSTSClient(&aws.Config{Region: aws.String(region), Credentials: creds}),
+		RoleArn:         roleArn,
+		RoleSessionName: "devicefarm-" + strconv.FormatInt(time.Now().Unix(), 10),
+		Duration:        time.Hour,
+	})
+}
+
+func (provider *AssumeRoleProvider) Retrieve() (credentials.Value, error) {
+	params := &stsInput{url.Values{
+		"Action":          {"AssumeRole"},
+		"Version":         {provider.Client.ClientInfo.APIVersion},
+		"RoleArn":         {provider.RoleArn},
+		"RoleSessionName": {provider.RoleSessionName},
+		"DurationSeconds": {strconv.Itoa(int(provider.Duration / time.Second))},
+	}}
+	operation := &request.Operation{
+		Name:       "AssumeRole",
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}
+	output := &assumeRoleResponse{}
+	req := provider.Client.NewRequest(operation, params, output)
+	if err := req.Send(); err != nil {
+		return credentials.Value{}, err
+	}
+	creds := output.Credentials
+	provider.SetExpiration(creds.Expiration, time.Minute)
+	return credentials.Value{
+		AccessKeyID:     creds.AccessKeyId,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+	}, nil
+}
+
+// stsInput holds the form values of an STS request. The SDK requires
+// request params to be a pointer to a struct.
+type stsInput struct {
+	Values url.Values
+}
+
+type assumeRoleResponse struct {
+	Credentials struct {
+		AccessKeyId     string
+		SecretAccessKey string
+		SessionToken    string
+		Expiration      time.Time
+	} `xml:"AssumeRoleResult>Credentials"`
+}
+
+type stsErrorResponse struct {
+	Code      string `xml:"Error>Code"`
+	Message   string `xml:"Error>Message"`
+	RequestId string `xml:"RequestId"`
+}
+
+// newSTSClient returns a client which sends signed STS query API requests
+// and decodes their XML responses.
+func newSTSClient(cfg *aws.Config) *client.Client {
+	clientConfig := session.New(cfg).ClientConfig("sts")
+	c := client.New(
+		*clientConfig.Config,
+		metadata.ClientInfo{
+			ServiceName:   "sts",
+			SigningRegion: clientConfig.SigningRegion,
+			Endpoint:      clientConfig.Endpoint,
+			APIVersion:    "2011-06-15",
+		},
+		clientConfig.Handlers,
+	)
+	c.Handlers.Sign.PushBack(v4.Sign)
+	c.Handlers.Build.PushBack(buildSTSRequest)
+	c.Handlers.Unmarshal.PushBack(unmarshalSTSResponse)
+	c.Handlers.UnmarshalError.PushBack(unmarshalSTSError)
+	return c
+}
+
+func buildSTSRequest(r *request.Request) {
+	params := r.Params.(*stsInput)
+	r.HTTPRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	r.SetBufferBody([]byte(params.Values.Encode()))
+}
+
+func unmarshalSTSResponse(r *request.Request) {
+	defer r.HTTPResponse.Body.Close()
+	err := xml.NewDecoder(r.HTTPResponse.Body).Decode(r.Data)
+	if err != nil {
+		r.Error = awserr.New("SerializationError", "failed decoding STS response", err)
+	}
+}
+
+func unmarshalSTSError(r *request.Request) {
+	defer r.HTTPResponse.Body.Close()
+	resp := &stsErrorResponse{}
+	err := xml.NewDecoder(r.HTTPResponse.Body).Decode(resp)
+	if err != nil {
+		r.Error = awserr.New("SerializationError", "failed decoding STS error response", err)
+		return
+	}
+	r.Error = awserr.NewRequestFailure(awserr.New(resp.Code, resp.Message, nil), r.HTTPResponse.StatusCode, resp.RequestId)
+}
@@ -0,0 +1,73 @@
+package awsutil
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAssumeRoleProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	expiration := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		if req.Form.Get("RoleArn") != "arn:aws:iam::123456789012:role/testing" {
+			res.WriteHeader(http.StatusForbidden)
+			res.Write([]byte(`<ErrorResponse>
+				<Error><Code>AccessDenied</Code><Message>Not authorized</Message></Error>
+				<RequestId>request-id</RequestId>
+			</ErrorResponse>`))
+			return
+		}
+		if req.Form.Get("Action") != "AssumeRole" || len(req.Header.Get("Authorization")) == 0 {
+			res.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		res.Write([]byte(`<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+			<AssumeRoleResult>
+				<Credentials>
+					<AccessKeyId>access-key</AccessKeyId>
+					<SecretAccessKey>secret</SecretAccessKey>
+					<SessionToken>token</SessionToken>
+					<Expiration>` + expiration + `</Expiration>
+				</Credentials>
+			</AssumeRoleResult>
+		</AssumeRoleResponse>`))
+	}))
+	defer server.Close()
+
+	client := newSTSClient(&aws.Config{
+		Region:      aws.String("us-west-2"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("foo", "bar", ""),
+		MaxRetries:  aws.Int(0),
+	})
+
+	// should succeed and expire the credentials
+	provider := &AssumeRoleProvider{
+		Client:          client,
+		RoleArn:         "arn:aws:iam::123456789012:role/testing",
+		RoleSessionName: "devicefarm",
+		Duration:        time.Hour,
+	}
+	value, err := provider.Retrieve()
+	assert.Nil(err)
+	assert.Equal(credentials.Value{AccessKeyID: "access-key", SecretAccessKey: "secret", SessionToken: "token"}, value)
+	assert.False(provider.IsExpired())
+
+	// should fail with the error from STS
+	provider.RoleArn = "arn:aws:iam::123456789012:role/other"
+	_, err = provider.Retrieve()
+	assert.NotNil(err)
+	if awsErr, ok := err.(awserr.RequestFailure); assert.True(ok) {
+		assert.Equal("AccessDenied", awsErr.Code())
+		assert.Equal(http.StatusForbidden, awsErr.StatusCode())
+		assert.Equal("request-id", awsErr.RequestID())
+	}
+}
@@ -0,0 +1,151 @@
+package awsutil
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/devicefarm"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// UploadCacheExpiry is how long an UploadCache remembers an upload.
+const UploadCacheExpiry = 7 * 24 * time.Hour
+
+// An UploadCache remembers the upload created for each file (by hash) in a
+// JSON file, so that CreateUpload can reuse it without listing every upload
+// in the project.
+type UploadCache struct {
+	Filename string
+	Entries  map[string]*UploadCacheEntry
+}
+
+type UploadCacheEntry struct {
+	Arn     string    `json:"arn"`
+	Expires time.Time `json:"expires"`
+}
+
+// LoadUploadCache reads an UploadCache from a file. A missing file gives an
+// empty cache.
+func LoadUploadCache(filename string) (*UploadCache, error) {
+	cache := &UploadCache{Filename: filename, Entries: map[string]*UploadCacheEntry{}}
+	bytes, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bytes, &cache.Entries); err != nil {
+		return nil, err
+	}
+	return cache, nil
+}
+
+// Get returns the upload ARN stored for the key, unless it has expired.
+func (cache *UploadCache) Get(key string) (string, bool) {
+	entry, ok := cache.Entries[key]
+	if !ok || time.Now().After(entry.Expires) {
+		return "", false
+	}
+	return entry.Arn, true
+}
+
+// Put stores an upload ARN for the key, drops expired entries and saves the
+// cache file.
+func (cache *UploadCache) Put(key, arn string) error {
+	now := time.Now()
+	for k, entry := range cache.Entries {
+		if now.After(entry.Expires) {
+			delete(cache.Entries, k)
+		}
+	}
+	cache.Entries[key] = &UploadCacheEntry{Arn: arn, Expires: now.Add(UploadCacheExpiry)}
+	if err := os.MkdirAll(filepath.Dir(cache.Filename), 0700); err != nil {
+		return err
+	}
+	// there will never be an error marshalling a map of simple structs
+	bytes, _ := json.MarshalIndent(cache.Entries, "", "  ")
+	return ioutil.WriteFile(cache.Filename, bytes, 0600)
+}
+
+// uploadCacheKey identifies the upload of a file in an UploadCache.
+func uploadCacheKey(projectArn, uploadType, hash string) string {
+	return projectArn + " " + uploadType + " " + hash
+}
+
+// uploadName returns the name given to the upload of a file, which starts
+// with the file's hash and upload type so that the upload can be found by
+// findUpload. The original name comes last, keeping its extension.
+func uploadName(hash, uploadType, name string) string {
+	return uploadNamePrefix(hash, uploadType) + name
+}
+
+func uploadNamePrefix(hash, uploadType string) string {
+	return hash + "-" + uploadType + "-"
+}
+
+// fileHash returns the hex encoded SHA-256 hash of a file.
+func fileHash(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// findUpload returns the ARN of a succeeded upload of a file with the given
+// hash and type in the project, looking in df.Uploads first and then through
+// the project's uploads. Errors are logged and treated as a miss, since the
+// file can always be uploaded again.
+func (df *DeviceFarm) findUpload(ctx context.Context, projectArn, uploadType, hash string) (string, bool) {
+	key := uploadCacheKey(projectArn, uploadType, hash)
+	if df.Uploads != nil {
+		if arn, ok := df.Uploads.Get(key); ok {
+			if succeeded, err := df.UploadSucceeded(ctx, arn); err == nil && succeeded {
+				return arn, true
+			}
+		}
+	}
+	prefix := uploadNamePrefix(hash, uploadType)
+	found := ""
+	err := df.EachUpload(ctx, projectArn, func(upload *devicefarm.Upload) bool {
+		if strings.HasPrefix(aws.StringValue(upload.Name), prefix) &&
+			aws.StringValue(upload.Type) == uploadType &&
+			aws.StringValue(upload.Status) == devicefarm.UploadStatusSucceeded {
+			found = aws.StringValue(upload.Arn)
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		df.Log.Warnln("Could not list uploads:", err)
+		return "", false
+	}
+	if len(found) == 0 {
+		return "", false
+	}
+	df.cacheUpload(key, found)
+	return found, true
+}
+
+// cacheUpload stores an upload in df.Uploads, if there is one.
+func (df *DeviceFarm) cacheUpload(key, arn string) {
+	if df.Uploads == nil {
+		return
+	}
+	if err := df.Uploads.Put(key, arn); err != nil {
+		df.Log.Warnln("Could not save upload cache:", err)
+	}
+}
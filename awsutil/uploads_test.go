@@ -0,0 +1,114 @@
+package awsutil
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/devicefarm"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUploadCache(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "devicefarm")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	filename := filepath.Join(tmpDir, "cache", "uploads.json")
+
+	// should start empty when the file does not exist
+	cache, err := LoadUploadCache(filename)
+	assert.Nil(err)
+	_, ok := cache.Get("key")
+	assert.False(ok)
+
+	// should save entries, and drop expired ones
+	cache.Entries["old"] = &UploadCacheEntry{Arn: "oldArn", Expires: time.Now().Add(-time.Hour)}
+	assert.Nil(cache.Put("key", "uploadArn"))
+	cache, err = LoadUploadCache(filename)
+	assert.Nil(err)
+	arn, ok := cache.Get("key")
+	assert.True(ok)
+	assert.Equal("uploadArn", arn)
+	assert.Equal(1, len(cache.Entries))
+
+	// should not return expired entries
+	cache.Entries["key"].Expires = time.Now().Add(-time.Second)
+	_, ok = cache.Get("key")
+	assert.False(ok)
+
+	// should fail with an invalid file
+	ioutil.WriteFile(filename, []byte("not json"), 0600)
+	_, err = LoadUploadCache(filename)
+	assert.NotNil(err)
+}
+
+func TestCreateUploadReuse(t *testing.T) {
+	assert := assert.New(t)
+	client, mock := mockClient()
+
+	tmpDir, err := ioutil.TempDir("", "devicefarm")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	client.Uploads, _ = LoadUploadCache(filepath.Join(tmpDir, "uploads.json"))
+
+	hash, err := fileHash("testdata/foo.txt")
+	assert.Nil(err)
+	upload := func(arn, uploadType, status string) *devicefarm.Upload {
+		return &devicefarm.Upload{
+			Arn:    aws.String(arn),
+			Name:   aws.String(uploadName(hash, uploadType, "foo.txt")),
+			Type:   aws.String(uploadType),
+			Status: aws.String(status),
+		}
+	}
+
+	// should find a succeeded upload of the same file and type
+	mock.enqueuePages(
+		&devicefarm.ListUploadsOutput{Uploads: []*devicefarm.Upload{
+			upload("failedArn", devicefarm.UploadTypeAndroidApp, devicefarm.UploadStatusFailed),
+			upload("testArn", devicefarm.UploadTypeInstrumentationTestPackage, devicefarm.UploadStatusSucceeded),
+		}},
+		&devicefarm.ListUploadsOutput{Uploads: []*devicefarm.Upload{
+			upload("appArn", devicefarm.UploadTypeAndroidApp, devicefarm.UploadStatusSucceeded),
+		}},
+	)
+	arn, err := client.CreateUpload(ctx, "projectArn", "testdata/foo.txt", devicefarm.UploadTypeAndroidApp, "app.apk")
+	assert.Nil(err)
+	assert.Equal("appArn", arn)
+
+	// should then use the cache, checking the upload still exists
+	mock.enqueue(&devicefarm.GetUploadOutput{Upload: upload("appArn", devicefarm.UploadTypeAndroidApp, devicefarm.UploadStatusSucceeded)}, nil)
+	arn, err = client.CreateUpload(ctx, "projectArn", "testdata/foo.txt", devicefarm.UploadTypeAndroidApp, "app.apk")
+	assert.Nil(err)
+	assert.Equal("appArn", arn)
+	assert.Equal(3, len(mock.Inputs()))
+
+	// should fall back to listing uploads when the cached upload is gone, and
+	// upload again when listing fails
+	url, ln, err := mockS3(t, "Foo\n")
+	defer ln.Close()
+	mock.enqueue(nil, errors.New("not found"))
+	mock.enqueue(nil, errors.New("fake error"))
+	mock.enqueue(&devicefarm.CreateUploadOutput{Upload: &devicefarm.Upload{Arn: aws.String("newArn"), Url: aws.String(url)}}, nil)
+	arn, err = client.CreateUpload(ctx, "projectArn", "testdata/foo.txt", devicefarm.UploadTypeAndroidApp, "app.apk")
+	assert.Nil(err)
+	assert.Equal("newArn", arn)
+	cached, _ := client.Uploads.Get(uploadCacheKey("projectArn", devicefarm.UploadTypeAndroidApp, hash))
+	assert.Equal("newArn", cached)
+
+	// should always upload with NoCache
+	client.NoCache = true
+	mock.enqueue(&devicefarm.CreateUploadOutput{Upload: &devicefarm.Upload{Arn: aws.String("freshArn"), Url: aws.String(url)}}, nil)
+	arn, err = client.CreateUpload(ctx, "projectArn", "testdata/foo.txt", devicefarm.UploadTypeAndroidApp, "app.apk")
+	assert.Nil(err)
+	assert.Equal("freshArn", arn)
+}
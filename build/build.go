@@ -7,30 +7,63 @@ Device Farm tests.
 package build
 
 import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/devicefarm"
 	"github.com/ride/devicefarm/awsutil"
 	"github.com/ride/devicefarm/config"
 	"github.com/ride/devicefarm/util"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 )
 
+// LogFile is the file, relative to the build's Dir, which Run() writes the
+// full output of the build steps to.
+const LogFile = ".devicefarm/build.log"
+
 // A Build specifies all information needed to run a local app build: the
-// working directory, the current Git branch of that directory, the full
-// repo config, and the particular manifest for the given branch.
+// working directory, the Git branch being built (and where it was found, e.g.
+// "CIRCLE_BRANCH") and commit SHA, the CI job (if any), the full repo config,
+// and the particular manifest for the given branch. When running build steps,
+// Verbose streams their output to the log, while Quiet hides the commands as
+// well.
 type Build struct {
-	Log      util.Logger
-	Dir      string
-	Branch   string
-	Config   *config.Config
-	Manifest *config.BuildManifest
-	Client   *awsutil.DeviceFarm
+	Log          util.Logger
+	Dir          string
+	Branch       string
+	BranchSource string
+	Commit       string
+	CI           *util.CIBuild
+	Config       *config.Config
+	Manifest     *config.BuildManifest
+	Client       *awsutil.DeviceFarm
+	Verbose      bool
+	Quiet        bool
 }
 
-// Creates a new Build from a directory and a config file
+// Creates a new Build from a directory and a config file, detecting the
+// branch with util.DetectBranch
 func New(log util.Logger, dir string, configFile string) (*Build, error) {
+	return NewForBranch(log, dir, configFile, "")
+}
+
+// NewForBranch creates a new Build for the given branch, e.g. from a
+// --branch flag. If branch is blank, it is detected with util.DetectBranch.
+func NewForBranch(log util.Logger, dir string, configFile string, branch string) (*Build, error) {
 	config, err := config.New(configFile)
 	if err != nil {
 		return nil, err
 	}
-	branch, err := util.GitBranch(dir)
+	source := "--branch"
+	if len(branch) == 0 {
+		branch, source, err = util.DetectBranch(dir, os.Getenv)
+		if err != nil {
+			return nil, err
+		}
+	}
+	commit, err := util.GitCommit(dir)
 	if err != nil {
 		return nil, err
 	}
@@ -39,18 +72,214 @@ func New(log util.Logger, dir string, configFile string) (*Build, error) {
 		return nil, err
 	}
 	build := Build{
-		Log:      log,
-		Dir:      dir,
-		Branch:   branch,
-		Config:   config,
-		Manifest: manifest,
+		Log:          log,
+		Dir:          dir,
+		Branch:       branch,
+		BranchSource: source,
+		Commit:       commit,
+		CI:           util.DetectCI(os.Getenv),
+		Config:       config,
+		Manifest:     manifest,
+	}
+	// the template is parsed by IsRunnable, but may still fail to render
+	if _, err := build.RunName(); err != nil {
+		return nil, err
 	}
 	return &build, nil
 }
 
-func (build *Build) Run() error {
-	// Runs the build steps specified in this build's manifest, returning an error
-	// if any of the build steps produced an error
-	_, err := util.RunAllLog(build.Log, build.Dir, build.Manifest.Steps...)
+func (build *Build) Run(ctx context.Context) error {
+	// Runs the build steps specified in this build's manifest with its shell
+	// and environment, returning an error (a *util.StepError, which includes
+	// the end of the output) if any of the build steps failed. Cancelling ctx
+	// kills the running step
+	logFilename := build.LogFilename()
+	if err := os.MkdirAll(filepath.Dir(logFilename), 0755); err != nil {
+		return err
+	}
+	logFile, err := os.Create(logFilename)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	runner := &util.Runner{
+		Log:       build.Log,
+		Shell:     build.Manifest.Shell,
+		LogFile:   logFile,
+		TailLines: util.DefaultTailLines,
+	}
+	if build.Quiet {
+		runner.Log = util.NilLogger
+	} else if build.Verbose {
+		runner.Output = util.LogWriter(build.Log)
+	}
+	_, err = runner.RunSteps(ctx, build.Dir, build.Steps()...)
 	return err
 }
+
+// Steps returns the manifest's build steps for a util.Runner, with the
+// manifest's env and each step's own env (which takes precedence).
+func (build *Build) Steps() []util.Step {
+	steps := make([]util.Step, len(build.Manifest.Steps))
+	for i, step := range build.Manifest.Steps {
+		steps[i] = util.Step{
+			Cmd:             step.Run,
+			Dir:             step.Dir,
+			Env:             append(envList(build.Manifest.Env), envList(step.Env)...),
+			Timeout:         step.Timeout,
+			Retries:         step.Retries,
+			ContinueOnError: step.ContinueOnError,
+		}
+	}
+	return steps
+}
+
+// envList returns "KEY=value" pairs for a map of environment variables,
+// sorted by key.
+func envList(env map[string]string) []string {
+	list := []string{}
+	for key, value := range env {
+		list = append(list, key+"="+value)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// LogFilename returns the path of the build's LogFile.
+func (build *Build) LogFilename() string {
+	return filepath.Join(build.Dir, LogFile)
+}
+
+// RunConfig returns the files to upload, the type of test to schedule and the
+// name of the run for this build's manifest. File paths are resolved relative
+// to the build's Dir.
+func (build *Build) RunConfig() *awsutil.RunConfig {
+	runConfig := build.testRunConfig()
+	// New() checks that the name renders, so the error can be ignored
+	runConfig.Name, _ = build.RunName()
+	return runConfig
+}
+
+func (build *Build) testRunConfig() *awsutil.RunConfig {
+	manifest := build.Manifest
+	if !manifest.Appium.IsEmpty() {
+		return build.appiumRunConfig()
+	}
+	if !manifest.Builtin.IsEmpty() {
+		return build.builtinRunConfig()
+	}
+	runConfig := build.appRunConfig()
+	if manifest.Platform() == config.PlatformIOS {
+		runConfig.TestPackage = filepath.Join(build.Dir, manifest.IOS.XCTestPackage)
+		runConfig.TestPackageType = devicefarm.UploadTypeXctestTestPackage
+		runConfig.TestType = devicefarm.TestTypeXctest
+		if manifest.IOS.TestType == config.IOSTestTypeXCTestUI {
+			runConfig.TestPackageType = devicefarm.UploadTypeXctestUiTestPackage
+			runConfig.TestType = devicefarm.TestTypeXctestUi
+		}
+		return runConfig
+	}
+	runConfig.TestPackage = filepath.Join(build.Dir, manifest.Android.ApkInstrumentation)
+	runConfig.TestPackageType = devicefarm.UploadTypeInstrumentationTestPackage
+	runConfig.TestType = devicefarm.TestTypeInstrumentation
+	return runConfig
+}
+
+// appiumTypes holds the Device Farm upload and test types for an Appium
+// flavor, for native and web tests.
+type appiumTypes struct {
+	uploadType    string
+	testType      string
+	webUploadType string
+	webTestType   string
+}
+
+var appiumFlavors = map[string]appiumTypes{
+	config.AppiumFlavorJavaJUnit: {
+		devicefarm.UploadTypeAppiumJavaJunitTestPackage, devicefarm.TestTypeAppiumJavaJunit,
+		devicefarm.UploadTypeAppiumWebJavaJunitTestPackage, devicefarm.TestTypeAppiumWebJavaJunit,
+	},
+	config.AppiumFlavorJavaTestNG: {
+		devicefarm.UploadTypeAppiumJavaTestngTestPackage, devicefarm.TestTypeAppiumJavaTestng,
+		devicefarm.UploadTypeAppiumWebJavaTestngTestPackage, devicefarm.TestTypeAppiumWebJavaTestng,
+	},
+	config.AppiumFlavorPython: {
+		devicefarm.UploadTypeAppiumPythonTestPackage, devicefarm.TestTypeAppiumPython,
+		devicefarm.UploadTypeAppiumWebPythonTestPackage, devicefarm.TestTypeAppiumWebPython,
+	},
+}
+
+func (build *Build) appiumRunConfig() *awsutil.RunConfig {
+	appium := build.Manifest.Appium
+	types := appiumFlavors[appium.Flavor]
+	if appium.IsWeb() {
+		return &awsutil.RunConfig{
+			TestPackage:     filepath.Join(build.Dir, appium.TestPackage),
+			TestPackageType: types.webUploadType,
+			TestType:        types.webTestType,
+		}
+	}
+	runConfig := build.appRunConfig()
+	runConfig.TestPackage = filepath.Join(build.Dir, appium.TestPackage)
+	runConfig.TestPackageType = types.uploadType
+	runConfig.TestType = types.testType
+	return runConfig
+}
+
+func (build *Build) builtinRunConfig() *awsutil.RunConfig {
+	builtin := build.Manifest.Builtin
+	runConfig := build.appRunConfig()
+	runConfig.TestParameters = map[string]string{}
+	if builtin.Type == config.BuiltinTypeExplorer {
+		runConfig.TestType = devicefarm.TestTypeBuiltinExplorer
+		if len(builtin.Username) > 0 {
+			runConfig.TestParameters["username"] = builtin.Username
+		}
+		if len(builtin.Password) > 0 {
+			runConfig.TestParameters["password"] = builtin.Password
+		}
+		return runConfig
+	}
+	runConfig.TestType = devicefarm.TestTypeBuiltinFuzz
+	if builtin.EventCount > 0 {
+		runConfig.TestParameters["event_count"] = strconv.Itoa(builtin.EventCount)
+	}
+	if builtin.EventThrottle > 0 {
+		runConfig.TestParameters["throttle"] = strconv.Itoa(builtin.EventThrottle)
+	}
+	if builtin.Seed != 0 {
+		runConfig.TestParameters["seed"] = strconv.Itoa(builtin.Seed)
+	}
+	return runConfig
+}
+
+// appRunConfig returns a RunConfig with only the app (apk or ipa) set.
+func (build *Build) appRunConfig() *awsutil.RunConfig {
+	if build.Manifest.Platform() == config.PlatformIOS {
+		return &awsutil.RunConfig{
+			App:     filepath.Join(build.Dir, build.Manifest.IOS.Ipa),
+			AppType: devicefarm.UploadTypeIosApp,
+		}
+	}
+	return &awsutil.RunConfig{
+		App:     filepath.Join(build.Dir, build.Manifest.Android.Apk),
+		AppType: devicefarm.UploadTypeAndroidApp,
+	}
+}
+
+// DevicePoolRules returns the Device Farm rules for this build's DevicePool.
+func (build *Build) DevicePoolRules() ([]*devicefarm.Rule, error) {
+	rules, err := build.Config.PoolRules(build.Manifest.DevicePool)
+	if err != nil {
+		return nil, err
+	}
+	deviceFarmRules := []*devicefarm.Rule{}
+	for _, rule := range rules {
+		deviceFarmRules = append(deviceFarmRules, &devicefarm.Rule{
+			Attribute: aws.String(rule.Attribute),
+			Operator:  aws.String(rule.Operator),
+			Value:     aws.String(rule.Value()),
+		})
+	}
+	return deviceFarmRules, nil
+}
@@ -1,6 +1,9 @@
 package build
 
 import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/devicefarm"
 	"github.com/ride/devicefarm/config"
 	"github.com/ride/devicefarm/util"
 	"github.com/stretchr/testify/assert"
@@ -12,8 +15,36 @@ import (
 
 var log *util.StandardLogger = util.NilLogger
 
+var ctx = context.Background()
+
+func steps(commands ...string) []config.BuildStep {
+	list := []config.BuildStep{}
+	for _, command := range commands {
+		list = append(list, config.BuildStep{Run: command})
+	}
+	return list
+}
+
+// clearBranchEnv unsets the environment variables util.DetectBranch checks,
+// e.g. when the tests run in CI, and returns a function to restore them.
+func clearBranchEnv() func() {
+	saved := map[string]string{}
+	for _, name := range util.BranchEnvVars {
+		if value, ok := os.LookupEnv(name); ok {
+			saved[name] = value
+			os.Unsetenv(name)
+		}
+	}
+	return func() {
+		for name, value := range saved {
+			os.Setenv(name, value)
+		}
+	}
+}
+
 func TestNew(t *testing.T) {
 	assert := assert.New(t)
+	defer clearBranchEnv()()
 
 	tmpDir, err := ioutil.TempDir("", "devicefarm")
 	if err != nil {
@@ -58,6 +89,26 @@ func TestNew(t *testing.T) {
 	build, err = New(log, tmpDir, absConfigFile)
 	assert.Nil(err)
 	assert.NotNil(build)
+	assert.Equal("master", build.Branch)
+	assert.Equal("git", build.BranchSource)
+	commit, _ := util.GitCommit(tmpDir)
+	assert.Equal(40, len(commit))
+	assert.Equal(commit, build.Commit)
+
+	// the branch should come from the environment in CI, even when detached
+	util.RunAll(tmpDir, "git checkout -b foobar2", "git checkout HEAD~0")
+	os.Setenv("CIRCLE_BRANCH", "master")
+	build, err = New(log, tmpDir, absConfigFile)
+	os.Unsetenv("CIRCLE_BRANCH")
+	assert.Nil(err)
+	assert.Equal("master", build.Branch)
+	assert.Equal("CIRCLE_BRANCH", build.BranchSource)
+
+	// or from the caller
+	build, err = NewForBranch(log, tmpDir, absConfigFile, "master")
+	assert.Nil(err)
+	assert.Equal("master", build.Branch)
+	assert.Equal("--branch", build.BranchSource)
 }
 
 func TestBuildRun(t *testing.T) {
@@ -74,16 +125,237 @@ func TestBuildRun(t *testing.T) {
 		Log: log,
 		Dir: tmpDir,
 		Manifest: &config.BuildManifest{
-			Steps:      []string{"echo Foo", "echo Bar"},
+			Steps:      steps("echo Foo", "echo Bar"),
 			Android:    config.AndroidConfig{},
 			DevicePool: "",
 		},
 	}
-	err = build.Run()
+	err = build.Run(ctx)
 	assert.Nil(err)
 
 	// should fail because "exit 1" produces an error
-	build.Manifest.Steps = []string{"echo Foo", "exit 1"}
-	err = build.Run()
+	build.Manifest.Steps = steps("echo Foo", "exit 1")
+	err = build.Run(ctx)
+	assert.NotNil(err)
+
+	// should use the shell, and write all output to the log file
+	build.Manifest.Steps = steps(`printf '%s\n' "a b" | tr a-z A-Z`, "echo err >&2 && echo ok")
+	build.Manifest.Shell = "bash -c"
+	err = build.Run(ctx)
+	assert.Nil(err)
+	bytes, err := ioutil.ReadFile(path.Join(tmpDir, LogFile))
+	assert.Nil(err)
+	assert.Equal("$ printf '%s\\n' \"a b\" | tr a-z A-Z\nA B\n$ echo err >&2 && echo ok\nerr\nok\n", string(bytes))
+
+	// should stream output when verbose, and report the exit code and the end
+	// of the output on failure
+	out, captureLog := util.NewCaptureLogger()
+	build.Log = captureLog
+	build.Verbose = true
+	build.Manifest.Steps = steps("echo Foo; exit 3")
+	err = build.Run(ctx)
+	assert.Equal([]string{"$ echo Foo; exit 3\n", "Foo\n"}, out.Out())
+	stepErr, ok := err.(*util.StepError)
+	assert.True(ok)
+	assert.Equal(3, stepErr.ExitCode)
+	assert.Equal([]string{"Foo"}, stepErr.Tail)
+
+	// should not log anything when quiet
+	out, captureLog = util.NewCaptureLogger()
+	build.Log = captureLog
+	build.Quiet = true
+	err = build.Run(ctx)
+	assert.NotNil(err)
+	assert.Nil(out.Out())
+}
+
+func TestBuildRunSteps(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "devicefarm")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	os.Mkdir(path.Join(tmpDir, "app"), 0755)
+
+	// should run steps in their dir, with the manifest env overridden by
+	// the step env, and carry on past a step with continue_on_error
+	build := Build{
+		Log: log,
+		Dir: tmpDir,
+		Manifest: &config.BuildManifest{
+			Env: map[string]string{"FOO": "foo", "BAR": "bar"},
+			Steps: []config.BuildStep{
+				{Run: "exit 1", ContinueOnError: true},
+				{Run: "echo $FOO $BAR > out.txt", Dir: "app", Env: map[string]string{"BAR": "baz"}},
+			},
+		},
+	}
+	err = build.Run(ctx)
+	assert.Nil(err)
+	bytes, err := ioutil.ReadFile(path.Join(tmpDir, "app", "out.txt"))
+	assert.Nil(err)
+	assert.Equal("foo baz\n", string(bytes))
+	assert.Equal([]string{"BAR=bar", "FOO=foo", "BAR=baz"}, build.Steps()[1].Env)
+}
+
+func TestBuildRunConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	// an android build should run instrumentation tests
+	build := Build{
+		Dir: "/dir",
+		Manifest: &config.BuildManifest{
+			Android: config.AndroidConfig{Apk: "app.apk", ApkInstrumentation: "tests.apk"},
+		},
+	}
+	runConfig := build.RunConfig()
+	assert.Equal("/dir/app.apk", runConfig.App)
+	assert.Equal(devicefarm.UploadTypeAndroidApp, runConfig.AppType)
+	assert.Equal("/dir/tests.apk", runConfig.TestPackage)
+	assert.Equal(devicefarm.UploadTypeInstrumentationTestPackage, runConfig.TestPackageType)
+	assert.Equal(devicefarm.TestTypeInstrumentation, runConfig.TestType)
+
+	// an ios build should default to xctest
+	build.Manifest = &config.BuildManifest{
+		IOS: config.IOSConfig{Ipa: "app.ipa", XCTestPackage: "tests.zip"},
+	}
+	runConfig = build.RunConfig()
+	assert.Equal("/dir/app.ipa", runConfig.App)
+	assert.Equal(devicefarm.UploadTypeIosApp, runConfig.AppType)
+	assert.Equal("/dir/tests.zip", runConfig.TestPackage)
+	assert.Equal(devicefarm.UploadTypeXctestTestPackage, runConfig.TestPackageType)
+	assert.Equal(devicefarm.TestTypeXctest, runConfig.TestType)
+
+	// an ios build with xctest_ui
+	build.Manifest.IOS.TestType = config.IOSTestTypeXCTestUI
+	runConfig = build.RunConfig()
+	assert.Equal(devicefarm.UploadTypeXctestUiTestPackage, runConfig.TestPackageType)
+	assert.Equal(devicefarm.TestTypeXctestUi, runConfig.TestType)
+}
+
+func TestBuildRunConfigAppium(t *testing.T) {
+	assert := assert.New(t)
+
+	// native appium tests should upload the apk
+	build := Build{
+		Dir: "/dir",
+		Manifest: &config.BuildManifest{
+			Android: config.AndroidConfig{Apk: "app.apk"},
+			Appium:  config.AppiumConfig{Flavor: config.AppiumFlavorJavaJUnit, TestPackage: "tests.zip"},
+		},
+	}
+	runConfig := build.RunConfig()
+	assert.Equal("/dir/app.apk", runConfig.App)
+	assert.Equal(devicefarm.UploadTypeAndroidApp, runConfig.AppType)
+	assert.Equal("/dir/tests.zip", runConfig.TestPackage)
+	assert.Equal(devicefarm.UploadTypeAppiumJavaJunitTestPackage, runConfig.TestPackageType)
+	assert.Equal(devicefarm.TestTypeAppiumJavaJunit, runConfig.TestType)
+
+	// native appium tests should upload the ipa
+	build.Manifest = &config.BuildManifest{
+		IOS:    config.IOSConfig{Ipa: "app.ipa"},
+		Appium: config.AppiumConfig{Flavor: config.AppiumFlavorPython, TestPackage: "tests.zip"},
+	}
+	runConfig = build.RunConfig()
+	assert.Equal("/dir/app.ipa", runConfig.App)
+	assert.Equal(devicefarm.UploadTypeIosApp, runConfig.AppType)
+	assert.Equal(devicefarm.UploadTypeAppiumPythonTestPackage, runConfig.TestPackageType)
+	assert.Equal(devicefarm.TestTypeAppiumPython, runConfig.TestType)
+
+	// web appium tests should not upload an app
+	web := true
+	build.Manifest = &config.BuildManifest{
+		Appium: config.AppiumConfig{Flavor: config.AppiumFlavorJavaTestNG, TestPackage: "tests.zip", Web: &web},
+	}
+	runConfig = build.RunConfig()
+	assert.Equal("", runConfig.App)
+	assert.Equal(devicefarm.UploadTypeAppiumWebJavaTestngTestPackage, runConfig.TestPackageType)
+	assert.Equal(devicefarm.TestTypeAppiumWebJavaTestng, runConfig.TestType)
+}
+
+func TestBuildRunConfigBuiltin(t *testing.T) {
+	assert := assert.New(t)
+
+	// fuzz tests should only upload the apk, and pass parameters
+	build := Build{
+		Dir: "/dir",
+		Manifest: &config.BuildManifest{
+			Android: config.AndroidConfig{Apk: "app.apk"},
+			Builtin: config.BuiltinConfig{Type: config.BuiltinTypeFuzz, EventCount: 100, EventThrottle: 50, Seed: 1234},
+		},
+	}
+	runConfig := build.RunConfig()
+	assert.Equal("/dir/app.apk", runConfig.App)
+	assert.Equal(devicefarm.UploadTypeAndroidApp, runConfig.AppType)
+	assert.Equal("", runConfig.TestPackage)
+	assert.Equal(devicefarm.TestTypeBuiltinFuzz, runConfig.TestType)
+	assert.Equal(map[string]string{
+		"event_count": "100",
+		"throttle":    "50",
+		"seed":        "1234",
+	}, runConfig.TestParameters)
+
+	// explorer tests should pass login credentials
+	build.Manifest.Builtin = config.BuiltinConfig{Type: config.BuiltinTypeExplorer, Username: "foo", Password: "bar"}
+	runConfig = build.RunConfig()
+	assert.Equal(devicefarm.TestTypeBuiltinExplorer, runConfig.TestType)
+	assert.Equal(map[string]string{
+		"username": "foo",
+		"password": "bar",
+	}, runConfig.TestParameters)
+}
+
+func TestBuildDevicePoolRules(t *testing.T) {
+	assert := assert.New(t)
+
+	build := Build{
+		Config: &config.Config{
+			DevicePoolDefinitions: map[string][]string{
+				"list": {"(arn=device:FOO) Foo"},
+			},
+			DevicePoolRules: map[string][]config.DeviceRule{
+				"rules": {
+					{Attribute: config.RuleAttributeManufacturer, Operator: config.RuleOperatorIn, Values: []string{"Samsung", "LG"}},
+					{Attribute: config.RuleAttributePlatform, Operator: config.RuleOperatorEquals, Values: []string{"ANDROID"}},
+				},
+			},
+		},
+		Manifest: &config.BuildManifest{DevicePool: "list"},
+	}
+
+	// a list of devices should become an ARN rule
+	rules, err := build.DevicePoolRules()
+	assert.Nil(err)
+	assert.Equal([]*devicefarm.Rule{
+		{
+			Attribute: aws.String("ARN"),
+			Operator:  aws.String("IN"),
+			Value:     aws.String("[\"arn:aws:devicefarm:us-west-2::device:FOO\"]"),
+		},
+	}, rules)
+
+	// rules should have JSON values
+	build.Manifest.DevicePool = "rules"
+	rules, err = build.DevicePoolRules()
+	assert.Nil(err)
+	assert.Equal([]*devicefarm.Rule{
+		{
+			Attribute: aws.String("MANUFACTURER"),
+			Operator:  aws.String("IN"),
+			Value:     aws.String("[\"Samsung\",\"LG\"]"),
+		},
+		{
+			Attribute: aws.String("PLATFORM"),
+			Operator:  aws.String("EQUALS"),
+			Value:     aws.String("\"ANDROID\""),
+		},
+	}, rules)
+
+	// should fail because the pool does not exist
+	build.Manifest.DevicePool = "missing"
+	rules, err = build.DevicePoolRules()
 	assert.NotNil(err)
+	assert.Nil(rules)
 }
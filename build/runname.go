@@ -0,0 +1,228 @@
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/devicefarm"
+	"github.com/ride/devicefarm/config"
+	"github.com/ride/devicefarm/util"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"unicode/utf8"
+)
+
+// maxRunNameLength is the longest run name Device Farm accepts.
+const maxRunNameLength = 256
+
+// RunMetadata describes the build which created a test run. It is the data
+// for the run_name template, and is parsed back out of run names by
+// ParseRunName, in which case the fields the template does not include
+// directly are blank, and Env is nil.
+type RunMetadata struct {
+	Branch      string
+	SHA         string
+	ShortSHA    string
+	BuildNumber string
+	BuildURL    string
+	CI          string
+	DevicePool  string
+	Env         map[string]string
+}
+
+// runNameFields are the fields of RunMetadata which ParseRunName can parse.
+var runNameFields = map[string]bool{
+	"Branch":      true,
+	"SHA":         true,
+	"ShortSHA":    true,
+	"BuildNumber": true,
+	"BuildURL":    true,
+	"CI":          true,
+	"DevicePool":  true,
+}
+
+// Metadata returns the RunMetadata of this build, with its CI job (if any)
+// and the current environment.
+func (build *Build) Metadata() *RunMetadata {
+	ci := build.CI
+	if ci == nil {
+		ci = &util.CIBuild{}
+	}
+	env := map[string]string{}
+	for _, pair := range os.Environ() {
+		if parts := strings.SplitN(pair, "=", 2); len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		}
+	}
+	return &RunMetadata{
+		Branch:      build.Branch,
+		SHA:         build.Commit,
+		ShortSHA:    util.ShortSHA(build.Commit),
+		BuildNumber: ci.BuildNumber,
+		BuildURL:    ci.BuildURL,
+		CI:          ci.Name,
+		DevicePool:  build.Manifest.DevicePool,
+		Env:         env,
+	}
+}
+
+// runNameTemplate returns the manifest's RunName, or config.DefaultRunName.
+func (build *Build) runNameTemplate() string {
+	if len(build.Manifest.RunName) > 0 {
+		return build.Manifest.RunName
+	}
+	return config.DefaultRunName
+}
+
+// RunName returns the name for a test run of this build, by rendering the
+// manifest's run_name template with the build's Metadata. Missing
+// environment variables are blank. Names which are too long are truncated,
+// without splitting a character.
+func (build *Build) RunName() (string, error) {
+	tmpl, err := template.New("run_name").Option("missingkey=zero").Parse(build.runNameTemplate())
+	if err != nil {
+		return "", fmt.Errorf("Invalid run_name: %s", err)
+	}
+	out := &bytes.Buffer{}
+	if err := tmpl.Execute(out, build.Metadata()); err != nil {
+		return "", fmt.Errorf("Invalid run_name: %s", err)
+	}
+	name := out.String()
+	if len(name) > maxRunNameLength {
+		end := maxRunNameLength
+		for end > 0 && !utf8.RuneStart(name[end]) {
+			end--
+		}
+		name = name[:end]
+	}
+	return name, nil
+}
+
+// ParseRunName returns the RunMetadata in a run name rendered from the given
+// run_name template, or false if the name does not match the template. Only
+// fields which the template includes as a plain action, like {{.Branch}},
+// are parsed.
+func ParseRunName(text, name string) (*RunMetadata, bool) {
+	re, err := runNameRegexp(text)
+	if err != nil {
+		return nil, false
+	}
+	return parseRunName(re, name)
+}
+
+func parseRunName(re *regexp.Regexp, name string) (*RunMetadata, bool) {
+	match := re.FindStringSubmatch(name)
+	if match == nil {
+		return nil, false
+	}
+	metadata := &RunMetadata{}
+	value := reflect.ValueOf(metadata).Elem()
+	for i, field := range re.SubexpNames() {
+		if len(field) > 0 {
+			value.FieldByName(field).SetString(match[i])
+		}
+	}
+	return metadata, true
+}
+
+// runNameRegexp converts a run_name template to a regexp which matches the
+// names it renders. Plain field actions become named groups, if blocks
+// become optional groups, and anything else matches any text.
+func runNameRegexp(text string) (*regexp.Regexp, error) {
+	tmpl, err := template.New("run_name").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	pattern := templatePattern(tmpl.Tree.Root, map[string]bool{})
+	return regexp.Compile("^" + pattern + "$")
+}
+
+func templatePattern(node parse.Node, seen map[string]bool) string {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		pattern := ""
+		if node != nil {
+			for _, child := range node.Nodes {
+				pattern += templatePattern(child, seen)
+			}
+		}
+		return pattern
+	case *parse.TextNode:
+		return regexp.QuoteMeta(string(node.Text))
+	case *parse.ActionNode:
+		field := pipeField(node.Pipe)
+		if runNameFields[field] && !seen[field] {
+			// a field can only be captured once
+			seen[field] = true
+			return "(?P<" + field + ">.*?)"
+		}
+	case *parse.IfNode:
+		if node.ElseList != nil {
+			return "(?:" + templatePattern(node.List, seen) + "|" + templatePattern(node.ElseList, seen) + ")"
+		}
+		return "(?:" + templatePattern(node.List, seen) + ")?"
+	}
+	return ".*?"
+}
+
+// pipeField returns the name of the field in a pipeline which is just a
+// field, like {{.Branch}}, and otherwise a blank string.
+func pipeField(pipe *parse.PipeNode) string {
+	if pipe == nil || len(pipe.Decl) > 0 || len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+		return ""
+	}
+	field, ok := pipe.Cmds[0].Args[0].(*parse.FieldNode)
+	if !ok || len(field.Ident) != 1 {
+		return ""
+	}
+	return field.Ident[0]
+}
+
+// A NamedRun is a test run with the RunMetadata parsed from its name.
+type NamedRun struct {
+	Run      *devicefarm.Run
+	Metadata *RunMetadata
+}
+
+// NamedRuns returns the runs (e.g. from ListRuns) whose names match this
+// build's run_name template, in the same order, with their metadata. This is
+// how earlier runs of a branch or commit are found.
+func (build *Build) NamedRuns(runs []*devicefarm.Run) []*NamedRun {
+	named := []*NamedRun{}
+	re, err := runNameRegexp(build.runNameTemplate())
+	if err != nil {
+		return named
+	}
+	for _, run := range runs {
+		if metadata, ok := parseRunName(re, aws.StringValue(run.Name)); ok {
+			named = append(named, &NamedRun{Run: run, Metadata: metadata})
+		}
+	}
+	return named
+}
+
+// LatestRun returns the most recently created of the runs (e.g. from
+// ListRuns) whose name shows it was a run of this build's branch, or nil if
+// there is none.
+func (build *Build) LatestRun(runs []*devicefarm.Run) *devicefarm.Run {
+	return build.LatestBranchRun(runs, build.Branch)
+}
+
+// LatestBranchRun is like LatestRun, but for runs of another branch, e.g. to
+// compare this branch's results with master's.
+func (build *Build) LatestBranchRun(runs []*devicefarm.Run, branch string) *devicefarm.Run {
+	var latest *devicefarm.Run
+	for _, named := range build.NamedRuns(runs) {
+		if named.Metadata.Branch != branch {
+			continue
+		}
+		if latest == nil || aws.TimeValue(named.Run.Created).After(aws.TimeValue(latest.Created)) {
+			latest = named.Run
+		}
+	}
+	return latest
+}
@@ -0,0 +1,140 @@
+package build
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/devicefarm"
+	"github.com/ride/devicefarm/config"
+	"github.com/ride/devicefarm/util"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestBuildRunName(t *testing.T) {
+	assert := assert.New(t)
+
+	build := Build{
+		Branch:   "feature/login",
+		Commit:   "1a2b3c4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b",
+		CI:       &util.CIBuild{Name: util.CICircle, BuildNumber: "42"},
+		Manifest: &config.BuildManifest{DevicePool: "everything"},
+	}
+
+	// should use the default template, with the build number
+	name, err := build.RunName()
+	assert.Nil(err)
+	assert.Equal("feature/login@1a2b3c4 #42", name)
+	assert.Equal("feature/login@1a2b3c4 #42", build.RunConfig().Name)
+
+	// and without it outside CI
+	build.CI = nil
+	name, err = build.RunName()
+	assert.Nil(err)
+	assert.Equal("feature/login@1a2b3c4", name)
+
+	// should render a custom template with environment variables, which are
+	// blank when missing
+	os.Setenv("DEVICEFARM_TEST_USER", "bob")
+	defer os.Unsetenv("DEVICEFARM_TEST_USER")
+	build.Manifest.RunName = "{{.DevicePool}} {{.SHA}} by {{.Env.DEVICEFARM_TEST_USER}}{{.Env.DEVICEFARM_TEST_MISSING}}"
+	name, err = build.RunName()
+	assert.Nil(err)
+	assert.Equal("everything 1a2b3c4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b by bob", name)
+
+	// should fail on an unknown field
+	build.Manifest.RunName = "{{.Nope}}"
+	_, err = build.RunName()
+	assert.NotNil(err)
+
+	// should be truncated to the maximum length
+	build.Manifest.RunName = strings.Repeat("x", 300)
+	name, err = build.RunName()
+	assert.Nil(err)
+	assert.Equal(256, len(name))
+
+	// without splitting a multi-byte character of the branch
+	build.Branch = strings.Repeat("x", 255) + "é"
+	build.Manifest.RunName = ""
+	name, err = build.RunName()
+	assert.Nil(err)
+	assert.True(utf8.ValidString(name))
+	assert.Equal(strings.Repeat("x", 255), name)
+}
+
+func TestParseRunName(t *testing.T) {
+	assert := assert.New(t)
+
+	// should parse the default template, with and without the build number
+	metadata, ok := ParseRunName(config.DefaultRunName, "feature/login@1a2b3c4 #42")
+	assert.True(ok)
+	assert.Equal(&RunMetadata{Branch: "feature/login", ShortSHA: "1a2b3c4", BuildNumber: "42"}, metadata)
+	metadata, ok = ParseRunName(config.DefaultRunName, "master@1a2b3c4")
+	assert.True(ok)
+	assert.Equal(&RunMetadata{Branch: "master", ShortSHA: "1a2b3c4"}, metadata)
+
+	// should not match a name from another template
+	_, ok = ParseRunName(config.DefaultRunName, "Unnamed run")
+	assert.False(ok)
+
+	// should escape text, match anything for other actions, and capture a
+	// field only once
+	metadata, ok = ParseRunName("[{{.CI}}] {{.Env.USER}}: {{.Branch}} ({{.Branch}})", "[circleci] bob: master (master)")
+	assert.True(ok)
+	assert.Equal(&RunMetadata{CI: "circleci", Branch: "master"}, metadata)
+
+	// an if/else should match either branch
+	text := "{{.Branch}}{{if .BuildNumber}} #{{.BuildNumber}}{{else}} local{{end}}"
+	metadata, ok = ParseRunName(text, "master local")
+	assert.True(ok)
+	assert.Equal(&RunMetadata{Branch: "master"}, metadata)
+	_, ok = ParseRunName(text, "master")
+	assert.False(ok)
+
+	// an invalid template matches nothing
+	_, ok = ParseRunName("{{.Branch", "master")
+	assert.False(ok)
+}
+
+func TestBuildNamedRuns(t *testing.T) {
+	assert := assert.New(t)
+
+	build := Build{Manifest: &config.BuildManifest{RunName: "{{.Branch}}@{{.ShortSHA}}"}}
+	runs := []*devicefarm.Run{
+		{Arn: aws.String("run1"), Name: aws.String("master@1a2b3c4")},
+		{Arn: aws.String("run2"), Name: aws.String("some other run")},
+		{Arn: aws.String("run3")},
+		{Arn: aws.String("run4"), Name: aws.String("feature@5d6e7f8")},
+	}
+	named := build.NamedRuns(runs)
+	assert.Equal(2, len(named))
+	assert.Equal("run1", *named[0].Run.Arn)
+	assert.Equal(&RunMetadata{Branch: "master", ShortSHA: "1a2b3c4"}, named[0].Metadata)
+	assert.Equal("run4", *named[1].Run.Arn)
+	assert.Equal("feature", named[1].Metadata.Branch)
+}
+
+func TestBuildLatestRun(t *testing.T) {
+	assert := assert.New(t)
+
+	build := Build{Branch: "master", Manifest: &config.BuildManifest{}}
+	now := time.Now()
+	runs := []*devicefarm.Run{
+		{Arn: aws.String("run1"), Name: aws.String("master@1a2b3c4"), Created: aws.Time(now.Add(-2 * time.Hour))},
+		{Arn: aws.String("run2"), Name: aws.String("master@5d6e7f8 #3"), Created: aws.Time(now.Add(-time.Hour))},
+		{Arn: aws.String("run3"), Name: aws.String("feature@9a8b7c6"), Created: aws.Time(now)},
+		{Arn: aws.String("run4"), Name: aws.String("Unnamed"), Created: aws.Time(now)},
+	}
+
+	// should find the newest run of the branch
+	assert.Equal("run2", *build.LatestRun(runs).Arn)
+
+	// or of another branch
+	assert.Equal("run3", *build.LatestBranchRun(runs, "feature").Arn)
+
+	// or nothing
+	build.Branch = "release"
+	assert.Nil(build.LatestRun(runs))
+}
@@ -15,6 +15,15 @@ Here is an annotated example of what a config file should look like:
 	# Project ARN. This property is REQUIRED.
 	project_arn: arn:aws:devicefarm:us-west-2:026109802893:project:1124416c-bfb2-4334-817c-e211ecef7dc0
 
+	# AWS region of the project. This property is OPTIONAL, and defaults to
+	# the region in project_arn. The AWS_REGION environment variable and the
+	# --region flag override it.
+	region: us-west-2
+
+	# IAM role to assume before calling Device Farm, e.g. when the project is
+	# in a different account from your credentials. This property is OPTIONAL.
+	assume_role_arn: arn:aws:iam::026109802893:role/devicefarm-testing
+
 	# Device Pool definitions. this block defines three Device Pools:
 	# samsung_s4, samsung_s5, and everything. The everything pool
 	# simply includes both the other pools.
@@ -36,22 +45,85 @@ Here is an annotated example of what a config file should look like:
 	  - +samsung_s4
 	  - +samsung_s5
 
+	# A pool may instead be a set of rules, so that it picks up new devices
+	# as Device Farm adds them. The keys are platform, manufacturer,
+	# form_factor and os. A plain value must be equal, and may be prefixed
+	# with a comparison (=, !=, >, <, >= or <=), while a list of values must
+	# contain the device's value. Any operator may also be given by name,
+	# for example {not_in: [LG, Motorola]}. Rule-based pools cannot be
+	# included in other pools with "+".
+	modern_samsung_phones:
+	  platform: ANDROID
+	  manufacturer: Samsung
+	  form_factor: PHONE
+	  os: ">= 5.0"
+
 	# Defaults defines the build config that will be used for all branches,
 	# unless overrides are specified in the branches section.
 	#
 	# This property is OPTIONAL, but building will fail on a particular branch
 	# unless a full definition is available for that branch.
 	defaults:
-	  # The bash commands to run for this build.
+	  # Environment variables for every build command. Branches may add to or
+	  # override these, one variable at a time.
+	  env:
+	    GRADLE_OPTS: -Xmx2g
+
+	  # The commands to run for this build. Each command is run with the
+	  # shell, so quoting, pipes, "&&" and variables work as usual. A step
+	  # may instead be a mapping with run (the command) and any of: dir
+	  # (relative to the build directory), env, timeout (e.g. 10m, after
+	  # which the step and anything it started is killed), retries, and
+	  # continue_on_error.
 	  build:
 	    - echo "Foo"
-	    - echo "Bar"
+	    - ./gradlew assemble -Pfoo="a b" | tee gradle.log
+	    - run: ./gradlew connectedCheck
+	      dir: android
+	      env:
+	        JAVA_HOME: /opt/jdk8
+	      timeout: 20m
+	      retries: 2
+	      continue_on_error: true
+
+	  # The shell used to run build commands, which is given each command as
+	  # its last argument. This property is OPTIONAL, and defaults to "sh -c".
+	  shell: bash -eo pipefail -c
 
 	  # The location of APK files, after build commands have been run.
 	  android:
 	    apk: ./path/to/build.apk
 	    apk_instrumentation: ./path/to/instrumentation.apk
 
+	  # For iOS apps, use an ios block instead of an android block. The
+	  # test_type may be xctest (the default) or xctest_ui.
+	  #
+	  # ios:
+	  #   ipa: ./path/to/build.ipa
+	  #   xctest_package: ./path/to/tests.zip
+	  #   test_type: xctest
+
+	  # To run Appium tests instead of instrumentation tests, add an appium
+	  # block. The flavor may be java_junit, java_testng or python. The tests
+	  # run against the apk (or ipa), unless web is true, in which case they
+	  # run in the device's browser and no app is needed.
+	  #
+	  # appium:
+	  #   flavor: java_junit
+	  #   test_package: ./path/to/appium-tests.zip
+	  #   web: false
+
+	  # To run Device Farm's built-in tests, which only need the apk (or ipa),
+	  # add a builtin block. The type may be fuzz or explorer (Android only).
+	  # event_count, event_throttle and seed configure fuzz tests, while
+	  # username and password let the explorer log in to your app.
+	  #
+	  # builtin:
+	  #   type: fuzz
+	  #   event_count: 6000
+	  #   event_throttle: 50
+	  #   seed: 1234
+
 	  # The device pool name that tests should be run on.
 	  devicepool: samsung_s4
 
@@ -61,38 +133,202 @@ Here is an annotated example of what a config file should look like:
 	# same properties from `defaults`. In this example, only the `devicepools`
 	# property will be overridden for the `master` branch.
 	#
+	# A key may also be a glob, like release/*, or a regular expression
+	# between slashes, like /^hotfix-/. Every key matching a branch is
+	# merged, so overrides can be layered. An exact branch name takes
+	# precedence over globs, a more specific glob (with more literal
+	# characters) over a less specific one, and globs over regular
+	# expressions, of which the first in the file takes precedence.
+	#
 	# This property is OPTIONAL, but building will fail on a particular branch
 	# unless a full definition is available for that branch.
 	branches:
 	  master:
 	    devicepool: everything
 
+	  release/*:
+	    devicepool: everything
+	    shell: bash -eo pipefail -c
+
+	  /^hotfix-[0-9]+$/:
+	    devicepool: samsung_s5
+
 */
 package config
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/ride/devicefarm/util"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"path"
 	"regexp"
 	"sort"
+	"strings"
+	"text/template"
+	"time"
 )
 
 // An AndroidConfig specifies the location of APKs after running the build steps.
 type AndroidConfig struct {
-	Apk                string `yaml:"apk"`
-	ApkInstrumentation string `yaml:"apk_instrumentation"`
+	Apk                string `yaml:"apk,omitempty"`
+	ApkInstrumentation string `yaml:"apk_instrumentation,omitempty"`
+}
+
+// IsEmpty returns true if none of the AndroidConfig fields are set.
+func (android *AndroidConfig) IsEmpty() bool {
+	return len(android.Apk) == 0 && len(android.ApkInstrumentation) == 0
+}
+
+// Valid values for IOSConfig.TestType.
+const (
+	IOSTestTypeXCTest   = "xctest"
+	IOSTestTypeXCTestUI = "xctest_ui"
+)
+
+// An IOSConfig specifies the location of the IPA and XCTest package after
+// running the build steps, and which kind of XCTest to run. If TestType is
+// blank, IOSTestTypeXCTest is assumed.
+type IOSConfig struct {
+	Ipa           string `yaml:"ipa,omitempty"`
+	XCTestPackage string `yaml:"xctest_package,omitempty"`
+	TestType      string `yaml:"test_type,omitempty"`
+}
+
+// IsEmpty returns true if none of the IOSConfig fields are set.
+func (ios *IOSConfig) IsEmpty() bool {
+	return len(ios.Ipa) == 0 && len(ios.XCTestPackage) == 0 && len(ios.TestType) == 0
+}
+
+// Valid values for AppiumConfig.Flavor.
+const (
+	AppiumFlavorJavaJUnit  = "java_junit"
+	AppiumFlavorJavaTestNG = "java_testng"
+	AppiumFlavorPython     = "python"
+)
+
+// An AppiumConfig specifies the location of an Appium test package after
+// running the build steps, and which flavor of Appium tests it contains.
+// Unless Web is true, the tests run against the app from the android or ios
+// block. Web tests run in the device's browser, so no app is uploaded.
+type AppiumConfig struct {
+	Flavor      string `yaml:"flavor,omitempty"`
+	TestPackage string `yaml:"test_package,omitempty"`
+	Web         *bool  `yaml:"web,omitempty"`
+}
+
+// IsEmpty returns true if none of the AppiumConfig fields are set.
+func (appium *AppiumConfig) IsEmpty() bool {
+	return len(appium.Flavor) == 0 && len(appium.TestPackage) == 0 && appium.Web == nil
+}
+
+// IsWeb returns true if the Appium tests should run in the device's browser.
+func (appium *AppiumConfig) IsWeb() bool {
+	return appium.Web != nil && *appium.Web
 }
 
+// Valid values for BuiltinConfig.Type.
+const (
+	BuiltinTypeFuzz     = "fuzz"
+	BuiltinTypeExplorer = "explorer"
+)
+
+// A BuiltinConfig specifies settings for Device Farm's built-in tests, which
+// only need the app. EventCount, EventThrottle and Seed apply to fuzz tests,
+// while Username and Password are used by the explorer to log in to the app.
+// Zero or blank values use Device Farm's defaults.
+type BuiltinConfig struct {
+	Type          string `yaml:"type,omitempty"`
+	EventCount    int    `yaml:"event_count,omitempty"`
+	EventThrottle int    `yaml:"event_throttle,omitempty"`
+	Seed          int    `yaml:"seed,omitempty"`
+	Username      string `yaml:"username,omitempty"`
+	Password      string `yaml:"password,omitempty"`
+}
+
+// IsEmpty returns true if none of the BuiltinConfig fields are set.
+func (builtin *BuiltinConfig) IsEmpty() bool {
+	return *builtin == BuiltinConfig{}
+}
+
+// DefaultRunName is the template used to name test runs when a manifest has
+// no RunName.
+const DefaultRunName = "{{.Branch}}@{{.ShortSHA}}{{if .BuildNumber}} #{{.BuildNumber}}{{end}}"
+
+// Platforms a BuildManifest may target. The values match Device Farm's
+// device platforms.
+const (
+	PlatformAndroid = "ANDROID"
+	PlatformIOS     = "IOS"
+)
+
 // A BuildManifest specifies the whole configuration for a build: the steps to
-// perform the build, the location of Android APKs, and the DevicePool names
-// to run on.
+// perform the build, the location of Android APKs or iOS packages, and the
+// DevicePool names to run on. Env holds environment variables for every step,
+// and RunName is a text/template for the names of test runs (see
+// DefaultRunName).
 type BuildManifest struct {
-	Steps      []string      `yaml:"build"`
-	Android    AndroidConfig `yaml:"android"`
-	DevicePool string        `yaml:"devicepool"`
+	Steps      []BuildStep       `yaml:"build,omitempty"`
+	Shell      string            `yaml:"shell,omitempty"`
+	Env        map[string]string `yaml:"env,omitempty"`
+	RunName    string            `yaml:"run_name,omitempty"`
+	Android    AndroidConfig     `yaml:"android,omitempty"`
+	IOS        IOSConfig         `yaml:"ios,omitempty"`
+	Appium     AppiumConfig      `yaml:"appium,omitempty"`
+	Builtin    BuiltinConfig     `yaml:"builtin,omitempty"`
+	DevicePool string            `yaml:"devicepool,omitempty"`
+}
+
+// A BuildStep is a command to run during a build. Dir is relative to the
+// build directory, and Env adds environment variables on top of the
+// manifest's Env. A step which fails is retried up to Retries times, and is
+// killed if it runs longer than Timeout (when non-zero). If ContinueOnError is
+// true, the build carries on when the step fails.
+type BuildStep struct {
+	Run             string            `yaml:"run,omitempty"`
+	Dir             string            `yaml:"dir,omitempty"`
+	Env             map[string]string `yaml:"env,omitempty"`
+	Timeout         time.Duration     `yaml:"timeout,omitempty"`
+	Retries         int               `yaml:"retries,omitempty"`
+	ContinueOnError bool              `yaml:"continue_on_error,omitempty"`
+}
+
+// UnmarshalYAML allows a step to be given as just its command, which is how
+// steps were written before they had options.
+func (step *BuildStep) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var command string
+	if err := unmarshal(&command); err == nil {
+		*step = BuildStep{Run: command}
+		return nil
+	}
+	type plain BuildStep
+	return unmarshal((*plain)(step))
+}
+
+// MarshalYAML writes a step with no options as just its command.
+func (step BuildStep) MarshalYAML() (interface{}, error) {
+	if step.Dir == "" && len(step.Env) == 0 && step.Timeout == 0 && step.Retries == 0 && !step.ContinueOnError {
+		return step.Run, nil
+	}
+	type plain BuildStep
+	return plain(step), nil
+}
+
+// IsValid returns true and nil if the step can be run, and returns false and
+// an error otherwise.
+func (step *BuildStep) IsValid() (bool, error) {
+	if len(strings.TrimSpace(step.Run)) == 0 {
+		return false, errors.New("Build step has no run command")
+	}
+	if step.Timeout < 0 {
+		return false, fmt.Errorf("Build step has a negative timeout: %s", step.Run)
+	}
+	if step.Retries < 0 {
+		return false, fmt.Errorf("Build step has negative retries: %s", step.Run)
+	}
+	return true, nil
 }
 
 // MergeManfiests merges together two BuildManifests, giving the second manifest
@@ -105,6 +341,26 @@ func MergeManifests(m1 *BuildManifest, m2 *BuildManifest) *BuildManifest {
 	} else {
 		merged.Steps = m1.Steps[:]
 	}
+	if len(m2.Shell) > 0 {
+		merged.Shell = m2.Shell
+	} else {
+		merged.Shell = m1.Shell
+	}
+	if len(m2.RunName) > 0 {
+		merged.RunName = m2.RunName
+	} else {
+		merged.RunName = m1.RunName
+	}
+	// variables are merged one by one, rather than replacing the whole map
+	if len(m1.Env) > 0 || len(m2.Env) > 0 {
+		merged.Env = map[string]string{}
+		for key, value := range m1.Env {
+			merged.Env[key] = value
+		}
+		for key, value := range m2.Env {
+			merged.Env[key] = value
+		}
+	}
 	if len(m2.Android.Apk) > 0 {
 		merged.Android.Apk = m2.Android.Apk
 	} else {
@@ -115,6 +371,66 @@ func MergeManifests(m1 *BuildManifest, m2 *BuildManifest) *BuildManifest {
 	} else {
 		merged.Android.ApkInstrumentation = m1.Android.ApkInstrumentation
 	}
+	if len(m2.IOS.Ipa) > 0 {
+		merged.IOS.Ipa = m2.IOS.Ipa
+	} else {
+		merged.IOS.Ipa = m1.IOS.Ipa
+	}
+	if len(m2.IOS.XCTestPackage) > 0 {
+		merged.IOS.XCTestPackage = m2.IOS.XCTestPackage
+	} else {
+		merged.IOS.XCTestPackage = m1.IOS.XCTestPackage
+	}
+	if len(m2.IOS.TestType) > 0 {
+		merged.IOS.TestType = m2.IOS.TestType
+	} else {
+		merged.IOS.TestType = m1.IOS.TestType
+	}
+	if len(m2.Appium.Flavor) > 0 {
+		merged.Appium.Flavor = m2.Appium.Flavor
+	} else {
+		merged.Appium.Flavor = m1.Appium.Flavor
+	}
+	if len(m2.Appium.TestPackage) > 0 {
+		merged.Appium.TestPackage = m2.Appium.TestPackage
+	} else {
+		merged.Appium.TestPackage = m1.Appium.TestPackage
+	}
+	if m2.Appium.Web != nil {
+		merged.Appium.Web = m2.Appium.Web
+	} else {
+		merged.Appium.Web = m1.Appium.Web
+	}
+	if len(m2.Builtin.Type) > 0 {
+		merged.Builtin.Type = m2.Builtin.Type
+	} else {
+		merged.Builtin.Type = m1.Builtin.Type
+	}
+	if m2.Builtin.EventCount != 0 {
+		merged.Builtin.EventCount = m2.Builtin.EventCount
+	} else {
+		merged.Builtin.EventCount = m1.Builtin.EventCount
+	}
+	if m2.Builtin.EventThrottle != 0 {
+		merged.Builtin.EventThrottle = m2.Builtin.EventThrottle
+	} else {
+		merged.Builtin.EventThrottle = m1.Builtin.EventThrottle
+	}
+	if m2.Builtin.Seed != 0 {
+		merged.Builtin.Seed = m2.Builtin.Seed
+	} else {
+		merged.Builtin.Seed = m1.Builtin.Seed
+	}
+	if len(m2.Builtin.Username) > 0 {
+		merged.Builtin.Username = m2.Builtin.Username
+	} else {
+		merged.Builtin.Username = m1.Builtin.Username
+	}
+	if len(m2.Builtin.Password) > 0 {
+		merged.Builtin.Password = m2.Builtin.Password
+	} else {
+		merged.Builtin.Password = m1.Builtin.Password
+	}
 	if len(m2.DevicePool) > 0 {
 		merged.DevicePool = m2.DevicePool[:]
 	} else {
@@ -126,8 +442,42 @@ func MergeManifests(m1 *BuildManifest, m2 *BuildManifest) *BuildManifest {
 // IsRunnable returns true and nil if the BuildManifest is properly configured
 // to run, and returns false and an error otherwise. For example, if a BuildManifest
 // has no DevicePool, it cannot be run.
+//
+// If an appium block is present, Appium tests are run instead of instrumentation
+// or XCTest tests, so apk_instrumentation and xctest_package are not required.
+// Otherwise, if a builtin block is present, built-in tests are run and only the
+// app is required.
 func (manifest *BuildManifest) IsRunnable() (bool, error) {
-	if len(manifest.Android.Apk) == 0 || len(manifest.Android.ApkInstrumentation) == 0 {
+	for _, step := range manifest.Steps {
+		if valid, err := step.IsValid(); !valid {
+			return false, err
+		}
+	}
+	if len(manifest.RunName) > 0 {
+		if _, err := template.New("run_name").Parse(manifest.RunName); err != nil {
+			return false, fmt.Errorf("Invalid run_name: %s", err)
+		}
+	}
+	if !manifest.Android.IsEmpty() && !manifest.IOS.IsEmpty() {
+		return false, fmt.Errorf("Cannot specify both android and ios")
+	}
+	if !manifest.Appium.IsEmpty() {
+		if runnable, err := manifest.isAppiumRunnable(); !runnable {
+			return false, err
+		}
+	} else if !manifest.Builtin.IsEmpty() {
+		if runnable, err := manifest.isBuiltinRunnable(); !runnable {
+			return false, err
+		}
+	} else if manifest.Platform() == PlatformIOS {
+		if len(manifest.IOS.Ipa) == 0 || len(manifest.IOS.XCTestPackage) == 0 {
+			return false, fmt.Errorf("Missing iOS ipa or xctest_package")
+		}
+		testType := manifest.IOS.TestType
+		if testType != "" && testType != IOSTestTypeXCTest && testType != IOSTestTypeXCTestUI {
+			return false, fmt.Errorf("Invalid iOS test_type: %s", testType)
+		}
+	} else if len(manifest.Android.Apk) == 0 || len(manifest.Android.ApkInstrumentation) == 0 {
 		return false, fmt.Errorf("Missing Android apk or apk_instrumentation")
 	}
 	if len(manifest.DevicePool) == 0 {
@@ -136,13 +486,301 @@ func (manifest *BuildManifest) IsRunnable() (bool, error) {
 	return true, nil
 }
 
+func (manifest *BuildManifest) isAppiumRunnable() (bool, error) {
+	appium := manifest.Appium
+	switch appium.Flavor {
+	case AppiumFlavorJavaJUnit, AppiumFlavorJavaTestNG, AppiumFlavorPython:
+	default:
+		return false, fmt.Errorf("Invalid appium flavor: %s", appium.Flavor)
+	}
+	if len(appium.TestPackage) == 0 {
+		return false, fmt.Errorf("Missing appium test_package")
+	}
+	if appium.IsWeb() {
+		return true, nil
+	}
+	if len(manifest.Android.Apk) == 0 && len(manifest.IOS.Ipa) == 0 {
+		return false, fmt.Errorf("Missing Android apk or iOS ipa for appium tests")
+	}
+	return true, nil
+}
+
+func (manifest *BuildManifest) isBuiltinRunnable() (bool, error) {
+	builtin := manifest.Builtin
+	switch builtin.Type {
+	case BuiltinTypeFuzz:
+		if len(manifest.Android.Apk) == 0 && len(manifest.IOS.Ipa) == 0 {
+			return false, fmt.Errorf("Missing Android apk or iOS ipa for builtin fuzz tests")
+		}
+	case BuiltinTypeExplorer:
+		if len(manifest.Android.Apk) == 0 {
+			return false, fmt.Errorf("Missing Android apk for builtin explorer tests")
+		}
+	default:
+		return false, fmt.Errorf("Invalid builtin type: %s", builtin.Type)
+	}
+	if builtin.EventCount < 0 || builtin.EventCount > 10000 {
+		return false, fmt.Errorf("builtin event_count must be between 1 and 10000")
+	}
+	if builtin.EventThrottle < 0 || builtin.EventThrottle > 1000 {
+		return false, fmt.Errorf("builtin event_throttle must be between 0 and 1000")
+	}
+	return true, nil
+}
+
+// Platform returns PlatformIOS if the manifest has an ios block, and
+// PlatformAndroid otherwise. Appium web tests can run on any platform,
+// so Platform returns a blank string for them.
+func (manifest *BuildManifest) Platform() string {
+	if manifest.Appium.IsWeb() {
+		return ""
+	}
+	if !manifest.IOS.IsEmpty() {
+		return PlatformIOS
+	}
+	return PlatformAndroid
+}
+
+// Device Farm rule attributes and operators used in DeviceRules. Device Farm
+// added OS_VERSION and the OR_EQUALS operators after the vendored SDK was
+// released, so the devicefarm package has no constants for them.
+const (
+	RuleAttributeArn          = "ARN"
+	RuleAttributePlatform     = "PLATFORM"
+	RuleAttributeManufacturer = "MANUFACTURER"
+	RuleAttributeFormFactor   = "FORM_FACTOR"
+	RuleAttributeOSVersion    = "OS_VERSION"
+
+	RuleOperatorEquals              = "EQUALS"
+	RuleOperatorIn                  = "IN"
+	RuleOperatorNotIn               = "NOT_IN"
+	RuleOperatorGreaterThan         = "GREATER_THAN"
+	RuleOperatorGreaterThanOrEquals = "GREATER_THAN_OR_EQUALS"
+	RuleOperatorLessThan            = "LESS_THAN"
+	RuleOperatorLessThanOrEquals    = "LESS_THAN_OR_EQUALS"
+)
+
+// ruleAttributes maps the keys of a rule-based DevicePool to Device Farm
+// rule attributes.
+var ruleAttributes = map[string]string{
+	"platform":     RuleAttributePlatform,
+	"manufacturer": RuleAttributeManufacturer,
+	"form_factor":  RuleAttributeFormFactor,
+	"os":           RuleAttributeOSVersion,
+}
+
+// ruleOperators maps the keys accepted in the `{operator: value}` form of a
+// rule to Device Farm rule operators.
+var ruleOperators = map[string]string{
+	"equals":                 RuleOperatorEquals,
+	"in":                     RuleOperatorIn,
+	"not_in":                 RuleOperatorNotIn,
+	"greater_than":           RuleOperatorGreaterThan,
+	"greater_than_or_equals": RuleOperatorGreaterThanOrEquals,
+	"less_than":              RuleOperatorLessThan,
+	"less_than_or_equals":    RuleOperatorLessThanOrEquals,
+}
+
+// ruleComparisons maps the prefixes accepted on a plain rule value to Device
+// Farm rule operators. Longer prefixes come first, so that ">=" is not read
+// as ">".
+var ruleComparisons = []struct {
+	prefix   string
+	operator string
+}{
+	{">=", RuleOperatorGreaterThanOrEquals},
+	{"<=", RuleOperatorLessThanOrEquals},
+	{"!=", RuleOperatorNotIn},
+	{">", RuleOperatorGreaterThan},
+	{"<", RuleOperatorLessThan},
+	{"=", RuleOperatorEquals},
+}
+
+// A DeviceRule is a rule which every device in a DevicePool must match, such
+// as MANUFACTURER IN ["Samsung", "LG"]. Values has a single item unless
+// Operator is IN or NOT_IN.
+type DeviceRule struct {
+	Attribute string
+	Operator  string
+	Values    []string
+}
+
+// Value returns the rule's value in the JSON format that Device Farm expects:
+// an array for IN and NOT_IN, and a string for every other operator.
+func (rule *DeviceRule) Value() string {
+	var val interface{} = rule.Values
+	if rule.Operator != RuleOperatorIn && rule.Operator != RuleOperatorNotIn && len(rule.Values) > 0 {
+		val = rule.Values[0]
+	}
+	// there will never be an error marshalling strings
+	bytes, _ := json.Marshal(val)
+	return string(bytes)
+}
+
+// parseDeviceRules parses the rules of a rule-based DevicePool. Each key is
+// an attribute (platform, manufacturer, form_factor or os) and each value is
+// one of:
+//
+//	Samsung                    # EQUALS
+//	">= 5.0"                   # a comparison: =, !=, >, <, >= or <=
+//	[Samsung, LG]              # IN
+//	{not_in: [Samsung, LG]}    # any operator, by name
+//
+// The rules are sorted by attribute and operator.
+func parseDeviceRules(def map[interface{}]interface{}) ([]DeviceRule, error) {
+	rules := []DeviceRule{}
+	for key, value := range def {
+		attribute, ok := ruleAttributes[fmt.Sprint(key)]
+		if !ok {
+			return nil, fmt.Errorf("Invalid rule attribute: %v", key)
+		}
+		switch value := value.(type) {
+		case []interface{}:
+			values, err := ruleValues(value)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, DeviceRule{attribute, RuleOperatorIn, values})
+		case map[interface{}]interface{}:
+			for name, operatorValue := range value {
+				operator, ok := ruleOperators[fmt.Sprint(name)]
+				if !ok {
+					return nil, fmt.Errorf("Invalid rule operator: %v", name)
+				}
+				values, err := ruleValues(operatorValue)
+				if err != nil {
+					return nil, err
+				}
+				if len(values) > 1 && operator != RuleOperatorIn && operator != RuleOperatorNotIn {
+					return nil, fmt.Errorf("Rule operator %v takes a single value", name)
+				}
+				rules = append(rules, DeviceRule{attribute, operator, values})
+			}
+		default:
+			values, err := ruleValues(value)
+			if err != nil {
+				return nil, err
+			}
+			operator := RuleOperatorEquals
+			for _, comparison := range ruleComparisons {
+				if strings.HasPrefix(values[0], comparison.prefix) {
+					operator = comparison.operator
+					values[0] = strings.TrimSpace(values[0][len(comparison.prefix):])
+					break
+				}
+			}
+			if len(values[0]) == 0 {
+				return nil, fmt.Errorf("Blank rule value for: %v", key)
+			}
+			rules = append(rules, DeviceRule{attribute, operator, values})
+		}
+	}
+	sort.Sort(deviceRulesByAttribute(rules))
+	return rules, nil
+}
+
+// ruleValues converts a YAML scalar or list of scalars into a list of
+// strings, returning an error if the list is empty or has blank items.
+func ruleValues(value interface{}) ([]string, error) {
+	items, ok := value.([]interface{})
+	if !ok {
+		items = []interface{}{value}
+	}
+	if len(items) == 0 {
+		return nil, errors.New("Rule has no values")
+	}
+	values := []string{}
+	for _, item := range items {
+		switch item.(type) {
+		case nil, []interface{}, map[interface{}]interface{}:
+			return nil, fmt.Errorf("Invalid rule value: %v", item)
+		}
+		str := strings.TrimSpace(fmt.Sprint(item))
+		if len(str) == 0 {
+			return nil, errors.New("Blank rule value")
+		}
+		values = append(values, str)
+	}
+	return values, nil
+}
+
+type deviceRulesByAttribute []DeviceRule
+
+func (rules deviceRulesByAttribute) Len() int      { return len(rules) }
+func (rules deviceRulesByAttribute) Swap(i, j int) { rules[i], rules[j] = rules[j], rules[i] }
+func (rules deviceRulesByAttribute) Less(i, j int) bool {
+	if rules[i].Attribute != rules[j].Attribute {
+		return rules[i].Attribute < rules[j].Attribute
+	}
+	return rules[i].Operator < rules[j].Operator
+}
+
 // A Config specifies configuration for a particular repo: the names of DevicePools,
 // the default BuildManifest, and override BuildManifests for particular branches.
+//
+// In the YAML, each entry in devicepool_definitions is either a list of
+// devices, which goes in DevicePoolDefinitions, or a mapping of rules, which
+// goes in DevicePoolRules. BranchOrder lists the keys of Branches in the order
+// they appear in the file, which decides the precedence of regexp keys (see
+// BranchOverrides).
 type Config struct {
 	ProjectArn            string                   `yaml:"project_arn"`
-	DevicePoolDefinitions map[string][]string      `yaml:"devicepool_definitions"`
+	Region                string                   `yaml:"region"`
+	AssumeRoleArn         string                   `yaml:"assume_role_arn"`
+	DevicePoolDefinitions map[string][]string      `yaml:"-"`
+	DevicePoolRules       map[string][]DeviceRule  `yaml:"-"`
 	Defaults              BuildManifest            `yaml:"defaults"`
 	Branches              map[string]BuildManifest `yaml:"branches"`
+	BranchOrder           []string                 `yaml:"-"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler, splitting devicepool_definitions
+// into DevicePoolDefinitions and DevicePoolRules, and recording BranchOrder.
+func (config *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Config
+	if err := unmarshal((*plain)(config)); err != nil {
+		return err
+	}
+	pools := struct {
+		Definitions map[string]interface{} `yaml:"devicepool_definitions"`
+		Branches    yaml.MapSlice          `yaml:"branches"`
+	}{}
+	if err := unmarshal(&pools); err != nil {
+		return err
+	}
+	for _, item := range pools.Branches {
+		config.BranchOrder = append(config.BranchOrder, fmt.Sprint(item.Key))
+	}
+	for name, def := range pools.Definitions {
+		if rulesDef, ok := def.(map[interface{}]interface{}); ok {
+			rules, err := parseDeviceRules(rulesDef)
+			if err != nil {
+				return fmt.Errorf("DevicePool %s: %s", name, err)
+			}
+			if config.DevicePoolRules == nil {
+				config.DevicePoolRules = map[string][]DeviceRule{}
+			}
+			config.DevicePoolRules[name] = rules
+			continue
+		}
+		items, _ := def.([]interface{})
+		if def != nil && items == nil {
+			return errors.New("Invalid DevicePool definition: " + name)
+		}
+		devices := []string{}
+		for _, item := range items {
+			device, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("Invalid DevicePool item in %s: %v", name, item)
+			}
+			devices = append(devices, device)
+		}
+		if config.DevicePoolDefinitions == nil {
+			config.DevicePoolDefinitions = map[string][]string{}
+		}
+		config.DevicePoolDefinitions[name] = devices
+	}
+	return nil
 }
 
 // Creates a new Config from a YAML file.
@@ -158,11 +796,11 @@ func New(filename string) (*Config, error) {
 	}
 	// build steps are optional
 	if config.Defaults.Steps == nil {
-		config.Defaults.Steps = []string{}
+		config.Defaults.Steps = []BuildStep{}
 	}
 	for _, manifest := range config.Branches {
 		if manifest.Steps == nil {
-			manifest.Steps = []string{}
+			manifest.Steps = []BuildStep{}
 		}
 	}
 	valid, err := config.IsValid()
@@ -185,27 +823,195 @@ func (config *Config) IsValid() (bool, error) {
 	if !util.ArnRegexp.MatchString(config.ProjectArn) {
 		return false, fmt.Errorf("project_arn is required")
 	}
-	if len(config.DevicePoolDefinitions) == 0 {
+	if len(config.Region) > 0 && !util.RegionRegexp.MatchString(config.Region) {
+		return false, fmt.Errorf("Invalid region: %s", config.Region)
+	}
+	if len(config.AssumeRoleArn) > 0 && !util.ArnRegexp.MatchString(config.AssumeRoleArn) {
+		return false, fmt.Errorf("Invalid assume_role_arn: %s", config.AssumeRoleArn)
+	}
+	if len(config.DevicePoolDefinitions) == 0 && len(config.DevicePoolRules) == 0 {
 		return false, fmt.Errorf("devicepools must have at least one pool")
 	}
+	for name, rules := range config.DevicePoolRules {
+		if len(rules) == 0 {
+			return false, errors.New("DevicePool has no rules: " + name)
+		}
+	}
 	_, err := config.FlatDevicePoolDefinitions()
 	if err != nil {
 		return false, err
 	}
+	for _, key := range config.branchKeys() {
+		if _, err := newBranchPattern(key); err != nil {
+			return false, err
+		}
+	}
 	return true, nil
 }
 
+// AwsRegion returns the AWS region to use for Device Farm: the config's
+// Region if set, otherwise the region of the ProjectArn, and otherwise
+// util.DefaultRegion.
+func (config *Config) AwsRegion() string {
+	if len(config.Region) > 0 {
+		return config.Region
+	}
+	if arn, err := util.NewArn(config.ProjectArn); err == nil && len(arn.Region) > 0 {
+		return arn.Region
+	}
+	return util.DefaultRegion
+}
+
+// AwsPartition returns the AWS partition of the ProjectArn, or
+// util.DefaultPartition if the ARN is missing.
+func (config *Config) AwsPartition() string {
+	if arn, err := util.NewArn(config.ProjectArn); err == nil {
+		return arn.Partition
+	}
+	return util.DefaultPartition
+}
+
 // BranchManifest returns a BuildManifest for the given branch name, by starting
-// from the Defaults manifest (if any) and merging branch-specific overrides on
-// top of it.
+// from the Defaults manifest (if any) and merging each of the branch's
+// overrides (see BranchOverrides) on top of it.
 func (config *Config) BranchManifest(branch string) *BuildManifest {
 	manifest := MergeManifests(&BuildManifest{}, &config.Defaults)
-	if branchOverrides, ok := config.Branches[branch]; ok {
-		manifest = MergeManifests(manifest, &branchOverrides)
+	for _, key := range config.BranchOverrides(branch) {
+		overrides := config.Branches[key]
+		manifest = MergeManifests(manifest, &overrides)
 	}
 	return manifest
 }
 
+// BranchOverrides returns the keys of Branches which match the given branch,
+// in the order they are merged by BranchManifest, so later keys take
+// precedence. A key is either a branch name, a glob (see path.Match, so
+// "release/*" matches "release/1.0") or a regexp between slashes, e.g.
+// "/^hotfix-/". Regexps come first, with the first in the file taking
+// precedence, then globs from least to most specific (the one with the most
+// literal characters), and then an exact branch name. Keys which are not
+// valid patterns never match.
+func (config *Config) BranchOverrides(branch string) []string {
+	matches := []*branchPattern{}
+	for i, key := range config.branchKeys() {
+		pattern, err := newBranchPattern(key)
+		if err == nil && pattern.match(branch) {
+			pattern.index = i
+			matches = append(matches, pattern)
+		}
+	}
+	sort.Sort(branchPatternsByPrecedence(matches))
+	keys := []string{}
+	for _, pattern := range matches {
+		keys = append(keys, pattern.key)
+	}
+	return keys
+}
+
+// branchKeys returns the keys of Branches in file order, if known, and
+// otherwise sorted.
+func (config *Config) branchKeys() []string {
+	if len(config.BranchOrder) == len(config.Branches) {
+		return config.BranchOrder
+	}
+	keys := []string{}
+	for key := range config.Branches {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Kinds of branchPattern, from lowest to highest precedence.
+const (
+	branchPatternRegexp = iota
+	branchPatternGlob
+	branchPatternExact
+)
+
+// A branchPattern is a parsed key of Config.Branches. For globs, specificity
+// is the number of literal characters. Index is the key's position in the
+// file.
+type branchPattern struct {
+	key         string
+	kind        int
+	regexp      *regexp.Regexp
+	specificity int
+	index       int
+}
+
+func newBranchPattern(key string) (*branchPattern, error) {
+	pattern := &branchPattern{key: key, kind: branchPatternExact}
+	if len(key) > 1 && strings.HasPrefix(key, "/") && strings.HasSuffix(key, "/") {
+		re, err := regexp.Compile(key[1 : len(key)-1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid branch regexp %s: %s", key, err)
+		}
+		pattern.kind = branchPatternRegexp
+		pattern.regexp = re
+	} else if strings.ContainsAny(key, "*?[\\") {
+		if _, err := path.Match(key, ""); err != nil {
+			return nil, fmt.Errorf("Invalid branch pattern %s: %s", key, err)
+		}
+		pattern.kind = branchPatternGlob
+		pattern.specificity = globSpecificity(key)
+	}
+	return pattern, nil
+}
+
+func (pattern *branchPattern) match(branch string) bool {
+	switch pattern.kind {
+	case branchPatternRegexp:
+		return pattern.regexp.MatchString(branch)
+	case branchPatternGlob:
+		matched, _ := path.Match(pattern.key, branch)
+		return matched
+	}
+	return pattern.key == branch
+}
+
+// globSpecificity counts the characters of a glob which match only
+// themselves, ignoring wildcards and character classes.
+func globSpecificity(glob string) int {
+	count := 0
+	inClass := false
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case inClass:
+			inClass = c != ']'
+		case c == '[':
+			inClass = true
+		case c == '*' || c == '?':
+		case c == '\\':
+			i++
+			count++
+		default:
+			count++
+		}
+	}
+	return count
+}
+
+// branchPatternsByPrecedence sorts branchPatterns from lowest to highest
+// precedence.
+type branchPatternsByPrecedence []*branchPattern
+
+func (patterns branchPatternsByPrecedence) Len() int { return len(patterns) }
+func (patterns branchPatternsByPrecedence) Swap(i, j int) {
+	patterns[i], patterns[j] = patterns[j], patterns[i]
+}
+func (patterns branchPatternsByPrecedence) Less(i, j int) bool {
+	p1, p2 := patterns[i], patterns[j]
+	if p1.kind != p2.kind {
+		return p1.kind < p2.kind
+	}
+	if p1.specificity != p2.specificity {
+		return p1.specificity < p2.specificity
+	}
+	// the first in the file takes precedence, so it is merged last
+	return p1.index > p2.index
+}
+
 // FlatDevicePoolDefinitions returns a map of device pool definitions with the "+"
 // references flattened, so that each device pool is just a list of device names.
 // It also sorts each list of device names. It detects circular references or
@@ -239,6 +1045,9 @@ func (config *Config) FlatDevicePoolDefinitions() (map[string][]string, error) {
 			if string(item[0]) == "+" {
 				poolRef := item[1:]
 				refItems, ok := defs[poolRef]
+				if _, isRules := config.DevicePoolRules[poolRef]; isRules {
+					return nil, errors.New("Cannot include rule-based DevicePool " + poolRef + " in: " + name)
+				}
 				if !ok {
 					return nil, errors.New("DevicePool definition does not exist: " + poolRef)
 				}
@@ -253,9 +1062,31 @@ func (config *Config) FlatDevicePoolDefinitions() (map[string][]string, error) {
 	return flat, nil
 }
 
+// PoolRules returns the rules for the named DevicePool. The rules of a
+// rule-based pool are returned as-is, while a list of devices becomes a
+// single rule matching their ARNs.
+func (config *Config) PoolRules(name string) ([]DeviceRule, error) {
+	if rules, ok := config.DevicePoolRules[name]; ok {
+		return rules, nil
+	}
+	flatDefs, err := config.FlatDevicePoolDefinitions()
+	if err != nil {
+		return nil, err
+	}
+	devices, ok := flatDefs[name]
+	if !ok {
+		return nil, errors.New("Device Pool not defined: " + name)
+	}
+	arns, err := config.DeviceArns(devices)
+	if err != nil {
+		return nil, err
+	}
+	return []DeviceRule{{RuleAttributeArn, RuleOperatorIn, arns}}, nil
+}
+
 // DeviceArns takes a list of devices from a config file, and returns a list
-// of full ARNs.
-func DeviceArns(devices []string) ([]string, error) {
+// of full ARNs in the config's partition and region.
+func (config *Config) DeviceArns(devices []string) ([]string, error) {
 	itemRegexp := regexp.MustCompile("\\(arn=([^\\)]+)\\)\\s*(.+)\\s*")
 	parsed := []string{}
 	for _, item := range devices {
@@ -263,13 +1094,7 @@ func DeviceArns(devices []string) ([]string, error) {
 		if len(match) < 3 {
 			return nil, errors.New("Invalid device " + item)
 		}
-		arn := util.Arn{
-			Partition: "aws",
-			Service:   "devicefarm",
-			Region:    "us-west-2",
-			AccountId: "",
-			Resource:  match[1],
-		}
+		arn := util.DeviceArn(config.AwsPartition(), config.AwsRegion(), match[1])
 		parsed = append(parsed, arn.String())
 	}
 	return parsed, nil
@@ -2,26 +2,37 @@ package config
 
 import (
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
 	"testing"
+	"time"
 )
 
+// steps returns plain build steps for the given commands
+func steps(commands ...string) []BuildStep {
+	list := []BuildStep{}
+	for _, command := range commands {
+		list = append(list, BuildStep{Run: command})
+	}
+	return list
+}
+
 func TestMergeManifests(t *testing.T) {
 	assert := assert.New(t)
 
 	// a complete manifest
 	m1 := BuildManifest{
-		Steps:      []string{"foo", "bar"},
+		Steps:      steps("foo", "bar"),
 		Android:    AndroidConfig{"foo", "bar"},
 		DevicePool: "foo",
 	}
 
 	// m2 should override only Steps
 	m2 := BuildManifest{
-		Steps: []string{"bar", "foo"},
+		Steps: steps("bar", "foo"),
 	}
 	merged := MergeManifests(&m1, &m2)
 	assert.Equal(BuildManifest{
-		Steps:      []string{"bar", "foo"},
+		Steps:      steps("bar", "foo"),
 		Android:    AndroidConfig{"foo", "bar"},
 		DevicePool: "foo",
 	}, *merged)
@@ -35,7 +46,7 @@ func TestMergeManifests(t *testing.T) {
 	}
 	merged = MergeManifests(&m1, &m3)
 	assert.Equal(BuildManifest{
-		Steps:      []string{"foo", "bar"},
+		Steps:      steps("foo", "bar"),
 		Android:    AndroidConfig{"bar", "bar"},
 		DevicePool: "foo",
 	}, *merged)
@@ -49,7 +60,7 @@ func TestMergeManifests(t *testing.T) {
 	}
 	merged = MergeManifests(&m1, &m4)
 	assert.Equal(BuildManifest{
-		Steps:      []string{"foo", "bar"},
+		Steps:      steps("foo", "bar"),
 		Android:    AndroidConfig{"foo", "bar"},
 		DevicePool: "bar",
 	}, *merged)
@@ -58,12 +69,266 @@ func TestMergeManifests(t *testing.T) {
 	assert.Equal(m1, *merged)
 }
 
+func TestMergeManifestsShell(t *testing.T) {
+	assert := assert.New(t)
+
+	m1 := BuildManifest{Steps: steps("foo"), Shell: "bash -c"}
+	m2 := BuildManifest{Shell: "zsh -c"}
+
+	// m2 should override only Shell
+	merged := MergeManifests(&m1, &m2)
+	assert.Equal(BuildManifest{Steps: steps("foo"), Shell: "zsh -c"}, *merged)
+
+	// a blank Shell should not override
+	merged = MergeManifests(&m1, &BuildManifest{})
+	assert.Equal("bash -c", merged.Shell)
+}
+
+func TestMergeManifestsRunName(t *testing.T) {
+	assert := assert.New(t)
+
+	m1 := BuildManifest{RunName: "{{.Branch}}", DevicePool: "foo"}
+
+	// a RunName should override, and a blank one should not
+	merged := MergeManifests(&m1, &BuildManifest{RunName: "{{.SHA}}"})
+	assert.Equal(BuildManifest{RunName: "{{.SHA}}", DevicePool: "foo"}, *merged)
+	merged = MergeManifests(&m1, &BuildManifest{})
+	assert.Equal("{{.Branch}}", merged.RunName)
+
+	// an invalid template should not be runnable
+	manifest := BuildManifest{
+		RunName:    "{{.Branch",
+		Android:    AndroidConfig{Apk: "app.apk", ApkInstrumentation: "tests.apk"},
+		DevicePool: "foo",
+	}
+	runnable, err := manifest.IsRunnable()
+	assert.False(runnable)
+	assert.Contains(err.Error(), "Invalid run_name")
+	manifest.RunName = "{{.Branch}}"
+	runnable, err = manifest.IsRunnable()
+	assert.True(runnable)
+	assert.Nil(err)
+}
+
+func TestMergeManifestsIOS(t *testing.T) {
+	assert := assert.New(t)
+
+	m1 := BuildManifest{
+		IOS:        IOSConfig{"foo.ipa", "foo.zip", IOSTestTypeXCTest},
+		DevicePool: "foo",
+	}
+
+	// m2 should override only IOS.TestType
+	m2 := BuildManifest{
+		IOS: IOSConfig{TestType: IOSTestTypeXCTestUI},
+	}
+	merged := MergeManifests(&m1, &m2)
+	assert.Equal(BuildManifest{
+		IOS:        IOSConfig{"foo.ipa", "foo.zip", IOSTestTypeXCTestUI},
+		DevicePool: "foo",
+	}, *merged)
+	// m1 should override everything in m2
+	merged = MergeManifests(&m2, &m1)
+	assert.Equal(m1, *merged)
+}
+
+func TestMergeManifestsAppium(t *testing.T) {
+	assert := assert.New(t)
+
+	web := true
+	native := false
+	m1 := BuildManifest{
+		Android:    AndroidConfig{Apk: "foo.apk"},
+		Appium:     AppiumConfig{AppiumFlavorJavaJUnit, "foo.zip", &native},
+		DevicePool: "foo",
+	}
+
+	// m2 should override only Appium.Web
+	m2 := BuildManifest{
+		Appium: AppiumConfig{Web: &web},
+	}
+	merged := MergeManifests(&m1, &m2)
+	assert.Equal(BuildManifest{
+		Android:    AndroidConfig{Apk: "foo.apk"},
+		Appium:     AppiumConfig{AppiumFlavorJavaJUnit, "foo.zip", &web},
+		DevicePool: "foo",
+	}, *merged)
+	// m1 should override everything in m2
+	merged = MergeManifests(&m2, &m1)
+	assert.Equal(m1, *merged)
+}
+
+func TestBuildManifestIsRunnableAppium(t *testing.T) {
+	assert := assert.New(t)
+
+	web := true
+
+	// appium tests against an apk, should be runnable
+	m1 := BuildManifest{
+		Android:    AndroidConfig{Apk: "foo.apk"},
+		Appium:     AppiumConfig{Flavor: AppiumFlavorPython, TestPackage: "foo.zip"},
+		DevicePool: "foo",
+	}
+	runnable, err := m1.IsRunnable()
+	assert.True(runnable)
+	assert.Nil(err)
+	assert.Equal(PlatformAndroid, m1.Platform())
+
+	// appium tests against an ipa, should be runnable
+	m2 := BuildManifest{
+		IOS:        IOSConfig{Ipa: "foo.ipa"},
+		Appium:     AppiumConfig{Flavor: AppiumFlavorJavaTestNG, TestPackage: "foo.zip"},
+		DevicePool: "foo",
+	}
+	runnable, err = m2.IsRunnable()
+	assert.True(runnable)
+	assert.Nil(err)
+	assert.Equal(PlatformIOS, m2.Platform())
+
+	// appium web tests without an app, should be runnable
+	m3 := BuildManifest{
+		Appium:     AppiumConfig{AppiumFlavorJavaJUnit, "foo.zip", &web},
+		DevicePool: "foo",
+	}
+	runnable, err = m3.IsRunnable()
+	assert.True(runnable)
+	assert.Nil(err)
+	assert.Equal("", m3.Platform())
+
+	// appium tests without an app, should NOT be runnable
+	m4 := BuildManifest{
+		Appium:     AppiumConfig{Flavor: AppiumFlavorJavaJUnit, TestPackage: "foo.zip"},
+		DevicePool: "foo",
+	}
+	runnable, err = m4.IsRunnable()
+	assert.False(runnable)
+	assert.NotNil(err)
+
+	// invalid flavor, should NOT be runnable
+	m5 := BuildManifest{
+		Android:    AndroidConfig{Apk: "foo.apk"},
+		Appium:     AppiumConfig{Flavor: "ruby", TestPackage: "foo.zip"},
+		DevicePool: "foo",
+	}
+	runnable, err = m5.IsRunnable()
+	assert.False(runnable)
+	assert.NotNil(err)
+
+	// missing test package, should NOT be runnable
+	m6 := BuildManifest{
+		Android:    AndroidConfig{Apk: "foo.apk"},
+		Appium:     AppiumConfig{Flavor: AppiumFlavorPython},
+		DevicePool: "foo",
+	}
+	runnable, err = m6.IsRunnable()
+	assert.False(runnable)
+	assert.NotNil(err)
+}
+
+func TestMergeManifestsBuiltin(t *testing.T) {
+	assert := assert.New(t)
+
+	m1 := BuildManifest{
+		Android:    AndroidConfig{Apk: "foo.apk"},
+		Builtin:    BuiltinConfig{BuiltinTypeFuzz, 100, 50, 1234, "", ""},
+		DevicePool: "foo",
+	}
+
+	// m2 should override only Builtin.EventCount
+	m2 := BuildManifest{
+		Builtin: BuiltinConfig{EventCount: 200},
+	}
+	merged := MergeManifests(&m1, &m2)
+	assert.Equal(BuildManifest{
+		Android:    AndroidConfig{Apk: "foo.apk"},
+		Builtin:    BuiltinConfig{BuiltinTypeFuzz, 200, 50, 1234, "", ""},
+		DevicePool: "foo",
+	}, *merged)
+	// m1 should override everything in m2
+	merged = MergeManifests(&m2, &m1)
+	assert.Equal(m1, *merged)
+}
+
+func TestBuildManifestIsRunnableBuiltin(t *testing.T) {
+	assert := assert.New(t)
+
+	// fuzz tests with only an apk, should be runnable
+	m1 := BuildManifest{
+		Android:    AndroidConfig{Apk: "foo.apk"},
+		Builtin:    BuiltinConfig{Type: BuiltinTypeFuzz, EventCount: 100},
+		DevicePool: "foo",
+	}
+	runnable, err := m1.IsRunnable()
+	assert.True(runnable)
+	assert.Nil(err)
+
+	// fuzz tests with only an ipa, should be runnable
+	m2 := BuildManifest{
+		IOS:        IOSConfig{Ipa: "foo.ipa"},
+		Builtin:    BuiltinConfig{Type: BuiltinTypeFuzz},
+		DevicePool: "foo",
+	}
+	runnable, err = m2.IsRunnable()
+	assert.True(runnable)
+	assert.Nil(err)
+
+	// explorer tests with only an apk, should be runnable
+	m3 := BuildManifest{
+		Android:    AndroidConfig{Apk: "foo.apk"},
+		Builtin:    BuiltinConfig{Type: BuiltinTypeExplorer, Username: "foo", Password: "bar"},
+		DevicePool: "foo",
+	}
+	runnable, err = m3.IsRunnable()
+	assert.True(runnable)
+	assert.Nil(err)
+
+	// explorer tests with an ipa, should NOT be runnable
+	m4 := BuildManifest{
+		IOS:        IOSConfig{Ipa: "foo.ipa"},
+		Builtin:    BuiltinConfig{Type: BuiltinTypeExplorer},
+		DevicePool: "foo",
+	}
+	runnable, err = m4.IsRunnable()
+	assert.False(runnable)
+	assert.NotNil(err)
+
+	// invalid type, should NOT be runnable
+	m5 := BuildManifest{
+		Android:    AndroidConfig{Apk: "foo.apk"},
+		Builtin:    BuiltinConfig{Type: "foo"},
+		DevicePool: "foo",
+	}
+	runnable, err = m5.IsRunnable()
+	assert.False(runnable)
+	assert.NotNil(err)
+
+	// event_count out of range, should NOT be runnable
+	m6 := BuildManifest{
+		Android:    AndroidConfig{Apk: "foo.apk"},
+		Builtin:    BuiltinConfig{Type: BuiltinTypeFuzz, EventCount: 10001},
+		DevicePool: "foo",
+	}
+	runnable, err = m6.IsRunnable()
+	assert.False(runnable)
+	assert.NotNil(err)
+
+	// event_throttle out of range, should NOT be runnable
+	m7 := BuildManifest{
+		Android:    AndroidConfig{Apk: "foo.apk"},
+		Builtin:    BuiltinConfig{Type: BuiltinTypeFuzz, EventThrottle: -1},
+		DevicePool: "foo",
+	}
+	runnable, err = m7.IsRunnable()
+	assert.False(runnable)
+	assert.NotNil(err)
+}
+
 func TestBuildManifestIsRunnable(t *testing.T) {
 	assert := assert.New(t)
 
 	// a complete manifest, should be runnable
 	m1 := BuildManifest{
-		Steps:      []string{"foo", "bar"},
+		Steps:      steps("foo", "bar"),
 		Android:    AndroidConfig{"foo", "bar"},
 		DevicePool: "foo",
 	}
@@ -73,7 +338,7 @@ func TestBuildManifestIsRunnable(t *testing.T) {
 
 	// a complete manifest missing build steps, should be runnable
 	m2 := BuildManifest{
-		Steps:      []string{},
+		Steps:      steps(),
 		Android:    AndroidConfig{"foo", "bar"},
 		DevicePool: "foo",
 	}
@@ -83,7 +348,7 @@ func TestBuildManifestIsRunnable(t *testing.T) {
 
 	// missing Android.Apk, should NOT be runnable
 	m3 := BuildManifest{
-		Steps:      []string{"foo", "bar"},
+		Steps:      steps("foo", "bar"),
 		Android:    AndroidConfig{ApkInstrumentation: "bar"},
 		DevicePool: "foo",
 	}
@@ -93,13 +358,52 @@ func TestBuildManifestIsRunnable(t *testing.T) {
 
 	// missing a device pool, should NOT be runnable
 	m4 := BuildManifest{
-		Steps:      []string{"foo", "bar"},
+		Steps:      steps("foo", "bar"),
 		Android:    AndroidConfig{"foo", "bar"},
 		DevicePool: "",
 	}
 	runnable, err = m4.IsRunnable()
 	assert.False(runnable)
 	assert.NotNil(err)
+
+	// a complete iOS manifest, should be runnable
+	m5 := BuildManifest{
+		IOS:        IOSConfig{Ipa: "foo.ipa", XCTestPackage: "foo.zip"},
+		DevicePool: "foo",
+	}
+	runnable, err = m5.IsRunnable()
+	assert.True(runnable)
+	assert.Nil(err)
+	assert.Equal(PlatformIOS, m5.Platform())
+	assert.Equal(PlatformAndroid, m1.Platform())
+
+	// missing IOS.XCTestPackage, should NOT be runnable
+	m6 := BuildManifest{
+		IOS:        IOSConfig{Ipa: "foo.ipa"},
+		DevicePool: "foo",
+	}
+	runnable, err = m6.IsRunnable()
+	assert.False(runnable)
+	assert.NotNil(err)
+
+	// invalid IOS.TestType, should NOT be runnable
+	m7 := BuildManifest{
+		IOS:        IOSConfig{"foo.ipa", "foo.zip", "foo"},
+		DevicePool: "foo",
+	}
+	runnable, err = m7.IsRunnable()
+	assert.False(runnable)
+	assert.NotNil(err)
+
+	// both android and ios, should NOT be runnable
+	m8 := BuildManifest{
+		Android:    AndroidConfig{"foo", "bar"},
+		IOS:        IOSConfig{"foo.ipa", "foo.zip", IOSTestTypeXCTestUI},
+		DevicePool: "foo",
+	}
+	runnable, err = m8.IsRunnable()
+	assert.False(runnable)
+	assert.NotNil(err)
 }
 
 func TestNew(t *testing.T) {
@@ -149,7 +453,7 @@ func TestNew(t *testing.T) {
 		},
 	}
 	defaultBuild := BuildManifest{
-		Steps: []string{"echo \"Foo\"", "echo \"Bar\""},
+		Steps: steps("echo \"Foo\"", "echo \"Bar\""),
 		Android: AndroidConfig{
 			Apk:                "./path/to/build.apk",
 			ApkInstrumentation: "./path/to/instrumentation.apk",
@@ -164,6 +468,7 @@ func TestNew(t *testing.T) {
 		DevicePoolDefinitions: devicePoolDefs,
 		Defaults:              defaultBuild,
 		Branches:              map[string]BuildManifest{"master": masterBuild},
+		BranchOrder:           []string{"master"},
 	}
 
 	// config from the file should match the expected config
@@ -173,7 +478,7 @@ func TestNew(t *testing.T) {
 	config, err = New("testdata/config_nobuild.yml")
 	assert.Nil(err)
 
-	expected.Defaults.Steps = []string{}
+	expected.Defaults.Steps = []BuildStep{}
 	assert.Equal(expected, *config)
 }
 
@@ -201,6 +506,138 @@ func TestNewInvalid(t *testing.T) {
 	assert.Nil(config)
 }
 
+func TestNewSteps(t *testing.T) {
+	assert := assert.New(t)
+
+	// steps may be plain commands or have options
+	config, err := New("testdata/config_steps.yml")
+	assert.Nil(err)
+	assert.Equal([]BuildStep{
+		{Run: "./gradlew clean"},
+		{
+			Run:     "./gradlew assembleDebug assembleAndroidTest",
+			Dir:     "android",
+			Env:     map[string]string{"JAVA_HOME": "/opt/jdk8"},
+			Timeout: 20 * time.Minute,
+			Retries: 2,
+		},
+		{Run: "./upload-mapping.sh", ContinueOnError: true},
+	}, config.Defaults.Steps)
+
+	// env should be merged for each branch
+	assert.Equal(map[string]string{"GRADLE_OPTS": "-Xmx2g", "FLAVOR": "release"}, config.BranchManifest("master").Env)
+	assert.Equal(map[string]string{"GRADLE_OPTS": "-Xmx2g", "FLAVOR": "debug"}, config.BranchManifest("foo").Env)
+	assert.Equal(3, len(config.BranchManifest("master").Steps))
+}
+
+func TestBuildStepIsValid(t *testing.T) {
+	assert := assert.New(t)
+
+	valid, err := (&BuildStep{Run: "echo foo", Timeout: time.Second, Retries: 1}).IsValid()
+	assert.True(valid)
+	assert.Nil(err)
+
+	for _, step := range []BuildStep{
+		{},
+		{Run: "  "},
+		{Run: "echo foo", Timeout: -time.Second},
+		{Run: "echo foo", Retries: -1},
+	} {
+		valid, err = step.IsValid()
+		assert.False(valid)
+		assert.NotNil(err)
+	}
+
+	// a manifest with an invalid step cannot be run
+	manifest := &BuildManifest{
+		Steps:      []BuildStep{{Run: "echo foo"}, {Dir: "android"}},
+		Android:    AndroidConfig{"foo", "bar"},
+		DevicePool: "foo",
+	}
+	valid, err = manifest.IsRunnable()
+	assert.False(valid)
+	assert.NotNil(err)
+}
+
+func TestNewRules(t *testing.T) {
+	assert := assert.New(t)
+
+	// a valid config with both kinds of device pools
+	config, err := New("testdata/config_rules.yml")
+	assert.Nil(err)
+	assert.Equal(map[string][]string{
+		"samsung_s3": {"(arn=device:50E24178F2274CFFA577EF130440D066) Samsung Galaxy S3 (AT&T)"},
+	}, config.DevicePoolDefinitions)
+	assert.Equal(map[string][]DeviceRule{
+		"modern_samsung_phones": {
+			{RuleAttributeFormFactor, RuleOperatorEquals, []string{"PHONE"}},
+			{RuleAttributeManufacturer, RuleOperatorEquals, []string{"Samsung"}},
+			{RuleAttributeOSVersion, RuleOperatorGreaterThanOrEquals, []string{"5.0"}},
+			{RuleAttributePlatform, RuleOperatorEquals, []string{"ANDROID"}},
+		},
+		"not_samsung": {
+			{RuleAttributeManufacturer, RuleOperatorNotIn, []string{"Samsung"}},
+			{RuleAttributeOSVersion, RuleOperatorGreaterThan, []string{"4.4"}},
+			{RuleAttributeOSVersion, RuleOperatorLessThan, []string{"7"}},
+		},
+		"any_tablet": {
+			{RuleAttributeFormFactor, RuleOperatorEquals, []string{"TABLET"}},
+			{RuleAttributePlatform, RuleOperatorIn, []string{"ANDROID", "IOS"}},
+		},
+	}, config.DevicePoolRules)
+
+	// invalid because of an unknown rule attribute
+	config, err = New("testdata/config_badrules.yml")
+	assert.NotNil(err)
+	assert.Nil(config)
+}
+
+func TestParseDeviceRules(t *testing.T) {
+	assert := assert.New(t)
+
+	// should parse comparison prefixes
+	rules, err := parseDeviceRules(map[interface{}]interface{}{
+		"os":           "< 6",
+		"manufacturer": "!= LG",
+		"platform":     "= IOS",
+	})
+	assert.Nil(err)
+	assert.Equal([]DeviceRule{
+		{RuleAttributeManufacturer, RuleOperatorNotIn, []string{"LG"}},
+		{RuleAttributeOSVersion, RuleOperatorLessThan, []string{"6"}},
+		{RuleAttributePlatform, RuleOperatorEquals, []string{"IOS"}},
+	}, rules)
+
+	// should fail because of bad values or operators
+	bad := []interface{}{
+		nil,
+		"",
+		">=",
+		[]interface{}{},
+		[]interface{}{"Samsung", []interface{}{"LG"}},
+		map[interface{}]interface{}{"about": "Samsung"},
+		map[interface{}]interface{}{"equals": []interface{}{"Samsung", "LG"}},
+	}
+	for _, value := range bad {
+		rules, err = parseDeviceRules(map[interface{}]interface{}{"manufacturer": value})
+		assert.NotNil(err, "%v", value)
+		assert.Nil(rules)
+	}
+}
+
+func TestDeviceRuleValue(t *testing.T) {
+	assert := assert.New(t)
+
+	rule := DeviceRule{RuleAttributeManufacturer, RuleOperatorIn, []string{"Samsung", "LG"}}
+	assert.Equal(`["Samsung","LG"]`, rule.Value())
+
+	rule = DeviceRule{RuleAttributeManufacturer, RuleOperatorNotIn, []string{"Samsung"}}
+	assert.Equal(`["Samsung"]`, rule.Value())
+
+	rule = DeviceRule{RuleAttributeOSVersion, RuleOperatorGreaterThan, []string{"5.0"}}
+	assert.Equal(`"5.0"`, rule.Value())
+}
+
 func TestConfigIsValid(t *testing.T) {
 	assert := assert.New(t)
 
@@ -235,6 +672,31 @@ func TestConfigIsValid(t *testing.T) {
 	ok, err = c5.IsValid()
 	assert.False(ok)
 	assert.NotNil(err)
+
+	// invalid due to a bad region
+	c8 := Config{ProjectArn: arn, Region: "the moon", DevicePoolDefinitions: map[string][]string{"foo": {"bar"}}}
+	ok, err = c8.IsValid()
+	assert.False(ok)
+	assert.NotNil(err)
+
+	// invalid due to a bad role ARN
+	c9 := Config{ProjectArn: arn, AssumeRoleArn: "role", DevicePoolDefinitions: map[string][]string{"foo": {"bar"}}}
+	ok, err = c9.IsValid()
+	assert.False(ok)
+	assert.NotNil(err)
+
+	// a valid config with only rule-based pools
+	rules := []DeviceRule{{RuleAttributePlatform, RuleOperatorEquals, []string{"IOS"}}}
+	c6 := Config{ProjectArn: arn, DevicePoolRules: map[string][]DeviceRule{"foo": rules}}
+	ok, err = c6.IsValid()
+	assert.True(ok)
+	assert.Nil(err)
+
+	// invalid due to a rule-based pool with no rules
+	c7 := Config{ProjectArn: arn, DevicePoolRules: map[string][]DeviceRule{"foo": {}}}
+	ok, err = c7.IsValid()
+	assert.False(ok)
+	assert.NotNil(err)
 }
 
 func TestConfigBranchManifest(t *testing.T) {
@@ -245,7 +707,7 @@ func TestConfigBranchManifest(t *testing.T) {
 
 	// build the expected manifest
 	masterManifest := BuildManifest{
-		Steps: []string{"echo \"Foo\"", "echo \"Bar\""},
+		Steps: steps("echo \"Foo\"", "echo \"Bar\""),
 		Android: AndroidConfig{
 			Apk:                "./path/to/build.apk",
 			ApkInstrumentation: "./path/to/instrumentation.apk",
@@ -255,6 +717,98 @@ func TestConfigBranchManifest(t *testing.T) {
 	assert.Equal(masterManifest, *config.BranchManifest("master"))
 }
 
+func TestConfigBranchOverrides(t *testing.T) {
+	assert := assert.New(t)
+
+	config, err := New("testdata/config_branches.yml")
+	assert.Nil(err)
+	assert.Equal([]string{"/^release/", "/-rc$/", "release/*", "release/1.*", "release/1.0"}, config.BranchOrder)
+
+	// an exact name should take precedence over globs, the more specific
+	// glob over the less specific one, and globs over regexps
+	assert.Equal([]string{"/^release/", "release/*", "release/1.*", "release/1.0"}, config.BranchOverrides("release/1.0"))
+	manifest := config.BranchManifest("release/1.0")
+	assert.Equal("exact", manifest.DevicePool)
+	assert.Equal("bash -c", manifest.Shell)
+	assert.Equal(map[string]string{"FROM_REGEXP": "1", "FROM_GLOB": "1"}, manifest.Env)
+	assert.Equal(steps("./gradlew assemble"), manifest.Steps)
+
+	// the first regexp in the file should take precedence
+	assert.Equal([]string{"/-rc$/", "/^release/", "release/*", "release/1.*"}, config.BranchOverrides("release/1.1-rc"))
+	manifest = config.BranchManifest("release/1.1-rc")
+	assert.Equal("release1", manifest.DevicePool)
+	assert.Equal("bash -c", manifest.Shell)
+
+	// globs should not match across slashes
+	assert.Equal([]string{"/^release/"}, config.BranchOverrides("release/2.0/hotfix"))
+	assert.Equal("everything", config.BranchManifest("release/2.0/hotfix").DevicePool)
+
+	// no overrides
+	assert.Equal([]string{}, config.BranchOverrides("master"))
+	assert.Equal("everything", config.BranchManifest("master").DevicePool)
+
+	// without BranchOrder, keys should be sorted
+	config.BranchOrder = nil
+	assert.Equal([]string{"/^release/", "/-rc$/", "release/*", "release/1.*"}, config.BranchOverrides("release/1.1-rc"))
+}
+
+func TestConfigIsValidBranches(t *testing.T) {
+	assert := assert.New(t)
+
+	arn := "arn:aws:devicefarm:us-west-2:026109802893:project:1124416c-bfb2-4334-817c-e211ecef7dc0"
+	pools := map[string][]string{"foo": {"bar"}}
+
+	// valid branch keys
+	config := Config{ProjectArn: arn, DevicePoolDefinitions: pools, Branches: map[string]BuildManifest{
+		"master": {}, "release/*": {}, "feature/[a-z]?*": {}, "/^hotfix-[0-9]+$/": {},
+	}}
+	ok, err := config.IsValid()
+	assert.True(ok)
+	assert.Nil(err)
+
+	// invalid regexp
+	config.Branches = map[string]BuildManifest{"/hotfix-(/": {}}
+	ok, err = config.IsValid()
+	assert.False(ok)
+	assert.Equal("Invalid branch regexp /hotfix-(/: error parsing regexp: missing closing ): `hotfix-(`", err.Error())
+
+	// invalid glob
+	config.Branches = map[string]BuildManifest{"release/[": {}}
+	ok, err = config.IsValid()
+	assert.False(ok)
+	assert.Equal("Invalid branch pattern release/[: syntax error in pattern", err.Error())
+}
+
+func TestGlobSpecificity(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(8, globSpecificity("release/*"))
+	assert.Equal(10, globSpecificity("release/1.*"))
+	assert.Equal(8, globSpecificity("release/[0-9]*"))
+	assert.Equal(2, globSpecificity("a\\*"))
+}
+
+func TestBuildManifestMarshalYAML(t *testing.T) {
+	assert := assert.New(t)
+
+	// steps without options should be written as plain commands, and empty
+	// fields should be left out
+	manifest := BuildManifest{
+		Steps: []BuildStep{
+			{Run: "./gradlew clean"},
+			{Run: "./gradlew assemble", Dir: "android", Timeout: 20 * time.Minute},
+		},
+		DevicePool: "everything",
+	}
+	out, err := yaml.Marshal(&manifest)
+	assert.Nil(err)
+	assert.Equal("build:\n- ./gradlew clean\n- run: ./gradlew assemble\n  dir: android\n  timeout: 20m0s\ndevicepool: everything\n", string(out))
+
+	// and read back the same
+	parsed := BuildManifest{}
+	assert.Nil(yaml.Unmarshal(out, &parsed))
+	assert.Equal(manifest, parsed)
+}
+
 func TestFlatDevicePoolDefinitions(t *testing.T) {
 	assert := assert.New(t)
 
@@ -288,14 +842,58 @@ func TestFlatDevicePoolDefinitions(t *testing.T) {
 	config = Config{DevicePoolDefinitions: defs}
 	flat, err = config.FlatDevicePoolDefinitions()
 	assert.NotNil(err)
+
+	// should fail because "pool3" is rule-based
+	config.DevicePoolRules = map[string][]DeviceRule{
+		"pool3": {{RuleAttributePlatform, RuleOperatorEquals, []string{"IOS"}}},
+	}
+	flat, err = config.FlatDevicePoolDefinitions()
+	assert.NotNil(err)
+	assert.Nil(flat)
+}
+
+func TestConfigPoolRules(t *testing.T) {
+	assert := assert.New(t)
+
+	iosRules := []DeviceRule{{RuleAttributePlatform, RuleOperatorEquals, []string{"IOS"}}}
+	config := Config{
+		DevicePoolDefinitions: map[string][]string{
+			"list": {"(arn=device:FOO) Foo"},
+			"bad":  {"foo"},
+		},
+		DevicePoolRules: map[string][]DeviceRule{"rules": iosRules},
+	}
+
+	// a list of devices should become a single ARN rule
+	rules, err := config.PoolRules("list")
+	assert.Nil(err)
+	assert.Equal([]DeviceRule{
+		{RuleAttributeArn, RuleOperatorIn, []string{"arn:aws:devicefarm:us-west-2::device:FOO"}},
+	}, rules)
+
+	// rules should be returned as-is
+	rules, err = config.PoolRules("rules")
+	assert.Nil(err)
+	assert.Equal(iosRules, rules)
+
+	// should fail because of an invalid device
+	rules, err = config.PoolRules("bad")
+	assert.NotNil(err)
+	assert.Nil(rules)
+
+	// should fail because the pool does not exist
+	rules, err = config.PoolRules("missing")
+	assert.NotNil(err)
+	assert.Nil(rules)
 }
 
 func TestDeviceArns(t *testing.T) {
 	assert := assert.New(t)
+	config := Config{}
 
 	// should fail because invalid format
 	devices := []string{"foo"}
-	parsed, err := DeviceArns(devices)
+	parsed, err := config.DeviceArns(devices)
 	assert.NotNil(err)
 	assert.Nil(parsed)
 
@@ -303,9 +901,36 @@ func TestDeviceArns(t *testing.T) {
 	devices = []string{
 		"(arn=device:50E24178F2274CFFA577EF130440D066) Samsung Galaxy S3 (AT&T)",
 	}
-	parsed, err = DeviceArns(devices)
+	parsed, err = config.DeviceArns(devices)
 	assert.Nil(err)
 	assert.Equal([]string{
 		"arn:aws:devicefarm:us-west-2::device:50E24178F2274CFFA577EF130440D066",
 	}, parsed)
+
+	// should use the config's partition and region
+	config = Config{ProjectArn: "arn:aws-cn:devicefarm:cn-north-1:026109802893:project:1124416c"}
+	parsed, err = config.DeviceArns(devices)
+	assert.Nil(err)
+	assert.Equal([]string{
+		"arn:aws-cn:devicefarm:cn-north-1::device:50E24178F2274CFFA577EF130440D066",
+	}, parsed)
+}
+
+func TestConfigAwsRegion(t *testing.T) {
+	assert := assert.New(t)
+
+	// should default when there is no project ARN
+	config := Config{}
+	assert.Equal("us-west-2", config.AwsRegion())
+	assert.Equal("aws", config.AwsPartition())
+
+	// should use the project ARN
+	config.ProjectArn = "arn:aws-cn:devicefarm:cn-north-1:026109802893:project:1124416c"
+	assert.Equal("cn-north-1", config.AwsRegion())
+	assert.Equal("aws-cn", config.AwsPartition())
+
+	// should prefer the region from the config
+	config.Region = "cn-northwest-1"
+	assert.Equal("cn-northwest-1", config.AwsRegion())
+	assert.Equal("aws-cn", config.AwsPartition())
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/devicefarm"
+	"github.com/codegangsta/cli"
+	"github.com/ride/devicefarm/awsutil"
+	"github.com/ride/devicefarm/results"
+	"github.com/ride/devicefarm/util"
+)
+
+// diffCommand returns the `diff` command.
+func diffCommand(buildFlags []cli.Flag) cli.Command {
+	return cli.Command{
+		Name:      "diff",
+		Usage:     "Compare the tests of two runs, showing which are newly failing, still failing, newly passing, added or removed",
+		ArgsUsage: "<base-run> <head-run>",
+		Action:    commandDiff,
+		Flags: append([]cli.Flag{
+			cli.StringFlag{
+				Name:  "base-branch",
+				Usage: "Compare with the latest completed run of this branch, instead of a base run argument",
+			},
+			cli.StringFlag{
+				Name:  "format",
+				Usage: "Output format: table, json or markdown",
+				Value: "table",
+			},
+		}, buildFlags...),
+	}
+}
+
+func commandDiff(c *cli.Context) {
+	usage := "Usage: devicefarm diff <base-run> <head-run>, or devicefarm diff --base-branch <branch> [head-run]"
+	format := c.String("format")
+	if format != "table" && format != "json" && format != "markdown" {
+		log.Fatalln("Unknown format: " + format)
+	}
+	var baseArn, headArn string
+	if branch := c.String("base-branch"); len(branch) > 0 {
+		if c.NArg() > 1 {
+			log.Fatalln(usage)
+		}
+		head := "latest"
+		if c.NArg() == 1 {
+			head = c.Args()[0]
+		}
+		headArn = getRunArn(c, head)
+		var err error
+		baseArn, err = findBaseRun(c, branch, headArn)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	} else {
+		if c.NArg() != 2 {
+			log.Fatalln(usage)
+		}
+		baseArn = getRunArn(c, c.Args()[0])
+		headArn = getRunArn(c, c.Args()[1])
+	}
+	client := getClient(c)
+	head, err := client.RunResults(ctx, headArn)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	diff, err := diffRuns(client, baseArn, head)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	switch format {
+	case "json":
+		printJSON(diff)
+	case "markdown":
+		err = results.WriteDiffMarkdown(util.LogWriter(log), diff)
+	default:
+		err = results.WriteDiffTable(util.LogWriter(log), diff)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// findBaseRun returns the ARN of the latest completed run of a branch, other
+// than the head run.
+func findBaseRun(c *cli.Context, branch, headArn string) (string, error) {
+	b := getBuild(c)
+	runs, err := getClient(c).ListRuns(ctx, b.Config.ProjectArn)
+	if err != nil {
+		return "", err
+	}
+	completed := []*devicefarm.Run{}
+	for _, run := range runs {
+		if aws.StringValue(run.Status) == devicefarm.ExecutionStatusCompleted && aws.StringValue(run.Arn) != headArn {
+			completed = append(completed, run)
+		}
+	}
+	run := b.LatestBranchRun(completed, branch)
+	if run == nil {
+		return "", fmt.Errorf("No completed runs found for branch %s", branch)
+	}
+	return aws.StringValue(run.Arn), nil
+}
+
+// diffRuns compares the results of a head run with those of the base run.
+func diffRuns(client *awsutil.DeviceFarm, baseArn string, head *results.Run) (*results.RunDiff, error) {
+	base, err := client.RunResults(ctx, baseArn)
+	if err != nil {
+		return nil, err
+	}
+	return results.Diff(base, head), nil
+}
+
+// regressionExitCode returns the exit code for a run which did not pass when
+// using --fail-on-regression. This is 0 if the run's failures were all
+// failing in the latest completed run of the --base-branch too, and
+// otherwise the exit code of the run's result. If there is no base run, or
+// the run failed without any failing tests (e.g. a device failed to set up),
+// the run's result decides. The head results are nil if they could not be
+// fetched, in which case the run's result decides as well.
+func regressionExitCode(c *cli.Context, client *awsutil.DeviceFarm, head *results.Run, result string) int {
+	code := awsutil.ResultExitCode(result)
+	if head == nil || (result != devicefarm.ExecutionResultFailed && result != devicefarm.ExecutionResultErrored) {
+		return code
+	}
+	branch := c.String("base-branch")
+	baseArn, err := findBaseRun(c, branch, head.Arn)
+	if err != nil {
+		log.Warnln("Could not compare with base branch:", err)
+		return code
+	}
+	log.Printf(">> Comparing with run %s of %s...\n", runId(baseArn), branch)
+	diff, err := diffRuns(client, baseArn, head)
+	if err != nil {
+		log.Warnln("Could not compare with base branch:", err)
+		return code
+	}
+	return diffExitCode(diff, branch, code)
+}
+
+func diffExitCode(diff *results.RunDiff, branch string, code int) int {
+	if regressions := diff.Regressions(); len(regressions) > 0 {
+		log.Printf(">> %d failures are new since the latest run of %s:\n", len(regressions), branch)
+		results.WriteDiffTable(util.LogWriter(log), &results.RunDiff{Base: diff.Base, Head: diff.Head, Changes: regressions})
+		return code
+	}
+	stillFailing := diff.Count(results.ChangeStillFailing)
+	if stillFailing == 0 {
+		return code
+	}
+	log.Printf(">> No new failures since the latest run of %s (%d tests still failing)\n", branch, stillFailing)
+	return 0
+}
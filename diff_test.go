@@ -0,0 +1,37 @@
+package main
+
+import (
+	"github.com/ride/devicefarm/results"
+	"github.com/ride/devicefarm/util"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestDiffExitCode(t *testing.T) {
+	assert := assert.New(t)
+	defer func(l *util.StandardLogger) { log = l }(log)
+	out, capture := util.NewCaptureLogger()
+	log = capture
+
+	stillFailing := &results.TestChange{Change: results.ChangeStillFailing, Device: "Pixel", Suite: "Suite", Test: "testA"}
+	newlyFailing := &results.TestChange{Change: results.ChangeNewlyFailing, Device: "Pixel", Suite: "Suite", Test: "testB"}
+	newlyPassing := &results.TestChange{Change: results.ChangeNewlyPassing, Device: "Pixel", Suite: "Suite", Test: "testC"}
+
+	// should keep the run's exit code if any failure is new
+	diff := &results.RunDiff{Base: "master@abc1234", Head: "feature@1234567", Changes: []*results.TestChange{newlyFailing, stillFailing}}
+	assert.Equal(1, diffExitCode(diff, "master", 1))
+	assert.Contains(out.Out()[0], "1 failures are new since the latest run of master")
+	assert.Contains(strings.Join(out.Out(), ""), "testB")
+	assert.NotContains(strings.Join(out.Out(), ""), "testA")
+
+	// should exit zero if every failure was failing on the base branch too
+	diff.Changes = []*results.TestChange{stillFailing, newlyPassing}
+	assert.Equal(0, diffExitCode(diff, "master", 1))
+	assert.Contains(out.Out()[len(out.Out())-1], "No new failures since the latest run of master (1 tests still failing)")
+
+	// should keep the run's exit code if no test is failing, e.g. when a
+	// device failed to set up
+	diff.Changes = []*results.TestChange{newlyPassing}
+	assert.Equal(2, diffExitCode(diff, "master", 2))
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/devicefarm"
+	"github.com/codegangsta/cli"
+	"github.com/ride/devicefarm/build"
+	"github.com/ride/devicefarm/history"
+	"github.com/ride/devicefarm/results"
+	"github.com/ride/devicefarm/util"
+	"path/filepath"
+	"time"
+)
+
+// historyCommand returns the `history` command group.
+func historyCommand(buildFlags []cli.Flag) cli.Command {
+	return cli.Command{
+		Name:  "history",
+		Usage: "Query the local history of test runs in " + history.Dir,
+		Subcommands: []cli.Command{
+			{
+				Name:      "list",
+				Usage:     "List the recorded runs of the current branch, newest first",
+				ArgsUsage: " ",
+				Action:    commandHistoryList,
+				Flags: append([]cli.Flag{
+					cli.BoolFlag{
+						Name:  "all",
+						Usage: "List the recorded runs of every branch",
+					},
+					cli.IntFlag{
+						Name:  "limit",
+						Usage: "Maximum number of runs to list (0 for no limit)",
+						Value: 20,
+					},
+					cli.StringFlag{
+						Name:  "format",
+						Usage: "Output format: table or json",
+						Value: "table",
+					},
+				}, buildFlags...),
+			},
+			{
+				Name:      "import",
+				Usage:     "Record the results of the project's completed runs which are not in the history yet",
+				ArgsUsage: " ",
+				Action:    commandHistoryImport,
+				Flags: append([]cli.Flag{
+					cli.BoolFlag{
+						Name:  "force",
+						Usage: "Import the results of runs which were already recorded too",
+					},
+				}, buildFlags...),
+			},
+		},
+	}
+}
+
+// flakyCommand returns the `flaky` command.
+func flakyCommand(buildFlags []cli.Flag) cli.Command {
+	return cli.Command{
+		Name:      "flaky",
+		Usage:     "Find flaky tests and unreliable devices in the recorded runs of the current branch",
+		ArgsUsage: " ",
+		Action:    commandFlaky,
+		Flags: append([]cli.Flag{
+			cli.BoolFlag{
+				Name:  "all",
+				Usage: "Use the recorded runs of every branch",
+			},
+			cli.IntFlag{
+				Name:  "last",
+				Usage: "Number of most recent completed runs to use (0 for all)",
+				Value: 20,
+			},
+			cli.StringFlag{
+				Name:  "format",
+				Usage: "Output format: table or json",
+				Value: "table",
+			},
+		}, buildFlags...),
+	}
+}
+
+// getHistory returns the history store in the build's directory.
+func getHistory(c *cli.Context) *history.Store {
+	return &history.Store{Dir: filepath.Join(getBuild(c).Dir, history.Dir)}
+}
+
+// getHistoryRuns returns every recorded run.
+func getHistoryRuns(c *cli.Context) []*history.Run {
+	runs, err := getHistory(c).Runs()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return runs
+}
+
+// recordRun records a run scheduled by this build in the history, with the
+// outcome of each test once results are given. Failing to record it is only a
+// warning.
+func recordRun(c *cli.Context, runArn, pool string, result *results.Run) {
+	b := getBuild(c)
+	run := &history.Run{
+		Arn:     runArn,
+		Status:  devicefarm.ExecutionStatusScheduling,
+		Created: time.Now().UTC(),
+		Tests:   []*history.Test{},
+	}
+	if result != nil {
+		run = history.NewRun(result)
+	}
+	if len(run.Name) == 0 {
+		run.Name, _ = b.RunName()
+	}
+	run.Branch = b.Branch
+	run.Commit = b.Commit
+	run.DevicePool = pool
+	if err := getHistory(c).Add(run); err != nil {
+		log.Warnln("Could not record run in history:", err)
+	}
+}
+
+func commandHistoryList(c *cli.Context) {
+	format := getFormat(c)
+	b := getBuild(c)
+	runs := getHistoryRuns(c)
+	limit := c.Int("limit")
+	listed := []*history.Run{}
+	for i := len(runs) - 1; i >= 0; i-- {
+		if limit > 0 && len(listed) >= limit {
+			break
+		}
+		if !c.Bool("all") && runs[i].Branch != b.Branch {
+			continue
+		}
+		listed = append(listed, runs[i])
+	}
+	if format == "json" {
+		printJSON(listed)
+		return
+	}
+	if len(listed) == 0 {
+		log.Println("No runs recorded. Runs are recorded by `devicefarm run`, or use `devicefarm history import`")
+		return
+	}
+	table := newTable()
+	fmt.Fprintln(table, "ID\tCREATED\tBRANCH\tCOMMIT\tPOOL\tSTATUS\tRESULT\tTESTS")
+	for _, run := range listed {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			shortRunId(run.Arn),
+			run.Created.Local().Format("2006-01-02 15:04"),
+			orDash(run.Branch),
+			orDash(util.ShortSHA(run.Commit)),
+			orDash(run.DevicePool),
+			run.Status,
+			orDash(run.Result),
+			formatTests(run.Counters))
+	}
+	table.Flush()
+}
+
+func orDash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
+
+func commandHistoryImport(c *cli.Context) {
+	b := getBuild(c)
+	client := getClient(c)
+	store := getHistory(c)
+	recorded := map[string]*history.Run{}
+	for _, run := range getHistoryRuns(c) {
+		recorded[run.Arn] = run
+	}
+	runs, err := client.ListRuns(ctx, b.Config.ProjectArn)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	metadata := map[*devicefarm.Run]*build.RunMetadata{}
+	for _, named := range b.NamedRuns(runs) {
+		metadata[named.Run] = named.Metadata
+	}
+	imported, skipped := 0, 0
+	for _, run := range runs {
+		arn := aws.StringValue(run.Arn)
+		existing := recorded[arn]
+		if aws.StringValue(run.Status) != devicefarm.ExecutionStatusCompleted {
+			continue
+		}
+		if existing != nil && existing.Status == history.StatusCompleted && !c.Bool("force") {
+			skipped++
+			continue
+		}
+		log.Printf(">> Importing run %s (%s)...\n", shortRunId(arn), aws.StringValue(run.Name))
+		result, err := client.RunResults(ctx, arn)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		record := history.NewRun(result)
+		if m := metadata[run]; m != nil {
+			record.Branch = m.Branch
+			record.Commit = m.SHA
+			if len(record.Commit) == 0 {
+				record.Commit = m.ShortSHA
+			}
+			record.DevicePool = m.DevicePool
+		}
+		// what was recorded when the run was scheduled is more accurate than
+		// what can be parsed from its name
+		if existing != nil {
+			record.Branch = existing.Branch
+			record.Commit = existing.Commit
+			record.DevicePool = existing.DevicePool
+		}
+		if err := store.Add(record); err != nil {
+			log.Fatalln(err)
+		}
+		imported++
+	}
+	log.Printf(">> Imported %d runs into %s (%d were already recorded)\n", imported, store.Filename(), skipped)
+}
+
+// flakyReport is the output of `flaky --format json`.
+type flakyReport struct {
+	Runs    int                    `json:"runs"`
+	Tests   []*history.TestStats   `json:"tests"`
+	Devices []*history.DeviceStats `json:"devices"`
+}
+
+func formatRate(rate float64) string {
+	return fmt.Sprintf("%.0f%%", rate*100)
+}
+
+func commandFlaky(c *cli.Context) {
+	format := getFormat(c)
+	branch := ""
+	if !c.Bool("all") {
+		branch = getBuild(c).Branch
+	}
+	runs := history.LastRuns(getHistoryRuns(c), c.Int("last"), branch)
+	report := &flakyReport{
+		Runs:    len(runs),
+		Tests:   history.Flakiness(runs),
+		Devices: history.DeviceFailures(runs),
+	}
+	if format == "json" {
+		printJSON(report)
+		return
+	}
+	if len(runs) == 0 {
+		log.Println("No completed runs recorded. Runs are recorded by `devicefarm run --wait`, or use `devicefarm history import`")
+		return
+	}
+	where := "every branch"
+	if len(branch) > 0 {
+		where = "branch " + branch
+	}
+	log.Printf("Over the last %d completed runs of %s:\n\n", len(runs), where)
+	flaky := 0
+	table := newTable()
+	fmt.Fprintln(table, "SUITE\tTEST\tRUNS\tFAILURES\tFLIPS\tFLIP RATE")
+	for _, stats := range report.Tests {
+		if stats.Flips == 0 {
+			continue
+		}
+		flaky++
+		fmt.Fprintf(table, "%s\t%s\t%d\t%d\t%d\t%s\n",
+			stats.Suite,
+			stats.Test,
+			stats.Runs,
+			stats.Failures,
+			stats.Flips,
+			formatRate(stats.FlipRate))
+	}
+	if flaky == 0 {
+		log.Println("No flaky tests found")
+	} else {
+		table.Flush()
+	}
+	log.Println()
+	table = newTable()
+	fmt.Fprintln(table, "DEVICE\tOS\tTESTS\tFAILURES\tFAILURE RATE")
+	for _, stats := range report.Devices {
+		fmt.Fprintf(table, "%s\t%s\t%d\t%d\t%s\n",
+			stats.Device,
+			stats.Os,
+			stats.Tests,
+			stats.Failures,
+			formatRate(stats.FailureRate))
+	}
+	table.Flush()
+}
@@ -0,0 +1,153 @@
+package history
+
+import (
+	"github.com/ride/devicefarm/results"
+	"sort"
+)
+
+// TestStats describes how a test's outcome changed over a series of runs.
+// Only outcomes which passed or failed are counted. A flip is a change
+// between passing and failing from one run to the next on the same device,
+// and FlipRate is the fraction of those consecutive pairs which flipped.
+type TestStats struct {
+	Suite       string  `json:"suite"`
+	Test        string  `json:"test"`
+	Runs        int     `json:"runs"`
+	Failures    int     `json:"failures"`
+	Flips       int     `json:"flips"`
+	FlipRate    float64 `json:"flip_rate"`
+	FailureRate float64 `json:"failure_rate"`
+}
+
+// DeviceStats describes how often tests failed on a device over a series of
+// runs. Only outcomes which passed or failed are counted. Os is the latest OS
+// the device ran, since it may have been updated between the runs.
+type DeviceStats struct {
+	Device      string  `json:"device"`
+	Os          string  `json:"os"`
+	Tests       int     `json:"tests"`
+	Failures    int     `json:"failures"`
+	FailureRate float64 `json:"failure_rate"`
+}
+
+// LastRuns returns the last n completed runs, oldest first, of the given
+// branch, or of every branch if branch is blank. If n is 0 there is no limit.
+func LastRuns(runs []*Run, n int, branch string) []*Run {
+	last := []*Run{}
+	for _, run := range runs {
+		if run.Status != StatusCompleted || (len(branch) > 0 && run.Branch != branch) {
+			continue
+		}
+		last = append(last, run)
+	}
+	if n > 0 && len(last) > n {
+		last = last[len(last)-n:]
+	}
+	return last
+}
+
+func rate(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+// Flakiness returns the stats of every test in the runs, which should be
+// oldest first, from the most to the least flaky: by flip rate, then number
+// of flips, then failure rate. Like a diff, consecutive outcomes on a device
+// are compared even if its OS was updated in between.
+func Flakiness(runs []*Run) []*TestStats {
+	type deviceKey struct{ suite, test, device string }
+	type testKey struct{ suite, test string }
+	byTest := map[testKey]*TestStats{}
+	pairs := map[testKey]int{}
+	last := map[deviceKey]bool{}
+	seen := map[deviceKey]bool{}
+	for _, run := range runs {
+		for _, test := range run.Tests {
+			failed := results.Failed(test.Result)
+			if !failed && !results.Passed(test.Result) {
+				continue
+			}
+			tk := testKey{test.Suite, test.Test}
+			stats, ok := byTest[tk]
+			if !ok {
+				stats = &TestStats{Suite: test.Suite, Test: test.Test}
+				byTest[tk] = stats
+			}
+			stats.Runs++
+			if failed {
+				stats.Failures++
+			}
+			dk := deviceKey{test.Suite, test.Test, test.Device}
+			if seen[dk] {
+				pairs[tk]++
+				if last[dk] != failed {
+					stats.Flips++
+				}
+			}
+			seen[dk] = true
+			last[dk] = failed
+		}
+	}
+	list := []*TestStats{}
+	for tk, stats := range byTest {
+		stats.FlipRate = rate(stats.Flips, pairs[tk])
+		stats.FailureRate = rate(stats.Failures, stats.Runs)
+		list = append(list, stats)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		switch {
+		case a.FlipRate != b.FlipRate:
+			return a.FlipRate > b.FlipRate
+		case a.Flips != b.Flips:
+			return a.Flips > b.Flips
+		case a.FailureRate != b.FailureRate:
+			return a.FailureRate > b.FailureRate
+		case a.Suite != b.Suite:
+			return a.Suite < b.Suite
+		}
+		return a.Test < b.Test
+	})
+	return list
+}
+
+// DeviceFailures returns the stats of every device in the runs, which should
+// be oldest first, from the highest to the lowest failure rate.
+func DeviceFailures(runs []*Run) []*DeviceStats {
+	byDevice := map[string]*DeviceStats{}
+	for _, run := range runs {
+		for _, test := range run.Tests {
+			failed := results.Failed(test.Result)
+			if !failed && !results.Passed(test.Result) {
+				continue
+			}
+			stats, ok := byDevice[test.Device]
+			if !ok {
+				stats = &DeviceStats{Device: test.Device}
+				byDevice[test.Device] = stats
+			}
+			stats.Os = test.Os
+			stats.Tests++
+			if failed {
+				stats.Failures++
+			}
+		}
+	}
+	list := []*DeviceStats{}
+	for _, stats := range byDevice {
+		stats.FailureRate = rate(stats.Failures, stats.Tests)
+		list = append(list, stats)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		switch {
+		case a.FailureRate != b.FailureRate:
+			return a.FailureRate > b.FailureRate
+		}
+		return a.Device < b.Device
+	})
+	return list
+}
@@ -0,0 +1,106 @@
+package history
+
+import (
+	"github.com/ride/devicefarm/results"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// flakyRun returns a completed run of master, with the given results of
+// testA and testB on a Pixel and testA on a Galaxy.
+func flakyRun(arn, pixelA, pixelB, galaxyA string) *Run {
+	return &Run{
+		Arn:    arn,
+		Branch: "master",
+		Status: StatusCompleted,
+		Tests: []*Test{
+			{Device: "Pixel", Os: "9", Suite: "Suite", Test: "testA", Result: pixelA},
+			{Device: "Pixel", Os: "9", Suite: "Suite", Test: "testB", Result: pixelB},
+			{Device: "Galaxy", Os: "8", Suite: "Suite", Test: "testA", Result: galaxyA},
+		},
+	}
+}
+
+func flakyRuns() []*Run {
+	pass, fail, skip := results.ResultPassed, results.ResultFailed, results.ResultSkipped
+	return []*Run{
+		flakyRun("run1", pass, fail, pass),
+		flakyRun("run2", fail, fail, pass),
+		flakyRun("run3", pass, fail, skip),
+		flakyRun("run4", pass, fail, fail),
+	}
+}
+
+func TestLastRuns(t *testing.T) {
+	assert := assert.New(t)
+	runs := append(flakyRuns(),
+		&Run{Arn: "running", Status: "RUNNING", Branch: "master"},
+		&Run{Arn: "feature", Status: StatusCompleted, Branch: "feature"})
+
+	last := LastRuns(runs, 2, "master")
+	assert.Equal(2, len(last))
+	assert.Equal("run3", last[0].Arn)
+	assert.Equal("run4", last[1].Arn)
+
+	// with no limit or branch, every completed run should be included
+	assert.Equal(5, len(LastRuns(runs, 0, "")))
+}
+
+func TestFlakiness(t *testing.T) {
+	assert := assert.New(t)
+	stats := Flakiness(flakyRuns())
+	assert.Equal(2, len(stats))
+
+	// testA flipped twice on the Pixel and once on the Galaxy, where it was
+	// skipped once, out of 3 + 2 consecutive pairs
+	assert.Equal(&TestStats{
+		Suite:       "Suite",
+		Test:        "testA",
+		Runs:        7,
+		Failures:    2,
+		Flips:       3,
+		FlipRate:    0.6,
+		FailureRate: 2.0 / 7,
+	}, stats[0])
+
+	// testB always fails, which is broken but not flaky
+	assert.Equal(&TestStats{
+		Suite:       "Suite",
+		Test:        "testB",
+		Runs:        4,
+		Failures:    4,
+		FlipRate:    0,
+		FailureRate: 1,
+	}, stats[1])
+
+	assert.Equal(0, len(Flakiness([]*Run{})))
+
+	// an OS update should not hide a flip on the same device
+	runs := flakyRuns()[:2]
+	for _, test := range runs[1].Tests {
+		test.Os = "10"
+	}
+	stats = Flakiness(runs)
+	assert.Equal("testA", stats[0].Test)
+	assert.Equal(1, stats[0].Flips)
+	assert.Equal(0.5, stats[0].FlipRate)
+}
+
+func TestDeviceFailures(t *testing.T) {
+	assert := assert.New(t)
+	stats := DeviceFailures(flakyRuns())
+	assert.Equal(2, len(stats))
+	assert.Equal(&DeviceStats{Device: "Pixel", Os: "9", Tests: 8, Failures: 5, FailureRate: 5.0 / 8}, stats[0])
+	assert.Equal(&DeviceStats{Device: "Galaxy", Os: "8", Tests: 3, Failures: 1, FailureRate: 1.0 / 3}, stats[1])
+
+	// a device should be counted once across an OS update, with its latest OS
+	runs := flakyRuns()
+	for _, test := range runs[3].Tests {
+		if test.Device == "Pixel" {
+			test.Os = "10"
+		}
+	}
+	stats = DeviceFailures(runs)
+	assert.Equal(2, len(stats))
+	assert.Equal(&DeviceStats{Device: "Pixel", Os: "10", Tests: 8, Failures: 5, FailureRate: 5.0 / 8}, stats[0])
+}
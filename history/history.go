@@ -0,0 +1,180 @@
+/*
+
+Package history keeps a local record of test runs, so that results can be
+compared across many runs, e.g. to find flaky tests, without going back to
+Device Farm.
+
+Runs are stored in a JSON lines file, one run per line. Recording a run again
+(e.g. once it completes) appends a new line, and the last line for each run
+wins when loading.
+
+*/
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/ride/devicefarm/results"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Dir is the directory, relative to a build's Dir, which the history is
+// stored in.
+const Dir = ".devicefarm/history"
+
+// RunsFile is the name of the file in the history directory which runs are
+// recorded in.
+const RunsFile = "runs.jsonl"
+
+// StatusCompleted is the Status of a run which has completed, matching
+// devicefarm.ExecutionStatusCompleted.
+const StatusCompleted = "COMPLETED"
+
+// A Run is a recorded test run. Tests is empty until the run completes.
+type Run struct {
+	Arn        string           `json:"arn"`
+	Name       string           `json:"name"`
+	Branch     string           `json:"branch,omitempty"`
+	Commit     string           `json:"commit,omitempty"`
+	DevicePool string           `json:"device_pool,omitempty"`
+	Created    time.Time        `json:"created"`
+	Status     string           `json:"status"`
+	Result     string           `json:"result"`
+	Counters   results.Counters `json:"counters"`
+	Seconds    float64          `json:"seconds"`
+	Tests      []*Test          `json:"tests"`
+	Recorded   time.Time        `json:"recorded"`
+}
+
+// A Test is the outcome of one test on one device in a recorded run.
+type Test struct {
+	Device  string  `json:"device"`
+	Os      string  `json:"os"`
+	Suite   string  `json:"suite"`
+	Test    string  `json:"test"`
+	Result  string  `json:"result"`
+	Seconds float64 `json:"seconds"`
+}
+
+// NewRun returns a Run for the results of a run, with the outcome of every
+// test. The caller should set Branch, Commit and DevicePool.
+func NewRun(result *results.Run) *Run {
+	run := &Run{
+		Arn:      result.Arn,
+		Name:     result.Name,
+		Created:  result.Created,
+		Status:   result.Status,
+		Result:   result.Result,
+		Counters: result.Counters,
+		Seconds:  result.Duration().Seconds(),
+		Tests:    []*Test{},
+	}
+	for _, job := range result.Jobs {
+		for _, suite := range job.Suites {
+			for _, test := range suite.Tests {
+				run.Tests = append(run.Tests, &Test{
+					Device:  job.Device,
+					Os:      job.Os,
+					Suite:   suite.Name,
+					Test:    test.Name,
+					Result:  test.Result,
+					Seconds: test.Duration().Seconds(),
+				})
+			}
+		}
+	}
+	return run
+}
+
+// A Store is a history of runs kept in a directory.
+type Store struct {
+	Dir string
+}
+
+// Filename returns the path of the store's RunsFile.
+func (store *Store) Filename() string {
+	return filepath.Join(store.Dir, RunsFile)
+}
+
+// Add records a run, replacing any earlier record of it. If the run's
+// Recorded time is not set, it is set to now.
+func (store *Store) Add(run *Run) error {
+	if run.Recorded.IsZero() {
+		run.Recorded = time.Now().UTC()
+	}
+	line, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(store.Dir, 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(store.Filename(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Runs returns the latest record of every run, oldest first. A store which
+// has no runs file yet has no runs.
+func (store *Store) Runs() ([]*Run, error) {
+	file, err := os.Open(store.Filename())
+	if os.IsNotExist(err) {
+		return []*Run{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	byArn := map[string]*Run{}
+	scanner := bufio.NewScanner(file)
+	// a run with many tests makes for a long line
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		run := &Run{}
+		if err := json.Unmarshal(scanner.Bytes(), run); err != nil {
+			return nil, fmt.Errorf("Invalid history in %s, line %d: %s", store.Filename(), n, err)
+		}
+		byArn[run.Arn] = run
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	runs := []*Run{}
+	for _, run := range byArn {
+		runs = append(runs, run)
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		if runs[i].Created.Equal(runs[j].Created) {
+			return runs[i].Arn < runs[j].Arn
+		}
+		return runs[i].Created.Before(runs[j].Created)
+	})
+	return runs, nil
+}
+
+// Get returns the latest record of a run, or nil if it has not been recorded.
+func (store *Store) Get(arn string) (*Run, error) {
+	runs, err := store.Runs()
+	if err != nil {
+		return nil, err
+	}
+	for _, run := range runs {
+		if run.Arn == arn {
+			return run, nil
+		}
+	}
+	return nil, nil
+}
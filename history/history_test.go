@@ -0,0 +1,82 @@
+package history
+
+import (
+	"github.com/ride/devicefarm/results"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempStore(t *testing.T) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "history")
+	assert.Nil(t, err)
+	store := &Store{Dir: filepath.Join(dir, Dir)}
+	return store, func() { os.RemoveAll(dir) }
+}
+
+func TestNewRun(t *testing.T) {
+	assert := assert.New(t)
+	result, err := results.Load("../results/testdata/run.json")
+	assert.Nil(err)
+
+	run := NewRun(result)
+	assert.Equal(result.Arn, run.Arn)
+	assert.Equal("master@abc1234", run.Name)
+	assert.Equal(results.ResultFailed, run.Result)
+	assert.Equal(int64(5), run.Counters.Total)
+	assert.Equal(600.0, run.Seconds)
+	assert.Equal(5, len(run.Tests))
+	assert.Equal(&Test{
+		Device:  "Samsung Galaxy S5 (AT&T)",
+		Os:      "5.0",
+		Suite:   "com.example.LoginTest",
+		Test:    "testLogout",
+		Result:  results.ResultFailed,
+		Seconds: run.Tests[1].Seconds,
+	}, run.Tests[1])
+}
+
+func TestStore(t *testing.T) {
+	assert := assert.New(t)
+	store, cleanup := tempStore(t)
+	defer cleanup()
+
+	// should have no runs before anything is recorded
+	runs, err := store.Runs()
+	assert.Nil(err)
+	assert.Equal(0, len(runs))
+
+	now := time.Now().UTC().Round(time.Second)
+	assert.Nil(store.Add(&Run{Arn: "run2", Created: now, Status: "SCHEDULING", Branch: "master"}))
+	assert.Nil(store.Add(&Run{Arn: "run1", Created: now.Add(-time.Hour), Status: StatusCompleted}))
+	assert.Nil(store.Add(&Run{Arn: "run2", Created: now, Status: StatusCompleted, Branch: "master", Tests: []*Test{{Test: "a"}}}))
+
+	// the last record of each run should win, and runs should be oldest first
+	runs, err = store.Runs()
+	assert.Nil(err)
+	assert.Equal(2, len(runs))
+	assert.Equal("run1", runs[0].Arn)
+	assert.Equal("run2", runs[1].Arn)
+	assert.Equal(StatusCompleted, runs[1].Status)
+	assert.Equal(1, len(runs[1].Tests))
+	assert.False(runs[1].Recorded.IsZero())
+
+	run, err := store.Get("run1")
+	assert.Nil(err)
+	assert.Equal("run1", run.Arn)
+	run, err = store.Get("nope")
+	assert.Nil(err)
+	assert.Nil(run)
+
+	// a corrupt line should be an error
+	file, err := os.OpenFile(store.Filename(), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(err)
+	file.WriteString("{nope\n")
+	file.Close()
+	_, err = store.Runs()
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "line 4")
+}
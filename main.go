@@ -1,17 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/service/devicefarm"
 	"github.com/codegangsta/cli"
 	"github.com/ride/devicefarm/awsutil"
 	"github.com/ride/devicefarm/build"
 	"github.com/ride/devicefarm/config"
+	"github.com/ride/devicefarm/results"
 	"github.com/ride/devicefarm/util"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
 	"os"
+	"os/signal"
 	"os/user"
 	"path/filepath"
-	"regexp"
+	"syscall"
+	"time"
 )
 
 // injected at compile time
@@ -20,10 +28,14 @@ var Version string = "development"
 // set during init()
 var currentUser *user.User
 var defaultAwsConfigFile string
+var defaultUploadCacheFile string
 
 // for convenience
 var log *util.StandardLogger = util.DefaultLogger
 
+// cancelled on SIGINT or SIGTERM, see interruptContext()
+var ctx context.Context = context.Background()
+
 func init() {
 	var err error
 	currentUser, err = user.Current()
@@ -31,6 +43,7 @@ func init() {
 		log.Fatalln("Could not get current user", err)
 	}
 	defaultAwsConfigFile = filepath.Join(currentUser.HomeDir, ".devicefarm.json")
+	defaultUploadCacheFile = filepath.Join(currentUser.HomeDir, ".devicefarm", "uploads.json")
 }
 
 func main() {
@@ -52,6 +65,90 @@ func main() {
 			Usage: "Config file relative to working directory (or absolute path)",
 			Value: "devicefarm.yml",
 		},
+		cli.StringFlag{
+			Name:  "branch",
+			Usage: "Branch to build (default: DEVICEFARM_BRANCH, the CI server's branch variable, or the branch checked out)",
+		},
+	}
+
+	// these flags are used for anything which runs the build steps
+	stepFlags := []cli.Flag{
+		cli.BoolFlag{
+			Name:  "verbose",
+			Usage: "Show the output of build steps as they run",
+		},
+		cli.BoolFlag{
+			Name:  "quiet",
+			Usage: "Hide build commands as well as their output",
+		},
+	}
+
+	// these flags are used for anything which downloads artifacts
+	artifactFlags := []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "artifact-type",
+			Usage: "Only download artifacts of this type, e.g. DEVICE_LOG or VIDEO (may be repeated)",
+		},
+		cli.IntFlag{
+			Name:  "download-concurrency",
+			Usage: "Maximum number of artifacts to download in parallel",
+			Value: 4,
+		},
+	}
+
+	// these flags are used when creating a test run
+	runFlags := append([]cli.Flag{
+		cli.BoolFlag{
+			Name:  "wait",
+			Usage: "Wait for the run to complete, and exit non-zero unless it passed",
+		},
+		cli.DurationFlag{
+			Name:  "poll-interval",
+			Usage: "How often to check the run status when using --wait",
+			Value: 30 * time.Second,
+		},
+		cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "How long to wait for the run to complete when using --wait",
+			Value: 60 * time.Minute,
+		},
+		cli.BoolFlag{
+			Name:  "fail-on-regression",
+			Usage: "When using --wait, exit zero if every failing test also failed in the latest run of --base-branch",
+		},
+		cli.StringFlag{
+			Name:  "base-branch",
+			Usage: "Branch to compare with when using --fail-on-regression",
+			Value: "master",
+		},
+		cli.BoolFlag{
+			Name:  "no-dashboard",
+			Usage: "Only print the run status when using --wait, without the progress of each device",
+		},
+		cli.StringFlag{
+			Name:  "artifacts-dir",
+			Usage: "Directory to download artifacts to after the run completes when using --wait",
+		},
+		cli.StringFlag{
+			Name:  "junit",
+			Usage: "File to write a JUnit XML report to after the run completes when using --wait",
+		},
+		cli.BoolFlag{
+			Name:  "no-cache",
+			Usage: "Upload the app and test package even if identical files were uploaded before",
+		},
+	}, append(stepFlags, append(artifactFlags, buildFlags...)...)...)
+
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "region",
+			Usage:  "AWS region (default: region from the config, or from its project_arn)",
+			EnvVar: "AWS_REGION",
+		},
+		cli.StringFlag{
+			Name:  "profile",
+			Usage: "Use credentials from this profile in ~/.aws/credentials",
+		},
 	}
 
 	app.Commands = []cli.Command{
@@ -60,14 +157,116 @@ func main() {
 			Usage:     "Create test run based on YAML config",
 			ArgsUsage: " ",
 			Action:    commandRun,
-			Flags:     buildFlags,
+			Flags:     runFlags,
 		},
 		{
 			Name:      "build",
 			Usage:     "Run local build based on YAML config",
 			ArgsUsage: " ",
 			Action:    commandBuild,
-			Flags:     buildFlags,
+			Flags:     append(stepFlags, buildFlags...),
+		},
+		{
+			Name:      "artifacts",
+			Usage:     "Download artifacts (logs, screenshots, videos) of a test run",
+			ArgsUsage: "<run-arn|run-id|latest>",
+			Action:    commandArtifacts,
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "artifacts-dir",
+					Usage: "Directory to download artifacts to",
+					Value: "artifacts",
+				},
+			}, append(artifactFlags, buildFlags...)...),
+		},
+		{
+			Name:      "report",
+			Usage:     "Export the results of a test run",
+			ArgsUsage: "<run-arn|run-id|latest>",
+			Action:    commandReport,
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "Report format: junit, json or html",
+					Value: "junit",
+				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "File to write the report to (default: stdout), or directory for an html report (default: report)",
+				},
+				cli.StringFlag{
+					Name:  "results",
+					Usage: "Report on a JSON results file (from --format json) instead of fetching a run",
+				},
+				cli.StringFlag{
+					Name:  "artifacts-dir",
+					Usage: "Directory of artifacts for an html report, which are downloaded unless it already has a manifest (default: <output>/artifacts)",
+				},
+			}, append(artifactFlags, buildFlags...)...),
+		},
+		{
+			Name:      "problems",
+			Usage:     "Summarize the failures of a test run, grouped by message",
+			ArgsUsage: "<run-arn|run-id|latest>",
+			Action:    commandProblems,
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "Output format: text, json or markdown",
+					Value: "text",
+				},
+			}, buildFlags...),
+		},
+		diffCommand(buildFlags),
+		historyCommand(buildFlags),
+		flakyCommand(buildFlags),
+		runsCommand(buildFlags),
+		{
+			Name:  "pools",
+			Usage: "Manage the device pools created for each branch",
+			Subcommands: []cli.Command{
+				{
+					Name:      "prune",
+					Usage:     "Delete device pools of branches which no longer exist",
+					ArgsUsage: " ",
+					Action:    commandPoolsPrune,
+					Flags: append([]cli.Flag{
+						cli.BoolFlag{
+							Name:  "dry-run",
+							Usage: "List the device pools which would be deleted, without deleting them",
+						},
+						cli.BoolFlag{
+							Name:  "yes, y",
+							Usage: "Delete the device pools without asking for confirmation",
+						},
+						cli.BoolFlag{
+							Name:  "local-only",
+							Usage: "Keep only the device pools of local and remote-tracking branches, without listing the branches of origin",
+						},
+						cli.DurationFlag{
+							Name:  "older-than",
+							Usage: "Only delete device pools last updated longer ago than this, e.g. 720h",
+						},
+						cli.StringSliceFlag{
+							Name:  "keep",
+							Usage: "Never delete device pools of this branch or branch pattern, e.g. release/* (may be repeated)",
+						},
+					}, buildFlags...),
+				},
+			},
+		},
+		{
+			Name:  "config",
+			Usage: "Inspect the YAML config",
+			Subcommands: []cli.Command{
+				{
+					Name:      "show",
+					Usage:     "Show the config for a branch, and which branch overrides it is merged from",
+					ArgsUsage: " ",
+					Action:    commandConfigShow,
+					Flags:     buildFlags,
+				},
+			},
 		},
 		{
 			Name:      "devices",
@@ -87,23 +286,301 @@ func main() {
 		},
 	}
 
+	ctx = interruptContext()
 	app.Run(os.Args)
 }
 
 func commandRun(c *cli.Context) {
+	if _, err := awsutil.CheckArtifactTypes(c.StringSlice("artifact-type")); err != nil {
+		log.Fatalln(err)
+	}
 	commandBuild(c)
 	pool := getDevicePool(c)
 	build := getBuild(c)
-	client := getClient()
-	apk := filepath.Join(build.Dir, build.Manifest.Android.Apk)
-	apkInstrumentation := filepath.Join(build.Dir, build.Manifest.Android.ApkInstrumentation)
-	runArn, err := client.CreateRun(build.Config.ProjectArn, *pool.Arn, apk, apkInstrumentation)
+	client := getClient(c)
+	runArn, err := client.CreateRun(ctx, build.Config.ProjectArn, *pool.Arn, build.RunConfig())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if url, err := consoleUrl(runArn); err == nil {
+		log.Println(url)
+	} else {
+		log.Println(runArn)
+	}
+	recordRun(c, runArn, *pool.Name, nil)
+	if ctx.Err() != nil {
+		stopRun(client, runArn)
+	}
+
+	if !c.Bool("wait") {
+		return
+	}
+	log.Println(">> Waiting for run to complete...")
+	timeoutMs := int(c.Duration("timeout") / time.Millisecond)
+	delayMs := int(c.Duration("poll-interval") / time.Millisecond)
+	var run *devicefarm.Run
+	if c.Bool("no-dashboard") {
+		run, err = client.WaitForRun(ctx, runArn, timeoutMs, delayMs)
+	} else {
+		run, err = client.WatchRun(ctx, runArn, timeoutMs, delayMs, awsutil.NewRunRenderer(log))
+	}
 	if err != nil {
+		if ctx.Err() != nil {
+			stopRun(client, runArn)
+		}
 		log.Fatalln(err)
 	}
-	re := regexp.MustCompile("run:([^/]+)/([^/]+)")
-	parts := re.FindStringSubmatch(runArn)
-	log.Printf("https://us-west-2.console.aws.amazon.com/devicefarm/home?region=us-west-2#/projects/%s/runs/%s\n", parts[1], parts[2])
+	log.Printf(">> Run result: %s\n", *run.Result)
+	// the results are fetched once for the history, the JUnit report and the
+	// comparison with the base branch
+	result, resultErr := client.RunResults(ctx, runArn)
+	if resultErr == nil {
+		recordRun(c, runArn, *pool.Name, result)
+	} else {
+		log.Warnln("Could not get run results:", resultErr)
+	}
+	if *run.Result != devicefarm.ExecutionResultPassed {
+		printProblemsSummary(client, runArn)
+	}
+	if len(c.String("artifacts-dir")) > 0 {
+		downloadArtifacts(c, runArn, c.String("artifacts-dir"))
+	}
+	if len(c.String("junit")) > 0 {
+		if resultErr != nil {
+			log.Fatalln(resultErr)
+		}
+		writeRunReport(c, runArn, result, "junit", c.String("junit"))
+	}
+	if c.Bool("fail-on-regression") {
+		os.Exit(regressionExitCode(c, client, result, *run.Result))
+	}
+	os.Exit(awsutil.ResultExitCode(*run.Result))
+}
+
+// stopRun stops a run which was scheduled before the command was interrupted,
+// so that it does not keep using device minutes, and exits.
+func stopRun(client *awsutil.DeviceFarm, runArn string) {
+	log.Println(">> Stopping run...")
+	stopCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := client.StopRun(stopCtx, runArn); err != nil {
+		log.Fatalln(err)
+	}
+	log.Fatalln("Interrupted, run stopped: " + runArn)
+}
+
+func commandArtifacts(c *cli.Context) {
+	if c.NArg() != 1 {
+		log.Fatalln("Usage: devicefarm artifacts <run-arn|run-id|latest>")
+	}
+	runArn := getRunArn(c, c.Args()[0])
+	downloadArtifacts(c, runArn, c.String("artifacts-dir"))
+}
+
+func downloadArtifacts(c *cli.Context, runArn, dir string) {
+	client := getClient(c)
+	log.Println(">> Listing artifacts...")
+	artifacts, err := client.ListRunArtifacts(ctx, runArn, c.StringSlice("artifact-type")...)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf(">> Downloading %d artifacts to %s...\n", len(artifacts), dir)
+	err = client.DownloadArtifacts(ctx, dir, artifacts, c.Int("download-concurrency"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func commandReport(c *cli.Context) {
+	usage := "Usage: devicefarm report [--format junit|json|html] [-o file] <run-arn|run-id|latest>"
+	if len(c.String("results")) > 0 {
+		// the results were saved earlier, so there is no run to fetch
+		if c.NArg() != 0 {
+			log.Fatalln(usage)
+		}
+		writeReport(c, "", c.String("format"), c.String("output"))
+		return
+	}
+	if c.NArg() != 1 {
+		log.Fatalln(usage)
+	}
+	runArn := getRunArn(c, c.Args()[0])
+	writeReport(c, runArn, c.String("format"), c.String("output"))
+}
+
+// getResults returns the results of a run, loaded from the --results file if
+// one was given.
+func getResults(c *cli.Context, runArn string) *results.Run {
+	if filename := c.String("results"); len(filename) > 0 {
+		run, err := results.Load(filename)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return run
+	}
+	run, err := getClient(c).RunResults(ctx, runArn)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return run
+}
+
+// writeReport exports the results of a run in the given format to a file,
+// or to stdout if filename is blank. An html report is written to a
+// directory instead.
+func writeReport(c *cli.Context, runArn, format, filename string) {
+	if format != "junit" && format != "json" && format != "html" {
+		log.Fatalln("Unknown report format: " + format)
+	}
+	writeRunReport(c, runArn, getResults(c, runArn), format, filename)
+}
+
+// writeRunReport is writeReport for results which were already fetched.
+func writeRunReport(c *cli.Context, runArn string, run *results.Run, format, filename string) {
+	if format == "html" {
+		writeHTMLReport(c, runArn, run, filename)
+		return
+	}
+	buffer := &bytes.Buffer{}
+	var err error
+	if format == "junit" {
+		err = run.WriteJUnit(buffer)
+	} else {
+		var out []byte
+		out, err = run.JSON()
+		buffer.Write(out)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(filename) == 0 {
+		log.Print(buffer.String())
+		return
+	}
+	err = ioutil.WriteFile(filename, buffer.Bytes(), 0644)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf(">> Wrote %s report to %s\n", format, filename)
+}
+
+// writeHTMLReport writes an html report of a run to index.html in dir. The
+// run's artifacts are downloaded first, unless the artifacts directory
+// already has a manifest (or there is no run to download them from, when
+// reporting on a results file).
+func writeHTMLReport(c *cli.Context, runArn string, run *results.Run, dir string) {
+	if len(dir) == 0 {
+		dir = "report"
+	}
+	artifactsDir := c.String("artifacts-dir")
+	if len(artifactsDir) == 0 {
+		artifactsDir = filepath.Join(dir, "artifacts")
+	}
+	manifest := filepath.Join(artifactsDir, awsutil.ArtifactManifestFile)
+	if _, err := os.Stat(manifest); os.IsNotExist(err) && len(runArn) > 0 {
+		downloadArtifacts(c, runArn, artifactsDir)
+	}
+	report := &results.HTMLReport{Run: run, ArtifactsDir: artifactsDir, PageDir: dir}
+	if _, err := os.Stat(manifest); err == nil {
+		report.Artifacts, err = results.LoadArtifacts(manifest)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	} else {
+		log.Warnf("No artifacts in %s, the report will not include screenshots or logs\n", artifactsDir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatalln(err)
+	}
+	filename := filepath.Join(dir, "index.html")
+	file, err := os.Create(filename)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer file.Close()
+	if err := report.Write(file); err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf(">> Wrote html report to %s\n", filename)
+}
+
+func commandProblems(c *cli.Context) {
+	if c.NArg() != 1 {
+		log.Fatalln("Usage: devicefarm problems [--format text|json|markdown] <run-arn|run-id|latest>")
+	}
+	format := c.String("format")
+	if format != "text" && format != "json" && format != "markdown" {
+		log.Fatalln("Unknown format: " + format)
+	}
+	runArn := getRunArn(c, c.Args()[0])
+	problems, err := listProblems(getClient(c), runArn)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	switch format {
+	case "json":
+		printJSON(problems)
+	case "markdown":
+		err = results.WriteProblemsMarkdown(util.LogWriter(log), problems)
+	default:
+		err = results.WriteProblemsText(util.LogWriter(log), problems)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func listProblems(client *awsutil.DeviceFarm, runArn string) ([]*results.Problem, error) {
+	unique, err := client.ListUniqueProblems(ctx, runArn)
+	if err != nil {
+		return nil, err
+	}
+	return awsutil.ConvertProblems(unique), nil
+}
+
+// printProblemsSummary prints the problems of a run which did not pass. It
+// only warns if they cannot be listed, so that the run's result still
+// decides the exit code.
+func printProblemsSummary(client *awsutil.DeviceFarm, runArn string) {
+	problems, err := listProblems(client, runArn)
+	if err != nil {
+		log.Warnln("Could not list problems:", err)
+		return
+	}
+	if len(problems) == 0 {
+		return
+	}
+	log.Println(">> Problems:")
+	if err := results.WriteProblemsText(util.LogWriter(log), problems); err != nil {
+		log.Warnln(err)
+	}
+}
+
+// getRunArn returns the run ARN for a command argument, which may be a run
+// ARN, a run ID or a unique prefix of one, or "latest" for the most recent
+// run of the branch.
+func getRunArn(c *cli.Context, arg string) string {
+	if _, err := util.NewArn(arg); err == nil {
+		return arg
+	}
+	build := getBuild(c)
+	client := getClient(c)
+	if arg != "latest" {
+		run, err := client.FindRun(ctx, build.Config.ProjectArn, arg)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return *run.Arn
+	}
+	runs, err := client.ListRuns(ctx, build.Config.ProjectArn)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	run := build.LatestRun(runs)
+	if run == nil {
+		log.Fatalln("No runs found for branch " + build.Branch)
+	}
+	return *run.Arn
 }
 
 func commandBuild(c *cli.Context) {
@@ -111,42 +588,101 @@ func commandBuild(c *cli.Context) {
 	if len(build.Manifest.Steps) == 0 {
 		return
 	}
-	log.Println(">> Running build... (silencing output)")
-	err := build.Run()
+	build.Verbose = c.Bool("verbose")
+	build.Quiet = c.Bool("quiet")
+	if build.Verbose {
+		log.Println(">> Running build...")
+	} else {
+		log.Printf(">> Running build... (output in %s)\n", build.LogFilename())
+	}
+	err := build.Run(ctx)
 	if err != nil {
-		log.Fatalln(err)
+		log.Errorln(err)
+		log.Fatalf("Full output in %s\n", build.LogFilename())
 	}
 	log.Println(">> Build complete")
 }
 
+func commandConfigShow(c *cli.Context) {
+	dir, configFile := getPaths(c)
+	cfg, err := config.New(configFile)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	branch := c.String("branch")
+	if len(branch) == 0 {
+		branch, _, err = util.DetectBranch(dir, os.Getenv)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	manifest := cfg.BranchManifest(branch)
+	// there will never be an error marshalling a BuildManifest
+	out, _ := yaml.Marshal(manifest)
+	log.Printf("# Branch: %s\n", branch)
+	log.Println("# Merged from: defaults")
+	for _, key := range cfg.BranchOverrides(branch) {
+		log.Printf("#   branches: %s\n", key)
+	}
+	log.Print(string(out))
+	if runnable, err := manifest.IsRunnable(); !runnable {
+		log.Warnln("This branch cannot be built:", err)
+	}
+}
+
 func getDevicePool(c *cli.Context) *devicefarm.DevicePool {
 	build := getBuild(c)
-	client := getClient()
+	client := getClient(c)
 
 	flatDefs, err := build.Config.FlatDevicePoolDefinitions()
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	pools, err := client.ListDevicePools(build.Config.ProjectArn)
+	pools, err := client.ListDevicePools(ctx, build.Config.ProjectArn)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
 	poolName := build.Manifest.DevicePool
-	def, ok := flatDefs[poolName]
-	if !ok {
-		log.Fatalln("Device Pool not defined: " + poolName)
-	}
-
-	arns, err := config.DeviceArns(def)
+	rules, err := build.DevicePoolRules()
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	log.Printf(">> Device Pool: %s (%d devices)\n", poolName, len(arns))
+	// a blank platform means the tests can run on any device
+	platform := build.Manifest.Platform()
+	if poolRules, ok := build.Config.DevicePoolRules[poolName]; ok {
+		log.Printf(">> Device Pool: %s (%d rules)\n", poolName, len(poolRules))
+		for _, rule := range poolRules {
+			if len(platform) > 0 && rule.Attribute == config.RuleAttributePlatform &&
+				rule.Operator == config.RuleOperatorEquals && rule.Values[0] != platform {
+				log.Fatalf("Device Pool %s has no %s devices\n", poolName, platform)
+			}
+		}
+	} else {
+		arns, err := build.Config.DeviceArns(flatDefs[poolName])
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		log.Printf(">> Device Pool: %s (%d devices)\n", poolName, len(arns))
+
+		if len(platform) > 0 {
+			mismatched, err := client.DevicesNotOnPlatform(ctx, arns, platform)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			if len(mismatched) == len(arns) {
+				log.Fatalf("Device Pool %s has no %s devices\n", poolName, platform)
+			}
+			for _, device := range mismatched {
+				log.Warnf("Device is not %s and will be skipped: %s", platform, *device.Name)
+			}
+		}
+	}
 
-	remoteName := "df:" + build.Branch + ":" + poolName
+	remoteName := awsutil.BranchPoolName(build.Branch, poolName)
 	var matchingPool *devicefarm.DevicePool
 	for _, pool := range pools {
 		if *pool.Name == remoteName {
@@ -156,23 +692,90 @@ func getDevicePool(c *cli.Context) *devicefarm.DevicePool {
 
 	if matchingPool == nil {
 		log.Println("...creating")
-		matchingPool, err = client.CreateDevicePool(build.Config.ProjectArn, remoteName, arns)
+		matchingPool, err = client.CreateDevicePool(ctx, build.Config.ProjectArn, remoteName, rules)
 		if err != nil {
 			log.Fatalln(err)
 		}
 	}
 
-	matches := client.DevicePoolMatches(matchingPool, arns)
+	matches := client.DevicePoolMatches(matchingPool, rules)
 	if !matches {
 		log.Println("...updating")
-		matchingPool, err = client.UpdateDevicePool(matchingPool, arns)
+		matchingPool, err = client.UpdateDevicePool(ctx, matchingPool, rules)
+		if err != nil {
+			log.Fatalln(err)
+		}
 	}
 
 	return matchingPool
 }
 
+func commandPoolsPrune(c *cli.Context) {
+	build := getBuild(c)
+	client := getClient(c)
+
+	branches, err := liveBranches(build.Dir, build.Branch, c.Bool("local-only"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	stale, err := client.StaleDevicePools(ctx, build.Config.ProjectArn, &awsutil.StalePoolOptions{
+		Branches:  branches,
+		Keep:      c.StringSlice("keep"),
+		OlderThan: c.Duration("older-than"),
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(stale) == 0 {
+		log.Println(">> No stale device pools")
+		return
+	}
+
+	dryRun := c.Bool("dry-run")
+	if dryRun {
+		log.Printf(">> Would delete %d device pools\n", len(stale))
+	} else {
+		log.Printf(">> Found %d stale device pools\n", len(stale))
+	}
+	for _, pool := range stale {
+		log.Println(*pool.Name)
+	}
+	if dryRun {
+		return
+	}
+	if !c.Bool("yes") && !confirm(fmt.Sprintf("Delete %d device pools?", len(stale))) {
+		log.Fatalln("Not deleting device pools")
+	}
+	for _, pool := range stale {
+		err := client.DeleteDevicePool(ctx, *pool.Arn)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	log.Printf(">> Deleted %d device pools\n", len(stale))
+}
+
+// liveBranches returns the branches whose device pools must be kept: the
+// local and remote-tracking branches, the branches of origin, and the current
+// branch. Local clones on CI are often shallow or of a single branch, so
+// unless localOnly is set, it is an error if origin cannot be listed.
+func liveBranches(dir, current string, localOnly bool) ([]string, error) {
+	branches, err := util.GitBranches(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !localOnly {
+		remoteBranches, err := util.GitRemoteBranches(dir, "origin")
+		if err != nil {
+			return nil, fmt.Errorf("Could not list the branches of origin (use --local-only to prune against local branches only): %s", err)
+		}
+		branches = append(branches, remoteBranches...)
+	}
+	return append(branches, current), nil
+}
+
 func commandDevices(c *cli.Context) {
-	client := getClient()
+	client := getClient(c)
 	search := ""
 	if c.NArg() > 0 {
 		search = c.Args()[0]
@@ -182,7 +785,7 @@ func commandDevices(c *cli.Context) {
 	if androidOnly && iosOnly {
 		log.Fatalln("Cannot use both --android and --ios")
 	}
-	devices, err := client.SearchDevices(search, androidOnly, iosOnly)
+	devices, err := client.SearchDevices(ctx, search, androidOnly, iosOnly)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -195,29 +798,90 @@ func commandDevices(c *cli.Context) {
 	}
 }
 
-func findCreds() *credentials.Credentials {
-	ok, creds := awsutil.CredsFromEnv()
-	if !ok {
-		ok, creds = awsutil.CredsFromFile(defaultAwsConfigFile)
+// findCreds returns the credentials given by --profile, or else the first
+// found by awsutil.DefaultCredsProviders. If the config has an
+// assume_role_arn, those credentials are used to assume the role.
+func findCreds(c *cli.Context, region string) *credentials.Credentials {
+	var ok bool
+	var creds *credentials.Credentials
+	if profile := c.GlobalString("profile"); len(profile) > 0 {
+		ok, creds = awsutil.CredsFromProfile("", profile)
+		if !ok {
+			log.Fatalln("Could not find AWS credentials for profile: " + profile)
+		}
+	} else {
+		ok, creds = awsutil.CredsChain(awsutil.DefaultCredsProviders(defaultAwsConfigFile)...)
+		if !ok {
+			log.Fatalln("Could not find AWS credentials")
+		}
 	}
-	if !ok {
-		log.Fatalln("Could not find AWS credentials")
+	if len(c.String("config")) > 0 {
+		if roleArn := getBuild(c).Config.AssumeRoleArn; len(roleArn) > 0 {
+			creds = awsutil.AssumeRoleCreds(creds, region, roleArn)
+		}
 	}
 	return creds
 }
 
 var cachedClient *awsutil.DeviceFarm
 
-func getClient() *awsutil.DeviceFarm {
+func getClient(c *cli.Context) *awsutil.DeviceFarm {
 	if cachedClient != nil {
 		return cachedClient
 	}
 
-	creds := findCreds()
-	client := awsutil.NewClient(creds, log)
+	region := getRegion(c)
+	creds := findCreds(c, region)
+	client := awsutil.NewClient(creds, region, log)
+	client.NoCache = c.Bool("no-cache")
+	uploads, err := awsutil.LoadUploadCache(defaultUploadCacheFile)
+	if err != nil {
+		log.Warnln("Ignoring upload cache:", err)
+	} else {
+		client.Uploads = uploads
+	}
+	cachedClient = client
 	return client
 }
 
+// getRegion returns the AWS region for the command: the region of the
+// build's config for commands which have one, and otherwise the --region
+// flag (or AWS_REGION), falling back to util.DefaultRegion.
+func getRegion(c *cli.Context) string {
+	if len(c.String("config")) > 0 {
+		return getBuild(c).Config.AwsRegion()
+	}
+	if region := c.GlobalString("region"); len(region) > 0 {
+		return region
+	}
+	return util.DefaultRegion
+}
+
+// consoleUrl returns the AWS console URL of a Device Farm run or project.
+func consoleUrl(arn string) (string, error) {
+	parsed, err := util.NewArn(arn)
+	if err != nil {
+		return "", err
+	}
+	return parsed.ConsoleUrl()
+}
+
+// interruptContext returns a context which is cancelled on the first SIGINT
+// or SIGTERM, stopping uploads and polling. A second signal exits right away.
+func interruptContext() context.Context {
+	interrupted, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Warnf("Received %s, stopping (repeat to exit immediately)", sig)
+		cancel()
+		<-signals
+		os.Exit(1)
+	}()
+	return interrupted
+}
+
 var cachedBuild *build.Build
 
 func getBuild(c *cli.Context) *build.Build {
@@ -225,6 +889,32 @@ func getBuild(c *cli.Context) *build.Build {
 		return cachedBuild
 	}
 
+	dir := c.String("dir")
+	configFile := c.String("config")
+	absDir, absConfigFile := getPaths(c)
+
+	build, err := build.NewForBranch(log, absDir, absConfigFile, c.String("branch"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// --region and AWS_REGION override the region from the config
+	if region := c.GlobalString("region"); len(region) > 0 {
+		if !util.RegionRegexp.MatchString(region) {
+			log.Fatalln("Invalid region: " + region)
+		}
+		build.Config.Region = region
+	}
+
+	log.Printf(">> Dir: %s, Config: %s, Branch: %s (from %s), Commit: %s\n", dir, configFile, build.Branch, build.BranchSource, util.ShortSHA(build.Commit))
+
+	cachedBuild = build
+
+	return build
+}
+
+// getPaths returns the absolute paths of the --dir and --config flags.
+func getPaths(c *cli.Context) (string, string) {
 	dir := c.String("dir")
 	configFile := c.String("config")
 
@@ -240,15 +930,5 @@ func getBuild(c *cli.Context) *build.Build {
 	if !filepath.IsAbs(configFile) {
 		absConfigFile = filepath.Join(absDir, configFile)
 	}
-
-	build, err := build.New(log, absDir, absConfigFile)
-	if err != nil {
-		log.Fatalln(err)
-	}
-
-	log.Printf(">> Dir: %s, Config: %s, Branch: %s\n", dir, configFile, build.Branch)
-
-	cachedBuild = build
-
-	return build
+	return absDir, absConfigFile
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/ride/devicefarm/util"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLiveBranches(t *testing.T) {
+	assert := assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "devicefarm")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	remoteDir, err := ioutil.TempDir("", "devicefarm")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(remoteDir)
+	util.RunAll(tmpDir,
+		"git init",
+		"git config user.email 'devops@ride.com'",
+		"git config user.name 'Devops'",
+		"git checkout -b master",
+		"touch foo",
+		"git add foo",
+		"git commit foo -m foo",
+		"git branch stray")
+
+	// should fail without an origin, even though a stray local branch exists,
+	// unless only local branches are wanted
+	branches, err := liveBranches(tmpDir, "feature", false)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "--local-only")
+	assert.Nil(branches)
+	branches, err = liveBranches(tmpDir, "feature", true)
+	assert.Nil(err)
+	assert.Equal([]string{"master", "stray", "feature"}, branches)
+
+	// should include branches of origin which were never fetched, and the
+	// current branch, which may not have been pushed or fetched either
+	util.RunAll(remoteDir, "git init --bare")
+	util.RunAll(tmpDir,
+		"git remote add origin "+remoteDir,
+		"git push origin master:release/1.0",
+		"git update-ref -d refs/remotes/origin/release/1.0")
+	local, err := util.GitBranches(tmpDir)
+	assert.Nil(err)
+	assert.NotContains(local, "release/1.0")
+	branches, err = liveBranches(tmpDir, "feature", false)
+	assert.Nil(err)
+	for _, branch := range []string{"master", "stray", "release/1.0", "feature"} {
+		assert.Contains(branches, branch)
+	}
+}
@@ -0,0 +1,233 @@
+package results
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Kinds of TestChange, in the order they are listed.
+const (
+	ChangeNewlyFailing = "newly failing"
+	ChangeStillFailing = "still failing"
+	ChangeNewlyPassing = "newly passing"
+	ChangeAdded        = "added"
+	ChangeRemoved      = "removed"
+)
+
+var changeOrder = map[string]int{
+	ChangeNewlyFailing: 0,
+	ChangeStillFailing: 1,
+	ChangeNewlyPassing: 2,
+	ChangeAdded:        3,
+	ChangeRemoved:      4,
+}
+
+// A TestChange is a test whose result differs between two runs, or which
+// failed in both. Tests are matched by device, suite and test name.
+// BaseResult is blank for added tests, and HeadResult for removed tests.
+type TestChange struct {
+	Change     string `json:"change"`
+	Device     string `json:"device"`
+	Os         string `json:"os"`
+	Suite      string `json:"suite"`
+	Test       string `json:"test"`
+	BaseResult string `json:"base_result,omitempty"`
+	HeadResult string `json:"head_result,omitempty"`
+	Message    string `json:"message,omitempty"`
+}
+
+// A RunDiff compares the tests of a head run with those of a base run, e.g.
+// a pull request's run with master's. Unchanged is the number of tests which
+// are in both runs and are not listed in Changes.
+type RunDiff struct {
+	Base      string        `json:"base"`
+	Head      string        `json:"head"`
+	Changes   []*TestChange `json:"changes"`
+	Unchanged int           `json:"unchanged"`
+}
+
+type diffTest struct {
+	job   *Job
+	suite *Suite
+	test  *Test
+}
+
+// diffKey matches a test across runs. The OS is left out so that a device
+// which was updated between the runs still matches.
+func diffKey(job *Job, suite *Suite, test *Test) string {
+	return strings.Join([]string{job.Device, suite.Name, test.Name}, "\x00")
+}
+
+// diffTests returns the tests of a run by key, and the keys in order. If a
+// device is in the run more than once, only its first job is used.
+func diffTests(run *Run) (map[string]*diffTest, []string) {
+	tests := map[string]*diffTest{}
+	keys := []string{}
+	for _, job := range run.Jobs {
+		for _, suite := range job.Suites {
+			for _, test := range suite.Tests {
+				key := diffKey(job, suite, test)
+				if _, ok := tests[key]; !ok {
+					tests[key] = &diffTest{job, suite, test}
+					keys = append(keys, key)
+				}
+			}
+		}
+	}
+	return tests, keys
+}
+
+// Diff compares the tests of two runs.
+func Diff(base, head *Run) *RunDiff {
+	diff := &RunDiff{Base: runLabel(base), Head: runLabel(head), Changes: []*TestChange{}}
+	baseTests, baseKeys := diffTests(base)
+	headTests, headKeys := diffTests(head)
+	for _, key := range headKeys {
+		h := headTests[key]
+		change := &TestChange{
+			Device:     h.job.Device,
+			Os:         h.job.Os,
+			Suite:      h.suite.Name,
+			Test:       h.test.Name,
+			HeadResult: h.test.Result,
+			Message:    h.test.Message,
+		}
+		b, ok := baseTests[key]
+		if ok {
+			change.BaseResult = b.test.Result
+		}
+		switch {
+		case !ok:
+			change.Change = ChangeAdded
+		case Failed(change.HeadResult) && Failed(change.BaseResult):
+			change.Change = ChangeStillFailing
+		case Failed(change.HeadResult):
+			change.Change = ChangeNewlyFailing
+		case Passed(change.HeadResult) && Failed(change.BaseResult):
+			change.Change = ChangeNewlyPassing
+			change.Message = ""
+		default:
+			diff.Unchanged++
+			continue
+		}
+		diff.Changes = append(diff.Changes, change)
+	}
+	for _, key := range baseKeys {
+		if _, ok := headTests[key]; ok {
+			continue
+		}
+		b := baseTests[key]
+		diff.Changes = append(diff.Changes, &TestChange{
+			Change:     ChangeRemoved,
+			Device:     b.job.Device,
+			Os:         b.job.Os,
+			Suite:      b.suite.Name,
+			Test:       b.test.Name,
+			BaseResult: b.test.Result,
+		})
+	}
+	sort.SliceStable(diff.Changes, func(i, j int) bool {
+		return changeOrder[diff.Changes[i].Change] < changeOrder[diff.Changes[j].Change]
+	})
+	return diff
+}
+
+func runLabel(run *Run) string {
+	if len(run.Name) > 0 {
+		return run.Name
+	}
+	return run.Arn
+}
+
+// Regressions returns the failures which head introduced: tests which are
+// newly failing, and added tests which failed.
+func (diff *RunDiff) Regressions() []*TestChange {
+	regressions := []*TestChange{}
+	for _, change := range diff.Changes {
+		if change.Change == ChangeNewlyFailing || (change.Change == ChangeAdded && Failed(change.HeadResult)) {
+			regressions = append(regressions, change)
+		}
+	}
+	return regressions
+}
+
+// Count returns the number of changes of a kind, e.g. ChangeNewlyFailing.
+func (diff *RunDiff) Count(change string) int {
+	n := 0
+	for _, c := range diff.Changes {
+		if c.Change == change {
+			n++
+		}
+	}
+	return n
+}
+
+// Summary describes the number of each kind of change, e.g. "2 newly failing,
+// 1 still failing, 0 newly passing, 0 added, 0 removed".
+func (diff *RunDiff) Summary() string {
+	parts := []string{}
+	for _, change := range []string{ChangeNewlyFailing, ChangeStillFailing, ChangeNewlyPassing, ChangeAdded, ChangeRemoved} {
+		parts = append(parts, fmt.Sprintf("%d %s", diff.Count(change), change))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (change *TestChange) device() string {
+	if len(change.Os) == 0 {
+		return change.Device
+	}
+	return change.Device + " (" + change.Os + ")"
+}
+
+func resultOrDash(result string) string {
+	if len(result) == 0 {
+		return "-"
+	}
+	return result
+}
+
+// WriteDiffTable writes the changes of a diff as an aligned table.
+func WriteDiffTable(w io.Writer, diff *RunDiff) error {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(table, "Base: %s\nHead: %s\n%s\n", diff.Base, diff.Head, diff.Summary())
+	if len(diff.Changes) > 0 {
+		fmt.Fprintln(table)
+		fmt.Fprintln(table, "CHANGE\tDEVICE\tSUITE\tTEST\tBASE\tHEAD")
+	}
+	for _, change := range diff.Changes {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			change.Change,
+			change.device(),
+			change.Suite,
+			change.Test,
+			resultOrDash(change.BaseResult),
+			resultOrDash(change.HeadResult))
+	}
+	return table.Flush()
+}
+
+// WriteDiffMarkdown writes the changes of a diff as Markdown, e.g. for a pull
+// request comment.
+func WriteDiffMarkdown(w io.Writer, diff *RunDiff) error {
+	out := &strings.Builder{}
+	out.WriteString("## Test changes\n\n")
+	fmt.Fprintf(out, "Comparing **%s** with base **%s**: %s.\n", markdownCell(diff.Head), markdownCell(diff.Base), diff.Summary())
+	if len(diff.Changes) > 0 {
+		out.WriteString("\n| Change | Device | Suite | Test | Base | Head |\n")
+		out.WriteString("| --- | --- | --- | --- | --- | --- |\n")
+	}
+	for _, change := range diff.Changes {
+		fmt.Fprintf(out, "| %s | %s | %s | %s | %s | %s |\n",
+			change.Change,
+			markdownCell(change.device()),
+			markdownCell(change.Suite),
+			markdownCell(change.Test),
+			resultOrDash(change.BaseResult),
+			resultOrDash(change.HeadResult))
+	}
+	_, err := io.WriteString(w, out.String())
+	return err
+}
@@ -0,0 +1,112 @@
+package results
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// diffRuns returns testdata/run.json as a base run, and a head run in which
+// one test is newly failing, one newly passing, one still failing, one added
+// (and failing) and one removed.
+func diffRuns(t *testing.T) (*Run, *Run) {
+	base, err := Load("testdata/run.json")
+	assert.Nil(t, err)
+	head, err := Load("testdata/run.json")
+	assert.Nil(t, err)
+	head.Name = "feature@1234567"
+	s5, s4 := head.Jobs[0].Suites[0], head.Jobs[1].Suites[0]
+	s5.Tests[0].Result = ResultFailed
+	s5.Tests[0].Message = "Boom"
+	s5.Tests[1].Result = ResultPassed
+	s5.Tests = s5.Tests[:2]
+	s4.Tests = append(s4.Tests, &Test{Name: "testSignup", Result: ResultFailed})
+	return base, head
+}
+
+func TestDiff(t *testing.T) {
+	assert := assert.New(t)
+	base, head := diffRuns(t)
+	diff := Diff(base, head)
+
+	assert.Equal("master@abc1234", diff.Base)
+	assert.Equal("feature@1234567", diff.Head)
+	assert.Equal(1, diff.Unchanged)
+	assert.Equal(5, len(diff.Changes))
+	assert.Equal(&TestChange{
+		Change:     ChangeNewlyFailing,
+		Device:     "Samsung Galaxy S5 (AT&T)",
+		Os:         "5.0",
+		Suite:      "com.example.LoginTest",
+		Test:       "testLogin",
+		BaseResult: ResultPassed,
+		HeadResult: ResultFailed,
+		Message:    "Boom",
+	}, diff.Changes[0])
+	assert.Equal(ChangeStillFailing, diff.Changes[1].Change)
+	assert.Equal("testLogout", diff.Changes[1].Test)
+	assert.Equal(ChangeNewlyPassing, diff.Changes[2].Change)
+	assert.Equal("", diff.Changes[2].Message)
+	assert.Equal(ChangeAdded, diff.Changes[3].Change)
+	assert.Equal("", diff.Changes[3].BaseResult)
+	assert.Equal(ChangeRemoved, diff.Changes[4].Change)
+	assert.Equal("testForgotPassword", diff.Changes[4].Test)
+	assert.Equal("", diff.Changes[4].HeadResult)
+	assert.Equal("1 newly failing, 1 still failing, 1 newly passing, 1 added, 1 removed", diff.Summary())
+
+	// regressions should include added tests which failed
+	regressions := diff.Regressions()
+	assert.Equal(2, len(regressions))
+	assert.Equal("testLogin", regressions[0].Test)
+	assert.Equal("testSignup", regressions[1].Test)
+
+	// a run compared with itself should have only the tests still failing
+	diff = Diff(base, base)
+	assert.Equal(0, len(diff.Regressions()))
+	assert.Equal(2, diff.Count(ChangeStillFailing))
+	assert.Equal(2, len(diff.Changes))
+
+	// tests should still match if a device's OS was updated, showing the
+	// head's OS
+	for _, job := range head.Jobs {
+		job.Os = "6.0"
+	}
+	diff = Diff(base, head)
+	assert.Equal("1 newly failing, 1 still failing, 1 newly passing, 1 added, 1 removed", diff.Summary())
+	assert.Equal("6.0", diff.Changes[0].Os)
+	assert.Equal("5.0", diff.Changes[4].Os)
+}
+
+func TestWriteDiffTable(t *testing.T) {
+	assert := assert.New(t)
+	base, head := diffRuns(t)
+	buffer := &bytes.Buffer{}
+	assert.Nil(WriteDiffTable(buffer, Diff(base, head)))
+	expected := `Base: master@abc1234
+Head: feature@1234567
+1 newly failing, 1 still failing, 1 newly passing, 1 added, 1 removed
+
+CHANGE         DEVICE                              SUITE                  TEST                BASE     HEAD
+newly failing  Samsung Galaxy S5 (AT&T) (5.0)      com.example.LoginTest  testLogin           PASSED   FAILED
+still failing  Samsung Galaxy S4 (Sprint) (4.4.2)  com.example.LoginTest  testLogout          ERRORED  ERRORED
+newly passing  Samsung Galaxy S5 (AT&T) (5.0)      com.example.LoginTest  testLogout          FAILED   PASSED
+added          Samsung Galaxy S4 (Sprint) (4.4.2)  com.example.LoginTest  testSignup          -        FAILED
+removed        Samsung Galaxy S5 (AT&T) (5.0)      com.example.LoginTest  testForgotPassword  SKIPPED  -
+`
+	assert.Equal(expected, buffer.String())
+}
+
+func TestWriteDiffMarkdown(t *testing.T) {
+	assert := assert.New(t)
+	base, head := diffRuns(t)
+	buffer := &bytes.Buffer{}
+	assert.Nil(WriteDiffMarkdown(buffer, Diff(base, head)))
+	assert.Contains(buffer.String(), "Comparing **feature@1234567** with base **master@abc1234**: 1 newly failing,")
+	assert.Contains(buffer.String(), "| newly failing | Samsung Galaxy S5 (AT&T) (5.0) | com.example.LoginTest | testLogin | PASSED | FAILED |\n")
+	assert.Contains(buffer.String(), "| removed | Samsung Galaxy S5 (AT&T) (5.0) | com.example.LoginTest | testForgotPassword | SKIPPED | - |\n")
+
+	// without changes there should be no table
+	buffer = &bytes.Buffer{}
+	assert.Nil(WriteDiffMarkdown(buffer, Diff(&Run{Name: "a"}, &Run{Name: "b"})))
+	assert.NotContains(buffer.String(), "| Change |")
+}
@@ -0,0 +1,265 @@
+package results
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// An Artifact is an artifact (log, screenshot, video, etc.) of a test in a
+// run, along with the device, suite and test it belongs to. File is the path
+// of the downloaded artifact, relative to the download directory (and the
+// manifest written there), and is set once the artifact is downloaded. Url is
+// only valid for a while, so it is not saved in the manifest.
+type Artifact struct {
+	Device    string `json:"device"`
+	Suite     string `json:"suite"`
+	Test      string `json:"test"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Extension string `json:"extension"`
+	Arn       string `json:"arn"`
+	File      string `json:"file"`
+	Url       string `json:"-"`
+}
+
+// screenshotType is the Device Farm artifact type of screenshots, which HTML
+// reports embed rather than link to.
+const screenshotType = "SCREENSHOT"
+
+// LoadArtifacts reads the artifacts listed in an artifact manifest file.
+func LoadArtifacts(filename string) ([]*Artifact, error) {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	artifacts := []*Artifact{}
+	err = json.Unmarshal(bytes, &artifacts)
+	if err != nil {
+		return nil, err
+	}
+	return artifacts, nil
+}
+
+// An HTMLReport renders a run as a single static HTML page which works
+// offline: a summary, a device by test matrix, and the details of each
+// failure. Artifacts are the downloaded artifacts of the run's tests, with
+// files relative to ArtifactsDir. Screenshots are embedded in the page, and
+// other artifacts are linked relative to PageDir, the directory the page is
+// saved in.
+type HTMLReport struct {
+	Run          *Run
+	Artifacts    []*Artifact
+	ArtifactsDir string
+	PageDir      string
+}
+
+type htmlLink struct {
+	Name string
+	Type string
+	Href string
+}
+
+type htmlCell struct {
+	Result string
+	Anchor string
+}
+
+type htmlRow struct {
+	Suite string
+	Test  string
+	Cells []htmlCell
+}
+
+type htmlFailure struct {
+	Anchor      string
+	Job         *Job
+	Suite       *Suite
+	Test        *Test
+	Screenshots []template.URL
+	Links       []htmlLink
+}
+
+type htmlDevice struct {
+	Job   *Job
+	Links []htmlLink
+}
+
+type htmlData struct {
+	Run      *Run
+	Duration time.Duration
+	Matrix   []*htmlRow
+	Failures []*htmlFailure
+	Devices  []*htmlDevice
+}
+
+// artifactKey identifies the test an artifact belongs to.
+func artifactKey(device, suite, test string) string {
+	return device + "\x00" + suite + "\x00" + test
+}
+
+// Write renders the report as HTML.
+func (report *HTMLReport) Write(w io.Writer) error {
+	run := report.Run
+	data := &htmlData{Run: run, Duration: run.Duration().Round(time.Second)}
+	byTest := map[string][]*Artifact{}
+	for _, artifact := range report.Artifacts {
+		key := artifactKey(artifact.Device, artifact.Suite, artifact.Test)
+		byTest[key] = append(byTest[key], artifact)
+	}
+
+	rows := map[string]*htmlRow{}
+	for i, job := range run.Jobs {
+		device := &htmlDevice{Job: job}
+		data.Devices = append(data.Devices, device)
+		for _, suite := range job.Suites {
+			for _, test := range suite.Tests {
+				key := suite.Name + "\x00" + test.Name
+				row, ok := rows[key]
+				if !ok {
+					row = &htmlRow{Suite: suite.Name, Test: test.Name, Cells: make([]htmlCell, len(run.Jobs))}
+					rows[key] = row
+					data.Matrix = append(data.Matrix, row)
+				}
+				row.Cells[i].Result = test.Result
+				artifacts := byTest[artifactKey(job.Device, suite.Name, test.Name)]
+				for _, artifact := range artifacts {
+					if artifact.Type != screenshotType {
+						device.Links = append(device.Links, report.link(artifact))
+					}
+				}
+				if test.Result != ResultFailed && test.Result != ResultErrored {
+					continue
+				}
+				failure := &htmlFailure{
+					Anchor: fmt.Sprintf("failure-%d", len(data.Failures)+1),
+					Job:    job,
+					Suite:  suite,
+					Test:   test,
+				}
+				row.Cells[i].Anchor = failure.Anchor
+				for _, artifact := range artifacts {
+					if screenshot, ok := report.screenshot(artifact); ok {
+						failure.Screenshots = append(failure.Screenshots, screenshot)
+					} else {
+						failure.Links = append(failure.Links, report.link(artifact))
+					}
+				}
+				data.Failures = append(data.Failures, failure)
+			}
+		}
+	}
+	return htmlTemplate.Execute(w, data)
+}
+
+// link returns a link to an artifact, relative to the page.
+func (report *HTMLReport) link(artifact *Artifact) htmlLink {
+	path := filepath.Join(report.ArtifactsDir, artifact.File)
+	if rel, err := filepath.Rel(report.PageDir, path); err == nil {
+		path = rel
+	}
+	return htmlLink{
+		Name: artifact.Test + ": " + artifact.Name,
+		Type: artifact.Type,
+		Href: filepath.ToSlash(path),
+	}
+}
+
+// screenshot returns a screenshot artifact as a data URL, or false if the
+// artifact is not a screenshot or its file cannot be read, in which case it
+// should be linked instead.
+func (report *HTMLReport) screenshot(artifact *Artifact) (template.URL, bool) {
+	if artifact.Type != screenshotType {
+		return "", false
+	}
+	bytes, err := ioutil.ReadFile(filepath.Join(report.ArtifactsDir, artifact.File))
+	if err != nil {
+		return "", false
+	}
+	mimeType := mime.TypeByExtension("." + strings.ToLower(artifact.Extension))
+	if !strings.HasPrefix(mimeType, "image/") {
+		mimeType = "image/png"
+	}
+	// data URLs are safe here, as they are built from files we downloaded
+	return template.URL("data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(bytes)), true
+}
+
+var htmlTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"lower": strings.ToLower,
+	"date": func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.UTC().Format("2006-01-02 15:04:05 MST")
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Run.Name}}</title>
+<style>
+body { font-family: -apple-system, Helvetica, Arial, sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ddd; padding: 4px 8px; text-align: left; vertical-align: top; }
+th { background: #f4f4f4; }
+pre { background: #f8f8f8; border: 1px solid #ddd; padding: 1em; overflow-x: auto; white-space: pre-wrap; }
+img { max-width: 240px; margin: 0 8px 8px 0; border: 1px solid #ddd; }
+.passed { background: #dff0d8; }
+.failed, .errored { background: #f2dede; }
+.warned { background: #fcf8e3; }
+.skipped, .stopped, .pending { background: #eee; }
+</style>
+</head>
+<body>
+<h1>{{.Run.Name}}</h1>
+<table>
+<tr><th>Result</th><td class="{{lower .Run.Result}}">{{.Run.Result}}</td></tr>
+<tr><th>Status</th><td>{{.Run.Status}}</td></tr>
+{{if .Run.Message}}<tr><th>Message</th><td>{{.Run.Message}}</td></tr>
+{{end}}<tr><th>Created</th><td>{{date .Run.Created}}</td></tr>
+<tr><th>Duration</th><td>{{.Duration}}</td></tr>
+<tr><th>Device minutes</th><td>{{printf "%.1f" .Run.DeviceMinutes}}</td></tr>
+<tr><th>Run</th><td>{{.Run.Arn}}</td></tr>
+</table>
+{{with .Run.Counters}}<table>
+<tr><th>Total</th><th>Passed</th><th>Failed</th><th>Errored</th><th>Warned</th><th>Skipped</th><th>Stopped</th></tr>
+<tr><td>{{.Total}}</td><td>{{.Passed}}</td><td>{{.Failed}}</td><td>{{.Errored}}</td><td>{{.Warned}}</td><td>{{.Skipped}}</td><td>{{.Stopped}}</td></tr>
+</table>
+{{end}}
+<h2>Tests</h2>
+<table>
+<tr><th>Suite</th><th>Test</th>{{range .Devices}}<th>{{.Job.Device}}<br>{{.Job.Os}}</th>{{end}}</tr>
+{{range .Matrix}}<tr><td>{{.Suite}}</td><td>{{.Test}}</td>{{range .Cells}}<td class="{{lower .Result}}">{{if .Anchor}}<a href="#{{.Anchor}}">{{.Result}}</a>{{else if .Result}}{{.Result}}{{else}}-{{end}}</td>{{end}}</tr>
+{{end}}</table>
+{{if .Failures}}
+<h2>Failures</h2>
+{{range .Failures}}<div id="{{.Anchor}}">
+<h3>{{.Test.Name}}</h3>
+<p>{{.Job.Device}} ({{.Job.Os}}) &middot; {{.Suite.Name}} &middot; {{.Test.Result}}</p>
+{{if .Test.Message}}<pre>{{.Test.Message}}</pre>
+{{end}}{{range .Screenshots}}<img src="{{.}}">{{end}}
+{{if .Links}}<ul>
+{{range .Links}}<li><a href="{{.Href}}">{{.Name}}</a> ({{.Type}})</li>
+{{end}}</ul>
+{{end}}</div>
+{{end}}{{end}}
+<h2>Devices</h2>
+{{range .Devices}}<h3>{{.Job.Device}} ({{.Job.Os}})</h3>
+<p class="{{lower .Job.Result}}">{{.Job.Result}}{{with .Job.Message}}: {{.}}{{end}}</p>
+{{if .Links}}<details>
+<summary>Logs and videos</summary>
+<ul>
+{{range .Links}}<li><a href="{{.Href}}">{{.Name}}</a> ({{.Type}})</li>
+{{end}}</ul>
+</details>
+{{end}}{{end}}
+</body>
+</html>
+`))
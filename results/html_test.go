@@ -0,0 +1,70 @@
+package results
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestLoadArtifacts(t *testing.T) {
+	assert := assert.New(t)
+	artifacts, err := LoadArtifacts("testdata/artifacts/manifest.json")
+	assert.Nil(err)
+	assert.Equal(2, len(artifacts))
+	assert.Equal("Samsung Galaxy S5 (AT&T)", artifacts[0].Device)
+	assert.Equal("SCREENSHOT", artifacts[0].Type)
+
+	_, err = LoadArtifacts("testdata/nope.json")
+	assert.NotNil(err)
+}
+
+func TestHTMLReport(t *testing.T) {
+	assert := assert.New(t)
+	run, err := Load("testdata/run.json")
+	assert.Nil(err)
+	artifacts, err := LoadArtifacts("testdata/artifacts/manifest.json")
+	assert.Nil(err)
+
+	report := &HTMLReport{
+		Run:          run,
+		Artifacts:    artifacts,
+		ArtifactsDir: "testdata/artifacts",
+		PageDir:      "testdata",
+	}
+	buffer := &bytes.Buffer{}
+	assert.Nil(report.Write(buffer))
+	html := buffer.String()
+
+	// should include the summary
+	assert.Contains(html, "<title>master@abc1234</title>")
+	assert.Contains(html, `<td class="failed">FAILED</td>`)
+
+	// should have one matrix row per test, with a cell per device
+	assert.Equal(1, strings.Count(html, "<td>testLogout</td>"))
+	assert.Contains(html, `<td>com.example.LoginTest</td><td>testForgotPassword</td><td class="skipped">SKIPPED</td><td class="">-</td>`)
+	assert.Contains(html, `<td class="failed"><a href="#failure-1">FAILED</a></td><td class="errored"><a href="#failure-2">ERRORED</a></td>`)
+
+	// should show each failure's message, escaped
+	assert.Contains(html, `<div id="failure-1">`)
+	assert.Contains(html, "<pre>junit.framework.AssertionFailedError: expected &lt;true&gt; but was &lt;false&gt;</pre>")
+	assert.Contains(html, "<pre>Process crashed.</pre>")
+
+	// should embed screenshots, and link to other artifacts relative to the page
+	assert.Contains(html, `<img src="data:image/png;base64,`+base64.StdEncoding.EncodeToString([]byte("PNGDATA"))+`">`)
+	assert.Contains(html, `<a href="artifacts/Samsung%20Galaxy%20S5%20%28AT_T%29/com.example.LoginTest/testLogout/Logcat.logcat">testLogout: Logcat</a> (DEVICE_LOG)`)
+
+	// screenshots which cannot be read should be linked instead
+	report.ArtifactsDir = "testdata/nope"
+	buffer = &bytes.Buffer{}
+	assert.Nil(report.Write(buffer))
+	assert.NotContains(buffer.String(), "data:image/png")
+	assert.Contains(buffer.String(), "testLogout: Screenshot 1</a> (SCREENSHOT)")
+
+	// should work without artifacts
+	report.Artifacts = nil
+	buffer = &bytes.Buffer{}
+	assert.Nil(report.Write(buffer))
+	assert.NotContains(buffer.String(), "<details>")
+}
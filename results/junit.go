@@ -0,0 +1,128 @@
+package results
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"time"
+)
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int64            `xml:"tests,attr"`
+	Failures int64            `xml:"failures,attr"`
+	Errors   int64            `xml:"errors,attr"`
+	Skipped  int64            `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name       string          `xml:"name,attr"`
+	Tests      int64           `xml:"tests,attr"`
+	Failures   int64           `xml:"failures,attr"`
+	Errors     int64           `xml:"errors,attr"`
+	Skipped    int64           `xml:"skipped,attr"`
+	Time       string          `xml:"time,attr"`
+	Timestamp  string          `xml:"timestamp,attr,omitempty"`
+	Properties []junitProperty `xml:"properties>property,omitempty"`
+	Cases      []junitTestCase `xml:"testcase"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr,omitempty"`
+	Type    string `xml:"type,attr,omitempty"`
+	Body    string `xml:",chardata"`
+}
+
+// junitTime formats a duration in seconds, as expected by JUnit consumers.
+func junitTime(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// WriteJUnit writes the run as JUnit XML, with one <testsuite> per device and
+// suite. Failed and errored tests carry the test's message, while skipped and
+// stopped tests are reported as skipped. The totals are counted from the
+// tests written, rather than taken from Device Farm's counters, so that they
+// always agree with the <testcase> elements.
+func (run *Run) WriteJUnit(w io.Writer) error {
+	suites := junitTestSuites{
+		Name: run.Name,
+		Time: junitTime(run.Duration()),
+	}
+	if len(suites.Name) == 0 {
+		suites.Name = run.Arn
+	}
+	for _, job := range run.Jobs {
+		for _, suite := range job.Suites {
+			junitSuite := newJUnitTestSuite(job, suite)
+			suites.Suites = append(suites.Suites, junitSuite)
+			suites.Tests += junitSuite.Tests
+			suites.Failures += junitSuite.Failures
+			suites.Errors += junitSuite.Errors
+			suites.Skipped += junitSuite.Skipped
+		}
+	}
+	bytes, err := xml.MarshalIndent(suites, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, xml.Header+string(bytes)+"\n")
+	return err
+}
+
+func newJUnitTestSuite(job *Job, suite *Suite) junitTestSuite {
+	name := job.Device + " - " + suite.Name
+	junitSuite := junitTestSuite{
+		Name: name,
+		Time: junitTime(suite.Duration()),
+		Properties: []junitProperty{
+			{"device", job.Device},
+			{"platform", job.Platform},
+			{"os", job.Os},
+		},
+	}
+	if !suite.Started.IsZero() {
+		junitSuite.Timestamp = suite.Started.UTC().Format("2006-01-02T15:04:05")
+	}
+	for _, test := range suite.Tests {
+		junitCase := junitTestCase{
+			Name:      test.Name,
+			Classname: name,
+			Time:      junitTime(test.Duration()),
+		}
+		message := &junitMessage{Message: test.Message, Type: test.Result, Body: test.Message}
+		switch test.Result {
+		case ResultFailed:
+			junitCase.Failure = message
+			junitSuite.Failures++
+		case ResultErrored:
+			junitCase.Error = message
+			junitSuite.Errors++
+		case ResultSkipped, ResultStopped:
+			junitCase.Skipped = &junitMessage{Message: test.Message}
+			junitSuite.Skipped++
+		case ResultWarned:
+			junitCase.SystemOut = test.Message
+		}
+		junitSuite.Cases = append(junitSuite.Cases, junitCase)
+		junitSuite.Tests++
+	}
+	return junitSuite
+}
@@ -0,0 +1,35 @@
+package results
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+)
+
+func TestWriteJUnit(t *testing.T) {
+	assert := assert.New(t)
+
+	run, err := Load("testdata/run.json")
+	assert.Nil(err)
+
+	// should match the expected XML
+	buffer := &bytes.Buffer{}
+	err = run.WriteJUnit(buffer)
+	assert.Nil(err)
+	expected, err := ioutil.ReadFile("testdata/junit.xml")
+	assert.Nil(err)
+	assert.Equal(string(expected), buffer.String())
+
+	// totals should be counted from the tests, even if the counters disagree
+	run.Counters = Counters{Total: 100, Failed: 10}
+	for _, job := range run.Jobs {
+		for _, suite := range job.Suites {
+			suite.Counters = Counters{Total: 50, Errored: 5, Stopped: 1}
+		}
+	}
+	buffer = &bytes.Buffer{}
+	err = run.WriteJUnit(buffer)
+	assert.Nil(err)
+	assert.Equal(string(expected), buffer.String())
+}
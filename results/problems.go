@@ -0,0 +1,158 @@
+package results
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// A Problem is a failure message shared by one or more tests, possibly on
+// several devices, as grouped by Device Farm's unique problems.
+type Problem struct {
+	Result      string               `json:"result"`
+	Message     string               `json:"message"`
+	Occurrences []*ProblemOccurrence `json:"occurrences"`
+}
+
+// A ProblemOccurrence is a test which had a problem. Suite and Test are blank
+// if the problem was not in a test, e.g. if the device failed to set up.
+type ProblemOccurrence struct {
+	Device string `json:"device"`
+	Os     string `json:"os"`
+	Suite  string `json:"suite,omitempty"`
+	Test   string `json:"test,omitempty"`
+	Arn    string `json:"arn,omitempty"`
+}
+
+// problemSeverity orders problems by result, most severe first.
+var problemSeverity = map[string]int{
+	ResultErrored: 0,
+	ResultFailed:  1,
+	ResultWarned:  2,
+	ResultStopped: 3,
+	ResultSkipped: 4,
+}
+
+// SortProblems sorts problems by result, most severe first, and then by how
+// many tests had them.
+func SortProblems(problems []*Problem) {
+	sort.SliceStable(problems, func(i, j int) bool {
+		a, b := problems[i], problems[j]
+		if problemSeverity[a.Result] != problemSeverity[b.Result] {
+			return problemSeverity[a.Result] < problemSeverity[b.Result]
+		}
+		if len(a.Occurrences) != len(b.Occurrences) {
+			return len(a.Occurrences) > len(b.Occurrences)
+		}
+		return a.Message < b.Message
+	})
+}
+
+// where describes an occurrence, e.g. "com.example.LoginTest > testLogout".
+func (o *ProblemOccurrence) where() string {
+	parts := []string{}
+	for _, part := range []string{o.Suite, o.Test} {
+		if len(part) > 0 {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return "(no test)"
+	}
+	return strings.Join(parts, " > ")
+}
+
+func (o *ProblemOccurrence) device() string {
+	if len(o.Os) == 0 {
+		return o.Device
+	}
+	return o.Device + " (" + o.Os + ")"
+}
+
+func pluralTests(n int) string {
+	if n == 1 {
+		return "1 test"
+	}
+	return fmt.Sprintf("%d tests", n)
+}
+
+// WriteProblemsText writes problems for reading in a terminal: each result
+// and message, followed by the tests which had it.
+func WriteProblemsText(w io.Writer, problems []*Problem) error {
+	out := &strings.Builder{}
+	if len(problems) == 0 {
+		out.WriteString("No problems found\n")
+	}
+	for i, problem := range problems {
+		if i > 0 {
+			out.WriteString("\n")
+		}
+		lines := strings.Split(strings.TrimSpace(problem.Message), "\n")
+		fmt.Fprintf(out, "%s (%s): %s\n", problem.Result, pluralTests(len(problem.Occurrences)), lines[0])
+		for _, line := range lines[1:] {
+			fmt.Fprintf(out, "    %s\n", strings.TrimRight(line, "\r"))
+		}
+		for _, o := range problem.Occurrences {
+			fmt.Fprintf(out, "  - %s: %s\n", o.device(), o.where())
+		}
+	}
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// WriteProblemsMarkdown writes problems as Markdown, e.g. for pasting into a
+// ticket or pull request comment.
+func WriteProblemsMarkdown(w io.Writer, problems []*Problem) error {
+	out := &strings.Builder{}
+	out.WriteString("## Problems\n\n")
+	if len(problems) == 0 {
+		out.WriteString("No problems found.\n")
+	}
+	for _, problem := range problems {
+		fmt.Fprintf(out, "### %s in %s\n\n", problem.Result, pluralTests(len(problem.Occurrences)))
+		fence := markdownFence(problem.Message)
+		fmt.Fprintf(out, "%s\n%s\n%s\n\n", fence, strings.TrimSpace(problem.Message), fence)
+		out.WriteString("| Device | OS | Suite | Test |\n")
+		out.WriteString("| --- | --- | --- | --- |\n")
+		for _, o := range problem.Occurrences {
+			fmt.Fprintf(out, "| %s | %s | %s | %s |\n",
+				markdownCell(o.Device),
+				markdownCell(o.Os),
+				markdownCell(o.Suite),
+				markdownCell(o.Test))
+		}
+		out.WriteString("\n")
+	}
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// markdownFence returns a code fence longer than any run of backticks in
+// text, so that the text cannot close it.
+func markdownFence(text string) string {
+	longest, run := 0, 0
+	for _, c := range text {
+		if c == '`' {
+			run++
+			if run > longest {
+				longest = run
+			}
+		} else {
+			run = 0
+		}
+	}
+	if longest < 3 {
+		return "```"
+	}
+	return strings.Repeat("`", longest+1)
+}
+
+// markdownCell escapes text for a Markdown table cell.
+func markdownCell(text string) string {
+	if len(text) == 0 {
+		return "-"
+	}
+	text = strings.Replace(text, "|", "\\|", -1)
+	return strings.Join(strings.Fields(text), " ")
+}
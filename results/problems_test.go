@@ -0,0 +1,93 @@
+package results
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func testProblems() []*Problem {
+	problems := []*Problem{
+		{
+			Result:  ResultFailed,
+			Message: "junit.framework.AssertionFailedError: expected <true>\n\tat com.example.LoginTest.testLogout(LoginTest.java:42)",
+			Occurrences: []*ProblemOccurrence{
+				{Device: "Google Pixel", Os: "9", Suite: "com.example.LoginTest", Test: "testLogout", Arn: "arn:test1"},
+			},
+		},
+		{
+			Result:  ResultErrored,
+			Message: "Device failed to set up",
+			Occurrences: []*ProblemOccurrence{
+				{Device: "Galaxy S4", Arn: "arn:job1"},
+			},
+		},
+		{
+			Result:  ResultFailed,
+			Message: "Timed out | waiting for `login`",
+			Occurrences: []*ProblemOccurrence{
+				{Device: "Google Pixel", Os: "9", Suite: "com.example.LoginTest", Test: "testLogin"},
+				{Device: "Galaxy S9", Os: "8.0.0", Suite: "com.example.LoginTest", Test: "testLogin"},
+			},
+		},
+	}
+	SortProblems(problems)
+	return problems
+}
+
+func TestSortProblems(t *testing.T) {
+	assert := assert.New(t)
+	problems := testProblems()
+
+	// should sort by result then test count
+	assert.Equal(3, len(problems))
+	assert.Equal(ResultErrored, problems[0].Result)
+	assert.Equal("Timed out | waiting for `login`", problems[1].Message)
+	assert.Equal(ResultFailed, problems[2].Result)
+}
+
+func TestWriteProblemsText(t *testing.T) {
+	assert := assert.New(t)
+	buffer := &bytes.Buffer{}
+	assert.Nil(WriteProblemsText(buffer, testProblems()))
+	expected := `ERRORED (1 test): Device failed to set up
+  - Galaxy S4: (no test)
+
+FAILED (2 tests): Timed out | waiting for ` + "`login`" + `
+  - Google Pixel (9): com.example.LoginTest > testLogin
+  - Galaxy S9 (8.0.0): com.example.LoginTest > testLogin
+
+FAILED (1 test): junit.framework.AssertionFailedError: expected <true>
+    	at com.example.LoginTest.testLogout(LoginTest.java:42)
+  - Google Pixel (9): com.example.LoginTest > testLogout
+`
+	assert.Equal(expected, buffer.String())
+
+	buffer = &bytes.Buffer{}
+	assert.Nil(WriteProblemsText(buffer, []*Problem{}))
+	assert.Equal("No problems found\n", buffer.String())
+}
+
+func TestWriteProblemsMarkdown(t *testing.T) {
+	assert := assert.New(t)
+	buffer := &bytes.Buffer{}
+	problems := testProblems()
+	assert.Nil(WriteProblemsMarkdown(buffer, problems[:2]))
+	expected := "## Problems\n\n" +
+		"### ERRORED in 1 test\n\n" +
+		"```\nDevice failed to set up\n```\n\n" +
+		"| Device | OS | Suite | Test |\n" +
+		"| --- | --- | --- | --- |\n" +
+		"| Galaxy S4 | - | - | - |\n\n" +
+		"### FAILED in 2 tests\n\n" +
+		"```\nTimed out | waiting for `login`\n```\n\n" +
+		"| Device | OS | Suite | Test |\n" +
+		"| --- | --- | --- | --- |\n" +
+		"| Google Pixel | 9 | com.example.LoginTest | testLogin |\n" +
+		"| Galaxy S9 | 8.0.0 | com.example.LoginTest | testLogin |\n\n"
+	assert.Equal(expected, buffer.String())
+
+	// messages should not be able to close their code block
+	assert.Equal("````", markdownFence("a ``` b"))
+	assert.Equal(`a \| b`, markdownCell("a | b"))
+}
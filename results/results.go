@@ -0,0 +1,142 @@
+/*
+Package results provides a model of Device Farm test results: a run, its jobs
+(one per device), their suites, and the tests in each suite. The model does not
+depend on AWS, so results can be saved, loaded and exported (e.g. to JUnit XML)
+without making any requests. The awsutil package converts Device Farm's types
+into the model.
+*/
+package results
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+)
+
+// Device Farm execution results, as found in the Result fields of the model.
+// These match the devicefarm.ExecutionResult* constants from the AWS SDK.
+const (
+	ResultPending = "PENDING"
+	ResultPassed  = "PASSED"
+	ResultWarned  = "WARNED"
+	ResultFailed  = "FAILED"
+	ResultSkipped = "SKIPPED"
+	ResultErrored = "ERRORED"
+	ResultStopped = "STOPPED"
+)
+
+// Failed returns true if a result is a failure, i.e. FAILED or ERRORED.
+func Failed(result string) bool {
+	return result == ResultFailed || result == ResultErrored
+}
+
+// Passed returns true if a result is a pass, i.e. PASSED or WARNED. Tests
+// which were skipped or stopped neither passed nor failed.
+func Passed(result string) bool {
+	return result == ResultPassed || result == ResultWarned
+}
+
+// Counters specifies how many tests had each result.
+type Counters struct {
+	Total   int64 `json:"total"`
+	Passed  int64 `json:"passed"`
+	Failed  int64 `json:"failed"`
+	Errored int64 `json:"errored"`
+	Warned  int64 `json:"warned"`
+	Skipped int64 `json:"skipped"`
+	Stopped int64 `json:"stopped"`
+}
+
+// Timing specifies when a run, job, suite or test started and stopped, and
+// how many device minutes it used.
+type Timing struct {
+	Started       time.Time `json:"started"`
+	Stopped       time.Time `json:"stopped"`
+	DeviceMinutes float64   `json:"device_minutes"`
+}
+
+// Duration returns how long something took, based on the Started and Stopped
+// timestamps. If either timestamp is missing, it falls back to DeviceMinutes.
+func (timing *Timing) Duration() time.Duration {
+	if !timing.Started.IsZero() && !timing.Stopped.IsZero() && timing.Stopped.After(timing.Started) {
+		return timing.Stopped.Sub(timing.Started)
+	}
+	return time.Duration(timing.DeviceMinutes * float64(time.Minute))
+}
+
+// A Run is the top level of the results model. It contains one Job per device.
+type Run struct {
+	Arn      string    `json:"arn"`
+	Name     string    `json:"name"`
+	Status   string    `json:"status"`
+	Result   string    `json:"result"`
+	Message  string    `json:"message,omitempty"`
+	Created  time.Time `json:"created"`
+	Counters Counters  `json:"counters"`
+	Timing
+	Jobs []*Job `json:"jobs"`
+}
+
+// A Job is the execution of a run on one device.
+type Job struct {
+	Arn      string   `json:"arn"`
+	Device   string   `json:"device"`
+	Platform string   `json:"platform"`
+	Os       string   `json:"os"`
+	Status   string   `json:"status"`
+	Result   string   `json:"result"`
+	Message  string   `json:"message,omitempty"`
+	Counters Counters `json:"counters"`
+	Timing
+	Suites []*Suite `json:"suites"`
+}
+
+// A Suite is a group of tests within a job.
+type Suite struct {
+	Arn      string   `json:"arn"`
+	Name     string   `json:"name"`
+	Status   string   `json:"status"`
+	Result   string   `json:"result"`
+	Message  string   `json:"message,omitempty"`
+	Counters Counters `json:"counters"`
+	Timing
+	Tests []*Test `json:"tests"`
+}
+
+// A Test is a single test within a suite.
+type Test struct {
+	Arn     string `json:"arn"`
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Result  string `json:"result"`
+	Message string `json:"message,omitempty"`
+	Timing
+}
+
+// Load reads a Run from a JSON file, such as one written by Save().
+func Load(filename string) (*Run, error) {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	run := &Run{}
+	err = json.Unmarshal(bytes, run)
+	if err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+// Save writes the Run to a JSON file.
+func (run *Run) Save(filename string) error {
+	bytes, err := run.JSON()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, bytes, 0644)
+}
+
+// JSON returns the Run as indented JSON.
+func (run *Run) JSON() ([]byte, error) {
+	return json.MarshalIndent(run, "", "  ")
+}
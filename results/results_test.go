@@ -0,0 +1,77 @@
+package results
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	assert := assert.New(t)
+
+	// should succeed
+	run, err := Load("testdata/run.json")
+	assert.Nil(err)
+	assert.Equal("master@abc1234", run.Name)
+	assert.Equal(ResultFailed, run.Result)
+	assert.Equal(int64(5), run.Counters.Total)
+	assert.Equal(2, len(run.Jobs))
+	assert.Equal("Samsung Galaxy S5 (AT&T)", run.Jobs[0].Device)
+	assert.Equal(3, len(run.Jobs[0].Suites[0].Tests))
+	assert.Equal(ResultErrored, run.Jobs[1].Suites[0].Tests[1].Result)
+
+	// should fail because file does not exist
+	run, err = Load("testdata/does-not-exist.json")
+	assert.NotNil(err)
+	assert.Nil(run)
+
+	// should fail because file is not valid JSON
+	run, err = Load("testdata/junit.xml")
+	assert.NotNil(err)
+	assert.Nil(run)
+}
+
+func TestSave(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "devicefarm")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	filename := filepath.Join(tmpDir, "run.json")
+
+	// a saved run should load back unchanged
+	run, err := Load("testdata/run.json")
+	assert.Nil(err)
+	err = run.Save(filename)
+	assert.Nil(err)
+	loaded, err := Load(filename)
+	assert.Nil(err)
+	assert.Equal(run, loaded)
+
+	// should fail because directory does not exist
+	err = run.Save(filepath.Join(tmpDir, "foo", "run.json"))
+	assert.NotNil(err)
+}
+
+func TestDuration(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+
+	// should use timestamps
+	timing := Timing{Started: now, Stopped: now.Add(time.Minute), DeviceMinutes: 5}
+	assert.Equal(time.Minute, timing.Duration())
+
+	// should fall back to device minutes
+	timing = Timing{Started: now, DeviceMinutes: 1.5}
+	assert.Equal(90*time.Second, timing.Duration())
+
+	// should be zero
+	timing = Timing{}
+	assert.Equal(time.Duration(0), timing.Duration())
+}
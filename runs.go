@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/devicefarm"
+	"github.com/codegangsta/cli"
+	"github.com/ride/devicefarm/awsutil"
+	"github.com/ride/devicefarm/build"
+	"github.com/ride/devicefarm/results"
+	"github.com/ride/devicefarm/util"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// shortIdLength is how much of a run's ID is shown in tables. Any unique
+// prefix can be given to commands which take a run.
+const shortIdLength = 8
+
+// runsCommand returns the `runs` command group.
+func runsCommand(buildFlags []cli.Flag) cli.Command {
+	formatFlag := cli.StringFlag{
+		Name:  "format",
+		Usage: "Output format: table or json",
+		Value: "table",
+	}
+	return cli.Command{
+		Name:  "runs",
+		Usage: "List and manage test runs. Runs are given by ARN, ID (or a unique prefix of one), or \"latest\" for the branch",
+		Subcommands: []cli.Command{
+			{
+				Name:      "list",
+				Usage:     "List the runs of the current branch, newest first",
+				ArgsUsage: " ",
+				Action:    commandRunsList,
+				Flags: append([]cli.Flag{
+					cli.BoolFlag{
+						Name:  "all",
+						Usage: "List the runs of every branch, including runs not named by this tool",
+					},
+					cli.StringFlag{
+						Name:  "status",
+						Usage: "Only list runs with this status, e.g. RUNNING or COMPLETED",
+					},
+					cli.StringFlag{
+						Name:  "result",
+						Usage: "Only list runs with this result, e.g. PASSED or FAILED",
+					},
+					cli.IntFlag{
+						Name:  "limit",
+						Usage: "Maximum number of runs to list (0 for no limit)",
+						Value: 20,
+					},
+					formatFlag,
+				}, buildFlags...),
+			},
+			{
+				Name:      "show",
+				Usage:     "Show the status, results and devices of a run",
+				ArgsUsage: "<run>",
+				Action:    commandRunsShow,
+				Flags:     append([]cli.Flag{formatFlag}, buildFlags...),
+			},
+			{
+				Name:      "stop",
+				Usage:     "Stop a run, skipping tests which have not started",
+				ArgsUsage: "<run>",
+				Action:    commandRunsStop,
+				Flags:     buildFlags,
+			},
+			{
+				Name:      "delete",
+				Usage:     "Delete a completed run and its results",
+				ArgsUsage: "<run>",
+				Action:    commandRunsDelete,
+				Flags: append([]cli.Flag{
+					cli.BoolFlag{
+						Name:  "yes, y",
+						Usage: "Delete without asking for confirmation",
+					},
+				}, buildFlags...),
+			},
+		},
+	}
+}
+
+// A runSummary is a run as listed by `runs list --format json`.
+type runSummary struct {
+	Id            string           `json:"id"`
+	Arn           string           `json:"arn"`
+	Name          string           `json:"name"`
+	Branch        string           `json:"branch,omitempty"`
+	Commit        string           `json:"commit,omitempty"`
+	Status        string           `json:"status"`
+	Result        string           `json:"result"`
+	Created       time.Time        `json:"created"`
+	Counters      results.Counters `json:"counters"`
+	DeviceMinutes float64          `json:"device_minutes"`
+}
+
+func newRunSummary(run *devicefarm.Run, metadata *build.RunMetadata) *runSummary {
+	result := awsutil.ConvertRun(run)
+	summary := &runSummary{
+		Id:            runId(result.Arn),
+		Arn:           result.Arn,
+		Name:          result.Name,
+		Status:        result.Status,
+		Result:        result.Result,
+		Created:       result.Created,
+		Counters:      result.Counters,
+		DeviceMinutes: result.DeviceMinutes,
+	}
+	if metadata != nil {
+		summary.Branch = metadata.Branch
+		summary.Commit = metadata.SHA
+		if len(summary.Commit) == 0 {
+			summary.Commit = metadata.ShortSHA
+		}
+	}
+	return summary
+}
+
+// runId returns the ID of a run ARN, or the ARN itself if it cannot be
+// parsed.
+func runId(runArn string) string {
+	arn, err := util.NewArn(runArn)
+	if err != nil {
+		return runArn
+	}
+	return arn.ResourceId()
+}
+
+func shortRunId(runArn string) string {
+	id := runId(runArn)
+	if len(id) > shortIdLength {
+		return id[:shortIdLength]
+	}
+	return id
+}
+
+// getFormat returns the --format flag, which must be table or json.
+func getFormat(c *cli.Context) string {
+	format := c.String("format")
+	if format != "table" && format != "json" {
+		log.Fatalln("Unknown format: " + format)
+	}
+	return format
+}
+
+// printJSON writes a value to stdout as indented JSON.
+func printJSON(value interface{}) {
+	out, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Println(string(out))
+}
+
+// newTable returns a tabwriter which writes aligned columns to stdout. It
+// must be flushed.
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(util.LogWriter(log), 0, 4, 2, ' ', 0)
+}
+
+func formatTests(counters results.Counters) string {
+	if counters.Total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d/%d passed", counters.Passed, counters.Total)
+}
+
+func commandRunsList(c *cli.Context) {
+	format := getFormat(c)
+	b := getBuild(c)
+	client := getClient(c)
+	runs, err := client.ListRuns(ctx, b.Config.ProjectArn)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	metadata := map[*devicefarm.Run]*build.RunMetadata{}
+	for _, named := range b.NamedRuns(runs) {
+		metadata[named.Run] = named.Metadata
+	}
+	sort.SliceStable(runs, func(i, j int) bool {
+		return aws.TimeValue(runs[i].Created).After(aws.TimeValue(runs[j].Created))
+	})
+	status := strings.ToUpper(c.String("status"))
+	result := strings.ToUpper(c.String("result"))
+	limit := c.Int("limit")
+	summaries := []*runSummary{}
+	for _, run := range runs {
+		if limit > 0 && len(summaries) >= limit {
+			break
+		}
+		if !c.Bool("all") && (metadata[run] == nil || metadata[run].Branch != b.Branch) {
+			continue
+		}
+		if len(status) > 0 && aws.StringValue(run.Status) != status {
+			continue
+		}
+		if len(result) > 0 && aws.StringValue(run.Result) != result {
+			continue
+		}
+		summaries = append(summaries, newRunSummary(run, metadata[run]))
+	}
+	if format == "json" {
+		printJSON(summaries)
+		return
+	}
+	if len(summaries) == 0 {
+		log.Println("No runs found")
+		return
+	}
+	table := newTable()
+	fmt.Fprintln(table, "ID\tCREATED\tSTATUS\tRESULT\tTESTS\tNAME")
+	for _, summary := range summaries {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			shortRunId(summary.Arn),
+			summary.Created.Local().Format("2006-01-02 15:04"),
+			summary.Status,
+			summary.Result,
+			formatTests(summary.Counters),
+			summary.Name)
+	}
+	table.Flush()
+}
+
+// getRunArg returns the run ARN of the command's only argument.
+func getRunArg(c *cli.Context) string {
+	if c.NArg() != 1 {
+		log.Fatalf("Usage: devicefarm runs %s <run-arn|run-id|latest>\n", c.Command.Name)
+	}
+	return getRunArn(c, c.Args()[0])
+}
+
+func commandRunsShow(c *cli.Context) {
+	format := getFormat(c)
+	runArn := getRunArg(c)
+	client := getClient(c)
+	run, err := client.GetRun(ctx, runArn)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	jobs, err := client.ListJobs(ctx, runArn)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	result := awsutil.ConvertRun(run)
+	for _, job := range jobs {
+		result.Jobs = append(result.Jobs, awsutil.ConvertJob(job))
+	}
+	if format == "json" {
+		printJSON(result)
+		return
+	}
+	table := newTable()
+	fmt.Fprintf(table, "Name:\t%s\n", result.Name)
+	fmt.Fprintf(table, "ID:\t%s\n", runId(result.Arn))
+	fmt.Fprintf(table, "Status:\t%s\n", result.Status)
+	fmt.Fprintf(table, "Result:\t%s\n", result.Result)
+	if len(result.Message) > 0 {
+		fmt.Fprintf(table, "Message:\t%s\n", result.Message)
+	}
+	fmt.Fprintf(table, "Created:\t%s\n", result.Created.Local().Format(time.RFC1123))
+	fmt.Fprintf(table, "Duration:\t%s\n", result.Duration().Round(time.Second))
+	fmt.Fprintf(table, "Device minutes:\t%.1f\n", result.DeviceMinutes)
+	fmt.Fprintf(table, "Tests:\t%s\n", awsutil.FormatCounters(run.Counters))
+	if url, err := consoleUrl(runArn); err == nil {
+		fmt.Fprintf(table, "URL:\t%s\n", url)
+	}
+	table.Flush()
+	if len(result.Jobs) == 0 {
+		return
+	}
+	log.Println()
+	table = newTable()
+	fmt.Fprintln(table, "DEVICE\tOS\tSTATUS\tRESULT\tTESTS\tDURATION")
+	for _, job := range result.Jobs {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			job.Device,
+			job.Os,
+			job.Status,
+			job.Result,
+			formatTests(job.Counters),
+			job.Duration().Round(time.Second))
+	}
+	table.Flush()
+}
+
+func commandRunsStop(c *cli.Context) {
+	runArn := getRunArg(c)
+	client := getClient(c)
+	log.Printf(">> Stopping run %s...\n", runId(runArn))
+	if err := client.StopRun(ctx, runArn); err != nil {
+		log.Fatalln(err)
+	}
+	log.Println(">> Run is stopping. Tests which have not started will be skipped.")
+}
+
+func commandRunsDelete(c *cli.Context) {
+	runArn := getRunArg(c)
+	client := getClient(c)
+	run, err := client.GetRun(ctx, runArn)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if status := aws.StringValue(run.Status); status != devicefarm.ExecutionStatusCompleted {
+		log.Fatalf("Run %s is %s, only completed runs can be deleted. Use `devicefarm runs stop` first.\n", runId(runArn), status)
+	}
+	if !c.Bool("yes") && !confirm(fmt.Sprintf("Delete run %s (%s)?", aws.StringValue(run.Name), runId(runArn))) {
+		log.Fatalln("Not deleting run")
+	}
+	if err := client.DeleteRun(ctx, runArn); err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf(">> Deleted run %s\n", runId(runArn))
+}
+
+// confirm asks a yes or no question on stdin, returning false unless the
+// answer is yes.
+func confirm(question string) bool {
+	log.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
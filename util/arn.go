@@ -2,10 +2,33 @@ package util
 
 import (
 	"errors"
+	"fmt"
 	"regexp"
 	"strings"
 )
 
+// The region and partition used when neither the config nor the project
+// ARN specifies one.
+const (
+	DefaultRegion    = "us-west-2"
+	DefaultPartition = "aws"
+)
+
+// RegionRegexp matches AWS region names, e.g. us-west-2 or cn-north-1.
+var RegionRegexp *regexp.Regexp = regexp.MustCompile("^[a-z]{2}(-[a-z]+)+-[0-9]+$")
+
+// consoleDomains maps AWS partitions to the domains of their web consoles.
+var consoleDomains = map[string]string{
+	"aws":        "console.aws.amazon.com",
+	"aws-cn":     "console.amazonaws.cn",
+	"aws-us-gov": "console.amazonaws-us-gov.com",
+}
+
+// consoleRunRegexp and consoleProjectRegexp match the resources of Device
+// Farm run and project ARNs, capturing their IDs.
+var consoleRunRegexp = regexp.MustCompile("^run:([^/]+)/([^/]+)$")
+var consoleProjectRegexp = regexp.MustCompile("^project:([^/]+)$")
+
 // ArnRegexp matches an AWS ARN with the following capture groups:
 //  1: partition
 //  2: service
@@ -48,3 +71,46 @@ func (arn *Arn) String() string {
 	parts := []string{"arn", arn.Partition, arn.Service, arn.Region, arn.AccountId, arn.Resource}
 	return strings.Join(parts, ":")
 }
+
+// DeviceArn returns the ARN of a Device Farm device, given its ID (e.g.
+// "device:5F9CEB47606A4709879003E11BEAFB08"), partition and region. Devices
+// are not owned by an account, so the account ID is blank.
+func DeviceArn(partition string, region string, id string) *Arn {
+	return &Arn{
+		Partition: partition,
+		Service:   "devicefarm",
+		Region:    region,
+		AccountId: "",
+		Resource:  id,
+	}
+}
+
+// ResourceId returns the ID at the end of the ARN's resource, e.g. the run
+// UUID of "run:<project-id>/<run-id>", which is unique enough to identify
+// the resource within its project.
+func (arn *Arn) ResourceId() string {
+	resource := arn.Resource
+	if i := strings.LastIndexAny(resource, ":/"); i >= 0 {
+		return resource[i+1:]
+	}
+	return resource
+}
+
+// ConsoleUrl returns the URL of a Device Farm project or run in the AWS
+// console for the ARN's partition and region. It returns an error for any
+// other kind of ARN.
+func (arn *Arn) ConsoleUrl() (string, error) {
+	domain, ok := consoleDomains[arn.Partition]
+	if !ok {
+		return "", errors.New("Unknown partition: " + arn.Partition)
+	}
+	var fragment string
+	if match := consoleRunRegexp.FindStringSubmatch(arn.Resource); match != nil {
+		fragment = fmt.Sprintf("projects/%s/runs/%s", match[1], match[2])
+	} else if match := consoleProjectRegexp.FindStringSubmatch(arn.Resource); match != nil {
+		fragment = fmt.Sprintf("projects/%s", match[1])
+	} else {
+		return "", errors.New("No console URL for ARN: " + arn.String())
+	}
+	return fmt.Sprintf("https://%s.%s/devicefarm/home?region=%s#/%s", arn.Region, domain, arn.Region, fragment), nil
+}
@@ -37,3 +37,57 @@ func TestArnString(t *testing.T) {
 	arn := example.String()
 	assert.Equal("arn:aws:devicefarm:us-west-2::device:5F9CEB47606A4709879003E11BEAFB08", arn)
 }
+
+func TestDeviceArn(t *testing.T) {
+	assert := assert.New(t)
+
+	arn := DeviceArn("aws-cn", "cn-north-1", "device:5F9CEB47606A4709879003E11BEAFB08")
+	assert.Equal("arn:aws-cn:devicefarm:cn-north-1::device:5F9CEB47606A4709879003E11BEAFB08", arn.String())
+}
+
+func TestArnResourceId(t *testing.T) {
+	assert := assert.New(t)
+	arn, _ := NewArn("arn:aws:devicefarm:us-west-2:026109802893:run:1124416c-bfb2-4334-817c-e211ecef7dc0/0fcac17b-6122-44d7-ae5a-12345678abcd")
+	assert.Equal("0fcac17b-6122-44d7-ae5a-12345678abcd", arn.ResourceId())
+	arn, _ = NewArn("arn:aws:devicefarm:us-west-2:026109802893:project:1124416c-bfb2-4334-817c-e211ecef7dc0")
+	assert.Equal("1124416c-bfb2-4334-817c-e211ecef7dc0", arn.ResourceId())
+	arn = DeviceArn("aws", "us-west-2", "device:5F9CEB47606A4709879003E11BEAFB08")
+	assert.Equal("5F9CEB47606A4709879003E11BEAFB08", arn.ResourceId())
+}
+
+func TestArnConsoleUrl(t *testing.T) {
+	assert := assert.New(t)
+
+	// a run
+	arn, _ := NewArn("arn:aws:devicefarm:us-west-2:026109802893:run:1124416c/0fcac17b")
+	url, err := arn.ConsoleUrl()
+	assert.Nil(err)
+	assert.Equal("https://us-west-2.console.aws.amazon.com/devicefarm/home?region=us-west-2#/projects/1124416c/runs/0fcac17b", url)
+
+	// a project in another partition
+	arn, _ = NewArn("arn:aws-cn:devicefarm:cn-north-1:026109802893:project:1124416c")
+	url, err = arn.ConsoleUrl()
+	assert.Nil(err)
+	assert.Equal("https://cn-north-1.console.amazonaws.cn/devicefarm/home?region=cn-north-1#/projects/1124416c", url)
+
+	// should fail for other resources
+	arn, _ = NewArn("arn:aws:devicefarm:us-west-2::device:5F9CEB47606A4709879003E11BEAFB08")
+	url, err = arn.ConsoleUrl()
+	assert.NotNil(err)
+
+	// should fail for unknown partitions
+	arn, _ = NewArn("arn:aws-foo:devicefarm:us-west-2:026109802893:project:1124416c")
+	url, err = arn.ConsoleUrl()
+	assert.NotNil(err)
+}
+
+func TestRegionRegexp(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, region := range []string{"us-west-2", "cn-north-1", "us-gov-west-1"} {
+		assert.True(RegionRegexp.MatchString(region), region)
+	}
+	for _, region := range []string{"", "us-west", "US-WEST-2", "us-west-2a"} {
+		assert.False(RegionRegexp.MatchString(region), region)
+	}
+}
@@ -0,0 +1,51 @@
+package util
+
+// A CIBuild describes the CI job the tool is running in. Name is one of the
+// CI* constants, or blank outside of a known CI server, in which case the
+// other fields are blank too.
+type CIBuild struct {
+	Name        string
+	BuildNumber string
+	BuildURL    string
+}
+
+// Names of the CI servers recognised by DetectCI.
+const (
+	CICircle  = "circleci"
+	CIGitHub  = "github"
+	CIGitLab  = "gitlab"
+	CIJenkins = "jenkins"
+)
+
+// DetectCI returns the CI job described by the environment variables looked
+// up with getenv, e.g. os.Getenv.
+func DetectCI(getenv func(string) string) *CIBuild {
+	switch {
+	case getenv("CIRCLECI") == "true":
+		return &CIBuild{
+			Name:        CICircle,
+			BuildNumber: getenv("CIRCLE_BUILD_NUM"),
+			BuildURL:    getenv("CIRCLE_BUILD_URL"),
+		}
+	case getenv("GITHUB_ACTIONS") == "true":
+		ci := &CIBuild{Name: CIGitHub, BuildNumber: getenv("GITHUB_RUN_NUMBER")}
+		server, repo, id := getenv("GITHUB_SERVER_URL"), getenv("GITHUB_REPOSITORY"), getenv("GITHUB_RUN_ID")
+		if len(server) > 0 && len(repo) > 0 && len(id) > 0 {
+			ci.BuildURL = server + "/" + repo + "/actions/runs/" + id
+		}
+		return ci
+	case getenv("GITLAB_CI") == "true":
+		return &CIBuild{
+			Name:        CIGitLab,
+			BuildNumber: getenv("CI_PIPELINE_IID"),
+			BuildURL:    getenv("CI_PIPELINE_URL"),
+		}
+	case len(getenv("JENKINS_URL")) > 0:
+		return &CIBuild{
+			Name:        CIJenkins,
+			BuildNumber: getenv("BUILD_NUMBER"),
+			BuildURL:    getenv("BUILD_URL"),
+		}
+	}
+	return &CIBuild{}
+}
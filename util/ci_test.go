@@ -0,0 +1,45 @@
+package util
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDetectCI(t *testing.T) {
+	assert := assert.New(t)
+	env := map[string]string{}
+	getenv := func(name string) string { return env[name] }
+
+	// not in CI
+	assert.Equal(&CIBuild{}, DetectCI(getenv))
+
+	env = map[string]string{
+		"CIRCLECI":         "true",
+		"CIRCLE_BUILD_NUM": "42",
+		"CIRCLE_BUILD_URL": "https://circleci.com/gh/ride/devicefarm/42",
+	}
+	assert.Equal(&CIBuild{CICircle, "42", "https://circleci.com/gh/ride/devicefarm/42"}, DetectCI(getenv))
+
+	env = map[string]string{
+		"GITHUB_ACTIONS":    "true",
+		"GITHUB_RUN_NUMBER": "7",
+		"GITHUB_SERVER_URL": "https://github.com",
+		"GITHUB_REPOSITORY": "ride/devicefarm",
+		"GITHUB_RUN_ID":     "123456",
+	}
+	assert.Equal(&CIBuild{CIGitHub, "7", "https://github.com/ride/devicefarm/actions/runs/123456"}, DetectCI(getenv))
+
+	env = map[string]string{
+		"GITLAB_CI":       "true",
+		"CI_PIPELINE_IID": "9",
+		"CI_PIPELINE_URL": "https://gitlab.com/ride/devicefarm/pipelines/99",
+	}
+	assert.Equal(&CIBuild{CIGitLab, "9", "https://gitlab.com/ride/devicefarm/pipelines/99"}, DetectCI(getenv))
+
+	env = map[string]string{
+		"JENKINS_URL":  "https://jenkins.example.com/",
+		"BUILD_NUMBER": "3",
+		"BUILD_URL":    "https://jenkins.example.com/job/app/3/",
+	}
+	assert.Equal(&CIBuild{CIJenkins, "3", "https://jenkins.example.com/job/app/3/"}, DetectCI(getenv))
+}
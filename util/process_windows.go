@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package util
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup does nothing on Windows, which has no process groups.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the command. Processes it started keep running.
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
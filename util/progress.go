@@ -0,0 +1,120 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// progressBarWidth is the number of characters inside a progress bar.
+const progressBarWidth = 30
+
+// progressLineStep is how often, in percent, a ProgressReader which is not
+// drawing a bar prints a line.
+const progressLineStep = 25
+
+// ProgressReader is an io.Reader which reports how much of the underlying
+// reader has been read to the Print*() methods of a Logger. If Bar is true
+// (e.g. on a terminal) a progress bar is redrawn in place, otherwise a line
+// is printed every 25 percent.
+type ProgressReader struct {
+	Reader io.Reader
+	Total  int64
+	Label  string
+	Log    Logger
+	Bar    bool
+	read   int64
+	shown  int
+	done   bool
+}
+
+// NewProgressReader returns a ProgressReader for a reader of total bytes,
+// which draws a progress bar if the logger writes to a terminal.
+func NewProgressReader(r io.Reader, total int64, label string, log Logger) *ProgressReader {
+	return &ProgressReader{
+		Reader: r,
+		Total:  total,
+		Label:  label,
+		Log:    log,
+		Bar:    IsTerminal(log),
+		shown:  -1,
+	}
+}
+
+func (r *ProgressReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	r.read += int64(n)
+	r.report()
+	return
+}
+
+// Reset starts reporting progress from zero again, e.g. when the underlying
+// reader is rewound to retry an upload.
+func (r *ProgressReader) Reset() {
+	r.read = 0
+	r.shown = -1
+	r.done = false
+}
+
+func (r *ProgressReader) report() {
+	if r.done {
+		return
+	}
+	percent := 100
+	if r.Total > 0 && r.read < r.Total {
+		percent = int(r.read * 100 / r.Total)
+	}
+	r.done = percent == 100
+	if r.Bar {
+		if percent == r.shown {
+			return
+		}
+		filled := percent * progressBarWidth / 100
+		bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+		r.Log.Printf("\r%s [%s] %3d%% %s", r.Label, bar, percent, r.sizes())
+		if r.done {
+			r.Log.Println()
+		}
+	} else {
+		if r.shown >= 0 && percent/progressLineStep == r.shown/progressLineStep {
+			return
+		}
+		r.Log.Printf("%s: %d%% %s\n", r.Label, percent, r.sizes())
+	}
+	r.shown = percent
+}
+
+func (r *ProgressReader) sizes() string {
+	return "(" + FormatBytes(r.read) + " of " + FormatBytes(r.Total) + ")"
+}
+
+// FormatBytes returns a human readable size, e.g. "12.3 MB".
+func FormatBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	size := float64(n) / 1024
+	for _, unit := range []string{"KB", "MB", "GB"} {
+		if size < 1024 || unit == "GB" {
+			return fmt.Sprintf("%.1f %s", size, unit)
+		}
+		size /= 1024
+	}
+	return ""
+}
+
+// IsTerminal returns true if the Print*() methods of the logger write to a
+// terminal.
+func IsTerminal(log Logger) bool {
+	standard, ok := log.(*StandardLogger)
+	if !ok {
+		return false
+	}
+	file, ok := standard.out.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
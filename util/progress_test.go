@@ -0,0 +1,66 @@
+package util
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestProgressReader(t *testing.T) {
+	assert := assert.New(t)
+
+	// should print a line every 25 percent
+	out, log := NewCaptureLogger()
+	r := NewProgressReader(iotest.OneByteReader(strings.NewReader("12345678")), 8, "foo.apk", log)
+	assert.False(r.Bar)
+	bytes, err := ioutil.ReadAll(r)
+	assert.Nil(err)
+	assert.Equal("12345678", string(bytes))
+	assert.Equal([]string{
+		"foo.apk: 12% (1 B of 8 B)\n",
+		"foo.apk: 25% (2 B of 8 B)\n",
+		"foo.apk: 50% (4 B of 8 B)\n",
+		"foo.apk: 75% (6 B of 8 B)\n",
+		"foo.apk: 100% (8 B of 8 B)\n",
+	}, out.Out())
+
+	// should redraw a bar, ending with a newline
+	out, log = NewCaptureLogger()
+	r = NewProgressReader(iotest.OneByteReader(strings.NewReader("1234")), 4, "foo.apk", log)
+	r.Bar = true
+	ioutil.ReadAll(r)
+	assert.Equal([]string{
+		"\rfoo.apk [=======                       ]  25% (1 B of 4 B)",
+		"\rfoo.apk [===============               ]  50% (2 B of 4 B)",
+		"\rfoo.apk [======================        ]  75% (3 B of 4 B)",
+		"\rfoo.apk [==============================] 100% (4 B of 4 B)",
+		"\n",
+	}, out.Out())
+
+	// should start again after Reset()
+	out, log = NewCaptureLogger()
+	r = NewProgressReader(strings.NewReader("1234"), 4, "foo.apk", log)
+	ioutil.ReadAll(r)
+	r.Reader = strings.NewReader("1234")
+	r.Reset()
+	ioutil.ReadAll(r)
+	assert.Equal(2, len(out.Out()))
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("0 B", FormatBytes(0))
+	assert.Equal("1023 B", FormatBytes(1023))
+	assert.Equal("1.5 KB", FormatBytes(1536))
+	assert.Equal("12.3 MB", FormatBytes(12900000))
+	assert.Equal("2048.0 GB", FormatBytes(2<<40))
+}
+
+func TestIsTerminal(t *testing.T) {
+	assert := assert.New(t)
+	_, log := NewCaptureLogger()
+	assert.False(IsTerminal(log))
+	assert.False(IsTerminal(NilLogger))
+}
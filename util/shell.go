@@ -0,0 +1,243 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultShell is the shell used to run commands when none is configured.
+const DefaultShell = "sh -c"
+
+// DefaultTailLines is how many lines of output a failed command reports.
+const DefaultTailLines = 20
+
+// ShellCmd creates an exec.Cmd which runs the command with the given shell in
+// the given directory. The shell is split on whitespace, and the command is
+// passed as its last argument, so "bash -eo pipefail -c" is a valid shell.
+func ShellCmd(shell, dir, command string) *exec.Cmd {
+	parts := strings.Fields(shell)
+	if len(parts) == 0 {
+		parts = strings.Fields(DefaultShell)
+	}
+	cmd := exec.Command(parts[0], append(parts[1:], command)...)
+	cmd.Dir = dir
+	return cmd
+}
+
+// A Step is a command for a Runner to run. Dir is relative to the directory
+// given to the Runner, and Env holds "KEY=value" pairs which are added to
+// the environment. A step which fails is retried up to Retries times, and is
+// killed along with any processes it started if it runs longer than Timeout
+// (when non-zero). If ContinueOnError is true, a failure is logged and later
+// steps still run.
+type Step struct {
+	Cmd             string
+	Dir             string
+	Env             []string
+	Timeout         time.Duration
+	Retries         int
+	ContinueOnError bool
+}
+
+// A Runner runs commands through a shell. Each command is logged with Log
+// before it runs. The combined stdout and stderr of each command is streamed
+// to Output and LogFile, either of which may be nil.
+type Runner struct {
+	Log       Logger
+	Shell     string
+	Output    io.Writer
+	LogFile   io.Writer
+	TailLines int
+}
+
+// NewRunner returns a Runner which logs commands and uses the default shell,
+// without streaming output.
+func NewRunner(log Logger) *Runner {
+	return &Runner{Log: log, Shell: DefaultShell, TailLines: DefaultTailLines}
+}
+
+// Run runs the commands in the given directory, see RunSteps.
+func (runner *Runner) Run(ctx context.Context, dir string, commands ...string) ([]*CmdOutput, error) {
+	steps := make([]Step, len(commands))
+	for i, command := range commands {
+		steps[i] = Step{Cmd: command}
+	}
+	return runner.RunSteps(ctx, dir, steps...)
+}
+
+// RunSteps runs the steps in the given directory, stopping at the first which
+// fails (unless it has ContinueOnError), and returns the CmdOutputs of the
+// steps that ran. If a step fails the error is a *StepError. Cancelling ctx
+// kills the running step, and no more steps are run.
+func (runner *Runner) RunSteps(ctx context.Context, dir string, steps ...Step) ([]*CmdOutput, error) {
+	outputs := []*CmdOutput{}
+	for _, step := range steps {
+		if err := ctx.Err(); err != nil {
+			return outputs, err
+		}
+		output := runner.runStep(ctx, dir, step)
+		outputs = append(outputs, output)
+		if output.Err == nil {
+			continue
+		}
+		if step.ContinueOnError && ctx.Err() == nil {
+			runner.Log.Warnln(output.Err)
+			runner.Log.Warnln("Continuing, because the step has continue_on_error")
+			continue
+		}
+		return outputs, output.Err
+	}
+	return outputs, nil
+}
+
+// runStep runs a step, retrying it if needed, and returns the output of the
+// last attempt.
+func (runner *Runner) runStep(ctx context.Context, dir string, step Step) *CmdOutput {
+	start := time.Now()
+	var output *CmdOutput
+	for attempt := 1; attempt <= step.Retries+1; attempt++ {
+		if attempt > 1 {
+			runner.Log.Warnf("Retrying (attempt %d of %d): %s", attempt, step.Retries+1, output.Err)
+		}
+		output = runner.runOnce(ctx, dir, step)
+		output.Attempts = attempt
+		if output.Err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	output.Duration = time.Since(start)
+	return output
+}
+
+func (runner *Runner) runOnce(ctx context.Context, dir string, step Step) *CmdOutput {
+	command := strings.TrimSpace(step.Cmd)
+	runner.Log.Println("$ " + command)
+	buffer := &bytes.Buffer{}
+	writers := []io.Writer{buffer}
+	if runner.Output != nil {
+		writers = append(writers, runner.Output)
+	}
+	if runner.LogFile != nil {
+		fmt.Fprintf(runner.LogFile, "$ %s\n", command)
+		writers = append(writers, runner.LogFile)
+	}
+	out := io.MultiWriter(writers...)
+	if len(step.Dir) > 0 && !filepath.IsAbs(step.Dir) {
+		dir = filepath.Join(dir, step.Dir)
+	} else if len(step.Dir) > 0 {
+		dir = step.Dir
+	}
+	cmd := ShellCmd(runner.Shell, dir, command)
+	if len(step.Env) > 0 {
+		cmd.Env = append(os.Environ(), step.Env...)
+	}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err, timedOut := runWithTimeout(ctx, cmd, step.Timeout)
+	output := &CmdOutput{Cmd: command, Output: strings.TrimSpace(buffer.String())}
+	if err != nil {
+		stepErr := newStepError(command, err, output.Output, runner.TailLines)
+		if timedOut {
+			stepErr.Timeout = step.Timeout
+		}
+		output.Err = stepErr
+	}
+	return output
+}
+
+// runWithTimeout runs the command in its own process group, and kills the
+// whole group if the timeout (when non-zero) expires or ctx is cancelled.
+func runWithTimeout(ctx context.Context, cmd *exec.Cmd, timeout time.Duration) (err error, timedOut bool) {
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err, false
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case err = <-done:
+		return err, false
+	case <-expired:
+		killProcessGroup(cmd)
+		<-done
+		return errors.New("timed out"), true
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		<-done
+		return ctx.Err(), false
+	}
+}
+
+// A StepError describes a command which failed. ExitCode is -1 if the
+// command did not exit normally, e.g. because the shell was not found, or
+// it was killed after Timeout. Tail holds the last lines of the command's
+// output.
+type StepError struct {
+	Cmd      string
+	ExitCode int
+	Timeout  time.Duration
+	Tail     []string
+	Err      error
+}
+
+func newStepError(command string, err error, output string, tailLines int) *StepError {
+	stepErr := &StepError{Cmd: command, ExitCode: -1, Err: err}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		stepErr.ExitCode = exitErr.ExitCode()
+	}
+	if len(output) > 0 && tailLines > 0 {
+		lines := strings.Split(output, "\n")
+		if len(lines) > tailLines {
+			lines = lines[len(lines)-tailLines:]
+		}
+		stepErr.Tail = lines
+	}
+	return stepErr
+}
+
+func (err *StepError) Error() string {
+	var message string
+	if err.Timeout > 0 {
+		message = fmt.Sprintf("Command timed out after %s: %s", err.Timeout, err.Cmd)
+	} else if err.ExitCode >= 0 {
+		message = fmt.Sprintf("Command failed with exit code %d: %s", err.ExitCode, err.Cmd)
+	} else {
+		message = fmt.Sprintf("Command failed: %s (%s)", err.Cmd, err.Err)
+	}
+	if len(err.Tail) > 0 {
+		message += fmt.Sprintf("\nLast %d lines of output:\n%s", len(err.Tail), strings.Join(err.Tail, "\n"))
+	}
+	return message
+}
+
+// logWriter is an io.Writer which writes to the Print*() methods of a Logger.
+type logWriter struct {
+	log Logger
+}
+
+// LogWriter returns an io.Writer which writes to the Print*() methods of the
+// given Logger, e.g. to stream command output to stdout.
+func LogWriter(log Logger) io.Writer {
+	return &logWriter{log}
+}
+
+func (w *logWriter) Write(b []byte) (int, error) {
+	w.log.Print(string(b))
+	return len(b), nil
+}
@@ -0,0 +1,164 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestShellCmd(t *testing.T) {
+	assert := assert.New(t)
+
+	cmd := ShellCmd("bash -eo pipefail -c", "/dir", "echo 'a b' | cat")
+	assert.Equal([]string{"bash", "-eo", "pipefail", "-c", "echo 'a b' | cat"}, cmd.Args)
+	assert.Equal("/dir", cmd.Dir)
+
+	// should use the default shell
+	cmd = ShellCmd("", "/dir", "echo foo")
+	assert.Equal([]string{"sh", "-c", "echo foo"}, cmd.Args)
+}
+
+func TestRunner(t *testing.T) {
+	assert := assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "devicefarm")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// should handle quoting, env assignments and pipes, and stream combined
+	// output
+	output := &bytes.Buffer{}
+	logFile := &bytes.Buffer{}
+	runner := NewRunner(NilLogger)
+	runner.Output = output
+	runner.LogFile = logFile
+	outputs, err := runner.Run(context.Background(), tmpDir,
+		`FOO="a b" sh -c 'echo "$FOO"'`,
+		"echo out && echo err >&2",
+		"printf 'x\\ny\\n' | wc -l | tr -d ' '")
+	assert.Nil(err)
+	assert.Equal(3, len(outputs))
+	assert.Equal("a b", outputs[0].Output)
+	assert.Equal("out\nerr", outputs[1].Output)
+	assert.Equal("2", outputs[2].Output)
+	assert.Equal("a b\nout\nerr\n2\n", output.String())
+	assert.Contains(logFile.String(), "$ echo out && echo err >&2\nout\nerr\n")
+
+	// should report the exit code and the last lines of output
+	runner = NewRunner(NilLogger)
+	runner.TailLines = 2
+	outputs, err = runner.Run(context.Background(), tmpDir, "echo a; echo b; echo c; exit 7", "echo never")
+	assert.Equal(1, len(outputs))
+	stepErr, ok := err.(*StepError)
+	assert.True(ok)
+	assert.Equal(7, stepErr.ExitCode)
+	assert.Equal([]string{"b", "c"}, stepErr.Tail)
+	assert.Equal(err, outputs[0].Err)
+	assert.Equal("Command failed with exit code 7: echo a; echo b; echo c; exit 7\nLast 2 lines of output:\nb\nc", err.Error())
+
+	// should fail without an exit code when the shell does not exist
+	runner.Shell = "does-not-exist -c"
+	_, err = runner.Run(context.Background(), tmpDir, "echo foo")
+	stepErr, ok = err.(*StepError)
+	assert.True(ok)
+	assert.Equal(-1, stepErr.ExitCode)
+	assert.Nil(stepErr.Tail)
+}
+
+func TestRunnerSteps(t *testing.T) {
+	assert := assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "devicefarm")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	os.Mkdir(filepath.Join(tmpDir, "sub"), 0755)
+
+	// should run in the step's dir with the step's env
+	out, log := NewCaptureLogger()
+	runner := NewRunner(log)
+	outputs, err := runner.RunSteps(context.Background(), tmpDir,
+		Step{Cmd: "basename $(pwd)", Dir: "sub"},
+		Step{Cmd: "echo $FOO", Env: []string{"FOO=bar"}})
+	assert.Nil(err)
+	assert.Equal("sub", outputs[0].Output)
+	assert.Equal("bar", outputs[1].Output)
+
+	// should retry a failing step, logging each attempt
+	counter := filepath.Join(tmpDir, "count")
+	outputs, err = runner.RunSteps(context.Background(), tmpDir,
+		Step{Cmd: "echo x >> " + counter + "; [ $(wc -l < " + counter + ") -ge 3 ]", Retries: 3})
+	assert.Nil(err)
+	assert.Equal(3, outputs[0].Attempts)
+	assert.Equal(5, len(out.Out()))
+
+	// should give up after the retries
+	outputs, err = runner.RunSteps(context.Background(), tmpDir,
+		Step{Cmd: "exit 2", Retries: 1},
+		Step{Cmd: "echo never"})
+	assert.NotNil(err)
+	assert.Equal(1, len(outputs))
+	assert.Equal(2, outputs[0].Attempts)
+
+	// should carry on past a step with ContinueOnError
+	outputs, err = runner.RunSteps(context.Background(), tmpDir,
+		Step{Cmd: "exit 2", ContinueOnError: true},
+		Step{Cmd: "echo after"})
+	assert.Nil(err)
+	assert.Equal(2, len(outputs))
+	assert.NotNil(outputs[0].Err)
+	assert.Equal("after", outputs[1].Output)
+}
+
+func TestRunnerTimeout(t *testing.T) {
+	assert := assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "devicefarm")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// should kill the step and the processes it started when it times out
+	runner := NewRunner(NilLogger)
+	start := time.Now()
+	outputs, err := runner.RunSteps(context.Background(), tmpDir,
+		Step{Cmd: "echo started; sleep 10 & sleep 10", Timeout: 100 * time.Millisecond})
+	assert.True(time.Since(start) < 5*time.Second)
+	stepErr, ok := err.(*StepError)
+	assert.True(ok)
+	assert.Equal(100*time.Millisecond, stepErr.Timeout)
+	assert.Equal("Command timed out after 100ms: echo started; sleep 10 & sleep 10\nLast 1 lines of output:\nstarted", err.Error())
+	assert.True(outputs[0].Duration >= 100*time.Millisecond)
+
+	// should kill the step when the context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start = time.Now()
+	_, err = runner.RunSteps(ctx, tmpDir, Step{Cmd: "sleep 10", Retries: 2}, Step{Cmd: "echo never"})
+	assert.True(time.Since(start) < 5*time.Second)
+	stepErr, ok = err.(*StepError)
+	assert.True(ok)
+	assert.Equal(context.Canceled, stepErr.Err)
+}
+
+func TestStepError(t *testing.T) {
+	assert := assert.New(t)
+	err := &StepError{Cmd: "foo", ExitCode: -1, Err: errors.New("not found")}
+	assert.Equal("Command failed: foo (not found)", err.Error())
+}
+
+func TestLogWriter(t *testing.T) {
+	assert := assert.New(t)
+	out, log := NewCaptureLogger()
+	n, err := LogWriter(log).Write([]byte("foo\n"))
+	assert.Nil(err)
+	assert.Equal(4, n)
+	assert.Equal([]string{"foo\n"}, out.Out())
+}
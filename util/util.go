@@ -4,11 +4,14 @@ Package util provides utility functions used by other packages.
 package util
 
 import (
+	"context"
 	"errors"
 	"io"
 	"os"
 	"os/exec"
+	"sort"
 	"strings"
+	"time"
 )
 
 // ErrDetached is returned if it looks like a Git repo is in a
@@ -66,6 +69,161 @@ func GitBranch(dir string) (branch string, err error) {
 	return
 }
 
+// GitBranches returns the names of all local and remote-tracking branches
+// in the given directory, as listed by `git branch -a`. Remote-tracking
+// branches are returned without their remote, so "remotes/origin/foo" is
+// returned as "foo". The names are sorted and unique.
+func GitBranches(dir string) ([]string, error) {
+	out, err := Cmd(dir, "git branch -a").Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseGitBranches(string(out)), nil
+}
+
+// parseGitBranches returns the sorted, unique branch names in the output of
+// `git branch -a`, without their remotes.
+func parseGitBranches(out string) []string {
+	seen := map[string]bool{}
+	branches := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		// each line starts with a two character marker, e.g. "* " for the
+		// current branch
+		if len(line) < 3 || strings.Contains(line, " -> ") {
+			continue
+		}
+		branch := strings.TrimSpace(line[2:])
+		if strings.HasPrefix(branch, "(") {
+			// e.g. "(HEAD detached at 1a2b3c4)"
+			continue
+		}
+		if strings.HasPrefix(branch, "remotes/") {
+			parts := strings.SplitN(branch, "/", 3)
+			if len(parts) < 3 {
+				continue
+			}
+			branch = parts[2]
+		}
+		if !seen[branch] {
+			seen[branch] = true
+			branches = append(branches, branch)
+		}
+	}
+	sort.Strings(branches)
+	return branches
+}
+
+// GitRemoteBranches returns the names of the branches of the given remote in
+// the given directory, as listed by `git ls-remote --heads`. Unlike
+// GitBranches, this includes branches which were never fetched, e.g. in a
+// shallow or single branch clone. The names are sorted and unique.
+func GitRemoteBranches(dir, remote string) ([]string, error) {
+	out, err := Cmd(dir, "git ls-remote --heads "+remote).Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseGitRemoteBranches(string(out)), nil
+}
+
+// parseGitRemoteBranches returns the sorted, unique branch names in the output
+// of `git ls-remote --heads`.
+func parseGitRemoteBranches(out string) []string {
+	seen := map[string]bool{}
+	branches := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		// each line is a SHA and a ref, e.g. "1a2b3c4...\trefs/heads/foo"
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "refs/heads/") {
+			continue
+		}
+		branch := strings.TrimPrefix(fields[1], "refs/heads/")
+		if !seen[branch] {
+			seen[branch] = true
+			branches = append(branches, branch)
+		}
+	}
+	sort.Strings(branches)
+	return branches
+}
+
+// GitCommit returns the full SHA of the commit checked out in the given
+// directory.
+func GitCommit(dir string) (string, error) {
+	out, err := Cmd(dir, "git rev-parse HEAD").Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// ShortSHA abbreviates a commit SHA to 7 characters, like git does.
+func ShortSHA(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
+
+// BranchEnvVars are the environment variables DetectBranch checks, in order:
+// DEVICEFARM_BRANCH, then those set by CircleCI, GitHub Actions, GitLab and
+// Jenkins.
+var BranchEnvVars = []string{
+	"DEVICEFARM_BRANCH",
+	"CIRCLE_BRANCH",
+	"GITHUB_HEAD_REF",
+	"GITHUB_REF",
+	"CI_COMMIT_REF_NAME",
+	"GIT_BRANCH",
+	"BRANCH_NAME",
+}
+
+// DetectBranch returns the branch being built in the given directory, and
+// where it was found. CI servers usually check out a detached HEAD, so the
+// first of BranchEnvVars which is set (looked up with getenv, e.g. os.Getenv)
+// is used. Otherwise the branch checked out by git is used, or if HEAD is
+// detached, the branch whose tip is HEAD (see `git name-rev`), or the only
+// branch containing HEAD. If none of these work, the error is ErrGitDetached
+// or the error from git.
+func DetectBranch(dir string, getenv func(string) string) (branch string, source string, err error) {
+	for _, name := range BranchEnvVars {
+		if branch := envBranch(name, getenv(name)); len(branch) > 0 {
+			return branch, name, nil
+		}
+	}
+	branch, err = GitBranch(dir)
+	if err != ErrGitDetached {
+		return branch, "git", err
+	}
+	out, nameErr := Cmd(dir, "git name-rev --name-only --no-undefined --refs=refs/heads/* --refs=refs/remotes/* HEAD").Output()
+	if name := strings.TrimSpace(string(out)); nameErr == nil && !strings.ContainsAny(name, "~^") {
+		if parts := strings.SplitN(name, "/", 3); len(parts) == 3 && parts[0] == "remotes" {
+			name = parts[2]
+		}
+		if len(name) > 0 {
+			return name, "git name-rev", nil
+		}
+	}
+	out, containsErr := Cmd(dir, "git branch -a --contains HEAD").Output()
+	if branches := parseGitBranches(string(out)); containsErr == nil && len(branches) == 1 {
+		return branches[0], "git branch --contains", nil
+	}
+	return "", "", ErrGitDetached
+}
+
+// envBranch returns the branch name in a CI environment variable, removing
+// "refs/heads/" and Jenkins' "origin/" prefix. GITHUB_REF is ignored unless
+// it names a branch, since it may be a tag or pull request.
+func envBranch(name, value string) string {
+	value = strings.TrimSpace(value)
+	switch {
+	case name == "GITHUB_REF" && !strings.HasPrefix(value, "refs/heads/"):
+		return ""
+	case name == "GIT_BRANCH":
+		value = strings.TrimPrefix(value, "origin/")
+	}
+	return strings.TrimPrefix(value, "refs/heads/")
+}
+
 // RunAll runs all the given commands in the given directory, and
 // returns a list of CmdOutputs.
 func RunAll(dir string, commands ...string) ([]*CmdOutput, error) {
@@ -73,32 +231,18 @@ func RunAll(dir string, commands ...string) ([]*CmdOutput, error) {
 }
 
 // RunAllLog is the same as RunAll but it logs commands as they are run.
+// Commands are run with the DefaultShell, see Runner.
 func RunAllLog(log Logger, dir string, commands ...string) ([]*CmdOutput, error) {
-	outputs := make([]*CmdOutput, len(commands))
-	var i int
-	var command string
-	var bytes []byte
-	var err error
-	for i, command = range commands {
-		command = strings.TrimSpace(command)
-		log.Println("$ " + command)
-		bytes, err = Cmd(dir, command).Output()
-		out := string(bytes)
-		log.Debugln(out)
-		outputs[i] = &CmdOutput{command, strings.TrimSpace(out), err}
-		if err != nil {
-			break
-		}
-	}
-	if len(outputs) > 0 {
-		return outputs[0 : i+1], err
-	}
-	return outputs, err
+	return NewRunner(log).Run(context.Background(), dir, commands...)
 }
 
-// CmdOutput represents the output of a bash command.
+// CmdOutput represents the combined stdout and stderr of a shell command.
+// Duration is how long the command took, including any retries, and Attempts
+// is how many times it ran.
 type CmdOutput struct {
-	Cmd    string
-	Output string
-	Err    error
+	Cmd      string
+	Output   string
+	Err      error
+	Duration time.Duration
+	Attempts int
 }
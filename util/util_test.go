@@ -42,6 +42,166 @@ func TestGitBranch(t *testing.T) {
 	assert.Equal(ErrGitDetached, err)
 }
 
+func TestGitBranches(t *testing.T) {
+	assert := assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "devicefarm")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	remoteDir, err := ioutil.TempDir("", "devicefarm")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(remoteDir)
+	// should fail because tmpDir is not a git repository
+	branches, err := GitBranches(tmpDir)
+	assert.NotNil(err)
+	assert.Nil(branches)
+	// create a repository with a few branches, and push one of them
+	// to a remote
+	RunAll(remoteDir, "git init --bare")
+	RunAll(tmpDir,
+		"git init",
+		"git config user.email 'devops@ride.com'",
+		"git config user.name 'Devops'",
+		"git checkout -b foobar",
+		"touch foo",
+		"git add foo",
+		"git commit foo -m foo",
+		"git branch feature/a",
+		"git remote add origin "+remoteDir,
+		"git push origin foobar:feature/b foobar:foobar",
+		"git fetch origin")
+	branches, err = GitBranches(tmpDir)
+	assert.Nil(err)
+	assert.Equal([]string{"feature/a", "feature/b", "foobar"}, branches)
+	// a detached HEAD should not be listed
+	RunAll(tmpDir, "git checkout HEAD~0")
+	branches, err = GitBranches(tmpDir)
+	assert.Nil(err)
+	assert.Equal([]string{"feature/a", "feature/b", "foobar"}, branches)
+}
+
+func TestGitRemoteBranches(t *testing.T) {
+	assert := assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "devicefarm")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	remoteDir, err := ioutil.TempDir("", "devicefarm")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(remoteDir)
+	// should fail because there is no such remote
+	RunAll(tmpDir, "git init")
+	branches, err := GitRemoteBranches(tmpDir, "origin")
+	assert.NotNil(err)
+	assert.Nil(branches)
+	// push a few branches without fetching them, as in a single branch clone
+	RunAll(remoteDir, "git init --bare")
+	RunAll(tmpDir,
+		"git config user.email 'devops@ride.com'",
+		"git config user.name 'Devops'",
+		"git checkout -b foobar",
+		"touch foo",
+		"git add foo",
+		"git commit foo -m foo",
+		"git branch feature/a",
+		"git remote add origin "+remoteDir,
+		"git push origin foobar:feature/b foobar:foobar")
+	branches, err = GitRemoteBranches(tmpDir, "origin")
+	assert.Nil(err)
+	assert.Equal([]string{"feature/b", "foobar"}, branches)
+}
+
+func TestDetectBranch(t *testing.T) {
+	assert := assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "devicefarm")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	env := map[string]string{}
+	getenv := func(name string) string { return env[name] }
+
+	// should fail because tmpDir is not a git repository
+	_, _, err = DetectBranch(tmpDir, getenv)
+	assert.NotNil(err)
+
+	// a repo with master at the first commit, and feature two commits ahead
+	RunAll(tmpDir,
+		"git init",
+		"git config user.email 'devops@ride.com'",
+		"git config user.name 'Devops'",
+		"git checkout -b master",
+		"git commit --allow-empty -m a",
+		"git checkout -b feature",
+		"git commit --allow-empty -m b",
+		"git commit --allow-empty -m c")
+	branch, source, err := DetectBranch(tmpDir, getenv)
+	assert.Nil(err)
+	assert.Equal("feature", branch)
+	assert.Equal("git", source)
+
+	// a detached HEAD at the tip of a branch
+	RunAll(tmpDir, "git checkout HEAD~0")
+	branch, source, err = DetectBranch(tmpDir, getenv)
+	assert.Nil(err)
+	assert.Equal("feature", branch)
+	assert.Equal("git name-rev", source)
+
+	// a detached HEAD contained only by one branch
+	RunAll(tmpDir, "git checkout HEAD~1")
+	branch, source, err = DetectBranch(tmpDir, getenv)
+	assert.Nil(err)
+	assert.Equal("feature", branch)
+	assert.Equal("git branch --contains", source)
+
+	// a detached HEAD contained by several branches
+	RunAll(tmpDir, "git branch other feature")
+	_, _, err = DetectBranch(tmpDir, getenv)
+	assert.Equal(ErrGitDetached, err)
+
+	// CI variables should be used in order, ignoring GITHUB_REF unless it
+	// is a branch
+	env["GITHUB_REF"] = "refs/pull/12/merge"
+	env["GIT_BRANCH"] = "origin/release/1.0"
+	branch, source, err = DetectBranch(tmpDir, getenv)
+	assert.Nil(err)
+	assert.Equal("release/1.0", branch)
+	assert.Equal("GIT_BRANCH", source)
+	env["GITHUB_REF"] = "refs/heads/main"
+	branch, source, err = DetectBranch(tmpDir, getenv)
+	assert.Equal("main", branch)
+	assert.Equal("GITHUB_REF", source)
+	env["DEVICEFARM_BRANCH"] = "override"
+	branch, source, err = DetectBranch(tmpDir, getenv)
+	assert.Equal("override", branch)
+	assert.Equal("DEVICEFARM_BRANCH", source)
+}
+
+func TestGitCommit(t *testing.T) {
+	assert := assert.New(t)
+	tmpDir, err := ioutil.TempDir("", "devicefarm")
+	if err != nil {
+		t.Error(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	_, err = GitCommit(tmpDir)
+	assert.NotNil(err)
+	RunAll(tmpDir,
+		"git init",
+		"git config user.email 'devops@ride.com'",
+		"git config user.name 'Devops'",
+		"git commit --allow-empty -m a")
+	commit, err := GitCommit(tmpDir)
+	assert.Nil(err)
+	assert.Regexp("^[0-9a-f]{40}$", commit)
+}
+
 func TestCmd(t *testing.T) {
 	assert := assert.New(t)
 	cmd := Cmd("/dir", "echo bar baz")
@@ -64,7 +224,10 @@ func TestRunAll(t *testing.T) {
 		"echo Bar")
 	assert.NotNil(err)
 	assert.Equal(2, len(outputs))
-	assert.Equal(CmdOutput{"echo Foo", "Foo", nil}, *outputs[0])
+	assert.Equal("echo Foo", outputs[0].Cmd)
+	assert.Equal("Foo", outputs[0].Output)
+	assert.Nil(outputs[0].Err)
+	assert.Equal(1, outputs[0].Attempts)
 	assert.NotNil(outputs[1].Err)
 	assert.Equal([]string{"$ echo Foo\n", "$ exit 1\n"}, out.Out())
 